@@ -8,13 +8,34 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"syscall"
 
 	"github.com/jumboframes/armorigo/sigaction"
 	conduit "github.com/moresec-io/conduit/pkg/conduit"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
 	//_ "net/http/pprof"
 )
 
 func main() {
+	err := config.Init()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "init config err: %s\n", err)
+		os.Exit(1)
+	}
+	if config.ValidateOnly {
+		fmt.Println("configuration is valid")
+		return
+	}
+	if config.DryRun {
+		if err = conduit.DryRun(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "dry run err: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	conduit, err := conduit.NewConduit()
 	if err != nil {
 		return
@@ -22,6 +43,7 @@ func main() {
 	conduit.Run()
 
 	sig := sigaction.NewSignal()
+	sig.Add(syscall.SIGHUP, conduit)
 	sig.Wait(context.TODO())
 
 	conduit.Close()
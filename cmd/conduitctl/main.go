@@ -0,0 +1,25 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/moresec-io/conduit/pkg/ctl"
+)
+
+func main() {
+	err := ctl.Run(os.Args[1:])
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -5,6 +5,8 @@ import (
 
 	"github.com/jumboframes/armorigo/sigaction"
 	"github.com/moresec-io/conduit/pkg/manager"
+	"github.com/moresec-io/conduit/pkg/manager/cms"
+	"github.com/moresec-io/conduit/pkg/manager/server"
 	"github.com/moresec-io/conduit/pkg/manager/service"
 )
 
@@ -13,8 +15,11 @@ func main() {
 	if err != nil {
 		return
 	}
-	err = container.Invoke(func(cm *service.ConduitManager) {
+	err = container.Invoke(func(cm *service.ConduitManager, server *server.Server, scanner *cms.ExpiryScanner) {
 		cm.Serve()
+		server.Serve()
+		scanner.SetCertSyncer(cm)
+		scanner.Serve()
 	})
 	if err != nil {
 		return
@@ -23,7 +28,9 @@ func main() {
 	sig := sigaction.NewSignal()
 	sig.Wait(context.TODO())
 
-	container.Invoke(func(cm *service.ConduitManager) {
+	container.Invoke(func(cm *service.ConduitManager, server *server.Server, scanner *cms.ExpiryScanner) {
+		scanner.Close()
+		server.Close()
 		cm.Close()
 	})
 }
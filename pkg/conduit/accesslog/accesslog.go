@@ -0,0 +1,224 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/syslog"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/natefinch/lumberjack"
+)
+
+var (
+	ErrUnsupportedSink = errors.New("unsupported access log sink")
+)
+
+const (
+	// close reasons
+	CloseLocal  = "local_closed"  // the proxied side closed
+	CloseRemote = "remote_closed" // the tunnel side closed
+	CloseError  = "error"
+
+	// failures before proxying
+	ClosePolicyNotFound = "policy_not_found"
+	CloseDial           = "dial_failed"
+	CloseHandshake      = "handshake_failed"
+	CloseHeader         = "header_failed"
+	CloseForbidden      = "forbidden"
+)
+
+// Record is a tunnelled connection, bytes are counted on the tunnel side
+type Record struct {
+	Time      time.Time `json:"time"`
+	Side      string    `json:"side"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"` // original dst
+	DstAs     string    `json:"dst_as"`
+	Peer      string    `json:"peer"`
+	Policy    string    `json:"policy,omitempty"`
+	Identity  string    `json:"identity,omitempty"` // client conduit identity
+	Next      string    `json:"next,omitempty"`     // next conduit if relayed
+	BytesSent int64     `json:"bytes_sent"`
+	BytesRecv int64     `json:"bytes_received"`
+	Duration  int64     `json:"duration_ms"`
+	Reason    string    `json:"close_reason"`
+	Error     string    `json:"error,omitempty"`
+
+	start   time.Time
+	sampled bool
+}
+
+type AccessLog struct {
+	conf *config.AccessLog
+
+	mtx sync.Mutex
+	w   io.WriteCloser
+}
+
+func NewAccessLog(conf *config.Config) (*AccessLog, error) {
+	alconf := &conf.AccessLog
+	al := &AccessLog{conf: alconf}
+	switch alconf.Sink {
+	case "", config.AccessLogSinkFile:
+		al.w = &lumberjack.Logger{
+			Filename:   alconf.File,
+			MaxSize:    alconf.MaxSize,
+			MaxBackups: alconf.MaxRolls,
+		}
+	case config.AccessLogSinkSyslog:
+		w, err := syslog.Dial(alconf.Syslog.Network, alconf.Syslog.Addr,
+			syslog.LOG_INFO|syslog.LOG_LOCAL0, alconf.Syslog.Tag)
+		if err != nil {
+			log.Errorf("new access log, dial syslog err: %s", err)
+			return nil, err
+		}
+		al.w = w
+	default:
+		return nil, ErrUnsupportedSink
+	}
+	return al, nil
+}
+
+// NewRecord starts a record and decides whether it's sampled, nil AccessLog is allowed
+func (al *AccessLog) NewRecord(side string) *Record {
+	record := &Record{Side: side, start: time.Now()}
+	if al != nil {
+		rate := al.conf.SampleRate
+		record.sampled = rate <= 0 || rate >= 1 || rand.Float64() < rate
+	}
+	return record
+}
+
+// Log writes the record if it's sampled or failed
+func (al *AccessLog) Log(record *Record) {
+	if al == nil || (!record.sampled && record.Error == "") {
+		return
+	}
+	record.Time = record.start
+	record.Duration = time.Since(record.start).Milliseconds()
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("access log, json marshal err: %s", err)
+		return
+	}
+	data = append(data, '\n')
+
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+	if _, err = al.w.Write(data); err != nil {
+		log.Errorf("access log, write err: %s", err)
+	}
+}
+
+// Fail marks the record failed, it's logged anyway
+func (record *Record) Fail(reason string, err error) {
+	record.Reason = reason
+	if err != nil {
+		record.Error = err.Error()
+	} else {
+		record.Error = reason
+	}
+}
+
+// Fail logs a connection failed before proxying
+func (al *AccessLog) Fail(record *Record, reason string, err error) {
+	record.Fail(reason, err)
+	al.Log(record)
+}
+
+func (al *AccessLog) Close() error {
+	if al == nil {
+		return nil
+	}
+	return al.w.Close()
+}
+
+// Conn counts bytes on the tunnel side, and logs the record once closed
+type Conn struct {
+	net.Conn
+	al     *AccessLog
+	record *Record
+
+	sent, recv int64
+	mtx        sync.Mutex
+	reason     string
+	err        error
+	once       sync.Once
+}
+
+func NewConn(conn net.Conn, al *AccessLog, record *Record) net.Conn {
+	if al == nil {
+		return conn
+	}
+	return &Conn{
+		Conn:   conn,
+		al:     al,
+		record: record,
+	}
+}
+
+func (conn *Conn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&conn.recv, int64(n))
+	if err != nil {
+		if err == io.EOF {
+			conn.closed(CloseRemote, nil)
+		} else {
+			conn.closed(CloseError, err)
+		}
+	}
+	return n, err
+}
+
+func (conn *Conn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.sent, int64(n))
+	if err != nil {
+		conn.closed(CloseError, err)
+	}
+	return n, err
+}
+
+// the first reason wins
+func (conn *Conn) closed(reason string, err error) {
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if conn.reason == "" {
+		conn.reason, conn.err = reason, err
+	}
+}
+
+func (conn *Conn) Close() error {
+	// before closing, or the pending read fails with a closed conn
+	conn.closed(CloseLocal, nil)
+	err := conn.Conn.Close()
+	conn.once.Do(func() {
+		record := conn.record
+		record.BytesSent = atomic.LoadInt64(&conn.sent)
+		record.BytesRecv = atomic.LoadInt64(&conn.recv)
+		conn.mtx.Lock()
+		// failed records keep their reasons
+		if record.Reason == "" {
+			record.Reason = conn.reason
+			if conn.err != nil && !errors.Is(conn.err, net.ErrClosed) {
+				record.Error = conn.err.Error()
+			}
+		}
+		conn.mtx.Unlock()
+		conn.al.Log(record)
+	})
+	return err
+}
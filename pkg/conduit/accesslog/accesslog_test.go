@@ -0,0 +1,83 @@
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func readRecords(file string) []*Record {
+	records := []*Record{}
+	f, err := os.Open(file)
+	if err != nil {
+		return records
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err == nil {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestAccessLog(t *testing.T) {
+	Convey("access log", t, func() {
+		conf := &config.Config{}
+		conf.AccessLog.File = filepath.Join(t.TempDir(), "access.log")
+		al, err := NewAccessLog(conf)
+		So(err, ShouldBeNil)
+		defer al.Close()
+
+		Convey("remote closed", func() {
+			left, right := net.Pipe()
+			record := al.NewRecord("client")
+			record.Src = "10.0.0.1:34567"
+			record.Dst = "10.0.0.2:80"
+			conn := NewConn(left, al, record)
+			go func() {
+				buf := make([]byte, 5)
+				io.ReadFull(right, buf)
+				right.Write([]byte("world!"))
+				right.Close()
+			}()
+			_, err := conn.Write([]byte("hello"))
+			So(err, ShouldBeNil)
+			io.ReadAll(conn)
+			conn.Close()
+			conn.Close()
+
+			records := readRecords(conf.AccessLog.File)
+			So(len(records), ShouldEqual, 1)
+			So(records[0].Src, ShouldEqual, "10.0.0.1:34567")
+			So(records[0].BytesSent, ShouldEqual, 5)
+			So(records[0].BytesRecv, ShouldEqual, 6)
+			So(records[0].Reason, ShouldEqual, CloseRemote)
+			So(records[0].Error, ShouldBeEmpty)
+		})
+
+		Convey("sampled out but failed", func() {
+			conf.AccessLog.SampleRate = 0.000001
+			record := al.NewRecord("server")
+			al.Log(record)
+			al.Fail(al.NewRecord("server"), CloseDial, errors.New("connection refused"))
+
+			records := readRecords(conf.AccessLog.File)
+			// the first one is sampled out with overwhelming probability
+			So(len(records), ShouldBeGreaterThanOrEqualTo, 1)
+			last := records[len(records)-1]
+			So(last.Reason, ShouldEqual, CloseDial)
+			So(last.Error, ShouldEqual, "connection refused")
+		})
+	})
+}
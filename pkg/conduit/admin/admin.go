@@ -0,0 +1,117 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/repo"
+	"github.com/moresec-io/conduit/pkg/conduit/syncer"
+)
+
+// Admin serves a local http api over unix socket, for troubleshooting
+type Admin struct {
+	conf   *config.Config
+	repo   repo.Repo
+	syncer syncer.Syncer // nil if manager disabled
+	reload func() error
+
+	socket string
+	ln     net.Listener
+	server *http.Server
+}
+
+func NewAdmin(conf *config.Config, repo repo.Repo, syncer syncer.Syncer) (*Admin, error) {
+	socket := conf.Admin.Socket
+	if socket == "" {
+		socket = config.DefaultAdminSocket
+	}
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		log.Errorf("new admin, mkdir err: %s", err)
+		return nil, err
+	}
+	// legacy socket from last run
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		log.Errorf("new admin, remove legacy socket err: %s", err)
+		return nil, err
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Errorf("new admin, listen err: %s", err)
+		return nil, err
+	}
+	// root only
+	if err = os.Chmod(socket, 0600); err != nil {
+		ln.Close()
+		log.Errorf("new admin, chmod socket err: %s", err)
+		return nil, err
+	}
+	admin := &Admin{
+		conf:   conf,
+		repo:   repo,
+		syncer: syncer,
+		socket: socket,
+		ln:     ln,
+	}
+	admin.server = &http.Server{Handler: admin.router()}
+	return admin, nil
+}
+
+func (admin *Admin) router() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", admin.Status)
+	mux.HandleFunc("/v1/peers", admin.Peers)
+	mux.HandleFunc("/v1/flows", admin.Flows)
+	mux.HandleFunc("/v1/flows/", admin.KillFlow)
+	mux.HandleFunc("/v1/policies", admin.Policies)
+	mux.HandleFunc("/v1/ipsets", admin.IPSets)
+	mux.HandleFunc("/v1/cluster", admin.Cluster)
+	mux.HandleFunc("/v1/reload", admin.Reload)
+	return mux
+}
+
+// OnReload sets the function called by POST /v1/reload
+func (admin *Admin) OnReload(reload func() error) {
+	admin.reload = reload
+}
+
+func (admin *Admin) Work() {
+	err := admin.server.Serve(admin.ln)
+	if err != nil && err != http.ErrServerClosed {
+		log.Errorf("admin serve err: %s", err)
+	}
+}
+
+func (admin *Admin) Close() {
+	admin.server.Close()
+	os.Remove(admin.socket)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, &errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/repo"
+	"github.com/moresec-io/conduit/pkg/network"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAdmin(t *testing.T) {
+	Convey("admin", t, func() {
+		conf := &config.Config{}
+		r := repo.NewRepo()
+		r.AddPortPolicy(9092, &repo.Policy{
+			PeerDialConfig: &network.DialConfig{
+				Netwotk: "tcp",
+				Addrs:   []string{"192.168.0.2:5053"},
+				TLS:     &network.TLS{Enable: true},
+			},
+			DstAs: "127.0.0.1:9092",
+		})
+		admin := &Admin{conf: conf, repo: r}
+		server := httptest.NewServer(admin.router())
+		defer server.Close()
+
+		Convey("policies", func() {
+			rsp, err := http.Get(server.URL + "/v1/policies")
+			So(err, ShouldBeNil)
+			defer rsp.Body.Close()
+			policies := []*Policy{}
+			So(json.NewDecoder(rsp.Body).Decode(&policies), ShouldBeNil)
+			So(len(policies), ShouldEqual, 1)
+			So(policies[0].Type, ShouldEqual, PolicyTypePort)
+			So(policies[0].Match, ShouldEqual, ":9092")
+			So(policies[0].Peers, ShouldResemble, []string{"192.168.0.2:5053"})
+			So(policies[0].TLS, ShouldBeTrue)
+		})
+
+		Convey("kill flow not found", func() {
+			req, _ := http.NewRequest(http.MethodDelete, server.URL+"/v1/flows/100", nil)
+			rsp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			rsp.Body.Close()
+			So(rsp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			req, _ = http.NewRequest(http.MethodDelete, server.URL+"/v1/flows/abc", nil)
+			rsp, err = http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			rsp.Body.Close()
+			So(rsp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("cluster without manager", func() {
+			rsp, err := http.Get(server.URL + "/v1/cluster")
+			So(err, ShouldBeNil)
+			defer rsp.Body.Close()
+			cluster := []interface{}{}
+			So(json.NewDecoder(rsp.Body).Decode(&cluster), ShouldBeNil)
+			So(len(cluster), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,245 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package admin
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/moresec-io/conduit/pkg/conduit/flow"
+	"github.com/moresec-io/conduit/pkg/conduit/repo"
+	"github.com/moresec-io/conduit/pkg/proto"
+)
+
+var (
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	ErrIllegalFlowID    = errors.New("illegal flow id")
+	ErrReloadDisabled   = errors.New("reload disabled")
+)
+
+const (
+	PolicyTypeIP     = "ip"
+	PolicyTypeIPPort = "ipport"
+	PolicyTypePort   = "port"
+	PolicyTypeNet    = "net"
+)
+
+type Status struct {
+	MachineID string `json:"machine_id"`
+	Client    bool   `json:"client"`
+	Server    bool   `json:"server"`
+	Manager   bool   `json:"manager"`
+	Flows     int    `json:"flows"`
+	Cluster   int    `json:"cluster"`
+}
+
+// GET /v1/status
+func (admin *Admin) Status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+		return
+	}
+	status := &Status{
+		MachineID: admin.conf.MachineID,
+		Client:    admin.conf.Client.Enable,
+		Server:    admin.conf.Server.Enable,
+		Manager:   admin.conf.Manager.Enable,
+		Flows:     flow.Flows.Len(),
+	}
+	if admin.syncer != nil {
+		status.Cluster = len(admin.syncer.Cluster())
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+type Peer struct {
+	Index     int      `json:"index"`
+	Network   string   `json:"network"`
+	Addresses []string `json:"addresses"`
+	TLS       bool     `json:"tls"`
+	MTLS      bool     `json:"mtls"`
+}
+
+// GET /v1/peers, static peers, peers from manager are in the cluster
+func (admin *Admin) Peers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+		return
+	}
+	peers := []*Peer{}
+	for _, elem := range admin.conf.Client.Peers {
+		peers = append(peers, &Peer{
+			Index:     elem.Index,
+			Network:   elem.Network,
+			Addresses: elem.Addresses,
+			TLS:       elem.TLS.Enable,
+			MTLS:      elem.TLS.MTLS,
+		})
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+// GET /v1/flows
+func (admin *Admin) Flows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, flow.Flows.List())
+}
+
+// DELETE /v1/flows/{id}
+func (admin *Admin) KillFlow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/v1/flows/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrIllegalFlowID)
+		return
+	}
+	if err = flow.Flows.Kill(id); err != nil {
+		if err == flow.ErrFlowNotFound {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type Policy struct {
+	Type    string   `json:"type"`
+	Match   string   `json:"match"`
+	DstAs   string   `json:"dst_as,omitempty"`
+	Network string   `json:"network"`
+	Peers   []string `json:"peers"`
+	TLS     bool     `json:"tls"`
+	MTLS    bool     `json:"mtls"`
+	Route   []string `json:"route,omitempty"`
+}
+
+func newPolicy(typ, match string, policy *repo.Policy) *Policy {
+	view := &Policy{
+		Type:  typ,
+		Match: match,
+		DstAs: policy.DstAs,
+		Route: policy.Route,
+	}
+	if dial := policy.PeerDialConfig; dial != nil {
+		view.Network = dial.Netwotk
+		view.Peers = dial.Addrs
+		if dial.TLS != nil {
+			view.TLS = dial.TLS.Enable
+			view.MTLS = dial.TLS.MTLS
+		}
+	}
+	return view
+}
+
+// GET /v1/policies
+func (admin *Admin) Policies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+		return
+	}
+	dump := admin.repo.DumpPolicies()
+	policies := []*Policy{}
+	for match, policy := range dump.IPPort {
+		policies = append(policies, newPolicy(PolicyTypeIPPort, match, policy))
+	}
+	for port, policy := range dump.Port {
+		policies = append(policies, newPolicy(PolicyTypePort, ":"+strconv.Itoa(port), policy))
+	}
+	for match, policy := range dump.IP {
+		policies = append(policies, newPolicy(PolicyTypeIP, match, policy))
+	}
+	for match, policy := range dump.Net {
+		policies = append(policies, newPolicy(PolicyTypeNet, match, policy))
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Type != policies[j].Type {
+			return policies[i].Type < policies[j].Type
+		}
+		return policies[i].Match < policies[j].Match
+	})
+	writeJSON(w, http.StatusOK, policies)
+}
+
+type IPSet struct {
+	Name    string   `json:"name"`
+	Entries []string `json:"entries"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// GET /v1/ipsets
+func (admin *Admin) IPSets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+		return
+	}
+	ipsets := []*IPSet{}
+	for _, name := range []string{repo.ConduitIPSetPort, repo.ConduitIPSetIPPort, repo.ConduitIPSetIP, repo.ConduitIPSetNet} {
+		ipset := &IPSet{Name: name, Entries: []string{}}
+		entries, err := admin.repo.ListIPSet(name)
+		if err != nil {
+			ipset.Error = err.Error()
+		}
+		for _, entry := range entries {
+			var str string
+			switch {
+			case entry.IP != nil && entry.CIDR != 0:
+				str = entry.IP.String() + "/" + strconv.Itoa(int(entry.CIDR))
+			case entry.IP != nil && entry.Port != nil:
+				str = net.JoinHostPort(entry.IP.String(), strconv.Itoa(int(*entry.Port)))
+			case entry.Port != nil:
+				str = ":" + strconv.Itoa(int(*entry.Port))
+			case entry.IP != nil:
+				str = entry.IP.String()
+			}
+			ipset.Entries = append(ipset.Entries, str)
+		}
+		ipsets = append(ipsets, ipset)
+	}
+	writeJSON(w, http.StatusOK, ipsets)
+}
+
+// GET /v1/cluster
+func (admin *Admin) Cluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+		return
+	}
+	cluster := []proto.Conduit{}
+	if admin.syncer != nil {
+		cluster = admin.syncer.Cluster()
+	}
+	writeJSON(w, http.StatusOK, cluster)
+}
+
+// POST /v1/reload, reload the configuration file
+func (admin *Admin) Reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed)
+		return
+	}
+	if admin.reload == nil {
+		writeError(w, http.StatusNotImplemented, ErrReloadDisabled)
+		return
+	}
+	if err := admin.reload(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -8,25 +8,29 @@ package client
 
 import (
 	"context"
-	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/jumboframes/armorigo/log"
 	"github.com/jumboframes/armorigo/rproxy"
+	"github.com/moresec-io/conduit/pkg/conduit/accesslog"
 	"github.com/moresec-io/conduit/pkg/conduit/config"
 	ierrors "github.com/moresec-io/conduit/pkg/conduit/errors"
+	"github.com/moresec-io/conduit/pkg/conduit/flow"
+	"github.com/moresec-io/conduit/pkg/conduit/kube"
+	"github.com/moresec-io/conduit/pkg/conduit/metrics"
 	"github.com/moresec-io/conduit/pkg/conduit/proto"
 	"github.com/moresec-io/conduit/pkg/conduit/repo"
 	"github.com/moresec-io/conduit/pkg/conduit/syncer"
 	"github.com/moresec-io/conduit/pkg/conduit/sys"
-	gconfig "github.com/moresec-io/conduit/pkg/config"
 	"github.com/moresec-io/conduit/pkg/network"
 	gproto "github.com/moresec-io/conduit/pkg/proto"
 )
@@ -34,15 +38,23 @@ import (
 const (
 	// chain
 	ConduitChain = "CONDUIT"
+	// selected local traffic, jumped from output chain only
+	ConduitSelectChain = "CONDUIT_SELECT"
+	// local traffic, jumped from NAT-OUTPUT
+	ConduitOutputChain = "CONDUIT_OUTPUT"
+	// traffic from ingress interfaces, jumped from NAT-PREROUTING
+	ConduitPreroutingChain = "CONDUIT_PREROUTING"
 
 	// ipset
 	ConduitIPSetPort   = "CONDUIT_PORT"
 	ConduitIPSetIPPort = "CONDUIT_IPPORT"
 	ConduitIPSetIP     = "CONDUIT_IP"
+	ConduitIPSetNet    = "CONDUIT_NET"
 )
 
 type peer struct {
 	index      int
+	conf       config.Peer
 	dialConfig *network.DialConfig
 }
 
@@ -60,34 +72,47 @@ type Client struct {
 
 	// static peers
 	peers map[int]*peer
-
-	repo   repo.Repo
-	syncer syncer.Syncer
+	// serialize reloads
+	reloadMtx sync.Mutex
+	drainOnce sync.Once
+	// tables installed, reconciled on timer, netfilter changes and reloads
+	tables      tablesState
+	reconcileCh chan struct{}
+	// container net namespaces intercepted
+	netnses  map[string]*netnsConduit
+	netnsMtx sync.Mutex
+	sysctl   *network.SysctlManager
+	// ipport policies from kube watcher, key: ip:port
+	kubePolicies map[string]*kube.Policy
+	// socks5 and http connect listeners
+	inbounds []net.Listener
+
+	repo      repo.Repo
+	syncer    syncer.Syncer
+	accessLog *accesslog.AccessLog
 }
 
-func NewClient(conf *config.Config, syncer syncer.Syncer, rp repo.Repo) (*Client, error) {
+func NewClient(conf *config.Config, syncer syncer.Syncer, rp repo.Repo, al *accesslog.AccessLog) (*Client, error) {
 	client := &Client{
-		conf:   conf,
-		quit:   make(chan struct{}),
-		peers:  make(map[int]*peer),
-		repo:   rp,
-		syncer: syncer,
+		conf:         conf,
+		quit:         make(chan struct{}),
+		reconcileCh:  make(chan struct{}, 1),
+		peers:        make(map[int]*peer),
+		netnses:      make(map[string]*netnsConduit),
+		sysctl:       network.NewSysctlManager(),
+		kubePolicies: make(map[string]*kube.Policy),
+		repo:         rp,
+		syncer:       syncer,
+		accessLog:    al,
 	}
 	// client listen
-	ipPort := strings.Split(conf.Client.Listen, ":")
-	if len(ipPort) != 2 {
-		return nil, ierrors.ErrIllegalClientListenAddress
-	}
-	port, err := strconv.Atoi(ipPort[1])
+	port, err := listenPort(conf.Client.Listen)
 	if err != nil {
 		return nil, err
 	}
 	client.port = port
-	// clear legacies
-	client.finiTables(log.LevelDebug, "flush tables before init")
-	client.repo.FiniIPSet(log.LevelDebug, "destroy ipset before init")
-
-	// set
+	// reconcile with what the last run left instead of tearing it down,
+	// the interception keeps working during restarts
 	err = client.setIPSet()
 	if err != nil {
 		return nil, err
@@ -96,18 +121,21 @@ func NewClient(conf *config.Config, syncer syncer.Syncer, rp repo.Repo) (*Client
 	if err != nil {
 		return nil, err
 	}
-	err = client.setProc()
+	err = client.setSysctls()
 	if err != nil {
 		return nil, err
 	}
-	err = client.setStaticPolicies()
+	err = client.reconcileIPSet()
 	if err != nil {
 		return nil, err
 	}
+	metrics.Registry.OnCollect(client.collectIPSet)
 	// manager
 	if conf.Manager.Enable {
 		_, err := syncer.ReportClient(&gproto.ReportClientRequest{
 			MachineID: conf.MachineID,
+			Zone:      conf.Zone,
+			Reaches:   conf.Reaches,
 		})
 		if err != nil {
 			return nil, err
@@ -117,92 +145,59 @@ func NewClient(conf *config.Config, syncer syncer.Syncer, rp repo.Repo) (*Client
 			return nil, err
 		}
 	}
+	err = client.reconcileClusterIPSet()
+	if err != nil {
+		return nil, err
+	}
+	// after the cluster pulled, exclusions from manager are there
+	client.triggerTables()
 
 	// peers
-	for _, elem := range conf.Client.Peers {
-		_, ok := client.peers[elem.Index]
-		if ok {
-			return nil, ierrors.ErrDuplicatedPeerIndexConfigured
-		}
-		config := &gconfig.Dial{
-			Network:   elem.Network,
-			Addresses: elem.Addresses,
-			TLS:       &elem.TLS,
-		}
-		dialConfig, err := network.ConvertDialConfig(config)
-		if err != nil {
-			return nil, err
-		}
-		client.peers[elem.Index] = &peer{
-			index:      elem.Index,
-			dialConfig: dialConfig,
-		}
+	client.peers, err = newPeers(conf.Client.Peers)
+	if err != nil {
+		return nil, err
 	}
 
 	// static forward match
-	for _, elem := range conf.Client.ForwardTable {
-		dst, dstAs := elem.Dst, elem.DstAs
-		dstIPPort := strings.Split(dst, ":")
-		if len(dstIPPort) != 2 {
-			return nil, errors.New("illegal policy")
-		}
-		dstAsIPPort := strings.Split(dstAs, ":")
-		if len(dstAsIPPort) != 2 {
-			return nil, errors.New("illegal policy")
-		}
-		ipstr := dstIPPort[0]
-		portstr := dstIPPort[1]
-		port, err := strconv.Atoi(portstr)
+	for i := range conf.Client.ForwardTable {
+		err = client.addForwardPolicy(&conf.Client.ForwardTable[i])
 		if err != nil {
 			return nil, err
 		}
-		peer, ok := client.peers[elem.PeerIndex]
-		if !ok {
-			return nil, ierrors.ErrPeerIndexNotfound
-		}
-		if ipstr == "" {
-			client.repo.AddPortPolicy(port, &repo.Policy{
-				PeerDialConfig: peer.dialConfig,
-				DstAs:          dstAs,
-			})
-		} else {
-			client.repo.AddIPPortPolicy(dst, &repo.Policy{
-				PeerDialConfig: peer.dialConfig,
-				DstAs:          dstAs,
-			})
-		}
 	}
 	return client, nil
 }
 
+func listenPort(listen string) (int, error) {
+	ipPort := strings.Split(listen, ":")
+	if len(ipPort) != 2 {
+		return 0, ierrors.ErrIllegalClientListenAddress
+	}
+	return strconv.Atoi(ipPort[1])
+}
+
 func (client *Client) Work() error {
 	// set up proxy
 	err := client.proxy()
 	if err != nil {
 		return err
 	}
+	err = client.listenInbounds()
+	if err != nil {
+		return err
+	}
+	if client.conf.Client.Netns.Enable {
+		go client.watchNetns()
+	}
 	return nil
 }
 
 func (client *Client) setStaticPolicies() error {
-	for _, elem := range client.conf.Client.ForwardTable {
-		transferIpPort := strings.Split(elem.Dst, ":")
-		ip := transferIpPort[0]
-		port, err := strconv.Atoi(transferIpPort[1])
+	for i := range client.conf.Client.ForwardTable {
+		err := client.addForwardIPSet(&client.conf.Client.ForwardTable[i])
 		if err != nil {
 			return err
 		}
-		if ip == "" {
-			err = client.repo.AddIPSetPort(uint16(port))
-			if err != nil {
-				return err
-			}
-		} else {
-			err = client.repo.AddIPSetIPPort(net.ParseIP(ip), uint16(port))
-			if err != nil {
-				return err
-			}
-		}
 	}
 	return nil
 }
@@ -212,7 +207,17 @@ func (client *Client) proxy() error {
 	if err != nil {
 		return err
 	}
-	rp, err := rproxy.NewRProxy(listener,
+	rp, err := client.newRProxy(listener)
+	if err != nil {
+		return err
+	}
+	go rp.Proxy(context.TODO())
+	client.rp = rp
+	return nil
+}
+
+func (client *Client) newRProxy(listener net.Listener) (*rproxy.RProxy, error) {
+	return rproxy.NewRProxy(listener,
 		rproxy.OptionRProxyAcceptConn(client.tproxyAcceptConn),
 		rproxy.OptionRProxyPostAccept(client.tproxyPostAccept),
 		rproxy.OptionRProxyPreDial(client.tproxyPreDial),
@@ -220,19 +225,36 @@ func (client *Client) proxy() error {
 		rproxy.OptionRProxyPreWrite(client.tproxyPreWrite),
 		rproxy.OptionRProxyReplaceDst(client.tproxyReplaceDst),
 		rproxy.OptionRProxyDial(client.tproxyDial))
-	if err != nil {
-		return err
-	}
-	go rp.Proxy(context.TODO())
-	client.rp = rp
-	return nil
+}
+
+// Drain stops intercepting new connections, active flows are left to finish
+// by the conntrack entries until Close removes the rules. In fail mode closed
+// the rules are kept, new connections fail on the closed listener.
+func (client *Client) Drain() {
+	client.drainOnce.Do(func() {
+		// no more tables checking, or the jumps would be added back
+		close(client.quit)
+		if client.conf.Client.FailMode != config.FailModeClosed {
+			client.unjumpTables(log.LevelWarn, "client drain")
+		}
+		if client.rp != nil {
+			client.rp.Close()
+		}
+		client.closeInbounds()
+		client.drainNetns()
+	})
 }
 
 func (client *Client) Close() {
-	client.rp.Close()
-	close(client.quit)
+	client.Drain()
+	if client.conf.Client.FailMode == config.FailModeClosed {
+		log.Infof("client fail mode closed, tables and ipset left installed")
+		return
+	}
 	client.finiTables(log.LevelWarn, "client fini tables")
 	client.repo.FiniIPSet(log.LevelWarn, "client fini ipset")
+	client.finiNetns()
+	client.finiSysctls()
 }
 
 type ctx struct {
@@ -245,6 +267,14 @@ type ctx struct {
 	// mark    uint32
 	dial  *repo.Policy // proxy
 	dstAs string       // dst after proxy
+	// metrics labels
+	policy    string // policy type
+	peerIndex int    // index of peer addrs to dial
+	peer      string
+	// datagrams from socks5 udp associate
+	udp bool
+	// access log
+	record *accesslog.Record
 }
 
 const (
@@ -352,14 +382,7 @@ func (client *Client) tproxyPostAccept(src, dst net.Addr, meta ...interface{}) (
 		return nil, err
 	}
 
-	ctx := &ctx{
-		srcIP:   srcIp,
-		srcPort: srcPort,
-		dstIP:   dstIp,
-		dstPort: dstPort,
-		dst:     dst.String(),
-		dstAs:   dstIp + ":" + strconv.Itoa(dstPort),
-	}
+	ctx := client.newCtx(srcIp, srcPort, dstIp, dstPort)
 
 	mark := meta[1].(uint32)
 	var policy *repo.Policy
@@ -369,47 +392,124 @@ func (client *Client) tproxyPostAccept(src, dst net.Addr, meta ...interface{}) (
 		policy = client.repo.GetPolicyByIP(ctx.dstIP)
 		if policy == nil {
 			log.Errorf("client tproxy post accept, ip: %s policy not found", ctx.dstIP)
+			metrics.PolicyNotFound.With(metrics.PolicyIP).Inc()
+			client.accessLog.Fail(ctx.record, accesslog.ClosePolicyNotFound, nil)
 			return nil, errors.New("policy not found")
 		}
 		ctx.dial = policy
+		ctx.policy = metrics.PolicyIP
 	case uint32(config.MarkIpsetIPPort):
 		policy = client.repo.GetPolicyByIPPort(ctx.dst)
 		if policy == nil {
 			log.Errorf("client tproxy post accept, ipport: %s policy not found", ctx.dst)
+			metrics.PolicyNotFound.With(metrics.PolicyIPPort).Inc()
+			client.accessLog.Fail(ctx.record, accesslog.ClosePolicyNotFound, nil)
 			return nil, errors.New("policy not found")
 		}
 		ctx.dial = policy
+		ctx.policy = metrics.PolicyIPPort
 	case uint32(config.MarkIpsetPort):
 		policy = client.repo.GetPolicyByPort(ctx.dstPort)
 		if policy == nil {
 			log.Errorf("client tproxy post accept, dstport: %v policy not found", ctx.dstPort)
+			metrics.PolicyNotFound.With(metrics.PolicyPort).Inc()
+			client.accessLog.Fail(ctx.record, accesslog.ClosePolicyNotFound, nil)
 			return nil, errors.New("policy not found")
 		}
 		ctx.dial = policy
+		ctx.policy = metrics.PolicyPort
+	case uint32(config.MarkIpsetNet):
+		// manager policy of cidrs like pod cidrs
+		policy = client.repo.GetPolicyByNet(ctx.dstIP)
+		if policy == nil {
+			log.Errorf("client tproxy post accept, net of ip: %s policy not found", ctx.dstIP)
+			metrics.PolicyNotFound.With(metrics.PolicyNet).Inc()
+			client.accessLog.Fail(ctx.record, accesslog.ClosePolicyNotFound, nil)
+			return nil, errors.New("policy not found")
+		}
+		ctx.dial = policy
+		ctx.policy = metrics.PolicyNet
 	default:
 		// failed to get mask, maybe fwmark_accept not enabled, we must iterate policies
 		policy = client.repo.GetPolicyByIPPort(ctx.dst)
 		if policy != nil {
 			ctx.dial = policy
+			ctx.policy = metrics.PolicyIPPort
 			break
 		}
 		policy = client.repo.GetPolicyByPort(ctx.dstPort)
 		if policy != nil {
 			ctx.dial = policy
+			ctx.policy = metrics.PolicyPort
 			break
 		}
 		policy = client.repo.GetPolicyByIP(ctx.dstIP)
 		if policy != nil {
 			ctx.dial = policy
+			ctx.policy = metrics.PolicyIP
+			break
+		}
+		policy = client.repo.GetPolicyByNet(ctx.dstIP)
+		if policy != nil {
+			ctx.dial = policy
+			ctx.policy = metrics.PolicyNet
 			break
 		}
 		log.Errorf("client tproxy post accept, ip: %s, ipport: %s, dstport: %v policy not found", ctx.dstIP, ctx.dst, ctx.dstPort)
+		metrics.PolicyNotFound.With(metrics.PolicyNone).Inc()
+		client.accessLog.Fail(ctx.record, accesslog.ClosePolicyNotFound, nil)
 		return nil, errors.New("policy not found")
 	}
+	client.usePolicy(ctx, policy)
+	return ctx, nil
+}
+
+func (client *Client) newCtx(srcIP string, srcPort int, dstIP string, dstPort int) *ctx {
+	ctx := &ctx{
+		srcIP:   srcIP,
+		srcPort: srcPort,
+		dstIP:   dstIP,
+		dstPort: dstPort,
+		dst:     net.JoinHostPort(dstIP, strconv.Itoa(dstPort)),
+		record:  client.accessLog.NewRecord(metrics.SideClient),
+	}
+	ctx.dstAs = ctx.dst
+	ctx.record.Src = net.JoinHostPort(srcIP, strconv.Itoa(srcPort))
+	ctx.record.Dst = ctx.dst
+	ctx.record.Identity = client.conf.MachineID
+	return ctx
+}
+
+// dial the policy's peer for the ctx, ctx.policy is the metrics label
+func (client *Client) usePolicy(ctx *ctx, policy *repo.Policy) {
+	ctx.dial = policy
 	if policy.DstAs != "" {
 		ctx.dstAs = policy.DstAs
 	}
-	return ctx, nil
+	// choose the peer addr here to label the connection
+	addrs := policy.PeerDialConfig.Addrs
+	if len(addrs) != 0 {
+		ctx.peerIndex = client.pickPeer(addrs)
+		ctx.peer = addrs[ctx.peerIndex]
+	}
+	metrics.ConnAccepted.With(metrics.SideClient, ctx.policy, ctx.peer).Inc()
+	ctx.record.DstAs = ctx.dstAs
+	ctx.record.Peer = ctx.peer
+	ctx.record.Policy = ctx.policy
+}
+
+// pick a random peer addr, draining ones are skipped unless all are draining
+func (client *Client) pickPeer(addrs []string) int {
+	candidates := make([]int, 0, len(addrs))
+	for i, addr := range addrs {
+		if !client.repo.IsPeerDraining(addr) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return rand.Intn(len(addrs))
+	}
+	return candidates[rand.Intn(len(candidates))]
 }
 
 func (client *Client) tproxyPreDial(custom interface{}) error {
@@ -420,7 +520,30 @@ func (client *Client) tproxyDial(dst net.Addr, custom interface{}) (net.Conn, er
 	ctx := custom.(*ctx)
 	config := ctx.dial.PeerDialConfig
 	config.Control = sys.Control
-	return network.DialRandomWithConfig(ctx.dial.PeerDialConfig)
+	start := time.Now()
+	conn, err := network.DialWithConfig(ctx.dial.PeerDialConfig, ctx.peerIndex)
+	if err != nil {
+		reason, closeReason := metrics.ReasonDial, accesslog.CloseDial
+		if config.TLS != nil && config.TLS.Enable {
+			if tlsReason := metrics.TLSFailureReason(err); tlsReason != "" {
+				reason, closeReason = metrics.ReasonHandshake, accesslog.CloseHandshake
+				metrics.TLSHandshakeFailures.With(metrics.SideClient, tlsReason).Inc()
+			}
+		}
+		metrics.ConnFailed.With(metrics.SideClient, ctx.policy, ctx.peer, reason).Inc()
+		client.accessLog.Fail(ctx.record, closeReason, err)
+		return nil, err
+	}
+	metrics.DialDuration.With(metrics.SideClient, ctx.peer).Observe(time.Since(start).Seconds())
+	mconn := metrics.NewConn(conn, metrics.SideClient, ctx.policy, ctx.peer)
+	return flow.Flows.Track(accesslog.NewConn(mconn, client.accessLog, ctx.record), &flow.Flow{
+		Side:   metrics.SideClient,
+		Src:    ctx.record.Src,
+		Dst:    ctx.dst,
+		DstAs:  ctx.dstAs,
+		Policy: ctx.policy,
+		Peer:   ctx.peer,
+	}), nil
 }
 
 func (client *Client) tproxyPostDial(custom interface{}) error {
@@ -429,26 +552,26 @@ func (client *Client) tproxyPostDial(custom interface{}) error {
 
 func (client *Client) tproxyPreWrite(writer io.Writer, custom interface{}) error {
 	ctx := custom.(*ctx)
-	proto := &proto.ConduitProto{
+	header := &proto.ConduitProto{
 		SrcIP:   ctx.srcIP,
 		SrcPort: ctx.srcPort,
 		DstIP:   ctx.dstIP,
 		DstPort: ctx.dstPort,
 		DstAs:   ctx.dstAs,
+		Route:   ctx.dial.Route,
 	}
-	data, err := json.Marshal(proto)
-	if err != nil {
-		return err
+	if ctx.udp {
+		header.Network = proto.NetworkUDP
 	}
-	length := uint32(len(data))
-	bs := make([]byte, 4)
-	binary.LittleEndian.PutUint32(bs, length)
-	_, err = writer.Write(bs)
+	data, err := proto.Frame(header)
 	if err != nil {
 		return err
 	}
 	_, err = writer.Write(data)
 	if err != nil {
+		metrics.ConnFailed.With(metrics.SideClient, ctx.policy, ctx.peer, metrics.ReasonHeader).Inc()
+		// logged once the conn closed
+		ctx.record.Fail(accesslog.CloseHeader, err)
 		return err
 	}
 	return nil
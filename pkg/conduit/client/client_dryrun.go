@@ -0,0 +1,105 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+)
+
+// DryRun prints the iptables rules, ipset entries and static policies
+// the client would install, nothing is touched in the kernel
+func DryRun(conf *config.Config, w io.Writer) error {
+	port, err := listenPort(conf.Client.Listen)
+	if err != nil {
+		return err
+	}
+	client := &Client{
+		conf: conf,
+		port: port,
+	}
+	client.peers, err = newPeers(conf.Client.Peers)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "# iptables rules, %s --noflush\n", IPTablesRestore)
+	rules, err := client.renderTables()
+	if err != nil {
+		return err
+	}
+	extra := strings.Join(builtinJumps, "\n") + "\n"
+	fmt.Fprint(w, restorePayload(ownedChains, rules, extra))
+
+	fmt.Fprintln(w, "\n# sysctls, restored on exit")
+	fmt.Fprintf(w, "%s = 1\n", SysctlRouteLocalnet)
+	fmt.Fprintf(w, "%s = 1\n", SysctlTCPFWMarkAccept)
+	for _, sysctl := range client.conf.Client.Sysctls {
+		fmt.Fprintf(w, "%s = %s\n", sysctl.Key, sysctl.Value)
+	}
+
+	fmt.Fprintln(w, "\n# ipset entries")
+	fmt.Fprintf(w, "ipset create %s bitmap:port range 0-65535\n", ConduitIPSetPort)
+	fmt.Fprintf(w, "ipset create %s hash:ip,port\n", ConduitIPSetIPPort)
+	fmt.Fprintf(w, "ipset create %s hash:ip\n", ConduitIPSetIP)
+	fmt.Fprintf(w, "ipset create %s hash:net\n", ConduitIPSetNet)
+	for i := range conf.Client.ForwardTable {
+		elem := &conf.Client.ForwardTable[i]
+		ip, port, err := parseForwardElem(elem)
+		if err != nil {
+			return err
+		}
+		if !elem.Selector.Empty() {
+			continue
+		}
+		if ip == "" {
+			fmt.Fprintf(w, "ipset add %s %d\n", ConduitIPSetPort, port)
+		} else {
+			fmt.Fprintf(w, "ipset add %s %s,tcp:%d\n", ConduitIPSetIPPort, ip, port)
+		}
+	}
+
+	fmt.Fprintln(w, "\n# policies")
+	for i := range conf.Client.ForwardTable {
+		elem := &conf.Client.ForwardTable[i]
+		ip, port, err := parseForwardElem(elem)
+		if err != nil {
+			return err
+		}
+		match := fmt.Sprintf("ipport %s", elem.Dst)
+		if ip == "" {
+			match = fmt.Sprintf("port %d", port)
+		}
+		peer, ok := client.peers[elem.PeerIndex]
+		if !ok {
+			return fmt.Errorf("%s: peer index %d not found", elem.Dst, elem.PeerIndex)
+		}
+		tls := "plain"
+		if peer.conf.TLS.Enable {
+			tls = "tls"
+			if peer.conf.TLS.MTLS {
+				tls = "mtls"
+			}
+		}
+		route := ""
+		if len(elem.Route) != 0 {
+			route = " relayed by " + strings.Join(elem.Route, " -> ")
+		}
+		fmt.Fprintf(w, "%s -> %s via peer %d %s %s %s%s\n", match, elem.DstAs, peer.index,
+			peer.conf.Network, strings.Join(peer.conf.Addresses, ","), tls, route)
+	}
+	if conf.Manager.Enable {
+		fmt.Fprintln(w, "# policies of the cluster are pulled from manager at runtime")
+	}
+	if conf.Client.Netns.Enable {
+		fmt.Fprintln(w, "# the rules and ipset entries are installed in container net namespaces too")
+	}
+	return nil
+}
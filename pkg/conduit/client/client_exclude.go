@@ -0,0 +1,105 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"fmt"
+	"net"
+
+	gconfig "github.com/moresec-io/conduit/pkg/config"
+)
+
+// exclusions are RETURN rules, cidrs go ahead of the ipset marks in conduit
+// chain and the selections in select chain, owners and cgroups go ahead of
+// the jumps in output chain since they are only valid for local traffic
+// while conduit chain is jumped from NAT-PREROUTING too.
+func excludeCIDRRules(chain string, exclude *gconfig.Exclude) []string {
+	rules := []string{}
+	for _, src := range exclude.Sources {
+		rules = append(rules, fmt.Sprintf("-A %s -s %s -j RETURN", chain, cidrString(src)))
+	}
+	for _, dst := range exclude.Destinations {
+		rules = append(rules, fmt.Sprintf("-A %s -d %s -j RETURN", chain, cidrString(dst)))
+	}
+	return rules
+}
+
+func excludeOwnerRules(chain string, exclude *gconfig.Exclude) []string {
+	rules := []string{}
+	for _, uid := range exclude.UIDs {
+		rules = append(rules, fmt.Sprintf("-A %s -m owner --uid-owner %d -j RETURN", chain, uid))
+	}
+	for _, gid := range exclude.GIDs {
+		rules = append(rules, fmt.Sprintf("-A %s -m owner --gid-owner %d -j RETURN", chain, gid))
+	}
+	for _, cgroup := range exclude.Cgroups {
+		rules = append(rules, fmt.Sprintf("-A %s -m cgroup --path %s -j RETURN", chain, cgroup))
+	}
+	return rules
+}
+
+// ip or cidr as iptables-save prints, 10.0.0.1/32 or 10.0.0.0/8
+func cidrString(cidr string) string {
+	if ip := net.ParseIP(cidr); ip != nil {
+		return ip.String() + "/32"
+	}
+	if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+		return ipnet.String()
+	}
+	return cidr
+}
+
+// exclusions of our own and the ones distributed by manager
+func (client *Client) mergedExclude() *gconfig.Exclude {
+	exclude := &gconfig.Exclude{}
+	sources := []*gconfig.Exclude{&client.conf.Client.Exclude}
+	if client.conf.Manager.Enable && client.syncer != nil {
+		if managed := client.syncer.Exclude(); managed != nil {
+			sources = append(sources, managed)
+		}
+	}
+	for _, source := range sources {
+		exclude.Sources = appendUnique(exclude.Sources, source.Sources...)
+		exclude.Destinations = appendUnique(exclude.Destinations, source.Destinations...)
+		exclude.Cgroups = appendUnique(exclude.Cgroups, source.Cgroups...)
+		exclude.UIDs = appendUniqueInt(exclude.UIDs, source.UIDs...)
+		exclude.GIDs = appendUniqueInt(exclude.GIDs, source.GIDs...)
+	}
+	return exclude
+}
+
+func appendUnique(strs []string, elems ...string) []string {
+	for _, elem := range elems {
+		found := false
+		for _, str := range strs {
+			if str == elem {
+				found = true
+				break
+			}
+		}
+		if !found {
+			strs = append(strs, elem)
+		}
+	}
+	return strs
+}
+
+func appendUniqueInt(ints []int, elems ...int) []int {
+	for _, elem := range elems {
+		found := false
+		for _, i := range ints {
+			if i == elem {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ints = append(ints, elem)
+		}
+	}
+	return ints
+}
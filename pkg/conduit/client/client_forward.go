@@ -0,0 +1,130 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	ierrors "github.com/moresec-io/conduit/pkg/conduit/errors"
+	"github.com/moresec-io/conduit/pkg/conduit/repo"
+	gconfig "github.com/moresec-io/conduit/pkg/config"
+	"github.com/moresec-io/conduit/pkg/network"
+)
+
+func newPeers(elems []config.Peer) (map[int]*peer, error) {
+	peers := map[int]*peer{}
+	for _, elem := range elems {
+		_, ok := peers[elem.Index]
+		if ok {
+			return nil, ierrors.ErrDuplicatedPeerIndexConfigured
+		}
+		tls := elem.TLS
+		config := &gconfig.Dial{
+			Network:   elem.Network,
+			Addresses: elem.Addresses,
+			TLS:       &tls,
+		}
+		dialConfig, err := network.ConvertDialConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		peers[elem.Index] = &peer{
+			index:      elem.Index,
+			conf:       elem,
+			dialConfig: dialConfig,
+		}
+	}
+	return peers, nil
+}
+
+// parse dst of a forward element, ip is empty for port only
+func parseForwardElem(elem *config.ForwardElem) (string, int, error) {
+	dstIPPort := strings.Split(elem.Dst, ":")
+	if len(dstIPPort) != 2 {
+		return "", 0, errors.New("illegal policy")
+	}
+	dstAsIPPort := strings.Split(elem.DstAs, ":")
+	if len(dstAsIPPort) != 2 {
+		return "", 0, errors.New("illegal policy")
+	}
+	port, err := strconv.Atoi(dstIPPort[1])
+	if err != nil {
+		return "", 0, err
+	}
+	return dstIPPort[0], port, nil
+}
+
+// add or replace the policy of a forward element
+func (client *Client) addForwardPolicy(elem *config.ForwardElem) error {
+	ip, port, err := parseForwardElem(elem)
+	if err != nil {
+		return err
+	}
+	peer, ok := client.peers[elem.PeerIndex]
+	if !ok {
+		return ierrors.ErrPeerIndexNotfound
+	}
+	policy := &repo.Policy{
+		PeerDialConfig: peer.dialConfig,
+		DstAs:          elem.DstAs,
+		Route:          elem.Route,
+	}
+	if ip == "" {
+		client.repo.AddPortPolicy(port, policy)
+	} else {
+		client.repo.AddIPPortPolicy(elem.Dst, policy)
+	}
+	return nil
+}
+
+// elements with selector are not in ipsets, see selectRules
+func (client *Client) addForwardIPSet(elem *config.ForwardElem) error {
+	ip, port, err := parseForwardElem(elem)
+	if err != nil {
+		return err
+	}
+	if !elem.Selector.Empty() {
+		return nil
+	}
+	if ip == "" {
+		return client.repo.AddIPSetPort(uint16(port))
+	}
+	return client.repo.AddIPSetIPPort(net.ParseIP(ip), uint16(port))
+}
+
+// delete the ipset entry first, no more new connections to the element then
+func (client *Client) delForward(elem *config.ForwardElem) error {
+	ip, port, err := parseForwardElem(elem)
+	if err != nil {
+		return err
+	}
+	err = client.delForwardIPSet(elem)
+	if ip == "" {
+		client.repo.DelPortPolicy(port)
+	} else {
+		client.repo.DelIPPortPolicy(elem.Dst)
+	}
+	return err
+}
+
+func (client *Client) delForwardIPSet(elem *config.ForwardElem) error {
+	ip, port, err := parseForwardElem(elem)
+	if err != nil {
+		return err
+	}
+	if !elem.Selector.Empty() {
+		return nil
+	}
+	if ip == "" {
+		return client.repo.DelIPSetPort(uint16(port))
+	}
+	return client.repo.DelIPSetIPPort(net.ParseIP(ip), uint16(port))
+}
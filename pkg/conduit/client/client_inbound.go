@@ -0,0 +1,502 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	ierrors "github.com/moresec-io/conduit/pkg/conduit/errors"
+	"github.com/moresec-io/conduit/pkg/conduit/metrics"
+	"github.com/moresec-io/conduit/pkg/conduit/sys"
+	"github.com/moresec-io/conduit/pkg/network"
+)
+
+const (
+	socks5Version         = 0x05
+	socks5MethodNoAuth    = 0x00
+	socks5MethodNoAccept  = 0xff
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+	socks5AtypIPv4        = 0x01
+	socks5AtypDomain      = 0x03
+	socks5AtypIPv6        = 0x04
+
+	socks5RepSucceeded       = 0x00
+	socks5RepFailure         = 0x01
+	socks5RepNotAllowed      = 0x02
+	socks5RepHostUnreachable = 0x04
+	socks5RepCmdUnsupported  = 0x07
+	socks5RepAtypUnsupported = 0x08
+
+	// handshakes must be done in time
+	inboundHandshakeTimeout = 10 * time.Second
+)
+
+// start the socks5 and http connect listeners
+func (client *Client) listenInbounds() error {
+	inbound := &client.conf.Client.Inbound
+	if inbound.SOCKS5.Enable {
+		ln, err := net.Listen("tcp", inbound.SOCKS5.Listen)
+		if err != nil {
+			return err
+		}
+		client.inbounds = append(client.inbounds, ln)
+		go client.serveInbound(ln, client.serveSOCKS5)
+	}
+	if inbound.HTTP.Enable {
+		ln, err := net.Listen("tcp", inbound.HTTP.Listen)
+		if err != nil {
+			return err
+		}
+		client.inbounds = append(client.inbounds, ln)
+		go client.serveInbound(ln, client.serveHTTP)
+	}
+	return nil
+}
+
+func (client *Client) closeInbounds() {
+	for _, ln := range client.inbounds {
+		ln.Close()
+	}
+}
+
+func (client *Client) serveInbound(ln net.Listener, serve func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Infof("client serve inbound, listener: %s accept err: %s, quiting", ln.Addr().String(), err)
+			return
+		}
+		go serve(conn)
+	}
+}
+
+// dial dst through the policy matched, or by no_match without one. For udp
+// the conn returned carries framed datagrams
+func (client *Client) dialInbound(src net.Addr, dstIP net.IP, dstPort int, udp bool) (net.Conn, error) {
+	srcIP, srcPort := "", 0
+	if host, port, err := net.SplitHostPort(src.String()); err == nil {
+		srcIP = host
+		srcPort, _ = strconv.Atoi(port)
+	}
+	ctx := client.newCtx(srcIP, srcPort, dstIP.String(), dstPort)
+	ctx.policy = metrics.PolicyProxy
+	ctx.udp = udp
+
+	policy := client.repo.GetPolicy(ctx.dst, ctx.dstPort, ctx.dstIP)
+	if policy == nil {
+		metrics.PolicyNotFound.With(metrics.PolicyProxy).Inc()
+		if client.conf.Client.Inbound.NoMatch != config.NoMatchDirect {
+			return nil, ierrors.ErrInboundRejected
+		}
+		networkType := "tcp"
+		if udp {
+			networkType = "udp"
+		}
+		dialer := &net.Dialer{Timeout: inboundHandshakeTimeout, Control: sys.Control}
+		conn, err := dialer.Dial(networkType, ctx.dst)
+		if err != nil {
+			return nil, err
+		}
+		if udp {
+			return network.NewDatagramConn(conn), nil
+		}
+		return conn, nil
+	}
+	client.usePolicy(ctx, policy)
+	conn, err := client.tproxyDial(nil, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.tproxyPreWrite(conn, ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// resolve to ipv4 first like the intercepted ones
+func resolveInbound(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), inboundHandshakeTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// copy both ways till either ends
+func pipe(left, right net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(right, left)
+	go cp(left, right)
+	<-done
+	left.Close()
+	right.Close()
+	<-done
+}
+
+// socks5
+
+func (client *Client) serveSOCKS5(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(inboundHandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	// greeting
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(reader, greeting); err != nil || greeting[0] != socks5Version {
+		conn.Close()
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		conn.Close()
+		return
+	}
+	method := byte(socks5MethodNoAccept)
+	for _, m := range methods {
+		if m == socks5MethodNoAuth {
+			method = socks5MethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil || method == socks5MethodNoAccept {
+		conn.Close()
+		return
+	}
+	// request
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(reader, request); err != nil || request[0] != socks5Version {
+		conn.Close()
+		return
+	}
+	host, port, err := readSOCKS5Addr(reader)
+	if err != nil {
+		if err == errSOCKS5Atyp {
+			writeSOCKS5Reply(conn, socks5RepAtypUnsupported, nil)
+		}
+		conn.Close()
+		return
+	}
+	switch request[1] {
+	case socks5CmdConnect:
+		ip, err := resolveInbound(host)
+		if err != nil {
+			log.Errorf("client serve socks5, resolve: %s err: %s", host, err)
+			writeSOCKS5Reply(conn, socks5RepHostUnreachable, nil)
+			conn.Close()
+			return
+		}
+		right, err := client.dialInbound(conn.RemoteAddr(), ip, port, false)
+		if err != nil {
+			log.Errorf("client serve socks5, dial: %s err: %s", net.JoinHostPort(host, strconv.Itoa(port)), err)
+			rep := byte(socks5RepHostUnreachable)
+			if err == ierrors.ErrInboundRejected {
+				rep = socks5RepNotAllowed
+			}
+			writeSOCKS5Reply(conn, rep, nil)
+			conn.Close()
+			return
+		}
+		if err = writeSOCKS5Reply(conn, socks5RepSucceeded, nil); err != nil {
+			conn.Close()
+			right.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		pipe(&bufferedConn{Conn: conn, reader: reader}, right)
+	case socks5CmdUDPAssociate:
+		client.associateUDP(conn)
+	default:
+		writeSOCKS5Reply(conn, socks5RepCmdUnsupported, nil)
+		conn.Close()
+	}
+}
+
+var errSOCKS5Atyp = errors.New("socks5 address type unsupported")
+
+// atyp, addr and port
+func readSOCKS5Addr(reader io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == socks5AtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+	default:
+		return "", 0, errSOCKS5Atyp
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// atyp, addr and port of an ip, 0.0.0.0:0 if nil
+func socks5Addr(addr *net.UDPAddr) []byte {
+	if addr == nil {
+		return []byte{socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	data := []byte{socks5AtypIPv4}
+	ip := addr.IP.To4()
+	if ip == nil {
+		data[0] = socks5AtypIPv6
+		ip = addr.IP.To16()
+	}
+	data = append(data, ip...)
+	return binary.BigEndian.AppendUint16(data, uint16(addr.Port))
+}
+
+func writeSOCKS5Reply(conn net.Conn, rep byte, bind *net.UDPAddr) error {
+	reply := append([]byte{socks5Version, rep, 0x00}, socks5Addr(bind)...)
+	_, err := conn.Write(reply)
+	return err
+}
+
+// datagrams of a udp associate, relayed per destination till the control
+// conn closes
+type udpAssociation struct {
+	client *Client
+	ctrl   net.Conn
+	pc     *net.UDPConn
+
+	mtx sync.Mutex
+	// where the replies go, the latest addr the client sent from
+	peer *net.UDPAddr
+	// key: dst ip:port
+	dsts map[string]net.Conn
+}
+
+func (client *Client) associateUDP(conn net.Conn) {
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if local == nil || remote == nil {
+		writeSOCKS5Reply(conn, socks5RepFailure, nil)
+		conn.Close()
+		return
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		log.Errorf("client serve socks5, listen udp err: %s", err)
+		writeSOCKS5Reply(conn, socks5RepFailure, nil)
+		conn.Close()
+		return
+	}
+	if err = writeSOCKS5Reply(conn, socks5RepSucceeded, pc.LocalAddr().(*net.UDPAddr)); err != nil {
+		pc.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	assoc := &udpAssociation{
+		client: client,
+		ctrl:   conn,
+		pc:     pc,
+		dsts:   make(map[string]net.Conn),
+	}
+	go assoc.serve(remote.IP)
+	// the association lives as long as the control conn
+	io.Copy(io.Discard, conn)
+	assoc.close()
+}
+
+func (assoc *udpAssociation) serve(clientIP net.IP) {
+	buf := make([]byte, network.MaxDatagram)
+	for {
+		n, addr, err := assoc.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// only the client of the control conn is served
+		if !addr.IP.Equal(clientIP) {
+			continue
+		}
+		assoc.mtx.Lock()
+		assoc.peer = addr
+		assoc.mtx.Unlock()
+		// rsv, frag, addr, data; fragments are dropped
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		reader := bytes.NewReader(buf[3:n])
+		host, port, err := readSOCKS5Addr(reader)
+		if err != nil {
+			continue
+		}
+		data := buf[n-reader.Len() : n]
+		ip, err := resolveInbound(host)
+		if err != nil {
+			log.Errorf("client serve socks5 udp, resolve: %s err: %s", host, err)
+			continue
+		}
+		dst, err := assoc.dst(&net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			log.Debugf("client serve socks5 udp, dial: %s err: %s", net.JoinHostPort(host, strconv.Itoa(port)), err)
+			continue
+		}
+		if err = network.WriteDatagram(dst, data); err != nil {
+			assoc.drop(dst, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		}
+	}
+}
+
+// the conn to the dst, dialed at the first datagram
+func (assoc *udpAssociation) dst(addr *net.UDPAddr) (net.Conn, error) {
+	key := addr.String()
+	assoc.mtx.Lock()
+	conn, ok := assoc.dsts[key]
+	assoc.mtx.Unlock()
+	if ok {
+		return conn, nil
+	}
+	conn, err := assoc.client.dialInbound(assoc.ctrl.RemoteAddr(), addr.IP, addr.Port, true)
+	if err != nil {
+		return nil, err
+	}
+	assoc.mtx.Lock()
+	assoc.dsts[key] = conn
+	assoc.mtx.Unlock()
+	go assoc.reply(conn, addr)
+	return conn, nil
+}
+
+// datagrams from the dst back to the client
+func (assoc *udpAssociation) reply(conn net.Conn, addr *net.UDPAddr) {
+	header := append([]byte{0x00, 0x00, 0x00}, socks5Addr(addr)...)
+	buf := make([]byte, network.MaxDatagram)
+	for {
+		data, err := network.ReadDatagram(conn, buf)
+		if err != nil {
+			assoc.drop(conn, addr.String())
+			return
+		}
+		assoc.mtx.Lock()
+		peer := assoc.peer
+		assoc.mtx.Unlock()
+		packet := append(append(make([]byte, 0, len(header)+len(data)), header...), data...)
+		if _, err = assoc.pc.WriteToUDP(packet, peer); err != nil {
+			log.Debugf("client serve socks5 udp, write to: %s err: %s", peer.String(), err)
+		}
+	}
+}
+
+func (assoc *udpAssociation) drop(conn net.Conn, key string) {
+	conn.Close()
+	assoc.mtx.Lock()
+	if assoc.dsts[key] == conn {
+		delete(assoc.dsts, key)
+	}
+	assoc.mtx.Unlock()
+}
+
+func (assoc *udpAssociation) close() {
+	assoc.ctrl.Close()
+	assoc.pc.Close()
+	assoc.mtx.Lock()
+	defer assoc.mtx.Unlock()
+	for key, conn := range assoc.dsts {
+		conn.Close()
+		delete(assoc.dsts, key)
+	}
+}
+
+// http connect
+
+func (client *Client) serveHTTP(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(inboundHandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if req.Method != http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	host, portStr, err := net.SplitHostPort(req.Host)
+	port, perr := strconv.Atoi(portStr)
+	if err != nil || perr != nil {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	ip, err := resolveInbound(host)
+	if err != nil {
+		log.Errorf("client serve http, resolve: %s err: %s", host, err)
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	right, err := client.dialInbound(conn.RemoteAddr(), ip, port, false)
+	if err != nil {
+		log.Errorf("client serve http, dial: %s err: %s", req.Host, err)
+		status := "502 Bad Gateway"
+		if err == ierrors.ErrInboundRejected {
+			status = "403 Forbidden"
+		}
+		conn.Write([]byte("HTTP/1.1 " + status + "\r\nConnection: close\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		right.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	pipe(&bufferedConn{Conn: conn, reader: reader}, right)
+}
+
+// bytes read ahead during handshakes are kept
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/repo"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func echoTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func socks5Connect(addr string, dst *net.TCPAddr) (net.Conn, byte, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return nil, 0, err
+	}
+	request := append([]byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypIPv4}, dst.IP.To4()...)
+	conn.Write(binary.BigEndian.AppendUint16(request, uint16(dst.Port)))
+	reply = make([]byte, 10)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return nil, 0, err
+	}
+	return conn, reply[1], nil
+}
+
+func TestInbound(t *testing.T) {
+	Convey("inbound", t, func() {
+		echo, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer echo.Close()
+		go echoTCP(echo)
+		dst := echo.Addr().(*net.TCPAddr)
+
+		conf := &config.Config{}
+		conf.Client.Inbound = config.Inbound{
+			SOCKS5:  config.InboundListen{Enable: true, Listen: "127.0.0.1:0"},
+			HTTP:    config.InboundListen{Enable: true, Listen: "127.0.0.1:0"},
+			NoMatch: config.NoMatchDirect,
+		}
+		client := &Client{conf: conf, repo: repo.NewRepo()}
+		So(client.listenInbounds(), ShouldBeNil)
+		defer client.closeInbounds()
+		socks5 := client.inbounds[0].Addr().String()
+		httpAddr := client.inbounds[1].Addr().String()
+
+		Convey("socks5 connect direct", func() {
+			conn, rep, err := socks5Connect(socks5, dst)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			So(rep, ShouldEqual, socks5RepSucceeded)
+			conn.Write([]byte("ping"))
+			data := make([]byte, 4)
+			_, err = io.ReadFull(conn, data)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "ping")
+		})
+
+		Convey("socks5 connect rejected", func() {
+			conf.Client.Inbound.NoMatch = config.NoMatchReject
+			conn, rep, err := socks5Connect(socks5, dst)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			So(rep, ShouldEqual, socks5RepNotAllowed)
+		})
+
+		Convey("socks5 udp associate direct", func() {
+			pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			So(err, ShouldBeNil)
+			defer pc.Close()
+			go func() {
+				buf := make([]byte, 1500)
+				for {
+					n, addr, err := pc.ReadFromUDP(buf)
+					if err != nil {
+						return
+					}
+					pc.WriteToUDP(buf[:n], addr)
+				}
+			}()
+
+			conn, err := net.Dial("tcp", socks5)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			conn.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+			reply := make([]byte, 2)
+			_, err = io.ReadFull(conn, reply)
+			So(err, ShouldBeNil)
+			conn.Write([]byte{socks5Version, socks5CmdUDPAssociate, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+			reply = make([]byte, 10)
+			_, err = io.ReadFull(conn, reply)
+			So(err, ShouldBeNil)
+			So(reply[1], ShouldEqual, socks5RepSucceeded)
+			bind := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+
+			uc, err := net.DialUDP("udp", nil, bind)
+			So(err, ShouldBeNil)
+			defer uc.Close()
+			header := append([]byte{0x00, 0x00, 0x00}, socks5Addr(pc.LocalAddr().(*net.UDPAddr))...)
+			_, err = uc.Write(append(header, []byte("ping")...))
+			So(err, ShouldBeNil)
+			buf := make([]byte, 1500)
+			n, err := uc.Read(buf)
+			So(err, ShouldBeNil)
+			So(buf[:n], ShouldResemble, append(header, []byte("ping")...))
+		})
+
+		Convey("http connect direct", func() {
+			conn, err := net.Dial("tcp", httpAddr)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			conn.Write([]byte("CONNECT " + dst.String() + " HTTP/1.1\r\nHost: " + dst.String() + "\r\n\r\n"))
+			reader := bufio.NewReader(conn)
+			rsp, err := http.ReadResponse(reader, nil)
+			So(err, ShouldBeNil)
+			So(rsp.StatusCode, ShouldEqual, http.StatusOK)
+			conn.Write([]byte("ping"))
+			data := make([]byte, 4)
+			_, err = io.ReadFull(reader, data)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "ping")
+		})
+
+		Convey("http connect rejected and methods other than connect", func() {
+			conf.Client.Inbound.NoMatch = config.NoMatchReject
+			conn, err := net.Dial("tcp", httpAddr)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			conn.Write([]byte("CONNECT " + dst.String() + " HTTP/1.1\r\nHost: " + dst.String() + "\r\n\r\n"))
+			rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			So(err, ShouldBeNil)
+			So(rsp.StatusCode, ShouldEqual, http.StatusForbidden)
+
+			conn2, err := net.Dial("tcp", httpAddr)
+			So(err, ShouldBeNil)
+			defer conn2.Close()
+			conn2.Write([]byte("GET http://" + dst.String() + "/ HTTP/1.1\r\nHost: " + dst.String() + "\r\n\r\n"))
+			rsp, err = http.ReadResponse(bufio.NewReader(conn2), nil)
+			So(err, ShouldBeNil)
+			So(rsp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+	})
+}
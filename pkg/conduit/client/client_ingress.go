@@ -0,0 +1,58 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+)
+
+// a jump to conduit chain in prerouting chain and a return in output chain
+// for each ingress interface pattern
+func ingressRules(patterns []string) ([]string, []string) {
+	jumps := []string{}
+	returns := []string{}
+	for _, pattern := range patterns {
+		jumps = append(jumps, fmt.Sprintf("-A %s -i %s -j %s", ConduitPreroutingChain, pattern, ConduitChain))
+		returns = append(returns, fmt.Sprintf("-A %s -o %s -j RETURN", ConduitOutputChain, pattern))
+	}
+	return jumps, returns
+}
+
+// rules older versions added to NAT-PREROUTING and NAT-OUTPUT, they are
+// deleted in the same restore installing the owned chains
+func legacyRules(snapshot []string, conf *config.Config) []string {
+	legacies := []string{}
+	accepts := map[string]struct{}{
+		fmt.Sprintf("-A OUTPUT -p tcp -m mark --mark %#x -j ACCEPT", config.MarkIgnoreOurself): {},
+	}
+	if conf.Manager.Enable {
+		for _, address := range conf.Manager.Dial.Addresses {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil || net.ParseIP(host) == nil {
+				continue
+			}
+			accepts[fmt.Sprintf("-A OUTPUT -d %s/32 -p tcp -m tcp --dport %s -j ACCEPT", host, port)] = struct{}{}
+		}
+	}
+	for _, line := range snapshot {
+		if !strings.HasPrefix(line, "-A PREROUTING ") && !strings.HasPrefix(line, "-A OUTPUT ") {
+			continue
+		}
+		_, accept := accepts[line]
+		if accept ||
+			strings.HasSuffix(line, " -j "+ConduitChain) ||
+			strings.HasSuffix(line, " -j "+ConduitSelectChain) ||
+			strings.Contains(line, "--comment conduit-") {
+			legacies = append(legacies, line)
+		}
+	}
+	return legacies
+}
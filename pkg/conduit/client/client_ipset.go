@@ -6,6 +6,14 @@
  */
 package client
 
+import (
+	"net"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/metrics"
+	"github.com/vishvananda/netlink"
+)
+
 func (client *Client) setIPSet() error {
 	err := client.repo.InitIPSet()
 	if err != nil {
@@ -13,3 +21,24 @@ func (client *Client) setIPSet() error {
 	}
 	return nil
 }
+
+// refresh ipset entries gauge before collecting metrics
+func (client *Client) collectIPSet() {
+	for _, set := range []string{ConduitIPSetPort, ConduitIPSetIPPort, ConduitIPSetIP, ConduitIPSetNet} {
+		entries, err := client.repo.ListIPSet(set)
+		if err != nil {
+			log.Debugf("client collect ipset: %s err: %s", set, err)
+			continue
+		}
+		metrics.IPSetEntries.With(set).Set(float64(len(entries)))
+	}
+}
+
+// entry of hash:net set
+func entryIPNet(entry *netlink.IPSetEntry) *net.IPNet {
+	bits := 8 * net.IPv6len
+	if entry.IP.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: entry.IP, Mask: net.CIDRMask(int(entry.CIDR), bits)}
+}
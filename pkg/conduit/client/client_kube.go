@@ -0,0 +1,75 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"net"
+	"reflect"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/kube"
+	"github.com/moresec-io/conduit/pkg/conduit/repo"
+)
+
+// SetKubePolicies replaces the ipport policies from kube watcher, a dst
+// in forward table wins over the one from kube
+func (client *Client) SetKubePolicies(policies []*kube.Policy) {
+	client.reloadMtx.Lock()
+	defer client.reloadMtx.Unlock()
+
+	peer, ok := client.peers[client.conf.Kube.PeerIndex]
+	if !ok {
+		log.Errorf("client set kube policies, peer index: %d not found", client.conf.Kube.PeerIndex)
+		return
+	}
+	statics := map[string]struct{}{}
+	for _, elem := range client.conf.Client.ForwardTable {
+		statics[elem.Dst] = struct{}{}
+	}
+	news := map[string]*kube.Policy{}
+	for _, policy := range policies {
+		if _, ok := statics[policy.Key()]; !ok {
+			news[policy.Key()] = policy
+		}
+	}
+
+	removed := 0
+	for key, old := range client.kubePolicies {
+		if _, ok := news[key]; ok {
+			continue
+		}
+		delete(client.kubePolicies, key)
+		removed++
+		if _, ok := statics[key]; ok {
+			// taken over by forward table after reload
+			continue
+		}
+		client.repo.DelIPPortPolicy(key)
+		if err := client.repo.DelIPSetIPPort(net.ParseIP(old.IP), uint16(old.Port)); err != nil {
+			log.Errorf("client set kube policies, del ipset: %s err: %s", key, err)
+		}
+	}
+	added := 0
+	for key, policy := range news {
+		if old, ok := client.kubePolicies[key]; ok && reflect.DeepEqual(old, policy) {
+			continue
+		}
+		dialConfig := *peer.dialConfig
+		dialConfig.Addrs = policy.Peers
+		client.repo.AddIPPortPolicy(key, &repo.Policy{
+			PeerDialConfig: &dialConfig,
+			DstAs:          policy.DstAs,
+		})
+		if err := client.repo.AddIPSetIPPort(net.ParseIP(policy.IP), uint16(policy.Port)); err != nil {
+			log.Errorf("client set kube policies, add ipset: %s err: %s", key, err)
+			continue
+		}
+		client.kubePolicies[key] = policy
+		added++
+	}
+	log.Infof("client set kube policies, added or changed: %d, removed: %d", added, removed)
+}
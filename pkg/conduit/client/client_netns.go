@@ -0,0 +1,278 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/jumboframes/armorigo/rproxy"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/network"
+	"github.com/vishvananda/netlink"
+)
+
+// a container net namespace intercepted, rules in it dnat to the listener
+// created in it, the conns are proxied by us in the host namespace.
+type netnsConduit struct {
+	link string // like net:[4026532281]
+	pid  int    // a process in it to enter by
+	rp   *rproxy.RProxy
+	// installed in it
+	tables tablesState
+}
+
+// scan namespaces appearing and disappearing, the rules in a disappeared
+// namespace are gone with it
+func (client *Client) watchNetns() {
+	client.scanNetns()
+	tick := time.NewTicker(time.Duration(client.conf.Client.Netns.ScanInterval) * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			client.scanNetns()
+		case <-client.quit:
+			return
+		}
+	}
+}
+
+func (client *Client) scanNetns() {
+	self, err := network.SelfNetNamespace()
+	if err != nil {
+		log.Errorf("client scan netns, get self netns err: %s", err)
+		return
+	}
+	pids, err := network.NetNamespacePids()
+	if err != nil {
+		log.Errorf("client scan netns, list netns err: %s", err)
+		return
+	}
+	entries, err := client.hostIPSet()
+	if err != nil {
+		log.Errorf("client scan netns, list host ipset err: %s", err)
+		return
+	}
+
+	client.netnsMtx.Lock()
+	defer client.netnsMtx.Unlock()
+
+	select {
+	case <-client.quit:
+		// draining, no more namespaces
+		return
+	default:
+	}
+	for link, pid := range pids {
+		if link == self {
+			continue
+		}
+		ns, ok := client.netnses[link]
+		if !ok {
+			ns, err = client.addNetns(link, pid)
+			if err != nil {
+				log.Warnf("client scan netns, add netns: %s pid: %d err: %s", link, pid, err)
+				continue
+			}
+			client.netnses[link] = ns
+			log.Infof("client scan netns, netns: %s pid: %d added", link, pid)
+		}
+		ns.pid = pid
+		if err = client.syncNetns(ns, entries); err != nil {
+			log.Warnf("client scan netns, sync netns: %s pid: %d err: %s", link, pid, err)
+		}
+	}
+	for link, ns := range client.netnses {
+		if _, ok := pids[link]; ok {
+			continue
+		}
+		ns.rp.Close()
+		delete(client.netnses, link)
+		log.Infof("client scan netns, netns: %s removed", link)
+	}
+}
+
+// the listener goes before the rules, nothing is dnatted to nowhere
+func (client *Client) addNetns(link string, pid int) (*netnsConduit, error) {
+	var listener net.Listener
+	err := network.InNetNamespace(pid, link, func() error {
+		var err error
+		listener, err = net.Listen(client.conf.Client.Network, client.conf.Client.Listen)
+		if err != nil {
+			return err
+		}
+		if err = client.repo.InitIPSet(); err != nil {
+			listener.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rp, err := client.newRProxy(listener)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go rp.Proxy(context.TODO())
+	return &netnsConduit{
+		link: link,
+		pid:  pid,
+		rp:   rp,
+	}, nil
+}
+
+// reconcile tables and mirror ipset entries of the host
+func (client *Client) syncNetns(ns *netnsConduit, entries map[string][]netlink.IPSetEntry) error {
+	client.reloadMtx.Lock()
+	defer client.reloadMtx.Unlock()
+
+	return network.InNetNamespace(ns.pid, ns.link, func() error {
+		err := client.mirrorIPSet(entries)
+		if err != nil {
+			return err
+		}
+		return client.reconcileTables(&ns.tables)
+	})
+}
+
+func (client *Client) hostIPSet() (map[string][]netlink.IPSetEntry, error) {
+	entries := map[string][]netlink.IPSetEntry{}
+	for _, set := range []string{ConduitIPSetPort, ConduitIPSetIPPort, ConduitIPSetIP, ConduitIPSetNet} {
+		setEntries, err := client.repo.ListIPSet(set)
+		if err != nil {
+			return nil, err
+		}
+		entries[set] = setEntries
+	}
+	return entries, nil
+}
+
+// make the ipsets of current namespace the same as entries
+func (client *Client) mirrorIPSet(entries map[string][]netlink.IPSetEntry) error {
+	for set, wants := range entries {
+		haves, err := client.repo.ListIPSet(set)
+		if err != nil {
+			return err
+		}
+		wantKeys := map[string]struct{}{}
+		for _, entry := range wants {
+			wantKeys[ipsetEntryKey(&entry)] = struct{}{}
+		}
+		haveKeys := map[string]struct{}{}
+		for _, entry := range haves {
+			key := ipsetEntryKey(&entry)
+			haveKeys[key] = struct{}{}
+			if _, ok := wantKeys[key]; !ok {
+				if err = client.ipsetEntry(set, &entry, false); err != nil {
+					return err
+				}
+			}
+		}
+		for _, entry := range wants {
+			if _, ok := haveKeys[ipsetEntryKey(&entry)]; !ok {
+				if err = client.ipsetEntry(set, &entry, true); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (client *Client) ipsetEntry(set string, entry *netlink.IPSetEntry, add bool) error {
+	switch set {
+	case ConduitIPSetPort:
+		if entry.Port == nil {
+			return nil
+		}
+		if add {
+			return client.repo.AddIPSetPort(*entry.Port)
+		}
+		return client.repo.DelIPSetPort(*entry.Port)
+	case ConduitIPSetIPPort:
+		if entry.IP == nil || entry.Port == nil {
+			return nil
+		}
+		if add {
+			return client.repo.AddIPSetIPPort(entry.IP, *entry.Port)
+		}
+		return client.repo.DelIPSetIPPort(entry.IP, *entry.Port)
+	case ConduitIPSetIP:
+		if entry.IP == nil {
+			return nil
+		}
+		if add {
+			return client.repo.AddIPSetIP(entry.IP)
+		}
+		return client.repo.DelIPSetIP(entry.IP)
+	case ConduitIPSetNet:
+		if entry.IP == nil {
+			return nil
+		}
+		if add {
+			return client.repo.AddIPSetNet(entryIPNet(entry))
+		}
+		return client.repo.DelIPSetNet(entryIPNet(entry))
+	}
+	return nil
+}
+
+func ipsetEntryKey(entry *netlink.IPSetEntry) string {
+	key := ""
+	if entry.IP != nil {
+		key = entry.IP.String()
+	}
+	if entry.Port != nil {
+		key += ":" + strconv.Itoa(int(*entry.Port))
+	}
+	if entry.CIDR != 0 {
+		key += "/" + strconv.Itoa(int(entry.CIDR))
+	}
+	return key
+}
+
+// stop intercepting new connections in namespaces
+func (client *Client) drainNetns() {
+	client.netnsMtx.Lock()
+	defer client.netnsMtx.Unlock()
+
+	for _, ns := range client.netnses {
+		if client.conf.Client.FailMode != config.FailModeClosed {
+			err := network.InNetNamespace(ns.pid, ns.link, func() error {
+				client.unjumpTables(log.LevelWarn, "client drain netns "+ns.link)
+				return nil
+			})
+			if err != nil {
+				log.Warnf("client drain netns: %s err: %s", ns.link, err)
+			}
+		}
+		ns.rp.Close()
+	}
+}
+
+func (client *Client) finiNetns() {
+	client.netnsMtx.Lock()
+	defer client.netnsMtx.Unlock()
+
+	for link, ns := range client.netnses {
+		err := network.InNetNamespace(ns.pid, ns.link, func() error {
+			client.finiTables(log.LevelWarn, "client fini netns "+ns.link+" tables")
+			client.repo.FiniIPSet(log.LevelWarn, "client fini netns "+ns.link+" ipset")
+			return nil
+		})
+		if err != nil {
+			log.Warnf("client fini netns: %s err: %s", ns.link, err)
+		}
+		delete(client.netnses, link)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/jumboframes/armorigo/log"
+)
+
+// delete static ipset entries not in the forward table, then add the
+// forward table, entries already there are kept.
+func (client *Client) reconcileIPSet() error {
+	ports := map[uint16]struct{}{}
+	ipports := map[string]struct{}{}
+	for i := range client.conf.Client.ForwardTable {
+		elem := &client.conf.Client.ForwardTable[i]
+		ip, port, err := parseForwardElem(elem)
+		if err != nil {
+			return err
+		}
+		if !elem.Selector.Empty() {
+			// selected ones are in select chain
+			continue
+		}
+		if ip == "" {
+			ports[uint16(port)] = struct{}{}
+		} else {
+			ipports[net.JoinHostPort(ip, strconv.Itoa(port))] = struct{}{}
+		}
+	}
+
+	entries, err := client.repo.ListIPSet(ConduitIPSetPort)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Port == nil {
+			continue
+		}
+		if _, ok := ports[*entry.Port]; !ok {
+			log.Infof("client reconcile ipset, delete stale port: %d", *entry.Port)
+			if err = client.repo.DelIPSetPort(*entry.Port); err != nil {
+				return err
+			}
+		}
+	}
+	entries, err = client.repo.ListIPSet(ConduitIPSetIPPort)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IP == nil || entry.Port == nil {
+			continue
+		}
+		ipport := net.JoinHostPort(entry.IP.String(), strconv.Itoa(int(*entry.Port)))
+		if _, ok := ipports[ipport]; !ok {
+			log.Infof("client reconcile ipset, delete stale ipport: %s", ipport)
+			if err = client.repo.DelIPSetIPPort(entry.IP, *entry.Port); err != nil {
+				return err
+			}
+		}
+	}
+	return client.setStaticPolicies()
+}
+
+// delete cluster ip entries of conduits no longer in the cluster, called
+// after the cluster pulled, all of them go if manager disabled.
+func (client *Client) reconcileClusterIPSet() error {
+	keeps := map[string]struct{}{}
+	keepNets := map[string]struct{}{}
+	if client.conf.Manager.Enable {
+		for _, conduit := range client.syncer.Cluster() {
+			for _, ip := range conduit.IPs {
+				keeps[ip.String()] = struct{}{}
+			}
+			for _, ipnet := range conduit.IPNets {
+				keepNets[ipnet.String()] = struct{}{}
+			}
+		}
+	}
+	entries, err := client.repo.ListIPSet(ConduitIPSetIP)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IP == nil {
+			continue
+		}
+		if _, ok := keeps[entry.IP.String()]; !ok {
+			log.Infof("client reconcile ipset, delete stale cluster ip: %s", entry.IP)
+			if err = client.repo.DelIPSetIP(entry.IP); err != nil {
+				return err
+			}
+		}
+	}
+	entries, err = client.repo.ListIPSet(ConduitIPSetNet)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IP == nil {
+			continue
+		}
+		ipnet := entryIPNet(&entry)
+		if _, ok := keepNets[ipnet.String()]; !ok {
+			log.Infof("client reconcile ipset, delete stale cluster net: %s", ipnet)
+			if err = client.repo.DelIPSetNet(ipnet); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
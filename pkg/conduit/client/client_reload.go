@@ -0,0 +1,109 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"reflect"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	ierrors "github.com/moresec-io/conduit/pkg/conduit/errors"
+)
+
+// Reload applies the delta of forward table and peers, established flows
+// hold their own conns and are left untouched.
+func (client *Client) Reload(conf *config.Config) error {
+	client.reloadMtx.Lock()
+	defer client.reloadMtx.Unlock()
+
+	// validate all before applying anything
+	peers, err := newPeers(conf.Client.Peers)
+	if err != nil {
+		log.Errorf("client reload, new peers err: %s", err)
+		return err
+	}
+	news := map[string]*config.ForwardElem{}
+	for i := range conf.Client.ForwardTable {
+		elem := &conf.Client.ForwardTable[i]
+		if _, _, err = parseForwardElem(elem); err != nil {
+			log.Errorf("client reload, illegal forward elem: %s", elem.Dst)
+			return err
+		}
+		if _, ok := peers[elem.PeerIndex]; !ok {
+			log.Errorf("client reload, forward elem: %s peer index: %d not found", elem.Dst, elem.PeerIndex)
+			return ierrors.ErrPeerIndexNotfound
+		}
+		news[elem.Dst] = elem
+	}
+	olds := map[string]*config.ForwardElem{}
+	for i := range client.conf.Client.ForwardTable {
+		elem := &client.conf.Client.ForwardTable[i]
+		olds[elem.Dst] = elem
+	}
+	// peers added or changed, elements referring them need new policies
+	changedPeers := map[int]bool{}
+	for index, peer := range peers {
+		old, ok := client.peers[index]
+		if !ok || !reflect.DeepEqual(old.conf, peer.conf) {
+			changedPeers[index] = true
+		}
+	}
+
+	client.peers = peers
+	added, changed, removed := 0, 0, 0
+	var retErr error
+	for dst, old := range olds {
+		if _, ok := news[dst]; ok {
+			continue
+		}
+		if err = client.delForward(old); err != nil {
+			// the entry may be gone already, go on
+			log.Warnf("client reload, del forward: %s err: %s", dst, err)
+		}
+		removed++
+	}
+	for dst, elem := range news {
+		old, ok := olds[dst]
+		if ok && reflect.DeepEqual(old, elem) && !changedPeers[elem.PeerIndex] {
+			continue
+		}
+		// validated above, it doesn't fail
+		client.addForwardPolicy(elem)
+		if ok && old.Selector.Empty() == elem.Selector.Empty() {
+			changed++
+			continue
+		}
+		if ok {
+			// moved between ipsets and select chain
+			if err = client.delForwardIPSet(old); err != nil {
+				log.Warnf("client reload, del forward ipset: %s err: %s", dst, err)
+			}
+			changed++
+		}
+		if err = client.addForwardIPSet(elem); err != nil {
+			log.Errorf("client reload, add forward ipset: %s err: %s", dst, err)
+			retErr = err
+			continue
+		}
+		if !ok {
+			added++
+		}
+	}
+	client.conf.Client.ForwardTable = conf.Client.ForwardTable
+	client.conf.Client.Peers = conf.Client.Peers
+	client.conf.Client.Exclude = conf.Client.Exclude
+	// keys removed keep their values till exit
+	if !reflect.DeepEqual(client.conf.Client.Sysctls, conf.Client.Sysctls) {
+		client.conf.Client.Sysctls = conf.Client.Sysctls
+		client.setExtraSysctls(log.LevelInfo)
+	}
+	// selections and exclusions are rendered into tables
+	client.triggerTables()
+	log.Infof("client reload, forward elems added: %d, changed: %d, removed: %d, peers changed: %d",
+		added, changed, removed, len(changedPeers))
+	return retErr
+}
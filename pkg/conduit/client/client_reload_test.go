@@ -0,0 +1,142 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/kube"
+	"github.com/moresec-io/conduit/pkg/conduit/repo"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// policies in memory, ipsets recorded
+type fakeRepo struct {
+	repo.Repo
+	ipsets map[string]bool
+}
+
+func (r *fakeRepo) AddIPSetPort(port uint16) error {
+	r.ipsets[":"+strconv.Itoa(int(port))] = true
+	return nil
+}
+
+func (r *fakeRepo) AddIPSetIPPort(ip net.IP, port uint16) error {
+	r.ipsets[net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))] = true
+	return nil
+}
+
+func (r *fakeRepo) DelIPSetPort(port uint16) error {
+	delete(r.ipsets, ":"+strconv.Itoa(int(port)))
+	return nil
+}
+
+func (r *fakeRepo) DelIPSetIPPort(ip net.IP, port uint16) error {
+	delete(r.ipsets, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	return nil
+}
+
+func TestClientReload(t *testing.T) {
+	Convey("client reload", t, func() {
+		conf := &config.Config{}
+		conf.Client.Peers = []config.Peer{
+			{Index: 1, Network: "tcp", Addresses: []string{"192.168.0.2:5053"}},
+		}
+		conf.Client.ForwardTable = []config.ForwardElem{
+			{Dst: ":80", PeerIndex: 1, DstAs: "127.0.0.1:80"},
+			{Dst: "10.0.0.1:9092", PeerIndex: 1, DstAs: "127.0.0.1:9092"},
+		}
+		r := &fakeRepo{Repo: repo.NewRepo(), ipsets: map[string]bool{}}
+		client := &Client{conf: conf, repo: r}
+		peers, err := newPeers(conf.Client.Peers)
+		So(err, ShouldBeNil)
+		client.peers = peers
+		for i := range conf.Client.ForwardTable {
+			So(client.addForwardPolicy(&conf.Client.ForwardTable[i]), ShouldBeNil)
+		}
+		So(client.setStaticPolicies(), ShouldBeNil)
+		kept := r.GetPolicyByPort(80)
+		So(kept, ShouldNotBeNil)
+
+		Convey("delta", func() {
+			newconf := &config.Config{}
+			newconf.Client.Peers = []config.Peer{
+				{Index: 1, Network: "tcp", Addresses: []string{"192.168.0.2:5053"}},
+				{Index: 2, Network: "tcp", Addresses: []string{"192.168.0.3:5053"}},
+			}
+			newconf.Client.ForwardTable = []config.ForwardElem{
+				{Dst: ":80", PeerIndex: 1, DstAs: "127.0.0.1:80"},
+				{Dst: ":443", PeerIndex: 2, DstAs: "127.0.0.1:443"},
+			}
+			So(client.Reload(newconf), ShouldBeNil)
+
+			// untouched
+			So(r.GetPolicyByPort(80), ShouldEqual, kept)
+			// added
+			So(r.GetPolicyByPort(443), ShouldNotBeNil)
+			So(r.GetPolicyByPort(443).PeerDialConfig.Addrs, ShouldResemble, []string{"192.168.0.3:5053"})
+			// removed
+			So(r.GetPolicyByIPPort("10.0.0.1:9092"), ShouldBeNil)
+			So(r.ipsets, ShouldResemble, map[string]bool{":80": true, ":443": true})
+			So(conf.Client.ForwardTable, ShouldResemble, newconf.Client.ForwardTable)
+		})
+
+		Convey("peer changed", func() {
+			newconf := &config.Config{}
+			newconf.Client.Peers = []config.Peer{
+				{Index: 1, Network: "tcp", Addresses: []string{"192.168.0.4:5053"}},
+			}
+			newconf.Client.ForwardTable = conf.Client.ForwardTable
+			So(client.Reload(newconf), ShouldBeNil)
+			So(r.GetPolicyByPort(80).PeerDialConfig.Addrs, ShouldResemble, []string{"192.168.0.4:5053"})
+		})
+
+		Convey("illegal", func() {
+			newconf := &config.Config{}
+			newconf.Client.ForwardTable = []config.ForwardElem{
+				{Dst: ":443", PeerIndex: 3, DstAs: "127.0.0.1:443"},
+			}
+			So(client.Reload(newconf), ShouldNotBeNil)
+			// nothing applied
+			So(r.GetPolicyByPort(80), ShouldEqual, kept)
+			So(r.GetPolicyByPort(443), ShouldBeNil)
+		})
+	})
+}
+
+func TestSetKubePolicies(t *testing.T) {
+	Convey("client set kube policies", t, func() {
+		conf := &config.Config{}
+		conf.Kube.PeerIndex = 1
+		conf.Client.Peers = []config.Peer{
+			{Index: 1, Network: "tcp", Addresses: []string{"192.168.0.2:5053"}},
+		}
+		conf.Client.ForwardTable = []config.ForwardElem{
+			{Dst: "10.96.0.11:80", PeerIndex: 1, DstAs: "127.0.0.1:80"},
+		}
+		r := &fakeRepo{Repo: repo.NewRepo(), ipsets: map[string]bool{}}
+		client := &Client{conf: conf, repo: r, kubePolicies: map[string]*kube.Policy{}}
+		peers, err := newPeers(conf.Client.Peers)
+		So(err, ShouldBeNil)
+		client.peers = peers
+
+		client.SetKubePolicies([]*kube.Policy{
+			{IP: "10.96.0.10", Port: 9092, DstAs: "10.96.0.10:9092", Peers: []string{"192.168.0.1:5053", "192.168.0.3:5053"}},
+			// forward table wins
+			{IP: "10.96.0.11", Port: 80, DstAs: "10.96.0.11:80", Peers: []string{"192.168.0.1:5053"}},
+		})
+		policy := r.GetPolicyByIPPort("10.96.0.10:9092")
+		So(policy, ShouldNotBeNil)
+		So(policy.DstAs, ShouldEqual, "10.96.0.10:9092")
+		So(policy.PeerDialConfig.Addrs, ShouldResemble, []string{"192.168.0.1:5053", "192.168.0.3:5053"})
+		So(r.GetPolicyByIPPort("10.96.0.11:80"), ShouldBeNil)
+		So(r.ipsets, ShouldResemble, map[string]bool{"10.96.0.10:9092": true})
+		// the peer's own addresses untouched
+		So(peers[1].dialConfig.Addrs, ShouldResemble, []string{"192.168.0.2:5053"})
+
+		client.SetKubePolicies(nil)
+		So(r.GetPolicyByIPPort("10.96.0.10:9092"), ShouldBeNil)
+		So(r.ipsets, ShouldResemble, map[string]bool{})
+	})
+}
@@ -0,0 +1,56 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"fmt"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+)
+
+// forward elements with selector are not in ipsets, they are rendered as
+// mark and dnat rules in select chain, matched by owner or cgroup of the
+// local process. owner and cgroup are only valid for local traffic, for
+// containers the rules go to their network namespaces.
+func selectRules(elems []config.ForwardElem, port int) ([]string, error) {
+	rules := []string{}
+	for i := range elems {
+		elem := &elems[i]
+		if elem.Selector.Empty() {
+			continue
+		}
+		ip, dstPort, err := parseForwardElem(elem)
+		if err != nil {
+			return nil, err
+		}
+		mark := config.MarkIpsetPort
+		base := "-A " + ConduitSelectChain
+		if ip != "" {
+			mark = config.MarkIpsetIPPort
+			base += " -d " + ip + "/32"
+		}
+		base += fmt.Sprintf(" -p tcp -m tcp --dport %d", dstPort)
+
+		matched := []string{}
+		for _, cgroup := range elem.Selector.Cgroups {
+			matched = append(matched, base+" -m cgroup --path "+cgroup)
+		}
+		for _, uid := range elem.Selector.UIDs {
+			matched = append(matched, fmt.Sprintf("%s -m owner --uid-owner %d", base, uid))
+		}
+		for _, gid := range elem.Selector.GIDs {
+			matched = append(matched, fmt.Sprintf("%s -m owner --gid-owner %d", base, gid))
+		}
+		// mark for policy lookup, then dnat to us
+		for _, rule := range matched {
+			rules = append(rules,
+				fmt.Sprintf("%s -j MARK --set-xmark %#x/0xffffffff", rule, mark),
+				fmt.Sprintf("%s -j DNAT --to-destination 127.0.0.1:%d", rule, port))
+		}
+	}
+	return rules, nil
+}
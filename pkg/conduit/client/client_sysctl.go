@@ -0,0 +1,68 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package client
+
+import (
+	"github.com/jumboframes/armorigo/log"
+)
+
+const (
+	// dnat to 127.0.0.1 from other interfaces
+	SysctlRouteLocalnet = "net.ipv4.conf.all.route_localnet"
+	// accepted sockets take the mark of syn, policies are looked up by it
+	SysctlTCPFWMarkAccept = "net.ipv4.tcp_fwmark_accept"
+)
+
+// set once here, then checked with tables on timer, values before are
+// restored on close
+func (client *Client) setSysctls() error {
+	_, err := client.sysctl.Set(SysctlRouteLocalnet, "1")
+	if err != nil {
+		log.Errorf("client set sysctls, enable route local net err: %s", err)
+		return err
+	}
+	_, err = client.sysctl.Set(SysctlTCPFWMarkAccept, "1")
+	if err != nil {
+		log.Warnf("client set sysctls, enable fwmark accept err: %s", err)
+	}
+	client.setExtraSysctls(log.LevelInfo)
+	return nil
+}
+
+// a value written after set is drift
+func (client *Client) syncSysctls() {
+	for _, key := range []string{SysctlRouteLocalnet, SysctlTCPFWMarkAccept} {
+		written, err := client.sysctl.Set(key, "1")
+		if err != nil {
+			log.Warnf("client sync sysctls, set %s err: %s", key, err)
+			continue
+		}
+		if written {
+			log.Warnf("client sync sysctls, %s drifted, set back to 1", key)
+		}
+	}
+	client.setExtraSysctls(log.LevelWarn)
+}
+
+func (client *Client) setExtraSysctls(level log.Level) {
+	for _, sysctl := range client.conf.Client.Sysctls {
+		written, err := client.sysctl.Set(sysctl.Key, sysctl.Value)
+		if err != nil {
+			log.Warnf("client set sysctls, set %s err: %s", sysctl.Key, err)
+			continue
+		}
+		if written {
+			log.Printf(level, "client set sysctls, %s set to %s", sysctl.Key, sysctl.Value)
+		}
+	}
+}
+
+func (client *Client) finiSysctls() {
+	if err := client.sysctl.Close(); err != nil {
+		log.Warnf("client fini sysctls, restore err: %s", err)
+	}
+}
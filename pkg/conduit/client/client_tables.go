@@ -7,477 +7,407 @@
 package client
 
 import (
-	"strconv"
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
 	"strings"
 	"time"
 
 	"github.com/jumboframes/armorigo/log"
 	"github.com/moresec-io/conduit/pkg/conduit/config"
-	"github.com/moresec-io/conduit/pkg/conduit/errors"
-	xtables "github.com/singchia/go-xtables"
-	"github.com/singchia/go-xtables/iptables"
-	"github.com/singchia/go-xtables/pkg/network"
+	"github.com/moresec-io/conduit/pkg/conduit/metrics"
+	"github.com/moresec-io/conduit/pkg/utils"
+	"golang.org/x/sys/unix"
 )
 
+const (
+	IPTablesSave    = "iptables-save"
+	IPTablesRestore = "iptables-restore"
+
+	// coalesce the table changes in a burst, our own restores included
+	reconcileDelay = 200 * time.Millisecond
+)
+
+// chains owned by us, rewritten as a whole in one restore, the builtin
+// chains only get a jump to them
+var ownedChains = []string{ConduitPreroutingChain, ConduitOutputChain, ConduitChain, ConduitSelectChain}
+
+var builtinJumps = []string{
+	"-A PREROUTING -j " + ConduitPreroutingChain,
+	"-A OUTPUT -j " + ConduitOutputChain,
+}
+
+// what we installed in a net namespace, the owned chains are recorded as
+// iptables-save prints them, drift is told by comparing with it
+type tablesState struct {
+	rendered []string
+	owned    map[string][]string
+}
+
+// reconcile once, then on timer and on netfilter changes
 func (client *Client) setTables() error {
-	err := client.initTables()
+	err := client.reconcileTables(&client.tables)
 	if err != nil {
-		log.Errorf("client set tables, init tables err: %s", err)
+		log.Errorf("client set tables, reconcile tables err: %s", err)
 		return err
 	}
+	events := watchNetfilter(client.quit)
 	go func() {
 		tick := time.NewTicker(time.Duration(client.conf.Client.CheckTime) * time.Second)
+		defer tick.Stop()
+		var delay <-chan time.Time
 		for {
 			select {
 			case <-tick.C:
-				err = client.initTables()
-				if err != nil {
-					log.Errorf("client set tables, init tables err: %s", err)
+				client.reloadMtx.Lock()
+				client.syncSysctls()
+				client.reloadMtx.Unlock()
+			case <-events:
+				if delay == nil {
+					delay = time.After(reconcileDelay)
 				}
+				continue
+			case <-client.reconcileCh:
+			case <-delay:
 			case <-client.quit:
 				return
 			}
+			delay = nil
+			client.reloadMtx.Lock()
+			err := client.reconcileTables(&client.tables)
+			client.reloadMtx.Unlock()
+			if err != nil {
+				log.Errorf("client set tables, reconcile tables err: %s", err)
+			}
 		}
 	}()
 	return nil
 }
 
-func (client *Client) initTables() error {
-	ipt := iptables.NewIPTables()
+// triggerTables reconciles tables asap, after forward table, selections or
+// exclusions changed
+func (client *Client) triggerTables() {
+	select {
+	case client.reconcileCh <- struct{}{}:
+	default:
+	}
+}
+
+// snapshot the nat table, apply the rendered rules in one restore if they
+// changed or drifted, nothing is executed but iptables-save if not.
+func (client *Client) reconcileTables(state *tablesState) error {
+	rendered, err := client.renderTables()
+	if err != nil {
+		return err
+	}
+	snapshot, err := saveNat()
+	if err != nil {
+		return err
+	}
+	owned := ownedRules(snapshot)
+	payload := &bytes.Buffer{}
+	drifted := false
+	if state.owned != nil {
+		for _, chain := range ownedChains {
+			if !reflect.DeepEqual(owned[chain], state.owned[chain]) {
+				log.Warnf("client reconcile tables, chain %s drifted, %d rules installed, %d found",
+					chain, len(state.owned[chain]), len(owned[chain]))
+				metrics.TablesDrift.With(chain).Inc()
+				drifted = true
+			}
+		}
+	}
+	for _, jump := range builtinJumps {
+		chain := strings.Fields(jump)[1]
+		switch count := countLines(snapshot, jump); {
+		case count == 0:
+			if state.owned != nil {
+				log.Warnf("client reconcile tables, jump in %s missing", chain)
+				metrics.TablesDrift.With(chain).Inc()
+			}
+			fmt.Fprintln(payload, jump)
+		case count > 1:
+			log.Warnf("client reconcile tables, jump in %s duplicated %d times", chain, count)
+			metrics.TablesDrift.With(chain).Inc()
+			for i := 1; i < count; i++ {
+				fmt.Fprintln(payload, "-D"+jump[2:])
+			}
+		}
+	}
+	legacies := legacyRules(snapshot, client.conf)
+	for _, legacy := range legacies {
+		fmt.Fprintln(payload, "-D"+legacy[2:])
+	}
+	if !drifted && payload.Len() == 0 && reflect.DeepEqual(rendered, state.rendered) {
+		metrics.TablesReconciles.With(metrics.ResultUnchanged).Inc()
+		return nil
+	}
+
+	err = restoreNat(ownedChains, rendered, payload.String())
+	if err != nil {
+		metrics.TablesReconciles.With(metrics.ResultFailed).Inc()
+		return err
+	}
+	if len(legacies) != 0 {
+		log.Infof("client reconcile tables, %d rules of older versions deleted", len(legacies))
+	}
+	// record what the kernel prints for them, it may differ from rendered
+	snapshot, err = saveNat()
+	if err != nil {
+		return err
+	}
+	state.owned = ownedRules(snapshot)
+	state.rendered = rendered
+	metrics.TablesReconciles.With(metrics.ResultApplied).Inc()
+	log.Debugf("client reconcile tables, %d rules applied", len(rendered))
+	return nil
+}
+
+// rules of owned chains in iptables-save format, in order
+func (client *Client) renderTables() ([]string, error) {
+	exclude := client.mergedExclude()
+	jumps, returns := ingressRules(client.conf.Client.IngressInterfaces)
+	rules := jumps
 
-	// ignore manager connection
+	// ourselves and manager connection
+	rules = append(rules, fmt.Sprintf("-A %s -p tcp -m mark --mark %#x -j RETURN",
+		ConduitOutputChain, config.MarkIgnoreOurself))
 	if client.conf.Manager.Enable {
 		for _, address := range client.conf.Manager.Dial.Addresses {
-			ipport := strings.Split(address, ":")
-			if len(ipport) != 2 {
-				continue
-			}
-			port, err := strconv.Atoi(ipport[1])
+			host, port, err := net.SplitHostPort(address)
 			if err != nil {
 				continue
 			}
-			exist, err := ipt.Table(iptables.TableTypeNat).
-				Chain(iptables.ChainTypeOUTPUT).
-				MatchIPv4().
-				MatchProtocol(false, network.ProtocolTCP).
-				MatchDestination(false, ipport[0]).
-				MatchTCP(iptables.WithMatchTCPDstPort(false, port)).
-				OptionWait(0).
-				TargetAccept().
-				Check()
+			ips, err := net.LookupIP(host)
 			if err != nil {
-				log.Errorf("client init tables, check manager addr err: %s", strings.TrimSuffix(err.Error(), "\n"))
-				return err
+				log.Warnf("client render tables, lookup manager: %s err: %s", host, err)
+				continue
 			}
-			if !exist {
-				err = ipt.Table(iptables.TableTypeNat).
-					Chain(iptables.ChainTypeOUTPUT).
-					MatchIPv4().
-					MatchProtocol(false, network.ProtocolTCP).
-					MatchDestination(false, ipport[0]).
-					MatchTCP(iptables.WithMatchTCPDstPort(false, port)).
-					OptionWait(0).
-					TargetAccept().
-					Insert()
-				if err != nil {
-					log.Errorf("client init tables, insert manager addr err: %s", strings.TrimSuffix(err.Error(), "\n"))
-					return err
+			for _, ip := range ips {
+				if ip.To4() == nil {
+					continue
 				}
+				rules = append(rules, fmt.Sprintf("-A %s -d %s/32 -p tcp -m tcp --dport %s -j RETURN",
+					ConduitOutputChain, ip, port))
 			}
 		}
 	}
+	// owners and cgroups are only valid for local traffic
+	rules = append(rules, excludeOwnerRules(ConduitOutputChain, exclude)...)
+	rules = append(rules, returns...)
+	rules = append(rules,
+		"-A "+ConduitOutputChain+" -j "+ConduitChain,
+		"-A "+ConduitOutputChain+" -j "+ConduitSelectChain)
 
-	// ignore ourself connection by setting mark
-	exist, err := ipt.Table(iptables.TableTypeNat).
-		Chain(iptables.ChainTypeOUTPUT).
-		MatchIPv4().
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchMark(false, config.MarkIgnoreOurself).
-		OptionWait(0).
-		TargetAccept().
-		Check()
-	if err != nil {
-		log.Errorf("client init tables, check mark err: %s", strings.TrimSuffix(err.Error(), "\n"))
-		return err
-	}
-	if !exist {
-		err = ipt.Table(iptables.TableTypeNat).
-			Chain(iptables.ChainTypeOUTPUT).
-			MatchIPv4().
-			MatchProtocol(false, network.ProtocolTCP).
-			MatchMark(false, config.MarkIgnoreOurself).
-			OptionWait(0).
-			TargetAccept().
-			Insert()
-		if err != nil {
-			log.Errorf("client init tables, insert mark err: %s", strings.TrimSuffix(err.Error(), "\n"))
-			return err
-		}
+	// ipset match mark then dnat, ipport > port > ip > net, marks don't
+	// terminate and the last match wins, so the lowest priority goes first
+	rules = append(rules, excludeCIDRRules(ConduitChain, exclude)...)
+	sets := []struct {
+		name  string
+		flags string
+		mark  int
+	}{
+		{ConduitIPSetNet, "dst", config.MarkIpsetNet},
+		{ConduitIPSetIP, "dst", config.MarkIpsetIP},
+		{ConduitIPSetPort, "dst", config.MarkIpsetPort},
+		{ConduitIPSetIPPort, "dst,dst", config.MarkIpsetIPPort},
+	}
+	for _, set := range sets {
+		rules = append(rules, fmt.Sprintf("-A %s -p tcp -m set --match-set %s %s -j MARK --set-xmark %#x/0xffffffff",
+			ConduitChain, set.name, set.flags, set.mark))
+	}
+	for _, set := range sets {
+		rules = append(rules, fmt.Sprintf("-A %s -p tcp -m set --match-set %s %s -j DNAT --to-destination 127.0.0.1:%d",
+			ConduitChain, set.name, set.flags, client.port))
 	}
 
-	// create conduit chain
-	err = ipt.Table(iptables.TableTypeNat).
-		OptionWait(0).
-		NewChain(ConduitChain)
+	// selected local traffic
+	rules = append(rules, excludeCIDRRules(ConduitSelectChain, exclude)...)
+	selects, err := selectRules(client.conf.Client.ForwardTable, client.port)
 	if err != nil {
-		_, ok := err.(*xtables.CommandError)
-		if !ok || !errors.IsErrChainExists(err) {
-			log.Errorf("client init tables, create conduit chain err: %s", strings.TrimSuffix(err.Error(), "\n"))
-			return err
-		}
+		return nil, err
 	}
+	return append(rules, selects...), nil
+}
 
-	// check jump conduit exists, in NAT-PREROUTING, for bridged traffic
-	exist, err = ipt.Table(iptables.TableTypeNat).
-		Chain(iptables.ChainTypePREROUTING).
-		MatchInInterface(false, "br+").
-		OptionWait(0).
-		TargetJumpChain(ConduitChain).
-		Check()
-	if err != nil && !errors.IsErrChainNoMatch(err) { // TODO PR to go-xtables
-		log.Errorf("client init tables, check jump conduit chain err: %s", strings.TrimSuffix(err.Error(), "\n"))
-		return err
-	}
-	if !exist {
-		err = ipt.Table(iptables.TableTypeNat).
-			Chain(iptables.ChainTypePREROUTING).
-			MatchInInterface(false, "br+").
-			OptionWait(0).
-			TargetJumpChain(ConduitChain).Append()
-		if err != nil {
-			log.Errorf("client init tables, add jump conduit chain err: %s", strings.TrimSuffix(err.Error(), "\n"))
-		}
-	}
-	// check jump conduit exists, in NAT-OUTPUT, for local traffic
-	// src->5013 => src->5052 => ?->5053 => ?->5013 => ...
-	// if the port 5013 belongs other proxy like docker-prory,
-	// this rule would avoid dead loop
-	exist, err = ipt.Table(iptables.TableTypeNat).
-		Chain(iptables.ChainTypeOUTPUT).
-		MatchOutInterface(true, "br+").
-		OptionWait(0).
-		TargetJumpChain(ConduitChain).
-		Check()
-	if err != nil && !errors.IsErrChainNoMatch(err) {
-		log.Errorf("client init tables, check jump conduit chain err: %s", strings.TrimSuffix(err.Error(), "\n"))
+// the owned chains are flushed by declaring them and refilled, extra
+// are the rules to add or delete in builtin chains
+func restoreNat(chains []string, rules []string, extra string) error {
+	payload := restorePayload(chains, rules, extra)
+	infoO, infoE, err := utils.CmdStdin([]byte(payload), IPTablesRestore, "--noflush", "-w")
+	if err != nil {
+		log.Errorf("client restore nat, err: %s, stdout: %s, stderr: %s",
+			err, infoO, strings.TrimSuffix(string(infoE), "\n"))
 		return err
 	}
-	if !exist {
-		err = ipt.Table(iptables.TableTypeNat).
-			Chain(iptables.ChainTypeOUTPUT).
-			MatchOutInterface(true, "br+").
-			OptionWait(0).
-			TargetJumpChain(ConduitChain).Append()
-		if err != nil {
-			log.Errorf("client init tables, add jump conduit chain err: %s", strings.TrimSuffix(err.Error(), "\n"))
-			return err
-		}
-	}
+	return nil
+}
 
-	userDefined := iptables.ChainTypeUserDefined
-	userDefined.SetName(ConduitChain)
+func restorePayload(chains []string, rules []string, extra string) string {
+	payload := &bytes.Buffer{}
+	fmt.Fprintln(payload, "*nat")
+	for _, chain := range chains {
+		fmt.Fprintf(payload, ":%s - [0:0]\n", chain)
+	}
+	for _, rule := range rules {
+		fmt.Fprintln(payload, rule)
+	}
+	payload.WriteString(extra)
+	fmt.Fprintln(payload, "COMMIT")
+	return payload.String()
+}
 
-	// add ipset match mark, ipport > port > ip
-	// ip set match and set mark
-	exist, err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIP, iptables.FlagDst)).OptionWait(0).
-		TargetMark(iptables.WithTargetMarkSet(config.MarkIpsetIP)).
-		Check()
-	if err != nil && !errors.IsErrChainNoMatch(err) {
-		log.Errorf("client init tables, check mark err: %s", strings.TrimSuffix(err.Error(), "\n"))
-		return err
+func saveNat() ([]string, error) {
+	infoO, infoE, err := utils.Cmd(IPTablesSave, "-t", "nat")
+	if err != nil {
+		log.Errorf("client save nat, err: %s, stderr: %s", err, strings.TrimSuffix(string(infoE), "\n"))
+		return nil, err
 	}
-	if !exist {
-		err = ipt.Table(iptables.TableTypeNat).
-			Chain(userDefined).
-			MatchProtocol(false, network.ProtocolTCP).
-			MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIP, iptables.FlagDst)).
-			OptionWait(0).
-			TargetMark(iptables.WithTargetMarkSet(config.MarkIpsetIP)).
-			Insert()
-		if err != nil {
-			log.Errorf("client init tables, insert mark err: %s", strings.TrimSuffix(err.Error(), "\n"))
-			return err
+	return strings.Split(string(infoO), "\n"), nil
+}
+
+// rules of owned chains in a snapshot, a chain missing is nil
+func ownedRules(snapshot []string) map[string][]string {
+	owned := map[string][]string{}
+	for _, line := range snapshot {
+		for _, chain := range ownedChains {
+			if strings.HasPrefix(line, ":"+chain+" ") {
+				if _, ok := owned[chain]; !ok {
+					owned[chain] = []string{}
+				}
+			} else if strings.HasPrefix(line, "-A "+chain+" ") {
+				owned[chain] = append(owned[chain], line)
+			}
 		}
 	}
-	// port set match and set mark
-	exist, err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetPort, iptables.FlagDst)).
-		OptionWait(0).
-		TargetMark(iptables.WithTargetMarkSet(config.MarkIpsetPort)).
-		Check()
-	if err != nil && !errors.IsErrChainNoMatch(err) {
-		log.Errorf("client init tables, check mark err: %s", strings.TrimSuffix(err.Error(), "\n"))
-		return err
-	}
-	if !exist {
-		err = ipt.Table(iptables.TableTypeNat).
-			Chain(userDefined).
-			MatchProtocol(false, network.ProtocolTCP).
-			MatchSet(iptables.WithMatchSetName(false, ConduitIPSetPort, iptables.FlagDst)).
-			OptionWait(0).
-			TargetMark(iptables.WithTargetMarkSet(config.MarkIpsetPort)).
-			Insert()
-		if err != nil {
-			log.Errorf("client init tables, insert mark err: %s", strings.TrimSuffix(err.Error(), "\n"))
-			return err
+	return owned
+}
+
+func countLines(snapshot []string, line string) int {
+	count := 0
+	for _, elem := range snapshot {
+		if elem == line {
+			count++
 		}
 	}
-	// ipport set match and set mark
-	exist, err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIPPort, iptables.FlagDst, iptables.FlagDst)).
-		OptionWait(0).
-		TargetMark(iptables.WithTargetMarkSet(config.MarkIpsetIPPort)).
-		Check()
-	if err != nil && !errors.IsErrChainNoMatch(err) {
-		log.Errorf("client init tables, check ipport target mark err: %s", strings.TrimSuffix(err.Error(), "\n"))
-		return err
-	}
-	if !exist {
-		err = ipt.Table(iptables.TableTypeNat).
-			Chain(userDefined).
-			MatchProtocol(false, network.ProtocolTCP).
-			MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIPPort, iptables.FlagDst, iptables.FlagDst)).
-			OptionWait(0).
-			TargetMark(iptables.WithTargetMarkSet(config.MarkIpsetIPPort)).
-			Insert()
-		if err != nil {
-			log.Errorf("client init tables, insert ipport target mark err: %s", strings.TrimSuffix(err.Error(), "\n"))
-			return err
+	return count
+}
+
+// delete jumps to owned chains, new connections are no longer intercepted
+func (client *Client) unjumpTables(level log.Level, prefix string) {
+	snapshot, err := saveNat()
+	if err != nil {
+		log.Printf(level, "%s, save nat err: %s", prefix, err)
+		return
+	}
+	payload := &bytes.Buffer{}
+	fmt.Fprintln(payload, "*nat")
+	for _, jump := range builtinJumps {
+		for i := 0; i < countLines(snapshot, jump); i++ {
+			fmt.Fprintln(payload, "-D"+jump[2:])
 		}
 	}
-
-	// add ipset match and dnat, ipport > port > ip
-	// dnat ip port
-	exist, err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIPPort, iptables.FlagDst, iptables.FlagDst)).
-		OptionWait(0).
-		TargetDNAT(iptables.WithTargetDNATToAddr(network.ParseIP("127.0.0.1"), client.port)).
-		Check()
-	if err != nil && !errors.IsErrChainNoMatch(err) {
-		log.Errorf("client init tables, check ipport dnat to dst err: %s", strings.TrimSuffix(err.Error(), "\n"))
-		return err
+	fmt.Fprintln(payload, "COMMIT")
+	infoO, infoE, err := utils.CmdStdin(payload.Bytes(), IPTablesRestore, "--noflush", "-w")
+	if err != nil {
+		log.Printf(level, "%s, delete jumps err: %s, stdout: %s, stderr: %s",
+			prefix, err, infoO, strings.TrimSuffix(string(infoE), "\n"))
 	}
-	if !exist {
-		err = ipt.Table(iptables.TableTypeNat).
-			Chain(userDefined).
-			MatchProtocol(false, network.ProtocolTCP).
-			MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIPPort, iptables.FlagDst, iptables.FlagDst)).
-			OptionWait(0).
-			TargetDNAT(iptables.WithTargetDNATToAddr(network.ParseIP("127.0.0.1"), client.port)).
-			Append()
-		if err != nil {
-			log.Errorf("client init tables, append ipport dnat to dst err: %s", strings.TrimSuffix(err.Error(), "\n"))
-			return err
+}
+
+// delete jumps, rules of older versions and owned chains in one restore
+func (client *Client) finiTables(level log.Level, prefix string) {
+	snapshot, err := saveNat()
+	if err != nil {
+		log.Printf(level, "%s, save nat err: %s", prefix, err)
+		return
+	}
+	owned := ownedRules(snapshot)
+	payload := &bytes.Buffer{}
+	fmt.Fprintln(payload, "*nat")
+	for _, jump := range builtinJumps {
+		for i := 0; i < countLines(snapshot, jump); i++ {
+			fmt.Fprintln(payload, "-D"+jump[2:])
 		}
 	}
-	// dnat port
-	exist, err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetPort, iptables.FlagDst)).
-		OptionWait(0).
-		TargetDNAT(iptables.WithTargetDNATToAddr(network.ParseIP("127.0.0.1"), client.port)).
-		Check()
-	if err != nil && !errors.IsErrChainNoMatch(err) {
-		log.Errorf("client init tables, check port dnat to dst err: %s", strings.TrimSuffix(err.Error(), "\n"))
-		return err
+	for _, legacy := range legacyRules(snapshot, client.conf) {
+		fmt.Fprintln(payload, "-D"+legacy[2:])
 	}
-	if !exist {
-		err = ipt.Table(iptables.TableTypeNat).
-			Chain(userDefined).
-			MatchProtocol(false, network.ProtocolTCP).
-			MatchSet(iptables.WithMatchSetName(false, ConduitIPSetPort, iptables.FlagDst)).
-			OptionWait(0).
-			TargetDNAT(iptables.WithTargetDNATToAddr(network.ParseIP("127.0.0.1"), client.port)).
-			Append()
-		if err != nil {
-			log.Errorf("client init tables, append port dnat to dst err: %s", strings.TrimSuffix(err.Error(), "\n"))
-			return err
+	// flush all before deleting any, output chain jumps the others
+	for _, chain := range ownedChains {
+		if _, ok := owned[chain]; ok {
+			fmt.Fprintf(payload, "-F %s\n", chain)
 		}
 	}
-	// dnat ip
-	exist, err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIP, iptables.FlagDst)).
-		OptionWait(0).
-		TargetDNAT(iptables.WithTargetDNATToAddr(network.ParseIP("127.0.0.1"), client.port)).
-		Check()
-	if err != nil && !errors.IsErrChainNoMatch(err) {
-		log.Errorf("client init tables, check ipport dnat to dst err: %s", strings.TrimSuffix(err.Error(), "\n"))
-		return err
-	}
-	if !exist {
-		err = ipt.Table(iptables.TableTypeNat).
-			Chain(userDefined).
-			MatchProtocol(false, network.ProtocolTCP).
-			MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIP, iptables.FlagDst)).
-			OptionWait(0).
-			TargetDNAT(iptables.WithTargetDNATToAddr(network.ParseIP("127.0.0.1"), client.port)).
-			Append()
-		if err != nil {
-			log.Errorf("client init tables, append ipport dnat to dst err: %s", strings.TrimSuffix(err.Error(), "\n"))
-			return err
+	for _, chain := range ownedChains {
+		if _, ok := owned[chain]; ok {
+			fmt.Fprintf(payload, "-X %s\n", chain)
 		}
 	}
-	return nil
+	fmt.Fprintln(payload, "COMMIT")
+	infoO, infoE, err := utils.CmdStdin(payload.Bytes(), IPTablesRestore, "--noflush", "-w")
+	if err != nil {
+		log.Printf(level, "%s, delete chains err: %s, stdout: %s, stderr: %s",
+			prefix, err, infoO, strings.TrimSuffix(string(infoE), "\n"))
+	}
 }
 
-func (client *Client) finiTables(level log.Level, prefix string) {
-	ipt := iptables.NewIPTables()
-
-	// delete ignore manager connection
-	if client.conf.Manager.Enable {
-		for _, address := range client.conf.Manager.Dial.Addresses {
-			ipport := strings.Split(address, ":")
-			if len(ipport) != 2 {
-				continue
-			}
-			port, err := strconv.Atoi(ipport[1])
-			if err != nil {
-				continue
+// netfilter changes by iptables-nft or nft are multicasted, iptables-legacy
+// changes are not and left to the timer, nil channel if not supported
+func watchNetfilter(quit chan struct{}) <-chan struct{} {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		log.Warnf("client watch netfilter, socket err: %s, timer only", err)
+		return nil
+	}
+	err = unix.Bind(fd, &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: 1 << (unix.NFNLGRP_NFTABLES - 1),
+	})
+	if err != nil {
+		unix.Close(fd)
+		log.Warnf("client watch netfilter, bind err: %s, timer only", err)
+		return nil
+	}
+	// wake up to check quit
+	tv := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		log.Warnf("client watch netfilter, set timeout err: %s, timer only", err)
+		return nil
+	}
+	events := make(chan struct{}, 1)
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 65536)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
 			}
-			err = ipt.Table(iptables.TableTypeNat).
-				Chain(iptables.ChainTypeOUTPUT).
-				MatchIPv4().
-				MatchProtocol(false, network.ProtocolTCP).
-				MatchDestination(false, ipport[0]).
-				MatchTCP(iptables.WithMatchTCPDstPort(false, port)).
-				OptionWait(0).
-				TargetAccept().
-				Delete()
+			_, _, err := unix.Recvfrom(fd, buf, 0)
 			if err != nil {
-				log.Printf(level, "%s, delete manager addr err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
+				if err == unix.EAGAIN || err == unix.EINTR || err == unix.ENOBUFS {
+					// timeout, or messages dropped which means changes too
+					if err == unix.ENOBUFS {
+						notify(events)
+					}
+					continue
+				}
+				log.Warnf("client watch netfilter, recv err: %s, timer only", err)
+				return
 			}
+			notify(events)
 		}
-	}
-
-	// delete the mark
-	err := ipt.Table(iptables.TableTypeNat).
-		Chain(iptables.ChainTypeOUTPUT).
-		MatchIPv4().
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchMark(false, config.MarkIgnoreOurself).
-		OptionWait(0).
-		TargetAccept().
-		Delete()
-	if err != nil && !errors.IsErrBadRule(err) {
-		log.Printf(level, "%s, delete mark err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
-	}
-
-	userDefined := iptables.ChainTypeUserDefined
-	userDefined.SetName(ConduitChain)
-	// delete marks
-	// delete ip mark
-	err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIP, iptables.FlagDst)).
-		OptionWait(0).
-		TargetMark(iptables.WithTargetMarkSet(config.MarkIpsetIP)).
-		Delete()
-	if err != nil && !errors.IsErrIPSetNoMatch(err) && !errors.IsErrChainNoMatch(err) {
-		log.Printf(level, "%s, delete ip ipset mark err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
-	}
-	// delete port mark
-	err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetPort, iptables.FlagDst)).
-		OptionWait(0).
-		TargetMark(iptables.WithTargetMarkSet(config.MarkIpsetPort)).
-		Delete()
-	if err != nil && !errors.IsErrIPSetNoMatch(err) && !errors.IsErrChainNoMatch(err) {
-		log.Printf(level, "%s, delete port ipset mark err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
-	}
-	err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIPPort, iptables.FlagDst, iptables.FlagDst)).
-		OptionWait(0).
-		TargetMark(iptables.WithTargetMarkSet(config.MarkIpsetIPPort)).
-		Delete()
-	if err != nil && !errors.IsErrIPSetNoMatch(err) && !errors.IsErrChainNoMatch(err) {
-		log.Printf(level, "%s, delete ipport ipset mark err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
-	}
-	// delete dnats
-	// dnat port
-	err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetPort, iptables.FlagDst)).
-		OptionWait(0).
-		TargetDNAT(iptables.WithTargetDNATToAddr(network.ParseIP("127.0.0.1"), client.port)).
-		Delete()
-	if err != nil && !errors.IsErrIPSetNoMatch(err) && !errors.IsErrChainNoMatch(err) {
-		log.Printf(level, "%s, delete dnat err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
-	}
-	// dnat ip port
-	err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIPPort, iptables.FlagDst, iptables.FlagDst)).
-		OptionWait(0).
-		TargetDNAT(iptables.WithTargetDNATToAddr(network.ParseIP("127.0.0.1"), client.port)).
-		Delete()
-	if err != nil && !errors.IsErrIPSetNoMatch(err) && !errors.IsErrChainNoMatch(err) {
-		log.Printf(level, "%s, delete dnat err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
-	}
-	// dnat ip
-	err = ipt.Table(iptables.TableTypeNat).
-		Chain(userDefined).
-		MatchProtocol(false, network.ProtocolTCP).
-		MatchSet(iptables.WithMatchSetName(false, ConduitIPSetIP, iptables.FlagDst)).
-		OptionWait(0).
-		TargetDNAT(iptables.WithTargetDNATToAddr(network.ParseIP("127.0.0.1"), client.port)).
-		Delete()
-	if err != nil && !errors.IsErrIPSetNoMatch(err) && !errors.IsErrChainNoMatch(err) {
-		log.Printf(level, "%s, delete dnat err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
-	}
-
-	// flush conduit chain
-	err = ipt.Table(iptables.TableTypeNat).
-		UserDefinedChain(ConduitChain).
-		OptionWait(0).
-		Flush()
-	if err != nil && !errors.IsErrChainNoMatch(err) {
-		log.Printf(level, "%s, flush conduit chain err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
-	}
-
-	// delete jump conduit, NAT-PREROUTING
-	err = ipt.Table(iptables.TableTypeNat).
-		Chain(iptables.ChainTypePREROUTING).
-		OptionWait(0).
-		TargetJumpChain(ConduitChain).
-		Delete()
-	if err != nil && !errors.IsErrChainNoMatch(err) && !errors.IsErrNoSuchFileOrDirectory(err) {
-		log.Printf(level, "%s, delete jump conduit chain err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
-	}
-	// delete jump conduit, NAT-OUTPUT
-	err = ipt.Table(iptables.TableTypeNat).
-		Chain(iptables.ChainTypeOUTPUT).
-		OptionWait(0).
-		TargetJumpChain(ConduitChain).
-		Delete()
-	if err != nil && !errors.IsErrChainNoMatch(err) && !errors.IsErrNoSuchFileOrDirectory(err) {
-		log.Printf(level, "%s, delete jump conduit chain err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
-	}
+	}()
+	return events
+}
 
-	// delete conduit chain
-	err = ipt.Table(iptables.TableTypeNat).
-		UserDefinedChain(ConduitChain).
-		OptionWait(0).
-		Delete()
-	if err != nil && !errors.IsErrBadRule(err) {
-		log.Printf(level, "%s, delete conduit chain err: %s", prefix, strings.TrimSuffix(err.Error(), "\n"))
+func notify(events chan struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
 	}
 }
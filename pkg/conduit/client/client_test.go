@@ -7,6 +7,7 @@
 package client
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/jumboframes/armorigo/log"
@@ -22,12 +23,12 @@ func TestSetTables(t *testing.T) {
 	conf.Client.Listen = "127.0.0.1:5052" // client
 	t.Log(conf.Client.ForwardTable[0].Dst)
 
-	client, err := NewClient(conf, nil, repo.NewRepo())
+	client, err := NewClient(conf, nil, repo.NewRepo(), nil)
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	client.initTables()
+	client.reconcileTables(&client.tables)
 }
 
 func TestUnSetTables(t *testing.T) {
@@ -38,10 +39,130 @@ func TestUnSetTables(t *testing.T) {
 	conf.Client.Listen = "127.0.0.1:5052" // client
 	t.Log(conf.Client.ForwardTable[0].Dst)
 
-	client, err := NewClient(conf, nil, repo.NewRepo())
+	client, err := NewClient(conf, nil, repo.NewRepo(), nil)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 	client.finiTables(log.LevelError, "client fini tables")
 }
+
+func TestPickPeer(t *testing.T) {
+	client := &Client{repo: repo.NewRepo()}
+	addrs := []string{"10.0.0.1:5053", "10.0.0.2:5053"}
+	client.repo.SetPeerDraining(addrs[0], true)
+	for i := 0; i < 10; i++ {
+		if index := client.pickPeer(addrs); index != 1 {
+			t.Errorf("draining peer picked, index: %d", index)
+		}
+	}
+	// all draining, still pick one
+	client.repo.SetPeerDraining(addrs[1], true)
+	if index := client.pickPeer(addrs); index < 0 || index > 1 {
+		t.Errorf("illegal index: %d", index)
+	}
+}
+
+func TestOwnedRules(t *testing.T) {
+	snapshot := []string{
+		"*nat",
+		":PREROUTING ACCEPT [0:0]",
+		":CONDUIT - [0:0]",
+		":CONDUIT_OUTPUT - [0:0]",
+		"-A PREROUTING -j CONDUIT_PREROUTING",
+		"-A CONDUIT_OUTPUT -j CONDUIT",
+		"-A CONDUIT -p tcp -m set --match-set CONDUIT_PORT dst -j DNAT --to-destination 127.0.0.1:5052",
+		"COMMIT",
+	}
+	owned := ownedRules(snapshot)
+	if len(owned[ConduitChain]) != 1 || len(owned[ConduitOutputChain]) != 1 {
+		t.Errorf("unexpected owned rules: %v", owned)
+	}
+	// declared but empty, or missing
+	if rules, ok := owned[ConduitPreroutingChain]; ok || rules != nil {
+		t.Errorf("unexpected prerouting chain: %v", rules)
+	}
+	if countLines(snapshot, builtinJumps[0]) != 1 || countLines(snapshot, builtinJumps[1]) != 0 {
+		t.Error("unexpected builtin jumps")
+	}
+}
+
+func TestLegacyRules(t *testing.T) {
+	conf := &config.Config{}
+	conf.Manager.Enable = true
+	conf.Manager.Dial.Addresses = []string{"10.0.0.9:5051"}
+	snapshot := []string{
+		"-A PREROUTING -i br+ -j CONDUIT",
+		"-A PREROUTING -j CONDUIT_PREROUTING",
+		"-A OUTPUT -p tcp -m mark --mark 0x5a4 -j ACCEPT",
+		"-A OUTPUT -d 10.0.0.9/32 -p tcp -m tcp --dport 5051 -j ACCEPT",
+		"-A OUTPUT -m owner --uid-owner 0 -m comment --comment conduit-exclude -j RETURN",
+		"-A OUTPUT ! -o br+ -j CONDUIT_SELECT",
+		"-A OUTPUT -j CONDUIT_OUTPUT",
+		"-A OUTPUT -d 10.0.0.1/32 -j ACCEPT",
+		"-A CONDUIT -p tcp -m set --match-set CONDUIT_PORT dst -j DNAT --to-destination 127.0.0.1:5052",
+	}
+	legacies := legacyRules(snapshot, conf)
+	if len(legacies) != 5 {
+		t.Errorf("unexpected legacy rules: %v", legacies)
+	}
+}
+
+func TestRenderTables(t *testing.T) {
+	conf := &config.Config{}
+	conf.Client.IngressInterfaces = []string{"docker0", "cali+"}
+	conf.Client.Exclude.Destinations = []string{"10.0.0.0/8", "10.1.0.1"}
+	conf.Client.Exclude.UIDs = []int{0}
+	conf.Client.ForwardTable = []config.ForwardElem{
+		{Dst: ":80", DstAs: "127.0.0.1:80"},
+		{Dst: "192.168.0.2:9092", DstAs: "127.0.0.1:9092", Selector: config.Selector{
+			Cgroups: []string{"/system.slice/app.service"},
+			UIDs:    []int{1000},
+		}},
+	}
+	client := &Client{conf: conf, port: 5052}
+	rules, err := client.renderTables()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	out := strings.Join(rules, "\n")
+	for _, want := range []string{
+		"-A CONDUIT_PREROUTING -i cali+ -j CONDUIT",
+		"-A CONDUIT_OUTPUT -o docker0 -j RETURN",
+		"-A CONDUIT_OUTPUT -m owner --uid-owner 0 -j RETURN",
+		"-A CONDUIT -d 10.1.0.1/32 -j RETURN",
+		"-A CONDUIT_SELECT -d 10.0.0.0/8 -j RETURN",
+		"-A CONDUIT -p tcp -m set --match-set CONDUIT_IPPORT dst,dst -j MARK --set-xmark 0x5a6/0xffffffff",
+		"-A CONDUIT_SELECT -d 192.168.0.2/32 -p tcp -m tcp --dport 9092 -m cgroup --path /system.slice/app.service -j DNAT --to-destination 127.0.0.1:5052",
+		"-A CONDUIT_SELECT -d 192.168.0.2/32 -p tcp -m tcp --dport 9092 -m owner --uid-owner 1000 -j MARK --set-xmark 0x5a6/0xffffffff",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q not found in:\n%s", want, out)
+		}
+	}
+	// unselected elems go by ipsets
+	if strings.Contains(out, "--dport 80 ") {
+		t.Errorf("unselected elem rendered:\n%s", out)
+	}
+}
+
+func TestRenderTablesMarkOrder(t *testing.T) {
+	client := &Client{conf: &config.Config{}, port: 5052}
+	rules, err := client.renderTables()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the last matched mark wins, ipport > port > ip > net
+	marks := []string{}
+	for _, rule := range rules {
+		if strings.HasPrefix(rule, "-A CONDUIT ") && strings.Contains(rule, "-j MARK") {
+			marks = append(marks, strings.Fields(rule)[7])
+		}
+	}
+	want := []string{"CONDUIT_NET", "CONDUIT_IP", "CONDUIT_PORT", "CONDUIT_IPPORT"}
+	if strings.Join(marks, ",") != strings.Join(want, ",") {
+		t.Errorf("marks in order %v, want %v", marks, want)
+	}
+}
@@ -7,35 +7,58 @@
 package conduit
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
 	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/accesslog"
+	"github.com/moresec-io/conduit/pkg/conduit/admin"
 	"github.com/moresec-io/conduit/pkg/conduit/client"
 	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/flow"
+	"github.com/moresec-io/conduit/pkg/conduit/kube"
+	"github.com/moresec-io/conduit/pkg/conduit/metrics"
 	"github.com/moresec-io/conduit/pkg/conduit/repo"
 	"github.com/moresec-io/conduit/pkg/conduit/server"
 	"github.com/moresec-io/conduit/pkg/conduit/syncer"
 )
 
 type Conduit struct {
-	conf   *config.Config
-	client *client.Client
-	server *server.Server
+	conf      *config.Config
+	client    *client.Client
+	server    *server.Server
+	metrics   *metrics.Metrics
+	accessLog *accesslog.AccessLog
+	admin     *admin.Admin
+	kube      *kube.Watcher
+}
+
+// DryRun prints what the conduit would install without touching the kernel
+func DryRun(w io.Writer) error {
+	if !config.Conf.Client.Enable {
+		fmt.Fprintln(w, "# client disabled, nothing to install")
+		return nil
+	}
+	return client.DryRun(config.Conf, w)
 }
 
+// NewConduit starts the conduit by config.Conf, config.Init must be called before
 func NewConduit() (*Conduit, error) {
 	var (
 		cli       *client.Client
 		clienable bool
 		srv       *server.Server
 		srvenable bool
+		mtc       *metrics.Metrics
+		al        *accesslog.AccessLog
+		adm       *admin.Admin
+		kw        *kube.Watcher
 		syn       syncer.Syncer
 		syncMode  int
 		err       error
 	)
-	err = config.Init()
-	if err != nil {
-		log.Fatalf("init config err: %s", err)
-		return nil, err
-	}
 	log.Infof(`
 ==================================================
                 CONDUIT STARTS
@@ -50,6 +73,23 @@ func NewConduit() (*Conduit, error) {
 		syncMode |= syncer.SyncModeUp
 	}
 
+	if config.Conf.Metrics.Enable {
+		mtc, err = metrics.NewMetrics(config.Conf)
+		if err != nil {
+			log.Errorf("conduit new metrics err: %s", err)
+			return nil, err
+		}
+		log.Infof("conduit new metrics success, addr: %s", config.Conf.Metrics.Listen.Addr)
+	}
+
+	if config.Conf.AccessLog.Enable {
+		al, err = accesslog.NewAccessLog(config.Conf)
+		if err != nil {
+			log.Errorf("conduit new access log err: %s", err)
+			return nil, err
+		}
+	}
+
 	repo := repo.NewRepo()
 	if config.Conf.Manager.Enable {
 		syn, err = syncer.NewSyncer(config.Conf, repo, syncMode)
@@ -59,8 +99,16 @@ func NewConduit() (*Conduit, error) {
 		}
 	}
 
+	if config.Conf.Admin.Enable {
+		adm, err = admin.NewAdmin(config.Conf, repo, syn)
+		if err != nil {
+			log.Errorf("conduit new admin err: %s", err)
+			return nil, err
+		}
+	}
+
 	if clienable {
-		cli, err = client.NewClient(config.Conf, syn, repo)
+		cli, err = client.NewClient(config.Conf, syn, repo, al)
 		if err != nil {
 			log.Errorf("conduit new client err: %s", err)
 			return nil, err
@@ -68,18 +116,70 @@ func NewConduit() (*Conduit, error) {
 		log.Infof("conduit new client success, addr: %s", config.Conf.Client.Listen)
 	}
 	if srvenable {
-		srv, err = server.NewServer(config.Conf, syn)
+		srv, err = server.NewServer(config.Conf, syn, al)
 		if err != nil {
 			log.Errorf("conduit new server err: %s", err)
 			return nil, err
 		}
 		log.Infof("conduit new server success, addr: %s", config.Conf.Server.Listen.Addr)
 	}
-	return &Conduit{
-		conf:   config.Conf,
-		client: cli,
-		server: srv,
-	}, nil
+	if config.Conf.Kube.Enable {
+		kw, err = kube.NewWatcher(config.Conf)
+		if err != nil {
+			log.Errorf("conduit new kube watcher err: %s", err)
+			return nil, err
+		}
+		kw.OnChange(func(state *kube.State) {
+			if cli != nil {
+				cli.SetKubePolicies(state.Policies)
+			}
+			if srv != nil {
+				srv.SetAllowed(state.Allowed)
+			}
+			if syn != nil {
+				syn.SetIPNets(state.PodCIDRs)
+			}
+		})
+	}
+	conduit := &Conduit{
+		conf:      config.Conf,
+		client:    cli,
+		server:    srv,
+		metrics:   mtc,
+		accessLog: al,
+		admin:     adm,
+		kube:      kw,
+	}
+	if adm != nil {
+		adm.OnReload(conduit.Reload)
+	}
+	return conduit, nil
+}
+
+// Reload re-reads the configuration, only log level, forward table and peers
+// take effect, others need a restart.
+func (Conduit *Conduit) Reload() error {
+	conf, err := config.Reload()
+	if err != nil {
+		log.Errorf("conduit reload config err: %s", err)
+		return err
+	}
+	if level, err := log.ParseLevel(conf.Log.Level); err == nil {
+		log.SetLevel(level)
+	}
+	if Conduit.conf.Client.Enable {
+		if err = Conduit.client.Reload(conf); err != nil {
+			log.Errorf("conduit reload client err: %s", err)
+			return err
+		}
+	}
+	log.Infof("conduit reload success")
+	return nil
+}
+
+// reload on SIGHUP
+func (Conduit *Conduit) Notify(os.Signal) {
+	Conduit.Reload()
 }
 
 func (Conduit *Conduit) Run() {
@@ -89,6 +189,15 @@ func (Conduit *Conduit) Run() {
 	if Conduit.conf.Server.Enable {
 		go Conduit.server.Work()
 	}
+	if Conduit.conf.Metrics.Enable {
+		go Conduit.metrics.Work()
+	}
+	if Conduit.conf.Admin.Enable {
+		go Conduit.admin.Work()
+	}
+	if Conduit.conf.Kube.Enable {
+		go Conduit.kube.Work()
+	}
 }
 
 func (Conduit *Conduit) Close() {
@@ -98,11 +207,45 @@ func (Conduit *Conduit) Close() {
                 CONDUIT ENDS
 ==================================================`)
 	}()
+	if Conduit.conf.Kube.Enable {
+		Conduit.kube.Close()
+	}
+	// stop taking new connections on both sides first
+	if Conduit.conf.Client.Enable {
+		Conduit.client.Drain()
+	}
+	if Conduit.conf.Server.Enable {
+		Conduit.server.Drain()
+	}
+	Conduit.drain()
 	if Conduit.conf.Client.Enable {
 		Conduit.client.Close()
 	}
 	if Conduit.conf.Server.Enable {
 		Conduit.server.Close()
 	}
+	if Conduit.conf.Metrics.Enable {
+		Conduit.metrics.Close()
+	}
+	if Conduit.conf.Admin.Enable {
+		Conduit.admin.Close()
+	}
+	Conduit.accessLog.Close()
 	config.RotateLog.Close()
 }
+
+// wait for active flows to finish, the left ones are killed after the timeout
+func (Conduit *Conduit) drain() {
+	n := flow.Flows.Len()
+	if n == 0 {
+		return
+	}
+	timeout := time.Duration(Conduit.conf.DrainTimeout) * time.Second
+	log.Infof("conduit draining %d flows, timeout: %s", n, timeout)
+	n = flow.Flows.Wait(timeout)
+	if n != 0 {
+		log.Warnf("conduit drain timeout, kill %d flows", flow.Flows.KillAll())
+		return
+	}
+	log.Infof("conduit drained")
+}
@@ -24,6 +24,11 @@ var (
 	Conf      *Config
 	RotateLog *lumberjack.Logger
 
+	// exit after validating the configuration
+	ValidateOnly bool
+	// print what the client would install without touching the kernel
+	DryRun bool
+
 	h           bool
 	file        string
 	defaultFile string = "./conduit.yaml"
@@ -34,6 +39,8 @@ var (
 	MarkIpsetIP       = 1445
 	MarkIpsetIPPort   = 1446
 	MarkIpsetPort     = 1447
+	MarkIpsetNet      = 1448
+	MarkTransparent   = 1449
 )
 
 type Manager struct {
@@ -41,10 +48,26 @@ type Manager struct {
 	Dial   config.Dial `yaml:"dial"`
 }
 
+// selects the local processes whose traffic is intercepted, any of them
+// matches, empty for all
+type Selector struct {
+	Cgroups []string `yaml:"cgroups"` // cgroup v2 paths
+	UIDs    []int    `yaml:"uids"`
+	GIDs    []int    `yaml:"gids"`
+}
+
+func (selector *Selector) Empty() bool {
+	return len(selector.Cgroups) == 0 && len(selector.UIDs) == 0 && len(selector.GIDs) == 0
+}
+
 type ForwardElem struct {
-	Dst       string `yaml:"dst"` // :9092 or 192.168.0.2:9092
-	PeerIndex int    `yaml:"peer_index"`
-	DstAs     string `yaml:"dst_as"`
+	Dst       string   `yaml:"dst"` // :9092 or 192.168.0.2:9092
+	PeerIndex int      `yaml:"peer_index"`
+	DstAs     string   `yaml:"dst_as"`
+	Selector  Selector `yaml:"selector"`
+	// conduit servers relaying in order after the peer, the last one dials
+	// dst_as, each must enable server.relay
+	Route []string `yaml:"route"`
 }
 
 type Peer struct {
@@ -54,30 +77,218 @@ type Peer struct {
 	TLS       config.TLS `yaml:"tls"`
 }
 
+const (
+	// rules removed on shutdown, traffic goes direct until the next start
+	FailModeOpen = "open"
+	// rules left installed on shutdown, traffic fails instead of leaking plaintext
+	FailModeClosed = "closed"
+)
+
+// a tunable under /proc/sys, like net.ipv4.ip_forward
+type Sysctl struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+}
+
+// intercept in container net namespaces too, each of them gets the chains,
+// ipsets and a listener of its own
+type Netns struct {
+	Enable       bool `yaml:"enable"`
+	ScanInterval int  `yaml:"scan_interval"` // seconds between scans of /proc
+}
+
 // TLS > Default TLS
 type Client struct {
-	Enable       bool          `yaml:"enable"`
-	Network      string        `yaml:"network"` // tcp, udp or tcp,udp
-	Listen       string        `yaml:"listen"`  // for tcp transparent
-	CheckTime    int           `yaml:"check_time"`
-	ForwardTable []ForwardElem `yaml:"forward_table"`
-	Peers        []Peer        `yaml:"peers"`
+	Enable       bool           `yaml:"enable"`
+	Network      string         `yaml:"network"` // tcp, udp or tcp,udp
+	Listen       string         `yaml:"listen"`  // for tcp transparent
+	CheckTime    int            `yaml:"check_time"`
+	FailMode     string         `yaml:"fail_mode"` // open or closed
+	ForwardTable []ForwardElem  `yaml:"forward_table"`
+	Peers        []Peer         `yaml:"peers"`
+	Exclude      config.Exclude `yaml:"exclude"`
+	Netns        Netns          `yaml:"netns"`
+	// interfaces container traffic comes in, jumped in NAT-PREROUTING and
+	// not intercepted in NAT-OUTPUT, like docker0, cni-podman0 or cali+
+	IngressInterfaces []string `yaml:"ingress_interfaces"`
+	// set besides route_localnet and tcp_fwmark_accept, restored on exit
+	Sysctls []Sysctl `yaml:"sysctls"`
+	// proxy listeners for apps that can't be intercepted but support proxies
+	Inbound Inbound `yaml:"inbound"`
+}
+
+const (
+	NoMatchDirect = "direct"
+	NoMatchReject = "reject"
+)
+
+// destinations are looked up in all policies like intercepted ones
+type Inbound struct {
+	SOCKS5 InboundListen `yaml:"socks5"` // connect and udp associate
+	HTTP   InboundListen `yaml:"http"`   // connect only
+	// direct or reject destinations without policy
+	NoMatch string `yaml:"no_match"`
+}
+
+type InboundListen struct {
+	Enable bool   `yaml:"enable"`
+	Listen string `yaml:"listen"` // like 127.0.0.1:1080
 }
 
 type Server struct {
 	Enable        bool `yaml:"enable"`
 	config.Listen `yaml:"listen"`
+	Relay         Relay   `yaml:"relay"`
+	Reverse       Reverse `yaml:"reverse"`
+	// the first matched is prepended to tcp dials of dst_as
+	ProxyProtocols []ProxyProtocol `yaml:"proxy_protocols"`
+	// for backends needing the client's ip on the socket
+	TransparentEgress TransparentEgress `yaml:"transparent_egress"`
+}
+
+// tcp dials of dst_as bound to the client's ip by IP_TRANSPARENT, replies
+// are routed back to us by a mark and a local route in the table. The rules
+// are removed on exit
+type TransparentEgress struct {
+	Enable bool `yaml:"enable"`
+	// dst_as patterns, * matches any and a trailing * matches the prefix
+	Dsts  []string `yaml:"dsts"`
+	Table int      `yaml:"table"` // routing table of the local route
+}
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// backends of the dsts see the client's addr by a proxy protocol header
+type ProxyProtocol struct {
+	// dst_as patterns, * matches any and a trailing * matches the prefix
+	Dsts    []string `yaml:"dsts"`
+	Version string   `yaml:"version"` // v1 or v2
+	// identity of the conduit dialing us in a tlv of type 0xe0, v2 only
+	Identity bool `yaml:"identity"`
+}
+
+// servers behind nat keep sessions to relays instead of being dialed,
+// connections are spliced down the sessions by relays
+type Reverse struct {
+	Enable  bool     `yaml:"enable"`
+	Network string   `yaml:"network"`
+	Relays  []string `yaml:"relays"` // reverse listen addrs of relays
+	// the manager's certs are used if manager enabled
+	TLS config.TLS `yaml:"tls"`
+}
+
+// connections with a route are relayed to the next conduit instead of
+// dialing dst_as
+type Relay struct {
+	Enable  bool   `yaml:"enable"`
+	Network string `yaml:"network"`
+	// to dial next conduits, the manager's certs are used if manager enabled
+	TLS config.TLS `yaml:"tls"`
+	// nothing relayed if empty
+	Allows []RelayAllow `yaml:"allows"`
+	// sessions of servers behind nat, dialed at the addrs they registered
+	Reverse ReverseListen `yaml:"reverse"`
+}
+
+type ReverseListen struct {
+	Enable bool `yaml:"enable"`
+	// tls of the manager's certs is used if manager enabled
+	Listen config.Listen `yaml:"listen"`
+	// servers allowed to keep sessions, same patterns as allows
+	Identities []string `yaml:"identities"`
+}
+
+// previous conduits with the identities may relay to the next hops,
+// identity is spiffe id or common name, * matches any and a trailing *
+// matches the prefix
+type RelayAllow struct {
+	Identities []string `yaml:"identities"`
+	Hops       []string `yaml:"hops"`
+}
+
+// prometheus metrics at /metrics
+type Metrics struct {
+	Enable bool          `yaml:"enable"`
+	Listen config.Listen `yaml:"listen"`
+}
+
+const (
+	AccessLogSinkFile   = "file"
+	AccessLogSinkSyslog = "syslog"
+)
+
+type Syslog struct {
+	Network string `yaml:"network"` // empty for local syslog
+	Addr    string `yaml:"addr"`
+	Tag     string `yaml:"tag"`
+}
+
+// json lines for every tunnelled connection
+type AccessLog struct {
+	Enable   bool   `yaml:"enable"`
+	Sink     string `yaml:"sink"` // file or syslog
+	File     string `yaml:"file"`
+	MaxSize  int    `yaml:"maxsize"`
+	MaxRolls int    `yaml:"maxrolls"`
+	Syslog   Syslog `yaml:"syslog"`
+	// fraction of connections logged, 0 means all, failed ones are always logged
+	SampleRate float64 `yaml:"sample_rate"`
+}
+
+const DefaultAdminSocket = "/var/run/conduit/admin.sock"
+
+// local admin api over unix socket
+type Admin struct {
+	Enable bool   `yaml:"enable"`
+	Socket string `yaml:"socket"`
+}
+
+// services and endpointslices annotated conduit.io/encrypt=true are
+// translated into client policies and server allowed dst_as
+type Kube struct {
+	Enable     bool   `yaml:"enable"`
+	Kubeconfig string `yaml:"kubeconfig"` // empty for in-cluster config
+	NodeName   string `yaml:"node_name"`  // empty for env NODE_NAME, then hostname
+	// conduits on other nodes are dialed at node internal ip and server
+	// port, with network and tls of the client peer
+	PeerIndex  int `yaml:"peer_index"`
+	ServerPort int `yaml:"server_port"`
+	// servers only dial dst_as of the annotated services and their endpoints
+	RestrictServer bool `yaml:"restrict_server"`
+	ResyncInterval int  `yaml:"resync_interval"` // seconds between full lists
 }
 
 type Config struct {
 	MachineID string `yaml:"-"`
 
+	// zone of the conduit and zones it reaches directly, manager routes
+	// clients through relays to servers in zones they don't reach
+	Zone    string   `yaml:"zone"`
+	Reaches []string `yaml:"reaches"`
+
+	Admin Admin `yaml:"admin"`
+
+	Metrics Metrics `yaml:"metrics"`
+
+	AccessLog AccessLog `yaml:"access_log"`
+
 	Manager Manager `yaml:"manager"`
 
 	Server Server `yaml:"server"`
 
 	Client Client `yaml:"client"`
 
+	Kube Kube `yaml:"kube"`
+
+	// local ips reported to manager
+	Networks config.IPFilter `yaml:"networks"`
+
+	// seconds to wait for active flows on shutdown, the left ones are killed
+	DrainTimeout int `yaml:"drain_timeout"`
+
 	Log struct {
 		Level    string `yaml:"level"`
 		File     string `yaml:"file"`
@@ -99,6 +310,14 @@ func Init() error {
 		return err
 	}
 
+	err = Conf.Validate()
+	if err != nil {
+		return err
+	}
+	if ValidateOnly {
+		return nil
+	}
+
 	err = initLog()
 	if err != nil {
 		return err
@@ -113,6 +332,8 @@ func Init() error {
 
 func initCmd() error {
 	flag.StringVar(&file, "c", defaultFile, "configuration file")
+	flag.BoolVar(&ValidateOnly, "validate", false, "validate the configuration file and exit")
+	flag.BoolVar(&DryRun, "dry-run", false, "print iptables rules, ipset entries and policies the client would install, then exit")
 	flag.BoolVar(&h, "h", false, "help")
 	flag.Parse()
 	if h {
@@ -129,7 +350,29 @@ func initConf() error {
 	}
 	Conf = &Config{}
 	err = yaml.Unmarshal([]byte(data), Conf)
-	return err
+	if err != nil {
+		return err
+	}
+	Conf.setDefaults()
+	return nil
+}
+
+// Reload re-reads the configuration file, Conf is left untouched
+func Reload() (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	conf := &Config{}
+	if err = yaml.Unmarshal(data, conf); err != nil {
+		return nil, err
+	}
+	conf.setDefaults()
+	if err = conf.Validate(); err != nil {
+		return nil, err
+	}
+	conf.MachineID = Conf.MachineID
+	return conf, nil
 }
 
 func initLog() error {
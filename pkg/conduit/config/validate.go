@@ -0,0 +1,530 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/config"
+	"github.com/moresec-io/conduit/pkg/network"
+)
+
+const (
+	DefaultClientNetwork    = "tcp"
+	DefaultCheckTime        = 60
+	DefaultDrainTimeout     = 30
+	DefaultScanInterval     = 5
+	DefaultKubeResync       = 300
+	DefaultTransparentTable = 1449
+)
+
+var DefaultIngressInterfaces = []string{"br+"}
+
+// FieldError is an illegal field, Field is the yaml path like client.forward_table[0].dst
+type FieldError struct {
+	Field string
+	Err   string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err
+}
+
+// ValidationError collects all illegal fields of a configuration
+type ValidationError []*FieldError
+
+func (errs ValidationError) Error() string {
+	strs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		strs = append(strs, err.Error())
+	}
+	return "illegal configuration: " + strings.Join(strs, "; ")
+}
+
+type validator struct {
+	errs ValidationError
+}
+
+func (v *validator) errorf(field string, format string, args ...interface{}) {
+	v.errs = append(v.errs, &FieldError{Field: field, Err: fmt.Sprintf(format, args...)})
+}
+
+// set defaults for fields which are unusable at zero value
+func (conf *Config) setDefaults() {
+	if conf.Client.Network == "" {
+		conf.Client.Network = DefaultClientNetwork
+	}
+	if conf.Client.CheckTime == 0 {
+		conf.Client.CheckTime = DefaultCheckTime
+	}
+	if conf.Client.FailMode == "" {
+		conf.Client.FailMode = FailModeOpen
+	}
+	if conf.Client.Netns.ScanInterval == 0 {
+		conf.Client.Netns.ScanInterval = DefaultScanInterval
+	}
+	if conf.Client.Inbound.NoMatch == "" {
+		conf.Client.Inbound.NoMatch = NoMatchReject
+	}
+	if conf.Client.IngressInterfaces == nil {
+		conf.Client.IngressInterfaces = DefaultIngressInterfaces
+	}
+	if conf.DrainTimeout == 0 {
+		conf.DrainTimeout = DefaultDrainTimeout
+	}
+	if conf.Server.Relay.Network == "" {
+		conf.Server.Relay.Network = DefaultClientNetwork
+	}
+	if conf.Server.Reverse.Network == "" {
+		conf.Server.Reverse.Network = DefaultClientNetwork
+	}
+	if conf.Server.TransparentEgress.Table == 0 {
+		conf.Server.TransparentEgress.Table = DefaultTransparentTable
+	}
+	if conf.Kube.ResyncInterval == 0 {
+		conf.Kube.ResyncInterval = DefaultKubeResync
+	}
+	if conf.Kube.ServerPort == 0 && conf.Server.Enable {
+		// every node listens the same
+		if _, port, err := net.SplitHostPort(conf.Server.Addr); err == nil {
+			conf.Kube.ServerPort, _ = strconv.Atoi(port)
+		}
+	}
+}
+
+// Validate checks the whole configuration and returns a ValidationError
+// with every illegal field, nil if the configuration is usable
+func (conf *Config) Validate() error {
+	v := &validator{}
+	if _, err := log.ParseLevel(conf.Log.Level); err != nil {
+		v.errorf("log.level", "%s", err)
+	}
+	if conf.DrainTimeout < 0 {
+		v.errorf("drain_timeout", "must be positive, got %d", conf.DrainTimeout)
+	}
+	if conf.Admin.Enable && conf.Admin.Socket != "" && !strings.HasPrefix(conf.Admin.Socket, "/") {
+		v.errorf("admin.socket", "must be an absolute path, got %q", conf.Admin.Socket)
+	}
+	if conf.Metrics.Enable {
+		v.listen("metrics.listen", &conf.Metrics.Listen)
+	}
+	if conf.AccessLog.Enable {
+		v.accessLog("access_log", &conf.AccessLog)
+	}
+	if conf.Manager.Enable {
+		v.dial("manager.dial", &conf.Manager.Dial)
+	}
+	if conf.Server.Enable {
+		v.listen("server.listen", &conf.Server.Listen)
+		if conf.Server.Relay.Enable {
+			v.relay("server.relay", &conf.Server.Relay, conf.Manager.Enable)
+		}
+		if conf.Server.Reverse.Enable {
+			v.reverse("server.reverse", &conf.Server.Reverse, conf.Manager.Enable)
+		}
+		for i := range conf.Server.ProxyProtocols {
+			v.proxyProtocol(fmt.Sprintf("server.proxy_protocols[%d]", i), &conf.Server.ProxyProtocols[i])
+		}
+		if conf.Server.TransparentEgress.Enable {
+			v.transparentEgress("server.transparent_egress", &conf.Server.TransparentEgress)
+		}
+	}
+	if conf.Client.Enable {
+		v.client("client", &conf.Client)
+	}
+	v.ipFilter("networks", &conf.Networks)
+	if conf.Kube.Enable {
+		v.kube("kube", conf)
+	}
+	if len(v.errs) != 0 {
+		return v.errs
+	}
+	return nil
+}
+
+func (v *validator) client(field string, client *Client) {
+	switch client.Network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		v.errorf(field+".network", "unsupported network %q", client.Network)
+	}
+	v.addr(field+".listen", client.Listen)
+	if client.CheckTime < 0 {
+		v.errorf(field+".check_time", "must be positive, got %d", client.CheckTime)
+	}
+	if client.FailMode != FailModeOpen && client.FailMode != FailModeClosed {
+		v.errorf(field+".fail_mode", "must be %s or %s, got %q", FailModeOpen, FailModeClosed, client.FailMode)
+	}
+
+	indexes := map[int]int{}
+	for i := range client.Peers {
+		peer := &client.Peers[i]
+		peerField := fmt.Sprintf("%s.peers[%d]", field, i)
+		if j, ok := indexes[peer.Index]; ok {
+			v.errorf(peerField+".index", "duplicated index %d, also at %s.peers[%d]", peer.Index, field, j)
+		} else {
+			indexes[peer.Index] = i
+		}
+		if peer.Network == "" {
+			v.errorf(peerField+".network", "required")
+		}
+		v.addrs(peerField+".addresses", peer.Addresses)
+		v.tls(peerField+".tls", &peer.TLS, false)
+	}
+
+	v.exclude(field+".exclude", &client.Exclude)
+	for i, iface := range client.IngressInterfaces {
+		v.iface(fmt.Sprintf("%s.ingress_interfaces[%d]", field, i), iface)
+	}
+	if client.Netns.Enable && client.Netns.ScanInterval < 0 {
+		v.errorf(field+".netns.scan_interval", "must be positive, got %d", client.Netns.ScanInterval)
+	}
+
+	if client.Inbound.SOCKS5.Enable {
+		v.addr(field+".inbound.socks5.listen", client.Inbound.SOCKS5.Listen)
+	}
+	if client.Inbound.HTTP.Enable {
+		v.addr(field+".inbound.http.listen", client.Inbound.HTTP.Listen)
+	}
+	if client.Inbound.NoMatch != NoMatchDirect && client.Inbound.NoMatch != NoMatchReject {
+		v.errorf(field+".inbound.no_match", "must be %s or %s, got %q", NoMatchDirect, NoMatchReject, client.Inbound.NoMatch)
+	}
+
+	keys := map[string]int{}
+	for i := range client.Sysctls {
+		sysctl := &client.Sysctls[i]
+		sysctlField := fmt.Sprintf("%s.sysctls[%d]", field, i)
+		if _, err := network.SysctlPath(sysctl.Key); err != nil {
+			v.errorf(sysctlField+".key", "illegal sysctl key %q", sysctl.Key)
+		} else if j, ok := keys[sysctl.Key]; ok {
+			v.errorf(sysctlField+".key", "duplicated key %q, also at %s.sysctls[%d]", sysctl.Key, field, j)
+		} else {
+			keys[sysctl.Key] = i
+		}
+		if strings.TrimSpace(sysctl.Value) == "" {
+			v.errorf(sysctlField+".value", "required")
+		}
+	}
+
+	dsts := map[string]int{}
+	for i := range client.ForwardTable {
+		elem := &client.ForwardTable[i]
+		elemField := fmt.Sprintf("%s.forward_table[%d]", field, i)
+		v.dst(elemField+".dst", elem.Dst)
+		if j, ok := dsts[elem.Dst]; ok {
+			v.errorf(elemField+".dst", "duplicated dst %q, also at %s.forward_table[%d]", elem.Dst, field, j)
+		} else {
+			dsts[elem.Dst] = i
+		}
+		v.addr(elemField+".dst_as", elem.DstAs)
+		if _, ok := indexes[elem.PeerIndex]; !ok {
+			v.errorf(elemField+".peer_index", "peer index %d not found in %s.peers", elem.PeerIndex, field)
+		}
+		v.selector(elemField+".selector", &elem.Selector)
+		for j, hop := range elem.Route {
+			v.addr(fmt.Sprintf("%s.route[%d]", elemField, j), hop)
+		}
+	}
+}
+
+func (v *validator) relay(field string, relay *Relay, manager bool) {
+	if relay.Network == "" {
+		v.errorf(field+".network", "required")
+	}
+	if !manager {
+		v.tls(field+".tls", &relay.TLS, false)
+	}
+	for i := range relay.Allows {
+		allow := &relay.Allows[i]
+		allowField := fmt.Sprintf("%s.allows[%d]", field, i)
+		if len(allow.Identities) == 0 {
+			v.errorf(allowField+".identities", "required")
+		}
+		if len(allow.Hops) == 0 {
+			v.errorf(allowField+".hops", "required")
+		}
+		for j, hop := range allow.Hops {
+			if hop != "*" {
+				v.addr(fmt.Sprintf("%s.hops[%d]", allowField, j), hop)
+			}
+		}
+	}
+	if relay.Reverse.Enable {
+		listen := relay.Reverse.Listen
+		if manager {
+			// tls from manager
+			listen.TLS = nil
+		}
+		v.listen(field+".reverse.listen", &listen)
+		if len(relay.Reverse.Identities) == 0 {
+			v.errorf(field+".reverse.identities", "required")
+		}
+	}
+}
+
+func (v *validator) reverse(field string, reverse *Reverse, manager bool) {
+	if reverse.Network == "" {
+		v.errorf(field+".network", "required")
+	}
+	v.addrs(field+".relays", reverse.Relays)
+	if !manager {
+		v.tls(field+".tls", &reverse.TLS, false)
+	}
+}
+
+func (v *validator) proxyProtocol(field string, pp *ProxyProtocol) {
+	if len(pp.Dsts) == 0 {
+		v.errorf(field+".dsts", "required")
+	}
+	switch pp.Version {
+	case ProxyProtocolV1:
+		if pp.Identity {
+			v.errorf(field+".identity", "tlvs need version %s", ProxyProtocolV2)
+		}
+	case ProxyProtocolV2:
+	default:
+		v.errorf(field+".version", "must be %s or %s, got %q", ProxyProtocolV1, ProxyProtocolV2, pp.Version)
+	}
+}
+
+func (v *validator) transparentEgress(field string, te *TransparentEgress) {
+	if len(te.Dsts) == 0 {
+		v.errorf(field+".dsts", "required")
+	}
+	// unspec, default, main and local are reserved
+	if te.Table <= 0 || (te.Table >= 253 && te.Table <= 255) {
+		v.errorf(field+".table", "must be positive and not reserved, got %d", te.Table)
+	}
+}
+
+func (v *validator) exclude(field string, exclude *config.Exclude) {
+	for i, src := range exclude.Sources {
+		v.cidr(fmt.Sprintf("%s.sources[%d]", field, i), src)
+	}
+	for i, dst := range exclude.Destinations {
+		v.cidr(fmt.Sprintf("%s.destinations[%d]", field, i), dst)
+	}
+	v.owners(field, exclude.UIDs, exclude.GIDs)
+	v.cgroups(field+".cgroups", exclude.Cgroups)
+}
+
+func (v *validator) selector(field string, selector *Selector) {
+	v.owners(field, selector.UIDs, selector.GIDs)
+	v.cgroups(field+".cgroups", selector.Cgroups)
+}
+
+func (v *validator) owners(field string, uids, gids []int) {
+	for i, uid := range uids {
+		if uid < 0 {
+			v.errorf(fmt.Sprintf("%s.uids[%d]", field, i), "illegal uid %d", uid)
+		}
+	}
+	for i, gid := range gids {
+		if gid < 0 {
+			v.errorf(fmt.Sprintf("%s.gids[%d]", field, i), "illegal gid %d", gid)
+		}
+	}
+}
+
+func (v *validator) kube(field string, conf *Config) {
+	kube := &conf.Kube
+	if kube.Kubeconfig != "" {
+		v.file(field+".kubeconfig", kube.Kubeconfig)
+	}
+	if kube.ServerPort <= 0 || kube.ServerPort > 65535 {
+		v.errorf(field+".server_port", "must be in 1-65535, got %d", kube.ServerPort)
+	}
+	if kube.ResyncInterval < 0 {
+		v.errorf(field+".resync_interval", "must be positive, got %d", kube.ResyncInterval)
+	}
+	if conf.Client.Enable {
+		found := false
+		for _, peer := range conf.Client.Peers {
+			if peer.Index == kube.PeerIndex {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.errorf(field+".peer_index", "peer index %d not found in client.peers", kube.PeerIndex)
+		}
+	}
+}
+
+func (v *validator) cgroups(field string, cgroups []string) {
+	for i, cgroup := range cgroups {
+		if !strings.HasPrefix(cgroup, "/") {
+			v.errorf(fmt.Sprintf("%s[%d]", field, i), "must be an absolute cgroup path, got %q", cgroup)
+		}
+	}
+}
+
+func (v *validator) ipFilter(field string, filter *config.IPFilter) {
+	for i, iface := range filter.IncludeInterfaces {
+		v.iface(fmt.Sprintf("%s.include_interfaces[%d]", field, i), iface)
+	}
+	for i, iface := range filter.ExcludeInterfaces {
+		v.iface(fmt.Sprintf("%s.exclude_interfaces[%d]", field, i), iface)
+	}
+	for i, scope := range filter.IncludeScopes {
+		v.scope(fmt.Sprintf("%s.include_scopes[%d]", field, i), scope)
+	}
+	for i, scope := range filter.ExcludeScopes {
+		v.scope(fmt.Sprintf("%s.exclude_scopes[%d]", field, i), scope)
+	}
+}
+
+// interface name or prefix ending with +, at most 15 chars like the kernel
+func (v *validator) iface(field, iface string) {
+	if iface == "" || iface == "+" || len(iface) > 15 || strings.ContainsAny(iface, " /:") {
+		v.errorf(field, "illegal interface %q", iface)
+	}
+}
+
+func (v *validator) scope(field, scope string) {
+	switch scope {
+	case "global", "site", "link", "host", "nowhere":
+	default:
+		v.errorf(field, "must be global, site, link, host or nowhere, got %q", scope)
+	}
+}
+
+// ipv4 or ipv4 cidr
+func (v *validator) cidr(field, cidr string) {
+	ip := net.ParseIP(cidr)
+	if ip == nil {
+		var err error
+		ip, _, err = net.ParseCIDR(cidr)
+		if err != nil {
+			v.errorf(field, "illegal ip or cidr %q", cidr)
+			return
+		}
+	}
+	if ip.To4() == nil {
+		v.errorf(field, "illegal ip or cidr %q, must be ipv4", cidr)
+	}
+}
+
+func (v *validator) accessLog(field string, al *AccessLog) {
+	switch al.Sink {
+	case AccessLogSinkFile:
+		if al.File == "" {
+			v.errorf(field+".file", "required by sink %s", AccessLogSinkFile)
+		}
+	case AccessLogSinkSyslog:
+		if al.Syslog.Network != "" {
+			v.addr(field+".syslog.addr", al.Syslog.Addr)
+		}
+	default:
+		v.errorf(field+".sink", "must be %s or %s, got %q", AccessLogSinkFile, AccessLogSinkSyslog, al.Sink)
+	}
+	if al.SampleRate < 0 || al.SampleRate > 1 {
+		v.errorf(field+".sample_rate", "must be in [0, 1], got %v", al.SampleRate)
+	}
+}
+
+func (v *validator) listen(field string, listen *config.Listen) {
+	if listen.Network == "" {
+		v.errorf(field+".network", "required")
+	}
+	v.addr(field+".addr", listen.Addr)
+	if listen.TLS != nil {
+		v.tls(field+".tls", listen.TLS, true)
+	}
+}
+
+func (v *validator) dial(field string, dial *config.Dial) {
+	if dial.Network == "" {
+		v.errorf(field+".network", "required")
+	}
+	v.addrs(field+".addresses", dial.Addresses)
+	if dial.TLS != nil {
+		v.tls(field+".tls", dial.TLS, false)
+	}
+}
+
+// server side requires certs, client side requires them only for mtls
+func (v *validator) tls(field string, tls *config.TLS, server bool) {
+	if !tls.Enable {
+		return
+	}
+	if len(tls.Certs) == 0 && (server || tls.MTLS) {
+		v.errorf(field+".certs", "required by tls")
+	}
+	for i, certKey := range tls.Certs {
+		v.file(fmt.Sprintf("%s.certs[%d].cert", field, i), certKey.Cert)
+		v.file(fmt.Sprintf("%s.certs[%d].key", field, i), certKey.Key)
+	}
+	if len(tls.CAs) == 0 && server && tls.MTLS {
+		v.errorf(field+".cas", "required by mtls")
+	}
+	for i, ca := range tls.CAs {
+		v.file(fmt.Sprintf("%s.cas[%d]", field, i), ca)
+	}
+}
+
+func (v *validator) file(field, file string) {
+	if file == "" {
+		v.errorf(field, "required")
+		return
+	}
+	if _, err := os.Stat(file); err != nil {
+		v.errorf(field, "%s", err)
+	}
+}
+
+func (v *validator) addrs(field string, addrs []string) {
+	if len(addrs) == 0 {
+		v.errorf(field, "required")
+	}
+	for i, addr := range addrs {
+		v.addr(fmt.Sprintf("%s[%d]", field, i), addr)
+	}
+}
+
+// addr is host:port, host may be empty
+func (v *validator) addr(field, addr string) {
+	if addr == "" {
+		v.errorf(field, "required")
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.errorf(field, "illegal address %q, want host:port", addr)
+		return
+	}
+	v.port(field, addr, port)
+}
+
+// dst is ipv4:port or :port, it's matched by ipset
+func (v *validator) dst(field, dst string) {
+	ipPort := strings.Split(dst, ":")
+	if len(ipPort) != 2 {
+		v.errorf(field, "illegal dst %q, want ip:port or :port", dst)
+		return
+	}
+	if ipPort[0] != "" {
+		ip := net.ParseIP(ipPort[0])
+		if ip == nil || ip.To4() == nil {
+			v.errorf(field, "illegal dst %q, ip must be ipv4", dst)
+			return
+		}
+	}
+	v.port(field, dst, ipPort[1])
+}
+
+func (v *validator) port(field, addr, port string) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		v.errorf(field, "illegal port in %q", addr)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package config
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func validConfig() *Config {
+	conf := &Config{}
+	conf.Log.Level = "info"
+	conf.Client = Client{
+		Enable: true,
+		Listen: "127.0.0.1:5052",
+		ForwardTable: []ForwardElem{
+			{Dst: ":80", DstAs: "127.0.0.1:80", PeerIndex: 1},
+			{Dst: "192.168.0.2:9092", DstAs: "127.0.0.1:9092", PeerIndex: 1},
+		},
+		Peers: []Peer{
+			{Index: 1, Network: "tcp", Addresses: []string{"172.168.0.11:5053"}},
+		},
+	}
+	conf.setDefaults()
+	return conf
+}
+
+func fields(err error) []string {
+	fields := []string{}
+	for _, fe := range err.(ValidationError) {
+		fields = append(fields, fe.Field)
+	}
+	return fields
+}
+
+func TestValidate(t *testing.T) {
+	Convey("validate config", t, func() {
+		Convey("valid config with defaults", func() {
+			conf := validConfig()
+			So(conf.Validate(), ShouldBeNil)
+			So(conf.Client.CheckTime, ShouldEqual, DefaultCheckTime)
+			So(conf.Client.Network, ShouldEqual, DefaultClientNetwork)
+			So(conf.Client.FailMode, ShouldEqual, FailModeOpen)
+		})
+
+		Convey("illegal forward elements", func() {
+			conf := validConfig()
+			conf.Client.ForwardTable[0].Dst = "80"
+			conf.Client.ForwardTable[1].PeerIndex = 2
+			conf.Client.ForwardTable[1].DstAs = "127.0.0.1"
+			err := conf.Validate()
+			So(err, ShouldNotBeNil)
+			So(fields(err), ShouldResemble, []string{
+				"client.forward_table[0].dst",
+				"client.forward_table[1].dst_as",
+				"client.forward_table[1].peer_index",
+			})
+		})
+
+		Convey("duplicated peers and dsts", func() {
+			conf := validConfig()
+			conf.Client.Peers = append(conf.Client.Peers, conf.Client.Peers[0])
+			conf.Client.ForwardTable[1].Dst = ":80"
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"client.peers[1].index",
+				"client.forward_table[1].dst",
+			})
+		})
+
+		Convey("negative check time, bad port and fail mode", func() {
+			conf := validConfig()
+			conf.Client.CheckTime = -1
+			conf.Client.Listen = "127.0.0.1:70000"
+			conf.Client.FailMode = "half"
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{"client.listen", "client.check_time", "client.fail_mode"})
+			So(err.Error(), ShouldContainSubstring, `client.listen: illegal port in "127.0.0.1:70000"`)
+		})
+
+		Convey("illegal exclusions", func() {
+			conf := validConfig()
+			conf.Client.Exclude.Sources = []string{"10.0.0.0/8", "10.0.0.1", "10.0.0.0/33"}
+			conf.Client.Exclude.Destinations = []string{"fe80::1"}
+			conf.Client.Exclude.UIDs = []int{0, -1}
+			conf.Client.Exclude.Cgroups = []string{"system.slice/backup.service"}
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"client.exclude.sources[2]",
+				"client.exclude.destinations[0]",
+				"client.exclude.uids[1]",
+				"client.exclude.cgroups[0]",
+			})
+		})
+
+		Convey("illegal interfaces and scopes", func() {
+			conf := validConfig()
+			conf.Client.IngressInterfaces = []string{"docker0", "cali+", "+"}
+			conf.Networks.ExcludeInterfaces = []string{"a-very-long-interface-name"}
+			conf.Networks.IncludeScopes = []string{"global", "universe"}
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"client.ingress_interfaces[2]",
+				"networks.exclude_interfaces[0]",
+				"networks.include_scopes[1]",
+			})
+		})
+
+		Convey("illegal selector", func() {
+			conf := validConfig()
+			conf.Client.ForwardTable[0].Selector = Selector{
+				Cgroups: []string{"/system.slice/app.service", "app.service"},
+				GIDs:    []int{-1},
+			}
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"client.forward_table[0].selector.gids[0]",
+				"client.forward_table[0].selector.cgroups[1]",
+			})
+		})
+
+		Convey("illegal sysctls", func() {
+			conf := validConfig()
+			conf.Client.Sysctls = []Sysctl{
+				{Key: "net.ipv4.ip_forward", Value: "1"},
+				{Key: "net..rp_filter", Value: "2"},
+				{Key: "net.ipv4.ip_forward", Value: ""},
+			}
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"client.sysctls[1].key",
+				"client.sysctls[2].key",
+				"client.sysctls[2].value",
+			})
+		})
+
+		Convey("relay and route", func() {
+			conf := validConfig()
+			conf.Client.ForwardTable[0].Route = []string{"10.0.1.1:5053", "10.0.2.1"}
+			conf.Server.Enable = true
+			conf.Server.Listen.Network = "tcp"
+			conf.Server.Listen.Addr = "0.0.0.0:5053"
+			conf.Server.Relay = Relay{
+				Enable: true,
+				Allows: []RelayAllow{
+					{Identities: []string{"*"}, Hops: []string{"*", "10.0.2.1"}},
+					{Hops: []string{"*"}},
+				},
+			}
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"server.relay.network",
+				"server.relay.allows[0].hops[1]",
+				"server.relay.allows[1].identities",
+				"client.forward_table[0].route[1]",
+			})
+		})
+
+		Convey("reverse", func() {
+			conf := validConfig()
+			conf.Server.Enable = true
+			conf.Server.Listen.Network = "tcp"
+			conf.Server.Listen.Addr = "0.0.0.0:5053"
+			conf.Server.Reverse = Reverse{Enable: true, Network: "tcp", Relays: []string{"10.0.1.1"}}
+			conf.Server.Relay = Relay{Enable: true, Network: "tcp", Reverse: ReverseListen{Enable: true}}
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"server.relay.reverse.listen.network",
+				"server.relay.reverse.listen.addr",
+				"server.relay.reverse.identities",
+				"server.reverse.relays[0]",
+			})
+		})
+
+		Convey("proxy protocols", func() {
+			conf := validConfig()
+			conf.Server.Enable = true
+			conf.Server.Listen.Network = "tcp"
+			conf.Server.Listen.Addr = "0.0.0.0:5053"
+			conf.Server.ProxyProtocols = []ProxyProtocol{
+				{Dsts: []string{"127.0.0.1:80"}, Version: ProxyProtocolV2, Identity: true},
+				{Version: "v3"},
+				{Dsts: []string{"*"}, Version: ProxyProtocolV1, Identity: true},
+			}
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"server.proxy_protocols[1].dsts",
+				"server.proxy_protocols[1].version",
+				"server.proxy_protocols[2].identity",
+			})
+		})
+
+		Convey("transparent egress", func() {
+			conf := validConfig()
+			So(conf.Server.TransparentEgress.Table, ShouldEqual, DefaultTransparentTable)
+			conf.Server.Enable = true
+			conf.Server.Listen.Network = "tcp"
+			conf.Server.Listen.Addr = "0.0.0.0:5053"
+			conf.Server.TransparentEgress = TransparentEgress{Enable: true, Table: 254}
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"server.transparent_egress.dsts",
+				"server.transparent_egress.table",
+			})
+		})
+
+		Convey("inbound", func() {
+			conf := validConfig()
+			So(conf.Client.Inbound.NoMatch, ShouldEqual, NoMatchReject)
+			conf.Client.Inbound = Inbound{
+				SOCKS5:  InboundListen{Enable: true, Listen: "127.0.0.1:1080"},
+				HTTP:    InboundListen{Enable: true},
+				NoMatch: "drop",
+			}
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"client.inbound.http.listen",
+				"client.inbound.no_match",
+			})
+		})
+
+		Convey("kube", func() {
+			conf := validConfig()
+			conf.Kube = Kube{Enable: true, PeerIndex: 2}
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"kube.server_port",
+				"kube.peer_index",
+			})
+
+			conf = validConfig()
+			conf.Server = Server{Enable: true}
+			conf.Server.Network = "tcp"
+			conf.Server.Addr = "0.0.0.0:5053"
+			conf.Kube = Kube{Enable: true, PeerIndex: 1}
+			conf.setDefaults()
+			So(conf.Kube.ServerPort, ShouldEqual, 5053)
+			So(conf.Kube.ResyncInterval, ShouldEqual, DefaultKubeResync)
+			So(conf.Validate(), ShouldBeNil)
+		})
+
+		Convey("enabled sections", func() {
+			conf := validConfig()
+			conf.Server.Enable = true
+			conf.AccessLog = AccessLog{Enable: true, Sink: "kafka", SampleRate: 2}
+			conf.Manager.Enable = true
+			err := conf.Validate()
+			So(fields(err), ShouldResemble, []string{
+				"access_log.sink",
+				"access_log.sample_rate",
+				"manager.dial.network",
+				"manager.dial.addresses",
+				"server.listen.network",
+				"server.listen.addr",
+			})
+		})
+	})
+}
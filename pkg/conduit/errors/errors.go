@@ -20,6 +20,9 @@ var (
 	ErrDuplicatedPeerIndexConfigured = errors.New("duplicated peer index configured")
 	ErrPeerIndexNotfound             = errors.New("peer index not found")
 	ErrIllegalClientListenAddress    = errors.New("illegal client listen address")
+	ErrDstAsForbidden                = errors.New("dst as forbidden")
+	ErrRelayForbidden                = errors.New("relay forbidden")
+	ErrInboundRejected               = errors.New("inbound rejected without policy")
 
 	ErrNoSuchFileOrDirectory = errors.New("o such file or directory") // "no such file or directory" or "No such file or directory"
 )
@@ -0,0 +1,172 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package flow
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrFlowNotFound = errors.New("flow not found")
+
+	// flows being proxied by this conduit
+	Flows = NewTable()
+)
+
+// Flow is a proxied connection, bytes are counted on the tunnel side
+type Flow struct {
+	ID        uint64    `json:"id"`
+	Side      string    `json:"side"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"` // original dst
+	DstAs     string    `json:"dst_as"`
+	Policy    string    `json:"policy,omitempty"`
+	Peer      string    `json:"peer"`
+	Start     time.Time `json:"start"`
+	Age       int64     `json:"age"` // seconds
+	BytesSent int64     `json:"bytes_sent"`
+	BytesRecv int64     `json:"bytes_received"`
+}
+
+type Table struct {
+	id    uint64
+	mtx   sync.RWMutex
+	conns map[uint64]*Conn
+}
+
+func NewTable() *Table {
+	return &Table{
+		conns: map[uint64]*Conn{},
+	}
+}
+
+// Track starts tracking the flow until the returned conn closed
+func (table *Table) Track(conn net.Conn, flow *Flow) net.Conn {
+	flow.ID = atomic.AddUint64(&table.id, 1)
+	if flow.Start.IsZero() {
+		flow.Start = time.Now()
+	}
+	tracked := &Conn{
+		Conn:  conn,
+		table: table,
+		flow:  *flow,
+	}
+	table.mtx.Lock()
+	table.conns[flow.ID] = tracked
+	table.mtx.Unlock()
+	return tracked
+}
+
+// List returns snapshots of active flows, the oldest first
+func (table *Table) List() []*Flow {
+	table.mtx.RLock()
+	flows := make([]*Flow, 0, len(table.conns))
+	for _, conn := range table.conns {
+		flows = append(flows, conn.snapshot())
+	}
+	table.mtx.RUnlock()
+
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].ID < flows[j].ID
+	})
+	return flows
+}
+
+func (table *Table) Len() int {
+	table.mtx.RLock()
+	defer table.mtx.RUnlock()
+
+	return len(table.conns)
+}
+
+// Kill closes the tunnel side of the flow, rproxy closes the other side then
+func (table *Table) Kill(id uint64) error {
+	table.mtx.RLock()
+	conn, ok := table.conns[id]
+	table.mtx.RUnlock()
+	if !ok {
+		return ErrFlowNotFound
+	}
+	return conn.Close()
+}
+
+// Wait waits until no flows left or timeout, returns the number left
+func (table *Table) Wait(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n := table.Len()
+		if n == 0 || !time.Now().Before(deadline) {
+			return n
+		}
+		<-ticker.C
+	}
+}
+
+// KillAll kills all active flows, returns the number killed
+func (table *Table) KillAll() int {
+	table.mtx.RLock()
+	conns := make([]*Conn, 0, len(table.conns))
+	for _, conn := range table.conns {
+		conns = append(conns, conn)
+	}
+	table.mtx.RUnlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+func (table *Table) remove(id uint64) {
+	table.mtx.Lock()
+	defer table.mtx.Unlock()
+
+	delete(table.conns, id)
+}
+
+// Conn counts bytes and removes the flow from table once closed
+type Conn struct {
+	net.Conn
+	sent, recv int64
+	table      *Table
+	flow       Flow
+	once       sync.Once
+}
+
+func (conn *Conn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&conn.recv, int64(n))
+	return n, err
+}
+
+func (conn *Conn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.sent, int64(n))
+	return n, err
+}
+
+func (conn *Conn) Close() error {
+	conn.once.Do(func() {
+		conn.table.remove(conn.flow.ID)
+	})
+	return conn.Conn.Close()
+}
+
+func (conn *Conn) snapshot() *Flow {
+	flow := conn.flow
+	flow.Age = int64(time.Since(flow.Start).Seconds())
+	flow.BytesSent = atomic.LoadInt64(&conn.sent)
+	flow.BytesRecv = atomic.LoadInt64(&conn.recv)
+	return &flow
+}
@@ -0,0 +1,48 @@
+package flow
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTable(t *testing.T) {
+	Convey("flow table", t, func() {
+		table := NewTable()
+		left, right := net.Pipe()
+		defer right.Close()
+		conn := table.Track(left, &Flow{Side: "client", Src: "10.0.0.1:34567", Dst: "10.0.0.2:80"})
+		go io.Copy(io.Discard, right)
+
+		_, err := conn.Write([]byte("hello"))
+		So(err, ShouldBeNil)
+		flows := table.List()
+		So(len(flows), ShouldEqual, 1)
+		So(flows[0].ID, ShouldEqual, 1)
+		So(flows[0].BytesSent, ShouldEqual, 5)
+
+		Convey("kill", func() {
+			So(table.Kill(flows[0].ID), ShouldBeNil)
+			So(table.Len(), ShouldEqual, 0)
+			_, err := conn.Write([]byte("hello"))
+			So(err, ShouldNotBeNil)
+			So(table.Kill(flows[0].ID), ShouldEqual, ErrFlowNotFound)
+		})
+
+		Convey("wait and kill all", func() {
+			So(table.Wait(150*time.Millisecond), ShouldEqual, 1)
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				conn.Close()
+			}()
+			So(table.Wait(time.Second), ShouldEqual, 0)
+
+			table.Track(left, &Flow{Side: "server"})
+			So(table.KillAll(), ShouldEqual, 1)
+			So(table.Len(), ShouldEqual, 0)
+		})
+	})
+}
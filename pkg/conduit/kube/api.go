@@ -0,0 +1,294 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+var (
+	ErrNotInCluster = errors.New("not in cluster, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT not set")
+	ErrNoContext    = errors.New("kubeconfig context not found")
+	// resource version too old, list again
+	ErrGone = errors.New("resource version gone")
+)
+
+// a plain client of the api server, only lists and watches
+type apiClient struct {
+	server    string
+	token     string
+	tokenFile string // read for each request, it's rotated
+	http      *http.Client
+}
+
+// in-cluster config if kubeconfig empty
+func newAPIClient(kubeconfig string) (*apiClient, error) {
+	if kubeconfig == "" {
+		return inClusterAPIClient()
+	}
+	return kubeconfigAPIClient(kubeconfig)
+}
+
+func inClusterAPIClient() (*apiClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+	ca, err := os.ReadFile(inClusterCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(ca, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return &apiClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: inClusterTokenFile,
+		http:      newHTTPClient(tlsConfig),
+	}, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// the current context of kubeconfig, token and client certificate auth only
+func kubeconfigAPIClient(file string) (*apiClient, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	kc := &kubeconfig{}
+	if err = yaml.Unmarshal(data, kc); err != nil {
+		return nil, err
+	}
+	// relative paths are relative to the kubeconfig
+	dir := filepath.Dir(file)
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	clusterName, userName := "", ""
+	for _, context := range kc.Contexts {
+		if context.Name == kc.CurrentContext {
+			clusterName, userName = context.Context.Cluster, context.Context.User
+			break
+		}
+	}
+	if clusterName == "" {
+		return nil, ErrNoContext
+	}
+	client := &apiClient{}
+	var ca, cert, key []byte
+	insecure := false
+	for _, cluster := range kc.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+		client.server = strings.TrimSuffix(cluster.Cluster.Server, "/")
+		insecure = cluster.Cluster.InsecureSkipTLSVerify
+		ca, err = fileOrData(resolve(cluster.Cluster.CertificateAuthority), cluster.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if client.server == "" {
+		return nil, fmt.Errorf("kubeconfig cluster %q not found", clusterName)
+	}
+	for _, user := range kc.Users {
+		if user.Name != userName {
+			continue
+		}
+		client.token = user.User.Token
+		client.tokenFile = resolve(user.User.TokenFile)
+		cert, err = fileOrData(resolve(user.User.ClientCertificate), user.User.ClientCertificateData)
+		if err != nil {
+			return nil, err
+		}
+		key, err = fileOrData(resolve(user.User.ClientKey), user.User.ClientKeyData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig, err := newTLSConfig(ca, cert, key, insecure)
+	if err != nil {
+		return nil, err
+	}
+	client.http = newHTTPClient(tlsConfig)
+	return client, nil
+}
+
+func fileOrData(file, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
+
+func newTLSConfig(ca, cert, key []byte, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if len(ca) != 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("illegal certificate authority")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(cert) != 0 && len(key) != 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return tlsConfig, nil
+}
+
+func newHTTPClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// no timeout, watches are long polls ended by timeoutSeconds
+	return &http.Client{Transport: transport}
+}
+
+func (client *apiClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	token := client.token
+	if client.tokenFile != "" {
+		data, err := os.ReadFile(client.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rsp, err := client.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(rsp.Body, 512))
+		if rsp.StatusCode == http.StatusGone {
+			return nil, ErrGone
+		}
+		return nil, fmt.Errorf("get %s: %s: %s", path, rsp.Status, strings.TrimSpace(string(body)))
+	}
+	return rsp, nil
+}
+
+func (client *apiClient) list(ctx context.Context, path string) (*list, error) {
+	rsp, err := client.get(ctx, path, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	list := &list{}
+	if err = json.NewDecoder(rsp.Body).Decode(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// calls fn for each event till the server ends the watch after timeout
+func (client *apiClient) watch(ctx context.Context, path, resourceVersion string, timeout int, fn func(*watchEvent) error) error {
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("timeoutSeconds", strconv.Itoa(timeout))
+	rsp, err := client.get(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	decoder := json.NewDecoder(rsp.Body)
+	for {
+		event := &watchEvent{}
+		if err = decoder.Decode(event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if event.Type == "ERROR" {
+			status := struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}{}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return ErrGone
+			}
+			return fmt.Errorf("watch %s: %d %s", path, status.Code, status.Message)
+		}
+		if err = fn(event); err != nil {
+			return err
+		}
+	}
+}
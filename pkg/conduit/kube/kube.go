@@ -0,0 +1,380 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+)
+
+const (
+	AnnotationEncrypt = "conduit.io/encrypt"
+	LabelServiceName  = "kubernetes.io/service-name"
+
+	PathServices       = "/api/v1/services"
+	PathEndpointSlices = "/apis/discovery.k8s.io/v1/endpointslices"
+	PathNodes          = "/api/v1/nodes"
+
+	retryInterval = 5 * time.Second
+	changeDelay   = 500 * time.Millisecond
+)
+
+// Policy is an ip:port of an annotated service or endpoint, dialed through
+// the conduits on the nodes of its ready endpoints
+type Policy struct {
+	IP    string
+	Port  int
+	DstAs string
+	Peers []string // node ip:server port
+}
+
+func (policy *Policy) Key() string {
+	return net.JoinHostPort(policy.IP, strconv.Itoa(policy.Port))
+}
+
+// State is what the cluster asks for on this node
+type State struct {
+	// client side
+	Policies []*Policy
+	// server side, dst_as of endpoints on this node and their cluster ips
+	Allowed map[string]struct{}
+	// pod cidrs of this node, reported to manager
+	PodCIDRs []net.IPNet
+}
+
+type resource struct {
+	path    string
+	decode  func(json.RawMessage) (*ObjectMeta, interface{}, error)
+	objects map[string]interface{} // key: namespace/name
+}
+
+// Watcher lists and watches services, endpointslices and nodes, the state
+// is rebuilt and handed to handlers on changes
+type Watcher struct {
+	conf     *config.Config
+	api      *apiClient
+	nodeName string
+
+	mtx       sync.Mutex
+	resources []*resource
+	handlers  []func(*State)
+
+	changed chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func NewWatcher(conf *config.Config) (*Watcher, error) {
+	api, err := newAPIClient(conf.Kube.Kubeconfig)
+	if err != nil {
+		log.Errorf("new kube watcher, new api client err: %s", err)
+		return nil, err
+	}
+	nodeName := conf.Kube.NodeName
+	if nodeName == "" {
+		nodeName = os.Getenv("NODE_NAME")
+	}
+	if nodeName == "" {
+		nodeName, err = os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Watcher{
+		conf:     conf,
+		api:      api,
+		nodeName: nodeName,
+		resources: []*resource{
+			{path: PathServices, decode: decodeService, objects: map[string]interface{}{}},
+			{path: PathEndpointSlices, decode: decodeEndpointSlice, objects: map[string]interface{}{}},
+			{path: PathNodes, decode: decodeNode, objects: map[string]interface{}{}},
+		},
+		changed: make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+// OnChange adds a handler called with the state after changes
+func (watcher *Watcher) OnChange(fn func(*State)) {
+	watcher.handlers = append(watcher.handlers, fn)
+}
+
+func (watcher *Watcher) Work() {
+	for _, res := range watcher.resources {
+		go watcher.watchResource(res)
+	}
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-watcher.changed:
+			if delay == nil {
+				delay = time.After(changeDelay)
+			}
+		case <-delay:
+			delay = nil
+			state := watcher.State()
+			log.Debugf("kube watcher, policies: %d, allowed: %d, pod cidrs: %v",
+				len(state.Policies), len(state.Allowed), state.PodCIDRs)
+			for _, fn := range watcher.handlers {
+				fn(state)
+			}
+		case <-watcher.ctx.Done():
+			return
+		}
+	}
+}
+
+func (watcher *Watcher) Close() {
+	watcher.cancel()
+}
+
+// State translates what we have now
+func (watcher *Watcher) State() *State {
+	watcher.mtx.Lock()
+	defer watcher.mtx.Unlock()
+
+	services := map[string]*Service{}
+	for key, obj := range watcher.resources[0].objects {
+		services[key] = obj.(*Service)
+	}
+	slices := map[string]*EndpointSlice{}
+	for key, obj := range watcher.resources[1].objects {
+		slices[key] = obj.(*EndpointSlice)
+	}
+	nodes := map[string]*Node{}
+	for key, obj := range watcher.resources[2].objects {
+		nodes[key] = obj.(*Node)
+	}
+	return translate(services, slices, nodes, watcher.nodeName, watcher.conf.Kube.ServerPort)
+}
+
+// list, then watch from the version listed, list again if the version's
+// gone or resync interval passed
+func (watcher *Watcher) watchResource(res *resource) {
+	for {
+		resourceVersion, err := watcher.relist(res)
+		if err == nil {
+			err = watcher.api.watch(watcher.ctx, res.path, resourceVersion, watcher.conf.Kube.ResyncInterval,
+				func(event *watchEvent) error {
+					meta, obj, err := res.decode(event.Object)
+					if err != nil {
+						return err
+					}
+					watcher.apply(res, event.Type, meta, obj)
+					return nil
+				})
+		}
+		if err != nil && err != ErrGone && watcher.ctx.Err() == nil {
+			log.Warnf("kube watcher, watch %s err: %s", res.path, err)
+		}
+		select {
+		case <-watcher.ctx.Done():
+			return
+		case <-time.After(retryDelay(err)):
+		}
+	}
+}
+
+func retryDelay(err error) time.Duration {
+	if err == nil || err == ErrGone {
+		return 0
+	}
+	return retryInterval
+}
+
+func (watcher *Watcher) relist(res *resource) (string, error) {
+	list, err := watcher.api.list(watcher.ctx, res.path)
+	if err != nil {
+		return "", err
+	}
+	objects := map[string]interface{}{}
+	for _, item := range list.Items {
+		meta, obj, err := res.decode(item)
+		if err != nil {
+			return "", err
+		}
+		objects[meta.Namespace+"/"+meta.Name] = obj
+	}
+	watcher.mtx.Lock()
+	res.objects = objects
+	watcher.mtx.Unlock()
+	watcher.notify()
+	return list.Metadata.ResourceVersion, nil
+}
+
+func (watcher *Watcher) apply(res *resource, typ string, meta *ObjectMeta, obj interface{}) {
+	key := meta.Namespace + "/" + meta.Name
+	watcher.mtx.Lock()
+	switch typ {
+	case "ADDED", "MODIFIED":
+		res.objects[key] = obj
+	case "DELETED":
+		delete(res.objects, key)
+	default:
+		// bookmark
+		watcher.mtx.Unlock()
+		return
+	}
+	watcher.mtx.Unlock()
+	watcher.notify()
+}
+
+func (watcher *Watcher) notify() {
+	select {
+	case watcher.changed <- struct{}{}:
+	default:
+	}
+}
+
+func decodeService(data json.RawMessage) (*ObjectMeta, interface{}, error) {
+	obj := &Service{}
+	err := json.Unmarshal(data, obj)
+	return &obj.Metadata, obj, err
+}
+
+func decodeEndpointSlice(data json.RawMessage) (*ObjectMeta, interface{}, error) {
+	obj := &EndpointSlice{}
+	err := json.Unmarshal(data, obj)
+	return &obj.Metadata, obj, err
+}
+
+func decodeNode(data json.RawMessage) (*ObjectMeta, interface{}, error) {
+	obj := &Node{}
+	err := json.Unmarshal(data, obj)
+	return &obj.Metadata, obj, err
+}
+
+func encrypted(meta *ObjectMeta) bool {
+	return meta.Annotations[AnnotationEncrypt] == "true"
+}
+
+func tcp(protocol string) bool {
+	return protocol == "" || protocol == "TCP"
+}
+
+// internal ipv4 of the node, or any ipv4
+func nodeIP(node *Node) string {
+	ip := ""
+	for _, addr := range node.Status.Addresses {
+		if net.ParseIP(addr.Address).To4() == nil {
+			continue
+		}
+		if addr.Type == "InternalIP" {
+			return addr.Address
+		}
+		if ip == "" {
+			ip = addr.Address
+		}
+	}
+	return ip
+}
+
+// endpointslices of annotated services, or annotated themselves, become
+// policies of endpoint ip:ports and cluster ip:ports
+func translate(services map[string]*Service, slices map[string]*EndpointSlice, nodes map[string]*Node,
+	nodeName string, serverPort int) *State {
+
+	state := &State{Allowed: map[string]struct{}{}}
+	policies := map[string]*Policy{}
+	addPolicy := func(ip string, port int, peer string, local bool) {
+		policy := &Policy{IP: ip, Port: port}
+		key := policy.Key()
+		if old, ok := policies[key]; ok {
+			policy = old
+		} else {
+			policy.DstAs = key
+			policies[key] = policy
+		}
+		found := false
+		for _, elem := range policy.Peers {
+			if elem == peer {
+				found = true
+				break
+			}
+		}
+		if !found {
+			policy.Peers = append(policy.Peers, peer)
+			sort.Strings(policy.Peers)
+		}
+		if local {
+			state.Allowed[key] = struct{}{}
+		}
+	}
+
+	for _, slice := range slices {
+		if slice.AddressType != "IPv4" {
+			continue
+		}
+		service := services[slice.Metadata.Namespace+"/"+slice.Metadata.Labels[LabelServiceName]]
+		if !encrypted(&slice.Metadata) && (service == nil || !encrypted(&service.Metadata)) {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			// nodes are cluster scoped, keyed by /name
+			node, ok := nodes["/"+endpoint.NodeName]
+			if !ok {
+				continue
+			}
+			ip := nodeIP(node)
+			if ip == "" {
+				continue
+			}
+			peer := net.JoinHostPort(ip, strconv.Itoa(serverPort))
+			local := endpoint.NodeName == nodeName
+			for _, port := range slice.Ports {
+				if !tcp(port.Protocol) || port.Port == 0 {
+					continue
+				}
+				for _, addr := range endpoint.Addresses {
+					addPolicy(addr, port.Port, peer, local)
+				}
+				// the cluster ip is dnatted by kube-proxy on the peer
+				if service == nil || net.ParseIP(service.Spec.ClusterIP).To4() == nil {
+					continue
+				}
+				for _, servicePort := range service.Spec.Ports {
+					if servicePort.Name == port.Name && tcp(servicePort.Protocol) {
+						addPolicy(service.Spec.ClusterIP, servicePort.Port, peer, local)
+					}
+				}
+			}
+		}
+	}
+	for _, policy := range policies {
+		state.Policies = append(state.Policies, policy)
+	}
+	sort.Slice(state.Policies, func(i, j int) bool {
+		return state.Policies[i].Key() < state.Policies[j].Key()
+	})
+
+	if node, ok := nodes["/"+nodeName]; ok {
+		cidrs := node.Spec.PodCIDRs
+		if len(cidrs) == 0 && node.Spec.PodCIDR != "" {
+			cidrs = []string{node.Spec.PodCIDR}
+		}
+		for _, cidr := range cidrs {
+			if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+				state.PodCIDRs = append(state.PodCIDRs, *ipnet)
+			}
+		}
+	}
+	return state
+}
@@ -0,0 +1,150 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package kube
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	testServices = `{"metadata":{"resourceVersion":"10"},"items":[
+{"metadata":{"name":"kafka","namespace":"data","annotations":{"conduit.io/encrypt":"true"}},
+ "spec":{"clusterIP":"10.96.0.10","ports":[{"name":"broker","protocol":"TCP","port":9092}]}},
+{"metadata":{"name":"web","namespace":"data"},"spec":{"clusterIP":"10.96.0.11","ports":[{"port":80}]}}]}`
+	testEndpointSlices = `{"metadata":{"resourceVersion":"11"},"items":[
+{"metadata":{"name":"kafka-x1","namespace":"data","labels":{"kubernetes.io/service-name":"kafka"}},
+ "addressType":"IPv4","ports":[{"name":"broker","protocol":"TCP","port":19092}],
+ "endpoints":[{"addresses":["10.244.1.5"],"conditions":{"ready":true},"nodeName":"node-1"},
+  {"addresses":["10.244.2.6"],"nodeName":"node-2"},
+  {"addresses":["10.244.2.7"],"conditions":{"ready":false},"nodeName":"node-2"}]},
+{"metadata":{"name":"web-x1","namespace":"data","labels":{"kubernetes.io/service-name":"web"}},
+ "addressType":"IPv4","ports":[{"port":8080}],
+ "endpoints":[{"addresses":["10.244.1.8"],"nodeName":"node-1"}]}]}`
+	testNodes = `{"metadata":{"resourceVersion":"12"},"items":[
+{"metadata":{"name":"node-1"},"spec":{"podCIDR":"10.244.1.0/24","podCIDRs":["10.244.1.0/24"]},
+ "status":{"addresses":[{"type":"Hostname","address":"node-1"},{"type":"InternalIP","address":"192.168.0.1"}]}},
+{"metadata":{"name":"node-2"},"spec":{"podCIDR":"10.244.2.0/24"},
+ "status":{"addresses":[{"type":"InternalIP","address":"192.168.0.2"}]}}]}`
+)
+
+// api server stand-in, watches end at once
+func newStandIn() *httptest.Server {
+	lists := map[string]string{
+		PathServices:       testServices,
+		PathEndpointSlices: testEndpointSlices,
+		PathNodes:          testNodes,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		list, ok := lists[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("watch") != "" {
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		fmt.Fprint(w, list)
+	}))
+}
+
+func writeKubeconfig(dir, server string) string {
+	file := filepath.Join(dir, "kubeconfig")
+	os.WriteFile(filepath.Join(dir, "token"), []byte("test\n"), 0600)
+	os.WriteFile(file, []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: local
+clusters:
+- name: standin
+  cluster:
+    server: %s
+contexts:
+- name: local
+  context:
+    cluster: standin
+    user: conduit
+users:
+- name: conduit
+  user:
+    tokenFile: token
+`, server)), 0600)
+	return file
+}
+
+func TestWatcher(t *testing.T) {
+	Convey("kube watcher", t, func() {
+		standIn := newStandIn()
+		defer standIn.Close()
+
+		conf := &config.Config{}
+		conf.Kube = config.Kube{
+			Enable:         true,
+			Kubeconfig:     writeKubeconfig(t.TempDir(), standIn.URL),
+			NodeName:       "node-1",
+			ServerPort:     5053,
+			ResyncInterval: 1,
+		}
+		watcher, err := NewWatcher(conf)
+		So(err, ShouldBeNil)
+		states := make(chan *State, 1)
+		watcher.OnChange(func(state *State) {
+			select {
+			case states <- state:
+			default:
+			}
+		})
+		go watcher.Work()
+		defer watcher.Close()
+
+		var state *State
+		select {
+		case state = <-states:
+		case <-time.After(5 * time.Second):
+		}
+		So(state, ShouldNotBeNil)
+
+		Convey("policies of annotated services", func() {
+			So(len(state.Policies), ShouldEqual, 3)
+			So(*state.Policies[0], ShouldResemble, Policy{
+				IP: "10.244.1.5", Port: 19092, DstAs: "10.244.1.5:19092", Peers: []string{"192.168.0.1:5053"},
+			})
+			So(*state.Policies[1], ShouldResemble, Policy{
+				IP: "10.244.2.6", Port: 19092, DstAs: "10.244.2.6:19092", Peers: []string{"192.168.0.2:5053"},
+			})
+			// through conduits of both nodes
+			So(*state.Policies[2], ShouldResemble, Policy{
+				IP: "10.96.0.10", Port: 9092, DstAs: "10.96.0.10:9092",
+				Peers: []string{"192.168.0.1:5053", "192.168.0.2:5053"},
+			})
+		})
+
+		Convey("allowed on this node", func() {
+			So(state.Allowed, ShouldResemble, map[string]struct{}{
+				"10.244.1.5:19092": {},
+				"10.96.0.10:9092":  {},
+			})
+		})
+
+		Convey("pod cidrs of this node", func() {
+			So(len(state.PodCIDRs), ShouldEqual, 1)
+			So(state.PodCIDRs[0].String(), ShouldEqual, "10.244.1.0/24")
+		})
+	})
+}
@@ -0,0 +1,197 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/metrics"
+	"github.com/moresec-io/conduit/pkg/network"
+)
+
+const (
+	SideClient = "client"
+	SideServer = "server"
+
+	// policy types on client side, decided by the ipset the dst matched
+	PolicyIP     = "ip"
+	PolicyIPPort = "ipport"
+	PolicyPort   = "port"
+	PolicyNet    = "net"
+	PolicyNone   = "none"
+	// dst requested by socks5 or http connect
+	PolicyProxy = "proxy"
+
+	// peer on server side before the client conduit is identified
+	PeerUnknown = "unknown"
+
+	// failure reasons
+	ReasonDial      = "dial"
+	ReasonHandshake = "handshake"
+	ReasonHeader    = "header"
+	ReasonForbidden = "forbidden"
+
+	// tables reconcile results
+	ResultApplied   = "applied"
+	ResultUnchanged = "unchanged"
+	ResultFailed    = "failed"
+)
+
+var (
+	Registry = metrics.NewRegistry()
+
+	ConnAccepted = Registry.NewCounterVec("conduit_connections_accepted_total",
+		"Connections accepted.", "side", "policy", "peer")
+	ConnActive = Registry.NewGaugeVec("conduit_connections_active",
+		"Connections being proxied.", "side", "policy", "peer")
+	ConnFailed = Registry.NewCounterVec("conduit_connections_failed_total",
+		"Connections failed before proxying.", "side", "policy", "peer", "reason")
+	// bytes are counted on the tunnel side, right conn of client and left conn of server
+	BytesIn = Registry.NewCounterVec("conduit_tunnel_received_bytes_total",
+		"Bytes received from the tunnel.", "side", "policy", "peer")
+	BytesOut = Registry.NewCounterVec("conduit_tunnel_sent_bytes_total",
+		"Bytes sent to the tunnel.", "side", "policy", "peer")
+	DialDuration = Registry.NewHistogramVec("conduit_dial_duration_seconds",
+		"Dial latency, including tls handshake on client side.", nil, "side", "peer")
+	TLSHandshakeFailures = Registry.NewCounterVec("conduit_tls_handshake_failures_total",
+		"TLS handshake failures.", "side", "reason")
+	PolicyNotFound = Registry.NewCounterVec("conduit_policy_not_found_total",
+		"Intercepted connections without matched policy.", "policy")
+	IPSetEntries = Registry.NewGaugeVec("conduit_ipset_entries",
+		"Entries in conduit ipsets.", "set")
+	TablesReconciles = Registry.NewCounterVec("conduit_tables_reconciles_total",
+		"Tables reconciles by result.", "result")
+	TablesDrift = Registry.NewCounterVec("conduit_tables_drift_total",
+		"Changes to conduit rules made by others.", "chain")
+	SyncerConnected = Registry.NewGaugeVec("conduit_syncer_connected",
+		"Whether the syncer is connected to manager.")
+	SyncerStateChanges = Registry.NewCounterVec("conduit_syncer_state_changes_total",
+		"Syncer connection state changes.", "state")
+)
+
+type Metrics struct {
+	ln     net.Listener
+	server *http.Server
+}
+
+func NewMetrics(conf *config.Config) (*Metrics, error) {
+	ln, err := network.Listen(&conf.Metrics.Listen)
+	if err != nil {
+		log.Errorf("new metrics, listen err: %s", err)
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Registry.Handler())
+	return &Metrics{
+		ln:     ln,
+		server: &http.Server{Handler: mux},
+	}, nil
+}
+
+func (metrics *Metrics) Work() {
+	err := metrics.server.Serve(metrics.ln)
+	if err != nil && err != http.ErrServerClosed {
+		log.Errorf("metrics serve err: %s", err)
+	}
+}
+
+func (metrics *Metrics) Close() {
+	metrics.server.Close()
+}
+
+// Conn counts tunnel bytes and tracks active connections until closed
+type Conn struct {
+	net.Conn
+	in, out *metrics.Counter
+	active  *metrics.Gauge
+	once    sync.Once
+}
+
+func NewConn(conn net.Conn, side, policy, peer string) *Conn {
+	active := ConnActive.With(side, policy, peer)
+	active.Inc()
+	return &Conn{
+		Conn:   conn,
+		in:     BytesIn.With(side, policy, peer),
+		out:    BytesOut.With(side, policy, peer),
+		active: active,
+	}
+}
+
+func (conn *Conn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.in.Add(float64(n))
+	return n, err
+}
+
+func (conn *Conn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.out.Add(float64(n))
+	return n, err
+}
+
+func (conn *Conn) Close() error {
+	conn.once.Do(conn.active.Dec)
+	return conn.Conn.Close()
+}
+
+// TLSFailureReason classifies tls handshake errors, returns empty if not a handshake failure
+func TLSFailureReason(err error) string {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		recordHeader     tls.RecordHeaderError
+		opErr            *net.OpError
+	)
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		// tcp level failure
+		return ""
+	}
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "unknown_authority"
+	case errors.As(err, &hostname):
+		return "hostname_mismatch"
+	case errors.As(err, &invalid):
+		if invalid.Reason == x509.Expired {
+			return "expired"
+		}
+		return "invalid_certificate"
+	case errors.As(err, &recordHeader):
+		return "not_tls"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case strings.Contains(err.Error(), "tls: "):
+		return alertReason(err.Error())
+	case errors.As(err, &opErr):
+		return "network"
+	}
+	return ""
+}
+
+// tls alerts and local errors are not exported, like "remote error: tls: bad certificate"
+func alertReason(str string) string {
+	idx := strings.Index(str, "tls: ")
+	reason := strings.TrimSpace(str[idx+len("tls: "):])
+	if idx := strings.IndexAny(reason, ":("); idx > 0 {
+		reason = strings.TrimSpace(reason[:idx])
+	}
+	return strings.ReplaceAll(reason, " ", "_")
+}
@@ -6,10 +6,43 @@
  */
 package proto
 
+import (
+	"encoding/binary"
+	"encoding/json"
+)
+
 type ConduitProto struct {
 	SrcIP   string
 	SrcPort int
 	DstIP   string
 	DstPort int
 	DstAs   string
+	// conduits to relay through after the receiving one, the last dials DstAs
+	Route []string `json:"Route,omitempty"`
+	// udp for datagrams framed by uint16 length, tcp if empty
+	Network string `json:"Network,omitempty"`
+}
+
+const NetworkUDP = "udp"
+
+func (proto *ConduitProto) UDP() bool {
+	return proto.Network == NetworkUDP
+}
+
+// ReverseMeta is the meta of a reverse session from a server behind nat,
+// connections to Addr are spliced down the session
+type ReverseMeta struct {
+	MachineID string
+	Addr      string
+}
+
+// Frame is little endian uint32 length then json, written first to the tunnel
+func Frame(proto *ConduitProto) ([]byte, error) {
+	data, err := json.Marshal(proto)
+	if err != nil {
+		return nil, err
+	}
+	bs := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(bs, uint32(len(data)))
+	return append(bs, data...), nil
 }
@@ -13,6 +13,7 @@ const (
 	ConduitIPSetPort   = "CONDUIT_PORT"
 	ConduitIPSetIPPort = "CONDUIT_IPPORT"
 	ConduitIPSetIP     = "CONDUIT_IP"
+	ConduitIPSetNet    = "CONDUIT_NET"
 )
 
 // A wrapper
@@ -34,6 +35,10 @@ func (ipset *ipset) AddIPSetIP(ip net.IP) error {
 	return addIPSetIP(ip)
 }
 
+func (ipset *ipset) AddIPSetNet(ipnet *net.IPNet) error {
+	return addIPSetNet(ipnet)
+}
+
 func (ipset *ipset) DelIPSetIPPort(ip net.IP, port uint16) error {
 	return delIPSetIPPort(ip, port)
 }
@@ -46,12 +51,22 @@ func (ipset *ipset) DelIPSetIP(ip net.IP) error {
 	return delIPSetIP(ip)
 }
 
+func (ipset *ipset) DelIPSetNet(ipnet *net.IPNet) error {
+	return delIPSetNet(ipnet)
+}
+
+func (ipset *ipset) ListIPSet(set string) ([]netlink.IPSetEntry, error) {
+	return listIPSet(set)
+}
+
 func (ipset *ipset) FiniIPSet(level log.Level, prefix string) error {
 	return finiIPSet(level, prefix)
 }
 
 func initIPSet() error {
+	// replace to keep the sets left by the last run
 	err := netlink.IpsetCreate(ConduitIPSetPort, "bitmap:port", netlink.IpsetCreateOptions{
+		Replace:  true,
 		PortFrom: 0,
 		PortTo:   65535,
 	})
@@ -60,6 +75,7 @@ func initIPSet() error {
 		return err
 	}
 	err = netlink.IpsetCreate(ConduitIPSetIPPort, "hash:ip,port", netlink.IpsetCreateOptions{
+		Replace:  true,
 		PortFrom: 0,
 		PortTo:   65535,
 	})
@@ -67,18 +83,28 @@ func initIPSet() error {
 		log.Errorf("client init ipport ipset, init err: %s", err)
 		return err
 	}
-	err = netlink.IpsetCreate(ConduitIPSetIP, "hash:ip", netlink.IpsetCreateOptions{})
+	err = netlink.IpsetCreate(ConduitIPSetIP, "hash:ip", netlink.IpsetCreateOptions{
+		Replace: true,
+	})
 	if err != nil {
 		log.Errorf("client init ip ipset, init err: %s", err)
 		return err
 	}
+	err = netlink.IpsetCreate(ConduitIPSetNet, "hash:net", netlink.IpsetCreateOptions{
+		Replace: true,
+	})
+	if err != nil {
+		log.Errorf("client init net ipset, init err: %s", err)
+		return err
+	}
 	return nil
 }
 
 func addIPSetIPPort(ip net.IP, port uint16) error {
 	err := netlink.IpsetAdd(ConduitIPSetIPPort, &netlink.IPSetEntry{
-		IP:   ip,
-		Port: &port,
+		IP:      ip,
+		Port:    &port,
+		Replace: true,
 	})
 	if err != nil {
 		log.Errorf("client add ipset ip: %s, port: %d err: %s", ip, port, err)
@@ -88,7 +114,8 @@ func addIPSetIPPort(ip net.IP, port uint16) error {
 
 func addIPSetPort(port uint16) error {
 	err := netlink.IpsetAdd(ConduitIPSetPort, &netlink.IPSetEntry{
-		Port: &port,
+		Port:    &port,
+		Replace: true,
 	})
 	if err != nil {
 		log.Errorf("client add ipset port: %d err: %s", port, err)
@@ -98,7 +125,8 @@ func addIPSetPort(port uint16) error {
 
 func addIPSetIP(ip net.IP) error {
 	err := netlink.IpsetAdd(ConduitIPSetIP, &netlink.IPSetEntry{
-		IP: ip,
+		IP:      ip,
+		Replace: true,
 	})
 	if err != nil {
 		log.Errorf("client add ip: %s err: %s", ip, err)
@@ -106,6 +134,19 @@ func addIPSetIP(ip net.IP) error {
 	return err
 }
 
+func addIPSetNet(ipnet *net.IPNet) error {
+	ones, _ := ipnet.Mask.Size()
+	err := netlink.IpsetAdd(ConduitIPSetNet, &netlink.IPSetEntry{
+		IP:      ipnet.IP,
+		CIDR:    uint8(ones),
+		Replace: true,
+	})
+	if err != nil {
+		log.Errorf("client add net: %s err: %s", ipnet, err)
+	}
+	return err
+}
+
 func delIPSetIPPort(ip net.IP, port uint16) error {
 	err := netlink.IpsetDel(ConduitIPSetIPPort, &netlink.IPSetEntry{
 		IP:   ip,
@@ -137,6 +178,26 @@ func delIPSetIP(ip net.IP) error {
 	return err
 }
 
+func delIPSetNet(ipnet *net.IPNet) error {
+	ones, _ := ipnet.Mask.Size()
+	err := netlink.IpsetDel(ConduitIPSetNet, &netlink.IPSetEntry{
+		IP:   ipnet.IP,
+		CIDR: uint8(ones),
+	})
+	if err != nil {
+		log.Errorf("client del net: %s err: %s", ipnet, err)
+	}
+	return err
+}
+
+func listIPSet(set string) ([]netlink.IPSetEntry, error) {
+	result, err := netlink.IpsetList(set)
+	if err != nil {
+		return nil, err
+	}
+	return result.Entries, nil
+}
+
 func finiIPSet(level log.Level, prefix string) error {
 	// flush
 	err := netlink.IpsetFlush(ConduitIPSetIPPort)
@@ -151,6 +212,10 @@ func finiIPSet(level log.Level, prefix string) error {
 	if err != nil && !errors.IsErrNoSuchFileOrDirectory(err) {
 		log.Printf(level, "%s, flush ipset: %s err: %s", prefix, ConduitIPSetIP, err)
 	}
+	err = netlink.IpsetFlush(ConduitIPSetNet)
+	if err != nil && !errors.IsErrNoSuchFileOrDirectory(err) {
+		log.Printf(level, "%s, flush ipset: %s err: %s", prefix, ConduitIPSetNet, err)
+	}
 
 	// destroy
 	err = netlink.IpsetDestroy(ConduitIPSetPort)
@@ -165,5 +230,9 @@ func finiIPSet(level log.Level, prefix string) error {
 	if err != nil && !errors.IsErrNoSuchFileOrDirectory(err) {
 		log.Printf(level, "%s, destroy ipset: %s err: %s", prefix, ConduitIPSetIP, err)
 	}
+	err = netlink.IpsetDestroy(ConduitIPSetNet)
+	if err != nil && !errors.IsErrNoSuchFileOrDirectory(err) {
+		log.Printf(level, "%s, destroy ipset: %s err: %s", prefix, ConduitIPSetNet, err)
+	}
 	return nil
 }
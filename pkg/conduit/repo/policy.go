@@ -1,6 +1,7 @@
 package repo
 
 import (
+	"net"
 	"sync"
 
 	"github.com/moresec-io/conduit/pkg/network"
@@ -9,12 +10,22 @@ import (
 type Policy struct {
 	PeerDialConfig *network.DialConfig // dial using our tls
 	DstAs          string
+	// conduits relaying after the peer, the last one dials dst as
+	Route []string
+}
+
+type netPolicy struct {
+	ipnet  *net.IPNet
+	policy *Policy
 }
 
 type cache struct {
 	ipportPolicies map[string]*Policy
 	portPolicies   map[int]*Policy
 	ipPolicies     map[string]*Policy
+	netPolicies    map[string]*netPolicy
+	// peer addrs draining, not to be picked by new connections
+	draining map[string]struct{}
 
 	mtx sync.RWMutex
 }
@@ -30,7 +41,7 @@ func (cache *cache) DelIPPortPolicy(ipport string) {
 	cache.mtx.Lock()
 	defer cache.mtx.Unlock()
 
-	delete(cache.ipPolicies, ipport)
+	delete(cache.ipportPolicies, ipport)
 }
 
 func (cache *cache) AddPortPolicy(port int, policy *Policy) {
@@ -61,6 +72,48 @@ func (cache *cache) DelIPPolicy(ip string) {
 	delete(cache.ipPolicies, ip)
 }
 
+func (cache *cache) AddNetPolicy(ipnet *net.IPNet, policy *Policy) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	cache.netPolicies[ipnet.String()] = &netPolicy{ipnet: ipnet, policy: policy}
+}
+
+func (cache *cache) DelNetPolicy(ipnet *net.IPNet) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	delete(cache.netPolicies, ipnet.String())
+}
+
+// the longest prefix containing ip
+func (cache *cache) GetPolicyByNet(ip string) *Policy {
+	cache.mtx.RLock()
+	defer cache.mtx.RUnlock()
+
+	return cache.getPolicyByNet(net.ParseIP(ip))
+}
+
+func (cache *cache) getPolicyByNet(ip net.IP) *Policy {
+	if ip == nil {
+		return nil
+	}
+	var (
+		policy  *Policy
+		longest = -1
+	)
+	for _, elem := range cache.netPolicies {
+		if !elem.ipnet.Contains(ip) {
+			continue
+		}
+		if ones, _ := elem.ipnet.Mask.Size(); ones > longest {
+			longest = ones
+			policy = elem.policy
+		}
+	}
+	return policy
+}
+
 func (cache *cache) GetPolicyByIP(ip string) *Policy {
 	cache.mtx.RLock()
 	defer cache.mtx.RUnlock()
@@ -85,7 +138,7 @@ func (cache *cache) GetPolicyByPort(port int) *Policy {
 	return policy
 }
 
-// first ipport, then port, last dstIP
+// first ipport, then port, then dstIP, last net of dstIP
 func (cache *cache) GetPolicy(ipport string, port int, ip string) *Policy {
 	cache.mtx.RLock()
 	defer cache.mtx.RUnlock()
@@ -98,6 +151,61 @@ func (cache *cache) GetPolicy(ipport string, port int, ip string) *Policy {
 	if ok {
 		return policy
 	}
-	policy = cache.ipPolicies[ip]
-	return policy
+	policy, ok = cache.ipPolicies[ip]
+	if ok {
+		return policy
+	}
+	return cache.getPolicyByNet(net.ParseIP(ip))
+}
+
+func (cache *cache) SetPeerDraining(addr string, draining bool) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if draining {
+		cache.draining[addr] = struct{}{}
+		return
+	}
+	delete(cache.draining, addr)
+}
+
+func (cache *cache) IsPeerDraining(addr string) bool {
+	cache.mtx.RLock()
+	defer cache.mtx.RUnlock()
+
+	_, ok := cache.draining[addr]
+	return ok
+}
+
+// PolicyDump is a copy of all policies
+type PolicyDump struct {
+	IPPort map[string]*Policy
+	Port   map[int]*Policy
+	IP     map[string]*Policy
+	Net    map[string]*Policy
+}
+
+func (cache *cache) DumpPolicies() *PolicyDump {
+	cache.mtx.RLock()
+	defer cache.mtx.RUnlock()
+
+	dump := &PolicyDump{
+		IPPort: make(map[string]*Policy, len(cache.ipportPolicies)),
+		Port:   make(map[int]*Policy, len(cache.portPolicies)),
+		IP:     make(map[string]*Policy, len(cache.ipPolicies)),
+		Net:    make(map[string]*Policy, len(cache.netPolicies)),
+	}
+	for key, policy := range cache.ipportPolicies {
+		dump.IPPort[key] = policy
+	}
+	for key, policy := range cache.portPolicies {
+		dump.Port[key] = policy
+	}
+	for key, policy := range cache.ipPolicies {
+		dump.IP[key] = policy
+	}
+	for key, elem := range cache.netPolicies {
+		dump.Net[key] = elem.policy
+	}
+	return dump
 }
@@ -4,27 +4,37 @@ import (
 	"net"
 
 	"github.com/jumboframes/armorigo/log"
+	"github.com/vishvananda/netlink"
 )
 
 type Repo interface {
 	AddIPPortPolicy(ipport string, policy *Policy)
 	AddPortPolicy(port int, policy *Policy)
 	AddIPPolicy(ip string, policy *Policy)
+	AddNetPolicy(ipnet *net.IPNet, policy *Policy)
 	GetPolicyByIP(ip string) *Policy
 	GetPolicyByIPPort(ipport string) *Policy
 	GetPolicyByPort(port int) *Policy
+	GetPolicyByNet(ip string) *Policy
 	GetPolicy(ipport string, port int, ip string) *Policy
 	DelIPPortPolicy(ipport string)
 	DelPortPolicy(port int)
 	DelIPPolicy(ip string)
+	DelNetPolicy(ipnet *net.IPNet)
+	DumpPolicies() *PolicyDump
+	SetPeerDraining(addr string, draining bool)
+	IsPeerDraining(addr string) bool
 
 	InitIPSet() error
 	AddIPSetIPPort(ip net.IP, port uint16) error
 	AddIPSetPort(port uint16) error
 	AddIPSetIP(ip net.IP) error
+	AddIPSetNet(ipnet *net.IPNet) error
 	DelIPSetIPPort(ip net.IP, port uint16) error
 	DelIPSetPort(port uint16) error
 	DelIPSetIP(ip net.IP) error
+	DelIPSetNet(ipnet *net.IPNet) error
+	ListIPSet(set string) ([]netlink.IPSetEntry, error)
 	FiniIPSet(level log.Level, prefix string) error
 }
 
@@ -39,6 +49,8 @@ func NewRepo() Repo {
 			ipportPolicies: make(map[string]*Policy),
 			portPolicies:   make(map[int]*Policy),
 			ipPolicies:     make(map[string]*Policy),
+			netPolicies:    make(map[string]*netPolicy),
+			draining:       make(map[string]struct{}),
 		},
 		ipset: &ipset{},
 	}
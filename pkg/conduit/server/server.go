@@ -8,47 +8,75 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/json"
 	"io"
 	"net"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/jumboframes/armorigo/log"
 	"github.com/jumboframes/armorigo/rproxy"
+	"github.com/moresec-io/conduit/pkg/conduit/accesslog"
 	"github.com/moresec-io/conduit/pkg/conduit/config"
+	ierrors "github.com/moresec-io/conduit/pkg/conduit/errors"
+	"github.com/moresec-io/conduit/pkg/conduit/flow"
+	"github.com/moresec-io/conduit/pkg/conduit/metrics"
 	"github.com/moresec-io/conduit/pkg/conduit/proto"
 	"github.com/moresec-io/conduit/pkg/conduit/syncer"
 	"github.com/moresec-io/conduit/pkg/conduit/sys"
 	"github.com/moresec-io/conduit/pkg/network"
 	gproto "github.com/moresec-io/conduit/pkg/proto"
+	"github.com/moresec-io/conduit/pkg/utils"
 )
 
 type Server struct {
-	conf   *config.Config
-	rp     *rproxy.RProxy
-	syncer syncer.Syncer
+	conf      *config.Config
+	rp        *rproxy.RProxy
+	syncer    syncer.Syncer
+	accessLog *accesslog.AccessLog
+	// to dial next hops, nil if relay disabled
+	relay *network.DialConfig
+	// relay side, sessions of servers behind nat
+	reverses       reverses
+	reverseRelayLn net.Listener
+	// behind nat side, sessions to relays and streams from them
+	reverseDial *network.DialConfig
+	reverseLn   *reverseListener
+
+	// dst as allowed by kube watcher if restricted
+	allowed    map[string]struct{}
+	allowedMtx sync.RWMutex
 
 	// listener
-	listener net.Listener
+	listener  net.Listener
+	drainOnce sync.Once
 }
 
-func NewServer(conf *config.Config, syncer syncer.Syncer) (*Server, error) {
+func NewServer(conf *config.Config, syncer syncer.Syncer, al *accesslog.AccessLog) (*Server, error) {
 	var (
 		err error
-		tls *gproto.TLS
+		tls *network.ReloadableTLS
 	)
 	if conf.Manager.Enable {
-		ips, err := network.ListIPs()
+		ips, err := network.ListIPs(&conf.Networks)
 		if err != nil {
 			return nil, err
 		}
 		// if manager configured, then use cluster tls configuration
-		response, err := syncer.ReportServer(&gproto.ReportServerRequest{
+		_, err = syncer.ReportServer(&gproto.ReportServerRequest{
 			MachineID: conf.MachineID,
 			Network:   conf.Server.Network,
 			Addr:      conf.Server.Addr,
 			IPs:       ips,
+			Relay:     conf.Server.Relay.Enable,
+			Reverse:   conf.Server.Reverse.Enable,
+			Zone:      conf.Zone,
+			Reaches:   conf.Reaches,
 		})
 		if err != nil {
 			return nil, err
@@ -57,20 +85,60 @@ func NewServer(conf *config.Config, syncer syncer.Syncer) (*Server, error) {
 		if err != nil {
 			return nil, err
 		}
-		tls = response.TLS
+		// swapped by syncer as manager rotates certs
+		tls = syncer.ServerTLS()
 	}
 	server := &Server{
-		conf:   conf,
-		syncer: syncer,
+		conf:      conf,
+		syncer:    syncer,
+		accessLog: al,
+		reverses: reverses{
+			sessions: map[string]*reverseSession{},
+		},
+	}
+	if conf.Server.Relay.Enable {
+		server.relay, err = newRelayDialConfig(&conf.Server.Relay, tls)
+		if err != nil {
+			log.Errorf("new server, new relay dial config err: %s", err)
+			return nil, err
+		}
+		if reverse := &conf.Server.Relay.Reverse; reverse.Enable {
+			if tls != nil {
+				server.reverseRelayLn, err = network.ListenReloadableMTLS(reverse.Listen.Network, reverse.Listen.Addr, tls)
+			} else {
+				server.reverseRelayLn, err = network.Listen(&reverse.Listen)
+			}
+			if err != nil {
+				log.Errorf("new server, listen reverse err: %s", err)
+				return nil, err
+			}
+		}
+	}
+	if conf.Server.Reverse.Enable {
+		server.reverseDial, err = newReverseDialConfig(&conf.Server.Reverse, tls)
+		if err != nil {
+			log.Errorf("new server, new reverse dial config err: %s", err)
+			return nil, err
+		}
 	}
 	if tls != nil {
-		server.listener, err = network.ListenDERMTLS(conf.Server.Network, conf.Server.Addr, tls.CA, tls.Cert, tls.Key)
+		server.listener, err = network.ListenReloadableMTLS(conf.Server.Network, conf.Server.Addr, tls)
 	} else {
 		server.listener, err = network.Listen(&conf.Server.Listen)
 	}
 	if err != nil {
 		return nil, err
 	}
+	if server.reverseDial != nil {
+		server.reverseLn = newReverseListener(server.listener.Addr())
+	}
+	if conf.Server.TransparentEgress.Enable {
+		err = server.setTransparent()
+		if err != nil {
+			server.listener.Close()
+			return nil, err
+		}
+	}
 	return server, nil
 }
 
@@ -82,24 +150,97 @@ func (server *Server) Work() error {
 	return nil
 }
 
+type ctx struct {
+	// metrics labels
+	policy string // dst as
+	peer   string // client conduit machine id, or common name if not spiffe-aware
+	// next hop and the header to it if relayed
+	next  string
+	relay []byte
+	// dst as dialed in udp, datagrams are framed in the tunnel
+	udp bool
+	// proxy protocol header written to dst as first
+	proxyHeader []byte
+	// client's ip dst as dialed from if transparent
+	transparent *net.TCPAddr
+	// access log
+	record *accesslog.Record
+}
+
 func (server *Server) proxy() error {
-	rp, err := rproxy.NewRProxy(server.listener,
-		rproxy.OptionRProxyDial(server.dial),
-		rproxy.OptionRProxyReplaceDst(server.replaceDstfunc))
+	rp, err := server.newRProxy(server.listener)
 	if err != nil {
 		return err
 	}
 	go rp.Proxy(context.TODO())
 	server.rp = rp
+
+	if server.reverseRelayLn != nil {
+		go server.acceptReverse(server.reverseRelayLn)
+	}
+	if server.reverseLn != nil {
+		// streams from relays are proxied the same
+		rp, err := server.newRProxy(server.reverseLn)
+		if err != nil {
+			return err
+		}
+		go rp.Proxy(context.TODO())
+		for i := range server.reverseDial.Addrs {
+			go server.keepReverse(server.reverseDial, i)
+		}
+	}
 	return nil
 }
 
+func (server *Server) newRProxy(listener net.Listener) (*rproxy.RProxy, error) {
+	return rproxy.NewRProxy(listener,
+		rproxy.OptionRProxyAcceptConn(server.acceptConn),
+		rproxy.OptionRProxyPostAccept(server.postAccept),
+		rproxy.OptionRProxyDial(server.dial),
+		rproxy.OptionRProxyReplaceDst(server.replaceDstfunc))
+}
+
+// the ctx is carried by meta to later hooks
+func (server *Server) acceptConn(conn net.Conn) ([]interface{}, error) {
+	ctx := &ctx{
+		policy: metrics.PolicyNone,
+		peer:   metrics.PeerUnknown,
+		record: server.accessLog.NewRecord(metrics.SideServer),
+	}
+	ctx.record.Peer = conn.RemoteAddr().String()
+	return []interface{}{ctx}, nil
+}
+
 func (server *Server) replaceDstfunc(conn net.Conn, meta ...interface{}) (net.Addr, net.Conn, error) {
+	ctx := meta[0].(*ctx)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// handshake explicitly to tell handshake failures from others
+		err := tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			log.Errorf("server replace dst func, tls handshake err: %s", err)
+			reason := metrics.TLSFailureReason(err)
+			if reason == "" {
+				reason = "unknown"
+			}
+			metrics.TLSHandshakeFailures.With(metrics.SideServer, reason).Inc()
+			metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonHandshake).Inc()
+			server.accessLog.Fail(ctx.record, accesslog.CloseHandshake, err)
+			return nil, nil, err
+		}
+		ctx.record.Identity = peerIdentity(tlsConn.ConnectionState().PeerCertificates)
+	}
+	if reverseConn, ok := conn.(*reverseConn); ok {
+		ctx.record.Identity = reverseConn.identity
+	}
+	ctx.peer = peerLabel(ctx.record.Identity)
 	bs := make([]byte, 4)
 	_, err := io.ReadFull(conn, bs)
 	if err != nil {
 		conn.Close()
 		log.Errorf("server replace dst func, read size err: %s", err)
+		metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonHeader).Inc()
+		server.accessLog.Fail(ctx.record, accesslog.CloseHeader, err)
 		return nil, nil, err
 	}
 	data := make([]byte, binary.LittleEndian.Uint32(bs))
@@ -107,6 +248,8 @@ func (server *Server) replaceDstfunc(conn net.Conn, meta ...interface{}) (net.Ad
 	if err != nil {
 		conn.Close()
 		log.Errorf("server replace dst func, read meta err: %s", err)
+		metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonHeader).Inc()
+		server.accessLog.Fail(ctx.record, accesslog.CloseHeader, err)
 		return nil, nil, err
 	}
 	proto := &proto.ConduitProto{}
@@ -114,28 +257,179 @@ func (server *Server) replaceDstfunc(conn net.Conn, meta ...interface{}) (net.Ad
 	if err != nil {
 		conn.Close()
 		log.Errorf("server replace dst func, json unmarshal err: %s", err)
+		metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonHeader).Inc()
+		server.accessLog.Fail(ctx.record, accesslog.CloseHeader, err)
 		return nil, nil, err
 	}
-	log.Debugf("server replace dst func, accept src: %s, dst: %s, as: %s",
-		conn.RemoteAddr().String(), conn.LocalAddr().String(), proto.DstAs)
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", proto.DstAs)
+	log.Debugf("server replace dst func, accept src: %s, dst: %s, as: %s, route: %v",
+		conn.RemoteAddr().String(), conn.LocalAddr().String(), proto.DstAs, proto.Route)
+	dst := proto.DstAs
+	if len(proto.Route) != 0 {
+		dst = proto.Route[0]
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", dst)
 	if err != nil {
 		conn.Close()
 		log.Errorf("server replace dst func, net resolve err: %s", err)
+		metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonHeader).Inc()
+		server.accessLog.Fail(ctx.record, accesslog.CloseHeader, err)
 		return nil, nil, err
 	}
-	return tcpAddr, conn, nil
+	if len(proto.Route) != 0 {
+		if server.relay == nil || !relayAllowed(&server.conf.Server.Relay, ctx.record.Identity, dst) {
+			conn.Close()
+			log.Warnf("server replace dst func, relay to: %s from: %s identity: %s forbidden",
+				dst, conn.RemoteAddr().String(), ctx.record.Identity)
+			metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonForbidden).Inc()
+			server.accessLog.Fail(ctx.record, accesslog.CloseForbidden, ierrors.ErrRelayForbidden)
+			return nil, nil, ierrors.ErrRelayForbidden
+		}
+		ctx.relay, err = relayHeader(proto)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		ctx.next = dst
+		ctx.record.Next = dst
+	} else if !server.isAllowed(proto.DstAs) {
+		conn.Close()
+		log.Warnf("server replace dst func, dst as: %s from: %s forbidden", proto.DstAs, conn.RemoteAddr().String())
+		metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonForbidden).Inc()
+		server.accessLog.Fail(ctx.record, accesslog.CloseForbidden, ierrors.ErrDstAsForbidden)
+		return nil, nil, ierrors.ErrDstAsForbidden
+	}
+	ctx.udp = proto.UDP()
+	if ctx.relay == nil && !ctx.udp {
+		ctx.proxyHeader = proxyProtocolHeader(server.conf.Server.ProxyProtocols, proto, ctx.record.Identity)
+		ctx.transparent = server.transparentAddr(proto.SrcIP, proto.DstAs)
+	}
+	ctx.policy = proto.DstAs
+	metrics.ConnAccepted.With(metrics.SideServer, ctx.policy, ctx.peer).Inc()
+	ctx.record.Src = net.JoinHostPort(proto.SrcIP, strconv.Itoa(proto.SrcPort))
+	ctx.record.Dst = net.JoinHostPort(proto.DstIP, strconv.Itoa(proto.DstPort))
+	ctx.record.DstAs = proto.DstAs
+	mconn := metrics.NewConn(conn, metrics.SideServer, ctx.policy, ctx.peer)
+	return tcpAddr, flow.Flows.Track(accesslog.NewConn(mconn, server.accessLog, ctx.record), &flow.Flow{
+		Side:  metrics.SideServer,
+		Src:   ctx.record.Src,
+		Dst:   ctx.record.Dst,
+		DstAs: proto.DstAs,
+		Peer:  ctx.record.Peer,
+	}), nil
+}
+
+func (server *Server) postAccept(_, _ net.Addr, meta ...interface{}) (interface{}, error) {
+	return meta[0], nil
 }
 
 func (server *Server) dial(dst net.Addr, custom interface{}) (net.Conn, error) {
+	ctx := custom.(*ctx)
+	if ctx.relay != nil {
+		return server.dialRelay(ctx)
+	}
 	timeout := time.Second * 10
 	dialer := net.Dialer{
 		Timeout: timeout,
 		Control: sys.Control,
 	}
-	return dialer.Dial("tcp", dst.String())
+	if ctx.transparent != nil {
+		dialer.LocalAddr = ctx.transparent
+		dialer.Control = sys.TransparentControl
+	}
+	networkType := "tcp"
+	if ctx.udp {
+		networkType = "udp"
+	}
+	start := time.Now()
+	conn, err := dialer.Dial(networkType, dst.String())
+	if err != nil {
+		metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonDial).Inc()
+		// logged once the left conn closed
+		ctx.record.Fail(accesslog.CloseDial, err)
+		return nil, err
+	}
+	metrics.DialDuration.With(metrics.SideServer, ctx.policy).Observe(time.Since(start).Seconds())
+	if ctx.udp {
+		return network.NewDatagramConn(conn), nil
+	}
+	if ctx.proxyHeader != nil {
+		if _, err = conn.Write(ctx.proxyHeader); err != nil {
+			conn.Close()
+			metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonHeader).Inc()
+			ctx.record.Fail(accesslog.CloseHeader, err)
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// SetAllowed replaces dst as allowed, all are forbidden before the first
+// set if kube restricts server
+func (server *Server) SetAllowed(allowed map[string]struct{}) {
+	server.allowedMtx.Lock()
+	defer server.allowedMtx.Unlock()
+
+	server.allowed = allowed
+}
+
+func (server *Server) isAllowed(dstAs string) bool {
+	if !server.conf.Kube.Enable || !server.conf.Kube.RestrictServer {
+		return true
+	}
+	server.allowedMtx.RLock()
+	defer server.allowedMtx.RUnlock()
+
+	_, ok := server.allowed[dstAs]
+	return ok
+}
+
+// spiffe id of the client conduit, or common name if not spiffe-aware
+func peerIdentity(certs []*x509.Certificate) string {
+	if len(certs) == 0 {
+		return ""
+	}
+	if id, err := utils.CertSPIFFEID(certs[0]); err == nil {
+		return id.String()
+	}
+	return certs[0].Subject.CommonName
+}
+
+// metrics label of the client conduit, bounded by certs issued unlike its ip
+func peerLabel(identity string) string {
+	if identity == "" {
+		return metrics.PeerUnknown
+	}
+	if uri, err := url.Parse(identity); err == nil {
+		if id, err := utils.ParseSPIFFEID(uri); err == nil {
+			return id.MachineID
+		}
+	}
+	return identity
+}
+
+// Drain tells manager to let clients pick other peers and stops accepting,
+// active flows are left to finish.
+func (server *Server) Drain() {
+	server.drainOnce.Do(func() {
+		if server.conf.Manager.Enable {
+			err := server.syncer.ReportDraining()
+			if err != nil {
+				log.Warnf("server drain, report draining err: %s", err)
+			}
+		}
+		server.listener.Close()
+		if server.reverseLn != nil {
+			server.reverseLn.Close()
+		}
+		if server.reverseRelayLn != nil {
+			server.reverseRelayLn.Close()
+		}
+	})
 }
 
 func (server *Server) Close() {
-	server.listener.Close()
+	server.Drain()
+	if server.conf.Server.TransparentEgress.Enable {
+		server.finiTransparent(log.LevelWarn, "server fini transparent")
+	}
 }
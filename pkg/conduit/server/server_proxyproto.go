@@ -0,0 +1,39 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package server
+
+import (
+	"net"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/proto"
+	"github.com/moresec-io/conduit/pkg/network"
+)
+
+// the proxy protocol header prepended to dst as, nil if none matches
+func proxyProtocolHeader(pps []config.ProxyProtocol, header *proto.ConduitProto, identity string) []byte {
+	for i := range pps {
+		pp := &pps[i]
+		if !matchAny(pp.Dsts, header.DstAs) {
+			continue
+		}
+		src := &net.TCPAddr{IP: net.ParseIP(header.SrcIP), Port: header.SrcPort}
+		dst := &net.TCPAddr{IP: net.ParseIP(header.DstIP), Port: header.DstPort}
+		if src.IP == nil || dst.IP == nil {
+			return nil
+		}
+		if pp.Version == config.ProxyProtocolV1 {
+			return network.ProxyHeaderV1(src, dst)
+		}
+		tlvs := []network.TLV{}
+		if pp.Identity && identity != "" {
+			tlvs = append(tlvs, network.TLV{Type: network.PP2TypeConduitIdentity, Value: []byte(identity)})
+		}
+		return network.ProxyHeaderV2(src, dst, tlvs...)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/proto"
+	"github.com/moresec-io/conduit/pkg/network"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	Convey("proxy protocol", t, func() {
+		pps := []config.ProxyProtocol{
+			{Dsts: []string{"127.0.0.1:80"}, Version: config.ProxyProtocolV1},
+			{Dsts: []string{"127.0.0.1:*"}, Version: config.ProxyProtocolV2, Identity: true},
+		}
+		header := &proto.ConduitProto{
+			SrcIP:   "10.0.0.1",
+			SrcPort: 34567,
+			DstIP:   "10.0.0.2",
+			DstPort: 8080,
+			DstAs:   "127.0.0.1:80",
+		}
+		src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 34567}
+		dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 8080}
+
+		Convey("first matched", func() {
+			So(proxyProtocolHeader(pps, header, "a"), ShouldResemble, network.ProxyHeaderV1(src, dst))
+		})
+
+		Convey("identity in tlv", func() {
+			header.DstAs = "127.0.0.1:443"
+			So(proxyProtocolHeader(pps, header, "a"), ShouldResemble,
+				network.ProxyHeaderV2(src, dst, network.TLV{Type: network.PP2TypeConduitIdentity, Value: []byte("a")}))
+		})
+
+		Convey("none matched", func() {
+			header.DstAs = "10.0.0.3:80"
+			So(proxyProtocolHeader(pps, header, "a"), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,126 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package server
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/accesslog"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/metrics"
+	"github.com/moresec-io/conduit/pkg/conduit/proto"
+	"github.com/moresec-io/conduit/pkg/conduit/sys"
+	gconfig "github.com/moresec-io/conduit/pkg/config"
+	"github.com/moresec-io/conduit/pkg/network"
+)
+
+// the dial config to next hops, with certs from manager if there are
+func newRelayDialConfig(relay *config.Relay, managerTLS *network.ReloadableTLS) (*network.DialConfig, error) {
+	if managerTLS == nil {
+		tls := relay.TLS
+		return network.ConvertDialConfig(&gconfig.Dial{
+			Network: relay.Network,
+			TLS:     &tls,
+		})
+	}
+	return &network.DialConfig{
+		Netwotk: relay.Network,
+		TLS: &network.TLS{
+			Enable:     true,
+			MTLS:       true,
+			Reloadable: managerTLS,
+		},
+	}, nil
+}
+
+// whether the previous conduit of identity may relay to the next hop
+func relayAllowed(relay *config.Relay, identity, next string) bool {
+	for _, allow := range relay.Allows {
+		if matchAny(allow.Identities, identity) && matchAny(allow.Hops, next) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == value {
+			return true
+		}
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(value, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// the header to the next hop, it takes the rest of the route
+func relayHeader(header *proto.ConduitProto) ([]byte, error) {
+	next := *header
+	next.Route = header.Route[1:]
+	return proto.Frame(&next)
+}
+
+// dial the next hop and write the proto with the rest of the route, the
+// next hop behind nat is reached by a stream down its reverse session
+func (server *Server) dialRelay(ctx *ctx) (net.Conn, error) {
+	if session := server.reverseSession(ctx.next); session != nil {
+		return server.dialReverse(ctx, session)
+	}
+	config := *server.relay
+	config.Addrs = []string{ctx.next}
+	config.Control = sys.Control
+	start := time.Now()
+	conn, err := network.DialWithConfig(&config, 0)
+	if err != nil {
+		reason, closeReason := metrics.ReasonDial, accesslog.CloseDial
+		if tlsReason := metrics.TLSFailureReason(err); tlsReason != "" {
+			reason, closeReason = metrics.ReasonHandshake, accesslog.CloseHandshake
+			metrics.TLSHandshakeFailures.With(metrics.SideServer, tlsReason).Inc()
+		}
+		log.Errorf("server dial relay, dial next hop: %s err: %s", ctx.next, err)
+		metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, reason).Inc()
+		// logged once the left conn closed
+		ctx.record.Fail(closeReason, err)
+		return nil, err
+	}
+	metrics.DialDuration.With(metrics.SideServer, ctx.policy).Observe(time.Since(start).Seconds())
+	_, err = conn.Write(ctx.relay)
+	if err != nil {
+		conn.Close()
+		log.Errorf("server dial relay, write header to next hop: %s err: %s", ctx.next, err)
+		metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonHeader).Inc()
+		ctx.record.Fail(accesslog.CloseHeader, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (server *Server) dialReverse(ctx *ctx, session *reverseSession) (net.Conn, error) {
+	start := time.Now()
+	stream, err := session.end.OpenStream()
+	if err != nil {
+		log.Errorf("server dial reverse, open stream to: %s err: %s", ctx.next, err)
+		metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonDial).Inc()
+		ctx.record.Fail(accesslog.CloseDial, err)
+		return nil, err
+	}
+	metrics.DialDuration.With(metrics.SideServer, ctx.policy).Observe(time.Since(start).Seconds())
+	_, err = stream.Write(ctx.relay)
+	if err != nil {
+		stream.Close()
+		log.Errorf("server dial reverse, write header to: %s err: %s", ctx.next, err)
+		metrics.ConnFailed.With(metrics.SideServer, ctx.policy, ctx.peer, metrics.ReasonHeader).Inc()
+		ctx.record.Fail(accesslog.CloseHeader, err)
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,53 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/proto"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRelay(t *testing.T) {
+	Convey("relay", t, func() {
+		relay := &config.Relay{
+			Enable: true,
+			Allows: []config.RelayAllow{
+				{Identities: []string{"spiffe://conduit.local/conduit/client/*"}, Hops: []string{"10.0.1.1:5053"}},
+				{Identities: []string{"edge"}, Hops: []string{"*"}},
+			},
+		}
+
+		Convey("allowed identities and hops", func() {
+			So(relayAllowed(relay, "spiffe://conduit.local/conduit/client/a", "10.0.1.1:5053"), ShouldBeTrue)
+			So(relayAllowed(relay, "spiffe://conduit.local/conduit/client/a", "10.0.1.2:5053"), ShouldBeFalse)
+			So(relayAllowed(relay, "spiffe://conduit.local/conduit/server/a", "10.0.1.1:5053"), ShouldBeFalse)
+			So(relayAllowed(relay, "edge", "10.0.1.2:5053"), ShouldBeTrue)
+			So(relayAllowed(relay, "", "10.0.1.1:5053"), ShouldBeFalse)
+			So(relayAllowed(&config.Relay{Enable: true}, "edge", "10.0.1.1:5053"), ShouldBeFalse)
+		})
+
+		Convey("next hop takes the rest of route", func() {
+			header := &proto.ConduitProto{
+				SrcIP: "192.168.0.1", SrcPort: 40000, DstIP: "192.168.1.2", DstPort: 3306,
+				DstAs: "127.0.0.1:3306", Route: []string{"10.0.1.1:5053", "10.0.2.1:5053"},
+			}
+			data, err := relayHeader(header)
+			So(err, ShouldBeNil)
+			So(binary.LittleEndian.Uint32(data[:4]), ShouldEqual, len(data)-4)
+			next := &proto.ConduitProto{}
+			So(json.Unmarshal(data[4:], next), ShouldBeNil)
+			So(next.Route, ShouldResemble, []string{"10.0.2.1:5053"})
+			So(next.DstAs, ShouldEqual, header.DstAs)
+			So(header.Route, ShouldHaveLength, 2)
+		})
+	})
+}
@@ -0,0 +1,287 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/proto"
+	"github.com/moresec-io/conduit/pkg/conduit/sys"
+	"github.com/moresec-io/conduit/pkg/network"
+	"github.com/moresec-io/conduit/pkg/utils"
+	"github.com/singchia/geminio"
+	gclient "github.com/singchia/geminio/client"
+	gserver "github.com/singchia/geminio/server"
+)
+
+const reverseRetryInterval = 5 * time.Second
+
+// relay side
+
+// a server behind nat keeping its session to us
+type reverseSession struct {
+	meta *proto.ReverseMeta
+	end  geminio.End
+}
+
+// sessions of servers behind nat, key: addr they registered
+type reverses struct {
+	mtx      sync.RWMutex
+	sessions map[string]*reverseSession
+}
+
+func (server *Server) acceptReverse(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Infof("server accept reverse, accept err: %s, quiting", err)
+			return
+		}
+		go server.serveReverse(conn)
+	}
+}
+
+// held till the session ends
+func (server *Server) serveReverse(conn net.Conn) {
+	identity, machineID := "", ""
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		err := tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			log.Errorf("server serve reverse, tls handshake err: %s", err)
+			return
+		}
+		certs := tlsConn.ConnectionState().PeerCertificates
+		identity = peerIdentity(certs)
+		if len(certs) != 0 {
+			if id, err := utils.CertSPIFFEID(certs[0]); err == nil {
+				machineID = id.MachineID
+			}
+		}
+	}
+	if !matchAny(server.conf.Server.Relay.Reverse.Identities, identity) {
+		conn.Close()
+		log.Warnf("server serve reverse, identity: %s from: %s forbidden", identity, conn.RemoteAddr().String())
+		return
+	}
+	end, err := gserver.NewEndWithConn(conn, gserver.NewEndOptions())
+	if err != nil {
+		conn.Close()
+		log.Errorf("server serve reverse, geminio new end err: %s", err)
+		return
+	}
+	meta := &proto.ReverseMeta{}
+	if err = json.Unmarshal(end.Meta(), meta); err != nil || meta.Addr == "" {
+		end.Close()
+		log.Errorf("server serve reverse, illegal meta: %s from: %s", string(end.Meta()), conn.RemoteAddr().String())
+		return
+	}
+	// registrations are bound to the machine id in the peer's cert
+	if machineID == "" || machineID != meta.MachineID {
+		end.Close()
+		log.Warnf("server serve reverse, conduit: %s from: %s mismatches identity: %s, forbidden",
+			meta.MachineID, conn.RemoteAddr().String(), identity)
+		return
+	}
+	if err = server.verifyReverseAddr(meta); err != nil {
+		end.Close()
+		log.Warnf("server serve reverse, conduit: %s addr: %s unverified, err: %s, forbidden",
+			meta.MachineID, meta.Addr, err)
+		return
+	}
+	session := &reverseSession{meta: meta, end: end}
+	server.reverses.mtx.Lock()
+	if old, ok := server.reverses.sessions[meta.Addr]; ok {
+		// reconnected before the old one's gone
+		old.end.Close()
+	}
+	server.reverses.sessions[meta.Addr] = session
+	server.reverses.mtx.Unlock()
+	log.Infof("server serve reverse, session of conduit: %s, addr: %s, identity: %s online", meta.MachineID, meta.Addr, identity)
+	server.reportReverses()
+
+	// streams are only opened by us, it returns once the session ends
+	for {
+		stream, err := end.AcceptStream()
+		if err != nil {
+			break
+		}
+		stream.Close()
+	}
+	end.Close()
+	server.reverses.mtx.Lock()
+	if server.reverses.sessions[meta.Addr] == session {
+		delete(server.reverses.sessions, meta.Addr)
+	}
+	server.reverses.mtx.Unlock()
+	log.Infof("server serve reverse, session of conduit: %s, addr: %s offline", meta.MachineID, meta.Addr)
+	server.reportReverses()
+}
+
+// the addr must be the one manager reports for the machine, or it may take
+// over sessions of others
+func (server *Server) verifyReverseAddr(meta *proto.ReverseMeta) error {
+	if !server.conf.Manager.Enable {
+		return nil
+	}
+	conduit, err := server.syncer.LookupConduit(meta.MachineID)
+	if err != nil {
+		return err
+	}
+	if conduit.Addr != meta.Addr {
+		return fmt.Errorf("addr: %s reported to manager", conduit.Addr)
+	}
+	return nil
+}
+
+func (server *Server) reverseSession(addr string) *reverseSession {
+	server.reverses.mtx.RLock()
+	defer server.reverses.mtx.RUnlock()
+
+	return server.reverses.sessions[addr]
+}
+
+// tell manager who's reachable through us
+func (server *Server) reportReverses() {
+	if !server.conf.Manager.Enable {
+		return
+	}
+	server.reverses.mtx.RLock()
+	machineIDs := make([]string, 0, len(server.reverses.sessions))
+	for _, session := range server.reverses.sessions {
+		if session.meta.MachineID != "" {
+			machineIDs = append(machineIDs, session.meta.MachineID)
+		}
+	}
+	server.reverses.mtx.RUnlock()
+	sort.Strings(machineIDs)
+	server.syncer.SetReverses(machineIDs)
+}
+
+// server behind nat side
+
+// streams from relays, identified by the relay
+type reverseConn struct {
+	net.Conn
+	identity string
+}
+
+// streams of all sessions are accepted here and proxied like the listener's
+type reverseListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newReverseListener(addr net.Addr) *reverseListener {
+	return &reverseListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (ln *reverseListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *reverseListener) push(conn net.Conn) {
+	select {
+	case ln.conns <- conn:
+	case <-ln.closed:
+		conn.Close()
+	}
+}
+
+func (ln *reverseListener) Close() error {
+	ln.once.Do(func() {
+		close(ln.closed)
+	})
+	return nil
+}
+
+func (ln *reverseListener) Addr() net.Addr {
+	return ln.addr
+}
+
+// keep the session to the relay at index, redialed till closed
+func (server *Server) keepReverse(dialConfig *network.DialConfig, index int) {
+	meta, _ := json.Marshal(&proto.ReverseMeta{
+		MachineID: server.conf.MachineID,
+		Addr:      server.conf.Server.Addr,
+	})
+	relay := dialConfig.Addrs[index]
+	for {
+		err := server.serveRelay(dialConfig, index, meta)
+		select {
+		case <-server.reverseLn.closed:
+			return
+		default:
+		}
+		log.Warnf("server keep reverse, session to relay: %s ended, err: %v, redial in %s", relay, err, reverseRetryInterval)
+		select {
+		case <-server.reverseLn.closed:
+			return
+		case <-time.After(reverseRetryInterval):
+		}
+	}
+}
+
+func (server *Server) serveRelay(dialConfig *network.DialConfig, index int, meta []byte) error {
+	conn, err := network.DialWithConfig(dialConfig, index)
+	if err != nil {
+		return err
+	}
+	identity := ""
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		identity = peerIdentity(tlsConn.ConnectionState().PeerCertificates)
+	}
+	opt := gclient.NewEndOptions()
+	opt.SetMeta(meta)
+	end, err := gclient.NewEndWithConn(conn, opt)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer end.Close()
+	log.Infof("server serve relay, session to relay: %s, identity: %s online", dialConfig.Addrs[index], identity)
+	for {
+		stream, err := end.AcceptStream()
+		if err != nil {
+			return err
+		}
+		server.reverseLn.push(&reverseConn{Conn: stream, identity: identity})
+	}
+}
+
+// the dial config to relays, with certs from manager if there are
+func newReverseDialConfig(reverse *config.Reverse, managerTLS *network.ReloadableTLS) (*network.DialConfig, error) {
+	dialConfig, err := newRelayDialConfig(&config.Relay{
+		Network: reverse.Network,
+		TLS:     reverse.TLS,
+	}, managerTLS)
+	if err != nil {
+		return nil, err
+	}
+	dialConfig.Addrs = reverse.Relays
+	dialConfig.Control = sys.Control
+	return dialConfig, nil
+}
@@ -0,0 +1,80 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/network"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReverse(t *testing.T) {
+	Convey("reverse session", t, func() {
+		ca, caKey := genTestCert(nil, nil, "")
+		ln, err := network.ListenReloadableMTLS("tcp", "127.0.0.1:0", newTestTLS(ca, caKey, "relay"))
+		So(err, ShouldBeNil)
+		defer ln.Close()
+		dialConfig := func(machineID string) *network.DialConfig {
+			return &network.DialConfig{
+				Netwotk: "tcp",
+				Addrs:   []string{ln.Addr().String()},
+				TLS:     &network.TLS{Enable: true, MTLS: true, Reloadable: newTestTLS(ca, caKey, machineID)},
+			}
+		}
+
+		relayConf := &config.Config{}
+		relayConf.Server.Relay.Reverse.Identities = []string{"*"}
+		relay := &Server{conf: relayConf, reverses: reverses{sessions: map[string]*reverseSession{}}}
+		go relay.acceptReverse(ln)
+
+		edgeConf := &config.Config{MachineID: "edge"}
+		edgeConf.Server.Addr = "192.168.0.1:5053"
+		edge := &Server{conf: edgeConf, reverseLn: newReverseListener(ln.Addr())}
+		defer edge.reverseLn.Close()
+		go edge.keepReverse(dialConfig("edge"), 0)
+
+		var session *reverseSession
+		for i := 0; i < 100 && session == nil; i++ {
+			time.Sleep(20 * time.Millisecond)
+			session = relay.reverseSession("192.168.0.1:5053")
+		}
+		So(session, ShouldNotBeNil)
+		So(session.meta.MachineID, ShouldEqual, "edge")
+
+		Convey("streams opened by relay are accepted by the server behind nat", func() {
+			stream, err := session.end.OpenStream()
+			So(err, ShouldBeNil)
+			defer stream.Close()
+			_, err = stream.Write([]byte("ping"))
+			So(err, ShouldBeNil)
+
+			conn, err := edge.reverseLn.Accept()
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			bs := make([]byte, 4)
+			_, err = io.ReadFull(conn, bs)
+			So(err, ShouldBeNil)
+			So(string(bs), ShouldEqual, "ping")
+		})
+
+		Convey("sessions claiming other machines are forbidden", func() {
+			impostorConf := &config.Config{MachineID: "edge"}
+			impostorConf.Server.Addr = "192.168.0.2:5053"
+			impostor := &Server{conf: impostorConf, reverseLn: newReverseListener(ln.Addr())}
+			defer impostor.reverseLn.Close()
+			go impostor.keepReverse(dialConfig("impostor"), 0)
+
+			time.Sleep(200 * time.Millisecond)
+			So(relay.reverseSession("192.168.0.2:5053"), ShouldBeNil)
+			So(relay.reverseSession("192.168.0.1:5053"), ShouldEqual, session)
+		})
+	})
+}
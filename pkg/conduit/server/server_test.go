@@ -0,0 +1,72 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/conduit/metrics"
+	"github.com/moresec-io/conduit/pkg/network"
+	"github.com/moresec-io/conduit/pkg/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// a self-signed CA if parent is nil, or a cert of the server conduit at
+// 127.0.0.1 signed by parent
+func genTestCert(parent *x509.Certificate, parentKey *rsa.PrivateKey, machineID string) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	So(err, ShouldBeNil)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	So(err, ShouldBeNil)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "conduit"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	} else {
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+		template.URIs = []*url.URL{utils.NewSPIFFEID("conduit.local", utils.SPIFFERoleServer, machineID).URL()}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(raw)
+	So(err, ShouldBeNil)
+	return cert, key
+}
+
+// certs of the machine as from manager
+func newTestTLS(ca *x509.Certificate, caKey *rsa.PrivateKey, machineID string) *network.ReloadableTLS {
+	cert, key := genTestCert(ca, caKey, machineID)
+	rt := &network.ReloadableTLS{}
+	So(rt.SetCAs([][]byte{ca.Raw}), ShouldBeNil)
+	So(rt.SetCert(cert.Raw, x509.MarshalPKCS1PrivateKey(key)), ShouldBeNil)
+	return rt
+}
+
+func TestPeerLabel(t *testing.T) {
+	Convey("peer label", t, func() {
+		So(peerLabel("spiffe://conduit.local/conduit/client/machine-a"), ShouldEqual, "machine-a")
+		So(peerLabel("edge"), ShouldEqual, "edge")
+		So(peerLabel(""), ShouldEqual, metrics.PeerUnknown)
+	})
+}
@@ -0,0 +1,191 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/utils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	iptablesSave    = "iptables-save"
+	iptablesRestore = "iptables-restore"
+
+	// replies to our transparent sockets are marked here
+	ConduitTransparentChain = "CONDUIT-TRANSPARENT"
+)
+
+var transparentJump = "-A PREROUTING -j " + ConduitTransparentChain
+
+// the client's ip of dst as dialed transparently, nil if not matched
+func (server *Server) transparentAddr(srcIP, dstAs string) *net.TCPAddr {
+	te := &server.conf.Server.TransparentEgress
+	if !te.Enable || !matchAny(te.Dsts, dstAs) {
+		return nil
+	}
+	// the mangle chain, rule and route are for ipv4 only, replies to an ipv6
+	// source would never come back to the socket, dial from our own instead
+	ip := net.ParseIP(srcIP)
+	if ip.To4() == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+// mark replies to transparent sockets and deliver the marked locally, the
+// chain is refilled and the rule and route replaced if left by the last run
+func (server *Server) setTransparent() error {
+	snapshot, err := saveMangle()
+	if err != nil {
+		return err
+	}
+	payload := &bytes.Buffer{}
+	fmt.Fprintln(payload, "*mangle")
+	fmt.Fprintf(payload, ":%s - [0:0]\n", ConduitTransparentChain)
+	fmt.Fprintf(payload, "-A %s -p tcp -m socket --transparent -j MARK --set-mark %d\n",
+		ConduitTransparentChain, config.MarkTransparent)
+	if countLines(snapshot, transparentJump) == 0 {
+		fmt.Fprintln(payload, transparentJump)
+	}
+	fmt.Fprintln(payload, "COMMIT")
+	infoO, infoE, err := utils.CmdStdin(payload.Bytes(), iptablesRestore, "--noflush", "-w")
+	if err != nil {
+		log.Errorf("server set transparent, restore mangle err: %s, stdout: %s, stderr: %s",
+			err, infoO, strings.TrimSuffix(string(infoE), "\n"))
+		return err
+	}
+
+	table := server.conf.Server.TransparentEgress.Table
+	rule := transparentRule(table)
+	rules, err := netlink.RuleListFiltered(netlink.FAMILY_V4, rule, netlink.RT_FILTER_MARK|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		log.Errorf("server set transparent, list rules err: %s", err)
+		return err
+	}
+	if len(rules) == 0 {
+		if err = netlink.RuleAdd(rule); err != nil {
+			log.Errorf("server set transparent, add rule err: %s", err)
+			return err
+		}
+	}
+	route, err := transparentRoute(table)
+	if err != nil {
+		log.Errorf("server set transparent, get lo err: %s", err)
+		return err
+	}
+	if err = netlink.RouteReplace(route); err != nil {
+		log.Errorf("server set transparent, replace route err: %s", err)
+		return err
+	}
+	return nil
+}
+
+// delete the jump, the chain, the rule and the route
+func (server *Server) finiTransparent(level log.Level, prefix string) {
+	snapshot, err := saveMangle()
+	if err != nil {
+		log.Printf(level, "%s, save mangle err: %s", prefix, err)
+	} else {
+		payload := &bytes.Buffer{}
+		fmt.Fprintln(payload, "*mangle")
+		for i := 0; i < countLines(snapshot, transparentJump); i++ {
+			fmt.Fprintln(payload, "-D"+transparentJump[2:])
+		}
+		if countPrefix(snapshot, ":"+ConduitTransparentChain+" ") != 0 {
+			fmt.Fprintf(payload, "-F %s\n", ConduitTransparentChain)
+			fmt.Fprintf(payload, "-X %s\n", ConduitTransparentChain)
+		}
+		fmt.Fprintln(payload, "COMMIT")
+		infoO, infoE, err := utils.CmdStdin(payload.Bytes(), iptablesRestore, "--noflush", "-w")
+		if err != nil {
+			log.Printf(level, "%s, delete chain err: %s, stdout: %s, stderr: %s",
+				prefix, err, infoO, strings.TrimSuffix(string(infoE), "\n"))
+		}
+	}
+
+	table := server.conf.Server.TransparentEgress.Table
+	rule := transparentRule(table)
+	rules, err := netlink.RuleListFiltered(netlink.FAMILY_V4, rule, netlink.RT_FILTER_MARK|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		log.Printf(level, "%s, list rules err: %s", prefix, err)
+	}
+	for range rules {
+		if err = netlink.RuleDel(rule); err != nil {
+			log.Printf(level, "%s, delete rule err: %s", prefix, err)
+			break
+		}
+	}
+	route, err := transparentRoute(table)
+	if err != nil {
+		log.Printf(level, "%s, get lo err: %s", prefix, err)
+		return
+	}
+	if err = netlink.RouteDel(route); err != nil && err != unix.ESRCH {
+		log.Printf(level, "%s, delete route err: %s", prefix, err)
+	}
+}
+
+func transparentRule(table int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = netlink.FAMILY_V4
+	rule.Mark = config.MarkTransparent
+	rule.Table = table
+	return rule
+}
+
+// local 0.0.0.0/0 dev lo table
+func transparentRoute(table int) (*netlink.Route, error) {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return nil, err
+	}
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	return &netlink.Route{
+		LinkIndex: lo.Attrs().Index,
+		Dst:       all,
+		Table:     table,
+		Type:      unix.RTN_LOCAL,
+		Scope:     netlink.SCOPE_HOST,
+	}, nil
+}
+
+func saveMangle() ([]string, error) {
+	infoO, infoE, err := utils.Cmd(iptablesSave, "-t", "mangle")
+	if err != nil {
+		log.Errorf("server save mangle, err: %s, stderr: %s", err, strings.TrimSuffix(string(infoE), "\n"))
+		return nil, err
+	}
+	return strings.Split(string(infoO), "\n"), nil
+}
+
+func countLines(snapshot []string, line string) int {
+	count := 0
+	for _, elem := range snapshot {
+		if elem == line {
+			count++
+		}
+	}
+	return count
+}
+
+func countPrefix(snapshot []string, prefix string) int {
+	count := 0
+	for _, elem := range snapshot {
+		if strings.HasPrefix(elem, prefix) {
+			count++
+		}
+	}
+	return count
+}
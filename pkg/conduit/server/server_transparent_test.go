@@ -0,0 +1,42 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTransparent(t *testing.T) {
+	Convey("transparent", t, func() {
+		conf := &config.Config{}
+		conf.Server.TransparentEgress = config.TransparentEgress{
+			Enable: true,
+			Dsts:   []string{"10.0.0.2:3306", "10.0.1.*"},
+		}
+		server := &Server{conf: conf}
+
+		Convey("dst as matched", func() {
+			So(server.transparentAddr("10.0.0.1", "10.0.0.2:3306"), ShouldResemble, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")})
+			So(server.transparentAddr("10.0.0.1", "10.0.1.2:3306"), ShouldNotBeNil)
+		})
+
+		Convey("dst as not matched, illegal or ipv6 src", func() {
+			So(server.transparentAddr("10.0.0.1", "10.0.0.2:80"), ShouldBeNil)
+			So(server.transparentAddr("", "10.0.0.2:3306"), ShouldBeNil)
+			So(server.transparentAddr("fd00::1", "10.0.0.2:3306"), ShouldBeNil)
+		})
+
+		Convey("disabled", func() {
+			conf.Server.TransparentEgress.Enable = false
+			So(server.transparentAddr("10.0.0.1", "10.0.0.2:3306"), ShouldBeNil)
+		})
+	})
+}
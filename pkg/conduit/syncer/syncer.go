@@ -2,21 +2,24 @@ package syncer
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/jumboframes/armorigo/log"
 	"github.com/moresec-io/conduit/pkg/conduit/config"
+	"github.com/moresec-io/conduit/pkg/conduit/metrics"
 	"github.com/moresec-io/conduit/pkg/conduit/repo"
+	gconfig "github.com/moresec-io/conduit/pkg/config"
 	"github.com/moresec-io/conduit/pkg/network"
 	"github.com/moresec-io/conduit/pkg/proto"
 	"github.com/moresec-io/conduit/pkg/utils"
 	"github.com/singchia/geminio"
 	gclient "github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/delegate"
 )
 
 const (
@@ -24,11 +27,29 @@ const (
 	SyncModeDown
 )
 
+var (
+	ErrConduitNotFound = errors.New("conduit not found")
+)
+
 type Syncer interface {
 	ReportServer(request *proto.ReportServerRequest) (*proto.ReportServerResponse, error)
 	ReportClient(request *proto.ReportClientRequest) (*proto.ReportClientResponse, error)
 	ReportNetworks() error
+	// server stops accepting, clients are told to pick other peers
+	ReportDraining() error
 	PullCluster() error
+	// conduits cached from manager
+	Cluster() []proto.Conduit
+	// the server conduit as manager reports, not cached
+	LookupConduit(machineID string) (*proto.Conduit, error)
+	// exclusions distributed by manager
+	Exclude() *gconfig.Exclude
+	// nets routed to us like pod cidrs, reported with local ips
+	SetIPNets(ipnets []net.IPNet)
+	// servers behind nat keeping sessions to us as the relay
+	SetReverses(machineIDs []string)
+	// certs of the server side from manager, swapped as manager rotates them
+	ServerTLS() *network.ReloadableTLS
 }
 
 func NewSyncer(conf *config.Config, repo repo.Repo, syncMode int) (Syncer, error) {
@@ -36,6 +57,7 @@ func NewSyncer(conf *config.Config, repo repo.Repo, syncMode int) (Syncer, error
 }
 
 type syncer struct {
+	*delegate.UnimplementedDelegate
 	machineid string
 	end       geminio.End
 	syncMode  int
@@ -44,17 +66,29 @@ type syncer struct {
 
 	mtx   sync.RWMutex
 	cache []proto.Conduit // key: machineid, value: conduits
-	// client certs
-	caPool     *x509.CertPool
-	clientCert *tls.Certificate
+	// exclusions from manager
+	exclude *gconfig.Exclude
+	// filters local ips reported
+	networks *gconfig.IPFilter
+	ipnets   []net.IPNet
+	// machine ids of servers with reverse sessions to us
+	reverses []string
+
+	// certs from manager
+	clientTLS *network.ReloadableTLS
+	serverTLS *network.ReloadableTLS
 }
 
 func newsyncer(conf *config.Config, repo repo.Repo, syncMode int) (*syncer, error) {
 	syncer := &syncer{
-		machineid: conf.MachineID,
-		cache:     []proto.Conduit{},
-		repo:      repo,
-		syncMode:  syncMode,
+		UnimplementedDelegate: &delegate.UnimplementedDelegate{},
+		machineid:             conf.MachineID,
+		networks:              &conf.Networks,
+		cache:                 []proto.Conduit{},
+		repo:                  repo,
+		syncMode:              syncMode,
+		clientTLS:             &network.ReloadableTLS{},
+		serverTLS:             &network.ReloadableTLS{},
 	}
 
 	// connect to manager
@@ -63,12 +97,15 @@ func newsyncer(conf *config.Config, repo repo.Repo, syncMode int) (*syncer, erro
 	}
 	opt := gclient.NewEndOptions()
 	opt.SetMeta([]byte(conf.MachineID))
+	opt.SetDelegate(syncer)
 	end, err := gclient.NewEndWithDialer(dialer, opt)
 	if err != nil {
 		log.Errorf("new syncer, geminio dial manager err: %s, sync mode: %d", err, syncMode)
+		metrics.SyncerConnected.With().Set(0)
 		return nil, err
 	}
 	syncer.end = end
+	metrics.SyncerConnected.With().Set(1)
 
 	// only downlink cares about other conduits online/offline
 	if syncMode&SyncModeDown != 0 {
@@ -87,6 +124,22 @@ func newsyncer(conf *config.Config, repo repo.Repo, syncMode int) (*syncer, erro
 			log.Errorf("new syncer, register sync conduit networks changed err: %s", err)
 			return nil, err
 		}
+		err = end.Register(context.TODO(), proto.RPCSyncConduitDraining, syncer.syncConduitDraining)
+		if err != nil {
+			log.Errorf("new syncer, register sync conduit draining err: %s", err)
+			return nil, err
+		}
+	}
+	// both sides take rotated certs
+	err = end.Register(context.TODO(), proto.RPCSyncTrustBundle, syncer.syncTrustBundle)
+	if err != nil {
+		log.Errorf("new syncer, register sync trust bundle err: %s", err)
+		return nil, err
+	}
+	err = end.Register(context.TODO(), proto.RPCSyncCertsRenewed, syncer.syncCertsRenewed)
+	if err != nil {
+		log.Errorf("new syncer, register sync certs renewed err: %s", err)
+		return nil, err
 	}
 
 	go syncer.sync()
@@ -116,6 +169,11 @@ func (syncer *syncer) ReportServer(request *proto.ReportServerRequest) (*proto.R
 		log.Errorf("syncer report server, json unmarshal response err: %s", err)
 		return nil, err
 	}
+	err = setTLS(syncer.serverTLS, response.TLS)
+	if err != nil {
+		log.Errorf("syncer report server, set tls err: %s", err)
+		return nil, err
+	}
 	return response, nil
 }
 
@@ -143,28 +201,104 @@ func (syncer *syncer) ReportClient(request *proto.ReportClientRequest) (*proto.R
 		log.Errorf("syncer report client, json unmarshal err: %s", err)
 		return nil, err
 	}
-	// der format to x509 certiface
-	x509cert, err := x509.ParseCertificate(response.TLS.CA)
+	// keep ca and client certificate
+	err = setTLS(syncer.clientTLS, response.TLS)
 	if err != nil {
-		log.Errorf("syncer report client, x509 parse certificate err: %s", err)
+		log.Errorf("syncer report client, set tls err: %s", err)
 		return nil, err
 	}
-	caPool := x509.NewCertPool()
-	caPool.AddCert(x509cert)
-	// keep ca
-	syncer.caPool = caPool
-	// keep client certificate, der format to rsa private key
-	privateKey, err := x509.ParsePKCS1PrivateKey(response.TLS.Key)
+	return response, nil
+}
+
+// der format cas, cert and key from manager
+func setTLS(rt *network.ReloadableTLS, tls *proto.TLS) error {
+	err := rt.SetCAs(tls.Bundle())
 	if err != nil {
-		log.Errorf("syncer report client, x509 parse pkcs #1 private key err: %s", err)
-		return nil, err
+		return err
+	}
+	return rt.SetCert(tls.Cert, tls.Key)
+}
+
+func (syncer *syncer) ServerTLS() *network.ReloadableTLS {
+	return syncer.serverTLS
+}
+
+// trust the next CA before certs signed by it show up
+func (syncer *syncer) syncTrustBundle(_ context.Context, req geminio.Request, rsp geminio.Response) {
+	request := &proto.SyncTrustBundleRequest{}
+	err := json.Unmarshal(req.Data(), request)
+	if err != nil {
+		log.Errorf("syncer sync trust bundle, json unmarshal err: %s", err)
+		rsp.SetError(err)
+		return
 	}
-	clientCert := &tls.Certificate{
-		Certificate: [][]byte{response.TLS.Cert},
-		PrivateKey:  privateKey,
+	for _, rt := range []*network.ReloadableTLS{syncer.clientTLS, syncer.serverTLS} {
+		if err = rt.SetCAs(request.CAs); err != nil {
+			log.Errorf("syncer sync trust bundle, set cas err: %s", err)
+			rsp.SetError(err)
+			return
+		}
 	}
-	syncer.clientCert = clientCert
-	return response, nil
+	log.Infof("syncer sync trust bundle, %d cas trusted", len(request.CAs))
+}
+
+// certs reissued by manager, pull them out of the call
+func (syncer *syncer) syncCertsRenewed(context.Context, geminio.Request, geminio.Response) {
+	go func() {
+		err := syncer.pullCerts()
+		if err != nil {
+			log.Errorf("syncer sync certs renewed, pull certs err: %s", err)
+		}
+	}()
+}
+
+func (syncer *syncer) pullCerts() error {
+	request := &proto.PullCertsRequest{
+		MachineID: syncer.machineid,
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req := syncer.end.NewRequest(data)
+	rsp, err := syncer.end.Call(context.TODO(), proto.RPCPullCerts, req)
+	if err != nil {
+		return err
+	}
+	if rsp.Error() != nil {
+		return rsp.Error()
+	}
+	response := &proto.PullCertsResponse{}
+	err = json.Unmarshal(rsp.Data(), response)
+	if err != nil {
+		return err
+	}
+	if response.Client != nil {
+		if err = setTLS(syncer.clientTLS, response.Client); err != nil {
+			return err
+		}
+	}
+	if response.Server != nil {
+		if err = setTLS(syncer.serverTLS, response.Server); err != nil {
+			return err
+		}
+	}
+	log.Infof("syncer pull certs, certs renewed")
+	return nil
+}
+
+// connection to manager
+func (syncer *syncer) ConnOnline(delegate.ConnDescriber) error {
+	metrics.SyncerConnected.With().Set(1)
+	metrics.SyncerStateChanges.With("online").Inc()
+	return nil
+}
+
+func (syncer *syncer) ConnOffline(delegate.ConnDescriber) error {
+	log.Warnf("syncer conn to manager offline")
+	metrics.SyncerConnected.With().Set(0)
+	metrics.SyncerStateChanges.With("offline").Inc()
+	return nil
 }
 
 // client only
@@ -182,32 +316,41 @@ func (syncer *syncer) syncConduitOnline(_ context.Context, req geminio.Request,
 	conduit := request.Conduit
 	syncer.mtx.Lock()
 	defer syncer.mtx.Unlock()
+	// online again after draining
+	syncer.repo.SetPeerDraining(conduit.Addr, false)
 
-	for _, elem := range syncer.cache {
+	for i := range syncer.cache {
+		elem := &syncer.cache[i]
 		if elem.MachineID == conduit.MachineID {
 			// found and unchanged
-			ok := compareConduit(&elem, conduit)
+			ok := compareConduit(elem, conduit)
 			if ok {
 				log.Infof("syncer conduit online, conduit: %s unchanged", conduit.MachineID)
 				return
 			}
 			// del ips
-			syncer.delResources(elem.IPs)
+			syncer.delResources(elem.IPs, elem.IPNets)
 			log.Infof("syncer conduit online, conduit: %s deleted ips: %v", conduit.MachineID, elem.IPs)
 			// add new ips
+			elem.Network = conduit.Network
+			elem.Addr = conduit.Addr
 			elem.IPs = conduit.IPs
-			syncer.addResources(conduit.Network, conduit.Addr, elem.IPs)
+			elem.IPNets = conduit.IPNets
+			elem.Route = conduit.Route
+			syncer.addResources(elem)
 			log.Infof("syncer conduit online, conduit: %s add ips: %v success", conduit.MachineID, elem.IPs)
 			return
 		}
 	}
 	// add new conduit
-	syncer.addResources(conduit.Network, conduit.Addr, conduit.IPs)
+	syncer.addResources(conduit)
 	syncer.cache = append(syncer.cache, proto.Conduit{
 		MachineID: conduit.MachineID,
 		Network:   conduit.Network,
 		Addr:      conduit.Addr,
 		IPs:       conduit.IPs,
+		IPNets:    conduit.IPNets,
+		Route:     conduit.Route,
 	})
 	log.Infof("syncer conduit online, add new conduit: %s, addr: %s, ips: %v success", conduit.MachineID, conduit.Addr, conduit.IPs)
 }
@@ -246,18 +389,46 @@ func (syncer *syncer) syncConduitNetworksChanged(_ context.Context, req geminio.
 	syncer.mtx.Lock()
 	defer syncer.mtx.Unlock()
 
-	for _, conduit := range syncer.cache {
+	for i := range syncer.cache {
+		conduit := &syncer.cache[i]
 		if conduit.MachineID == request.MachineID {
 			// del old ips
-			syncer.delResources(conduit.IPs)
+			syncer.delResources(conduit.IPs, conduit.IPNets)
 			// add new ips
 			conduit.IPs = request.IPs
-			syncer.addResources(conduit.Network, conduit.Addr, conduit.IPs)
+			conduit.IPNets = request.IPNets
+			syncer.addResources(conduit)
 			break
 		}
 	}
 }
 
+// client only
+func (syncer *syncer) syncConduitDraining(_ context.Context, req geminio.Request, rsp geminio.Response) {
+	data := req.Data()
+	request := &proto.SyncConduitDrainingRequest{}
+	err := json.Unmarshal(data, request)
+	if err != nil {
+		rsp.SetError(err)
+		return
+	}
+
+	log.Debugf("syncer sync conduit draining, response: %v", string(data))
+	syncer.mtx.Lock()
+	defer syncer.mtx.Unlock()
+
+	for i := range syncer.cache {
+		conduit := &syncer.cache[i]
+		if conduit.MachineID == request.MachineID {
+			conduit.Draining = true
+			syncer.repo.SetPeerDraining(conduit.Addr, true)
+			log.Infof("syncer sync conduit draining, conduit: %s, addr: %s", conduit.MachineID, conduit.Addr)
+			return
+		}
+	}
+	log.Warnf("syncer sync conduit draining, conduit: %s not found", request.MachineID)
+}
+
 func (syncer *syncer) sync() {
 	ticker := time.NewTicker(60 * time.Second)
 	for {
@@ -272,6 +443,10 @@ func (syncer *syncer) syncOnce() {
 		if err != nil {
 			log.Errorf("syncer sync, report agent err: %s", err)
 		}
+		err = syncer.reportReverses()
+		if err != nil {
+			log.Errorf("syncer sync, report reverses err: %s", err)
+		}
 	}
 	if syncer.syncMode&SyncModeDown != 0 {
 		err := syncer.PullCluster()
@@ -285,13 +460,17 @@ func (syncer *syncer) syncOnce() {
 func (syncer *syncer) ReportNetworks() error {
 	// conduit network
 	// currently we ignore networks
-	networks, err := network.ListIPs()
+	networks, err := network.ListIPs(syncer.networks)
 	if err != nil {
 		return err
 	}
+	syncer.mtx.RLock()
+	ipnets := syncer.ipnets
+	syncer.mtx.RUnlock()
 	request := &proto.ReportNetworksRequest{
 		MachineID: syncer.machineid,
 		IPs:       networks,
+		IPNets:    ipnets,
 	}
 	data, err := json.Marshal(request)
 	if err != nil {
@@ -308,6 +487,48 @@ func (syncer *syncer) ReportNetworks() error {
 	return nil
 }
 
+// server report draining to manager
+func (syncer *syncer) ReportDraining() error {
+	request := &proto.ReportDrainingRequest{
+		MachineID: syncer.machineid,
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req := syncer.end.NewRequest(data)
+	rsp, err := syncer.end.Call(context.TODO(), proto.RPCReportDraining, req)
+	if err != nil {
+		return err
+	}
+	return rsp.Error()
+}
+
+// relay report servers with reverse sessions to manager
+func (syncer *syncer) reportReverses() error {
+	syncer.mtx.RLock()
+	reverses := syncer.reverses
+	syncer.mtx.RUnlock()
+	if reverses == nil {
+		// never set, not a relay
+		return nil
+	}
+	request := &proto.ReportReversesRequest{
+		MachineID: syncer.machineid,
+		Reverses:  reverses,
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req := syncer.end.NewRequest(data)
+	rsp, err := syncer.end.Call(context.TODO(), proto.RPCReportReverses, req)
+	if err != nil {
+		return err
+	}
+	return rsp.Error()
+}
+
 // client pull cluster
 func (syncer *syncer) PullCluster() error {
 	request := &proto.PullClusterRequest{
@@ -338,23 +559,114 @@ func (syncer *syncer) PullCluster() error {
 	removes, adds := compareConduits(syncer.cache, response.Cluster)
 	// replace all
 	syncer.cache = response.Cluster
+	syncer.exclude = response.Exclude
 	// updates
 	for _, remove := range removes {
-		log.Debugf("syncer pull cluster, del conduit: %s, ips: %s", remove.MachineID, utils.IPs(remove.IPs))
-		syncer.delResources(remove.IPs)
+		log.Debugf("syncer pull cluster, del conduit: %s, ips: %s, ipnets: %s",
+			remove.MachineID, utils.IPs(remove.IPs), utils.IPNets(remove.IPNets))
+		syncer.delResources(remove.IPs, remove.IPNets)
+	}
+	for i := range adds {
+		add := &adds[i]
+		log.Debugf("syncer pull cluster, add conduit: %s, ip: %s, ipnets: %s, route: %v",
+			add.MachineID, utils.IPs(add.IPs), utils.IPNets(add.IPNets), add.Route)
+		syncer.addResources(add)
+	}
+	for _, remove := range removes {
+		syncer.repo.SetPeerDraining(remove.Addr, false)
 	}
-	for _, add := range adds {
-		log.Debugf("syncer pull cluster, add conduit: %s, ip: %s", add.MachineID, utils.IPs(add.IPs))
-		syncer.addResources(add.Network, add.Addr, add.IPs)
+	for _, conduit := range syncer.cache {
+		syncer.repo.SetPeerDraining(conduit.Addr, conduit.Draining)
 	}
 	return nil
 }
 
+func (syncer *syncer) LookupConduit(machineID string) (*proto.Conduit, error) {
+	request := &proto.PullClusterRequest{
+		MachineID: syncer.machineid,
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req := syncer.end.NewRequest(data)
+	rsp, err := syncer.end.Call(context.TODO(), proto.RPCPullCluster, req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Error() != nil {
+		return nil, rsp.Error()
+	}
+	response := &proto.PullClusterResponse{}
+	err = json.Unmarshal(rsp.Data(), response)
+	if err != nil {
+		return nil, err
+	}
+	for i := range response.Cluster {
+		if response.Cluster[i].MachineID == machineID {
+			return &response.Cluster[i], nil
+		}
+	}
+	return nil, ErrConduitNotFound
+}
+
+func (syncer *syncer) Cluster() []proto.Conduit {
+	syncer.mtx.RLock()
+	defer syncer.mtx.RUnlock()
+
+	cluster := make([]proto.Conduit, len(syncer.cache))
+	copy(cluster, syncer.cache)
+	return cluster
+}
+
+func (syncer *syncer) Exclude() *gconfig.Exclude {
+	syncer.mtx.RLock()
+	defer syncer.mtx.RUnlock()
+
+	return syncer.exclude
+}
+
+// report at once if changed, the server side only
+func (syncer *syncer) SetIPNets(ipnets []net.IPNet) {
+	syncer.mtx.Lock()
+	changed := !utils.CompareIPNets(syncer.ipnets, ipnets)
+	syncer.ipnets = ipnets
+	syncer.mtx.Unlock()
+
+	if !changed || syncer.syncMode&SyncModeUp == 0 {
+		return
+	}
+	err := syncer.ReportNetworks()
+	if err != nil {
+		log.Errorf("syncer set ipnets, report networks err: %s", err)
+	}
+}
+
+// report at once if changed, the relay side only
+func (syncer *syncer) SetReverses(machineIDs []string) {
+	if machineIDs == nil {
+		machineIDs = []string{}
+	}
+	syncer.mtx.Lock()
+	changed := syncer.reverses == nil || strings.Join(syncer.reverses, ",") != strings.Join(machineIDs, ",")
+	syncer.reverses = machineIDs
+	syncer.mtx.Unlock()
+
+	if !changed || syncer.syncMode&SyncModeUp == 0 {
+		return
+	}
+	err := syncer.reportReverses()
+	if err != nil {
+		log.Errorf("syncer set reverses, report reverses err: %s", err)
+	}
+}
+
 func (syncer *syncer) delConduit(machineID string) bool {
 	for i, elem := range syncer.cache {
 		if elem.MachineID == machineID {
 			// del resources
-			syncer.delResources(elem.IPs)
+			syncer.delResources(elem.IPs, elem.IPNets)
+			syncer.repo.SetPeerDraining(elem.Addr, false)
 			// del cache
 			syncer.cache = append(syncer.cache[:i], syncer.cache[i+1:]...)
 			log.Infof("syncer delete conduit, del conduit: %s success", machineID)
@@ -364,7 +676,15 @@ func (syncer *syncer) delConduit(machineID string) bool {
 	return false
 }
 
-func (syncer *syncer) delResources(ips []net.IP) {
+func (syncer *syncer) delResources(ips []net.IP, ipnets []net.IPNet) {
+	for i := range ipnets {
+		ipnet := &ipnets[i]
+		syncer.repo.DelNetPolicy(ipnet)
+		err := syncer.repo.DelIPSetNet(ipnet)
+		if err != nil {
+			log.Errorf("syncer offline conduit, del net ipset err: %s", err)
+		}
+	}
 	for _, ip := range ips {
 		// del policy
 		syncer.repo.DelIPPolicy(ip.String())
@@ -377,22 +697,38 @@ func (syncer *syncer) delResources(ips []net.IP) {
 	}
 }
 
-func (syncer *syncer) addResources(networktype, addr string, ips []net.IP) {
+// policies to the conduit, dialed at the first relay if routed
+func (syncer *syncer) addResources(conduit *proto.Conduit) {
+	ips, ipnets := conduit.IPs, conduit.IPNets
+	addr, route := conduit.Addr, []string(nil)
+	if len(conduit.Route) != 0 {
+		addr = conduit.Route[0]
+		route = append(append(route, conduit.Route[1:]...), conduit.Addr)
+	}
+	policy := &repo.Policy{
+		Route: route,
+		PeerDialConfig: &network.DialConfig{
+			Netwotk: conduit.Network,
+			Addrs:   []string{addr},
+			TLS: &network.TLS{
+				Enable:             true,
+				MTLS:               true,
+				InsecureSkipVerify: false,
+				Reloadable:         syncer.clientTLS,
+			},
+		},
+	}
+	for i := range ipnets {
+		ipnet := &ipnets[i]
+		syncer.repo.AddNetPolicy(ipnet, policy)
+		err := syncer.repo.AddIPSetNet(ipnet)
+		if err != nil {
+			log.Errorf("syncer pull cluster, add net ipset err: %s", err)
+		}
+	}
 	for _, ip := range ips {
 		// add policy
-		syncer.repo.AddIPPolicy(ip.String(), &repo.Policy{
-			PeerDialConfig: &network.DialConfig{
-				Netwotk: networktype,
-				Addrs:   []string{addr},
-				TLS: &network.TLS{
-					Enable:             true,
-					MTLS:               true,
-					CAPool:             syncer.caPool,
-					Certs:              []tls.Certificate{*syncer.clientCert},
-					InsecureSkipVerify: false,
-				},
-			},
-		})
+		syncer.repo.AddIPPolicy(ip.String(), policy)
 		// add ipset
 		err := syncer.repo.AddIPSetIP(ip)
 		if err != nil {
@@ -440,7 +776,9 @@ func compareConduit(old, new *proto.Conduit) bool {
 	if old.MachineID != new.MachineID ||
 		old.Addr != new.Addr ||
 		old.Network != new.Network ||
-		!utils.CompareNets(old.IPs, new.IPs) {
+		!utils.CompareNets(old.IPs, new.IPs) ||
+		!utils.CompareIPNets(old.IPNets, new.IPNets) ||
+		strings.Join(old.Route, ",") != strings.Join(new.Route, ",") {
 		return false
 	}
 	return true
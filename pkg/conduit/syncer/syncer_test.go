@@ -166,5 +166,28 @@ func TestCompareConduits(t *testing.T) {
 				So(len(adds), ShouldEqual, 0)
 			})
 		})
+
+		Convey("compare 2 route different conduits", func() {
+			old := []proto.Conduit{
+				{
+					MachineID: "1",
+					Network:   "tcp",
+					Addr:      "192.168.0.1:443",
+				},
+			}
+			new := []proto.Conduit{
+				{
+					MachineID: "1",
+					Network:   "tcp",
+					Addr:      "192.168.0.1:443",
+					Route:     []string{"10.0.0.1:443"},
+				},
+			}
+			removes, adds := compareConduits(old, new)
+			Convey("result", func() {
+				So(len(removes), ShouldEqual, 1)
+				So(len(adds), ShouldEqual, 1)
+			})
+		})
 	})
 }
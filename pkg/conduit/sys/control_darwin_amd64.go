@@ -10,8 +10,15 @@
 
 package sys
 
-import "syscall"
+import (
+	"errors"
+	"syscall"
+)
 
 func Control(network, address string, conn syscall.RawConn) error {
 	return nil
 }
+
+func TransparentControl(network, address string, conn syscall.RawConn) error {
+	return errors.New("transparent unsupported")
+}
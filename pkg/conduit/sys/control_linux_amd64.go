@@ -40,3 +40,24 @@ func Control(network, address string, conn syscall.RawConn) error {
 	}
 	return nil
 }
+
+// TransparentControl allows binding the client's ip which isn't local,
+// marked like Control
+func TransparentControl(network, address string, conn syscall.RawConn) error {
+	err := Control(network, address, conn)
+	if err != nil {
+		return err
+	}
+	var operr error
+	err = conn.Control(func(fd uintptr) {
+		operr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if operr != nil {
+		log.Errorf("transparent control | set sock opt err: %s", operr)
+		return operr
+	}
+	return nil
+}
@@ -25,3 +25,21 @@ type Dial struct {
 	Addresses []string `yaml:"addresses" json:"addresses"`
 	TLS       *TLS     `yaml:"tls,omitempty" json:"tls"`
 }
+
+// traffic matched is not intercepted
+type Exclude struct {
+	Sources      []string `yaml:"sources" json:"sources,omitempty"`           // ips or cidrs
+	Destinations []string `yaml:"destinations" json:"destinations,omitempty"` // ips or cidrs
+	UIDs         []int    `yaml:"uids" json:"uids,omitempty"`                 // owners of local processes
+	GIDs         []int    `yaml:"gids" json:"gids,omitempty"`
+	Cgroups      []string `yaml:"cgroups" json:"cgroups,omitempty"` // cgroup v2 paths of local processes
+}
+
+// filters the local ips reported, interfaces are names or prefixes ending
+// with + like iptables, scopes are global, site, link, host or nowhere
+type IPFilter struct {
+	IncludeInterfaces []string `yaml:"include_interfaces" json:"include_interfaces,omitempty"` // empty for all but bridges
+	ExcludeInterfaces []string `yaml:"exclude_interfaces" json:"exclude_interfaces,omitempty"`
+	IncludeScopes     []string `yaml:"include_scopes" json:"include_scopes,omitempty"` // empty for all
+	ExcludeScopes     []string `yaml:"exclude_scopes" json:"exclude_scopes,omitempty"`
+}
@@ -0,0 +1,180 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package ctl
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/utils"
+)
+
+var (
+	ErrIllegalPEM = errors.New("illegal pem certificate")
+)
+
+const (
+	UsageServer = "server"
+	UsageClient = "client"
+	UsageAny    = "any"
+)
+
+// CertInfo is a cert returned by manager or parsed locally
+type CertInfo struct {
+	ID        uint64    `json:"id,omitempty"`
+	SAN       string    `json:"san"`
+	SPIFFEID  string    `json:"spiffe_id,omitempty"`
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	PEM       string    `json:"pem,omitempty"`
+}
+
+func NewCertInfo(x509cert *x509.Certificate) *CertInfo {
+	info := &CertInfo{
+		Serial:    utils.FormatSerial(x509cert.SerialNumber),
+		Subject:   x509cert.Subject.String(),
+		Issuer:    x509cert.Issuer.String(),
+		NotBefore: x509cert.NotBefore,
+		NotAfter:  x509cert.NotAfter,
+	}
+	if len(x509cert.IPAddresses) != 0 {
+		info.SAN = x509cert.IPAddresses[0].String()
+	}
+	if id, err := utils.CertSPIFFEID(x509cert); err == nil {
+		info.SPIFFEID = id.String()
+	}
+	return info
+}
+
+func (ctl *Ctl) printCert(cert *CertInfo) error {
+	kvs := [][2]string{}
+	if cert.ID != 0 {
+		kvs = append(kvs, [2]string{"id", strconv.FormatUint(cert.ID, 10)})
+	}
+	kvs = append(kvs,
+		[2]string{"san", formatOr(cert.SAN, "-")},
+		[2]string{"spiffe id", formatOr(cert.SPIFFEID, "-")},
+		[2]string{"serial", cert.Serial},
+		[2]string{"subject", cert.Subject},
+		[2]string{"issuer", cert.Issuer},
+		[2]string{"not before", formatTime(cert.NotBefore)},
+		[2]string{"not after", formatTime(cert.NotAfter)},
+	)
+	return ctl.printKV(cert, kvs)
+}
+
+func parseCert(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, ErrIllegalPEM
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readCert(file string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseCert(data)
+}
+
+// Verify verifies a local cert against the CA in manager
+func (ctl *Ctl) Verify(args []string) error {
+	var usage string
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.StringVar(&usage, "usage", UsageAny, "expected usage, server, client or any")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return ErrIllegalArgs
+	}
+	cert, err := readCert(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cas, err := ctl.clusterCAs()
+	if err != nil {
+		return err
+	}
+	// the next CA is in the bundle too while rotating
+	for _, ca := range cas {
+		if err = VerifyCert(cert, ca, usage); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+	fmt.Fprintln(ctl.out, "certificate verified against the cluster CA")
+	return nil
+}
+
+func VerifyCert(cert, ca *x509.Certificate, usage string) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	opts := x509.VerifyOptions{Roots: roots}
+	switch usage {
+	case UsageServer:
+		opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case UsageClient:
+		opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	case UsageAny:
+		opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	default:
+		return fmt.Errorf("%w: usage %s", ErrIllegalArgs, usage)
+	}
+	_, err := cert.Verify(opts)
+	return err
+}
+
+func (ctl *Ctl) clusterCAs() ([]*x509.Certificate, error) {
+	rsp, err := ctl.http.Get(ctl.managerURL("/v1/trustbundle?format=pem"))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get trust bundle: %d %s", rsp.StatusCode, http.StatusText(rsp.StatusCode))
+	}
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	cas := []*x509.Certificate{}
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, ErrIllegalPEM
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, ca)
+		data = rest
+	}
+	if len(cas) == 0 {
+		return nil, ErrIllegalPEM
+	}
+	return cas, nil
+}
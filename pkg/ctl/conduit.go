@@ -0,0 +1,118 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package ctl
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/conduit/admin"
+	"github.com/moresec-io/conduit/pkg/conduit/flow"
+	"github.com/moresec-io/conduit/pkg/proto"
+)
+
+func (ctl *Ctl) Status() error {
+	status := &admin.Status{}
+	if err := ctl.do(ctl.admin, http.MethodGet, ctl.adminURL("/v1/status"), nil, status); err != nil {
+		return err
+	}
+	return ctl.printKV(status, [][2]string{
+		{"machine id", status.MachineID},
+		{"client", formatBool(status.Client)},
+		{"server", formatBool(status.Server)},
+		{"manager", formatBool(status.Manager)},
+		{"flows", strconv.Itoa(status.Flows)},
+		{"cluster", strconv.Itoa(status.Cluster)},
+	})
+}
+
+func (ctl *Ctl) Flows() error {
+	flows := []*flow.Flow{}
+	if err := ctl.do(ctl.admin, http.MethodGet, ctl.adminURL("/v1/flows"), nil, &flows); err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, f := range flows {
+		rows = append(rows, []string{
+			strconv.FormatUint(f.ID, 10), f.Side, f.Src, f.Dst, f.DstAs,
+			formatOr(f.Policy, "-"), f.Peer,
+			(time.Duration(f.Age) * time.Second).String(),
+			formatBytes(f.BytesSent), formatBytes(f.BytesRecv),
+		})
+	}
+	return ctl.print(flows, []string{"ID", "SIDE", "SRC", "DST", "DST AS", "POLICY", "PEER", "AGE", "SENT", "RECEIVED"}, rows)
+}
+
+func (ctl *Ctl) KillFlow(id string) error {
+	return ctl.do(ctl.admin, http.MethodDelete, ctl.adminURL("/v1/flows/"+id), nil, nil)
+}
+
+func (ctl *Ctl) Reload() error {
+	return ctl.do(ctl.admin, http.MethodPost, ctl.adminURL("/v1/reload"), nil, nil)
+}
+
+func (ctl *Ctl) Policies() error {
+	policies := []*admin.Policy{}
+	if err := ctl.do(ctl.admin, http.MethodGet, ctl.adminURL("/v1/policies"), nil, &policies); err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, policy := range policies {
+		rows = append(rows, []string{
+			policy.Type, policy.Match, formatOr(policy.DstAs, "-"), policy.Network,
+			strings.Join(policy.Peers, ","), formatBool(policy.TLS), formatBool(policy.MTLS),
+		})
+	}
+	return ctl.print(policies, []string{"TYPE", "MATCH", "DST AS", "NETWORK", "PEERS", "TLS", "MTLS"}, rows)
+}
+
+func (ctl *Ctl) Peers() error {
+	peers := []*admin.Peer{}
+	if err := ctl.do(ctl.admin, http.MethodGet, ctl.adminURL("/v1/peers"), nil, &peers); err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, peer := range peers {
+		rows = append(rows, []string{
+			strconv.Itoa(peer.Index), peer.Network, strings.Join(peer.Addresses, ","),
+			formatBool(peer.TLS), formatBool(peer.MTLS),
+		})
+	}
+	return ctl.print(peers, []string{"INDEX", "NETWORK", "ADDRESSES", "TLS", "MTLS"}, rows)
+}
+
+func (ctl *Ctl) IPSets() error {
+	ipsets := []*admin.IPSet{}
+	if err := ctl.do(ctl.admin, http.MethodGet, ctl.adminURL("/v1/ipsets"), nil, &ipsets); err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, ipset := range ipsets {
+		if ipset.Error != "" {
+			rows = append(rows, []string{ipset.Name, "error: " + ipset.Error})
+			continue
+		}
+		for _, entry := range ipset.Entries {
+			rows = append(rows, []string{ipset.Name, entry})
+		}
+	}
+	return ctl.print(ipsets, []string{"SET", "ENTRY"}, rows)
+}
+
+func (ctl *Ctl) ClusterCache() error {
+	cluster := []proto.Conduit{}
+	if err := ctl.do(ctl.admin, http.MethodGet, ctl.adminURL("/v1/cluster"), nil, &cluster); err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, conduit := range cluster {
+		rows = append(rows, []string{conduit.MachineID, conduit.Network, conduit.Addr, formatIPs(conduit.IPs)})
+	}
+	return ctl.print(cluster, []string{"MACHINE ID", "NETWORK", "ADDR", "IPS"}, rows)
+}
@@ -0,0 +1,219 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+// Package ctl implements conduitctl, it talks to the conduit admin socket
+// and the manager control plane.
+package ctl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/conduit/config"
+	mconfig "github.com/moresec-io/conduit/pkg/manager/config"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrIllegalArgs    = errors.New("illegal args")
+)
+
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+
+	DefaultManager = "http://127.0.0.1:5052"
+
+	usage = `usage: conduitctl [flags] <command> [args]
+
+conduit commands, through the admin socket:
+  status                          conduit status
+  flows                           active flows
+  flows kill <id>                 kill a flow
+  policies                        forwarding policies
+  peers                           static peers
+  ipsets                          ipset entries
+  cluster-cache                   cluster cached from manager
+  reload                          reload forward table and peers
+
+manager commands, through the control plane:
+  cluster                         registered conduits
+  cluster get <machine_id>        a conduit in detail
+  cert list                       server certs
+  cert issue -machine-id <id> -san <ip> [-renew]
+                                  issue a server cert, requires the token
+  cert revoke <san>               revoke and delete a server cert, requires the token
+  cert inspect <san>              a server cert in detail
+  cert inspect -f <pem>           a local cert in detail
+  verify [-usage server|client] <pem>
+                                  verify a local cert against the cluster CA
+
+flags:
+`
+)
+
+type Ctl struct {
+	socket  string
+	manager string
+	token   string
+	output  string
+	out     io.Writer
+
+	admin *http.Client
+	http  *http.Client
+}
+
+func Run(args []string) error {
+	ctl := &Ctl{out: os.Stdout}
+	fs := flag.NewFlagSet("conduitctl", flag.ContinueOnError)
+	fs.StringVar(&ctl.socket, "socket", config.DefaultAdminSocket, "conduit admin socket")
+	fs.StringVar(&ctl.manager, "manager", DefaultManager, "manager control plane url")
+	fs.StringVar(&ctl.token, "token", os.Getenv(mconfig.EnvControlPlaneToken),
+		"manager control plane token, default env "+mconfig.EnvControlPlaneToken)
+	fs.StringVar(&ctl.output, "o", OutputTable, "output format, table or json")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if ctl.output != OutputTable && ctl.output != OutputJSON {
+		return fmt.Errorf("%w: output %s", ErrIllegalArgs, ctl.output)
+	}
+	ctl.manager = strings.TrimSuffix(ctl.manager, "/")
+	ctl.admin = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				dialer := net.Dialer{}
+				return dialer.DialContext(ctx, "unix", ctl.socket)
+			},
+		},
+	}
+	ctl.http = &http.Client{Timeout: 10 * time.Second}
+
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return ErrIllegalArgs
+	}
+	return ctl.run(args[0], args[1:])
+}
+
+func (ctl *Ctl) run(command string, args []string) error {
+	switch command {
+	case "status":
+		return ctl.Status()
+	case "flows":
+		if len(args) == 2 && args[0] == "kill" {
+			return ctl.KillFlow(args[1])
+		}
+		return ctl.Flows()
+	case "policies":
+		return ctl.Policies()
+	case "peers":
+		return ctl.Peers()
+	case "ipsets":
+		return ctl.IPSets()
+	case "cluster-cache":
+		return ctl.ClusterCache()
+	case "reload":
+		return ctl.Reload()
+	case "cluster":
+		if len(args) == 2 && args[0] == "get" {
+			return ctl.ClusterNode(args[1])
+		}
+		return ctl.Cluster()
+	case "cert":
+		if len(args) == 0 {
+			return ErrIllegalArgs
+		}
+		switch args[0] {
+		case "list":
+			return ctl.CertList()
+		case "issue":
+			return ctl.CertIssue(args[1:])
+		case "revoke":
+			if len(args) != 2 {
+				return ErrIllegalArgs
+			}
+			return ctl.CertRevoke(args[1])
+		case "inspect":
+			return ctl.CertInspect(args[1:])
+		}
+	case "verify":
+		return ctl.Verify(args)
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownCommand, command)
+}
+
+// admin api over unix socket, the host is ignored
+func (ctl *Ctl) adminURL(path string) string {
+	return "http://conduit" + path
+}
+
+func (ctl *Ctl) managerURL(path string) string {
+	return ctl.manager + path
+}
+
+// do sends the request and decodes json response into v if not nil
+func (ctl *Ctl) do(client *http.Client, method, url string, body, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client == ctl.http && ctl.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ctl.token)
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode/100 != 2 {
+		msg := strings.TrimSpace(string(data))
+		errRsp := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(data, &errRsp) == nil && errRsp.Error != "" {
+			msg = errRsp.Error
+		}
+		if msg == "" {
+			msg = http.StatusText(rsp.StatusCode)
+		}
+		return fmt.Errorf("%s %s: %d %s", method, url, rsp.StatusCode, msg)
+	}
+	if v == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,97 @@
+package ctl
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newCert(template, parent *x509.Certificate, key, parentKey *rsa.PrivateKey) *x509.Certificate {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+	return cert
+}
+
+func TestVerifyCert(t *testing.T) {
+	Convey("verify cert", t, func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		So(err, ShouldBeNil)
+		now := time.Now()
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "ca"},
+			NotBefore:             now,
+			NotAfter:              now.Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		ca := newCert(template, template, key, key)
+		client := newCert(&x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			NotBefore:    now,
+			NotAfter:     now.Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, key, key)
+
+		So(VerifyCert(client, ca, UsageClient), ShouldBeNil)
+		So(VerifyCert(client, ca, UsageAny), ShouldBeNil)
+		So(VerifyCert(client, ca, UsageServer), ShouldNotBeNil)
+		So(VerifyCert(ca, client, UsageAny), ShouldNotBeNil)
+	})
+}
+
+func TestCluster(t *testing.T) {
+	Convey("cluster", t, func() {
+		manager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1/cluster":
+				w.Write([]byte(`[{"machine_id":"m1","client":true,"server":true,"remote":"10.0.0.1:40000","addr":"10.0.0.1:5053","ips":["10.0.0.1"]}]`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer manager.Close()
+		out := &bytes.Buffer{}
+		ctl := &Ctl{manager: manager.URL, output: OutputTable, out: out, http: manager.Client()}
+
+		So(ctl.Cluster(), ShouldBeNil)
+		So(out.String(), ShouldEqual, `MACHINE ID  ROLES          REMOTE          ADDR           IPS
+m1          client,server  10.0.0.1:40000  10.0.0.1:5053  10.0.0.1
+`)
+		So(ctl.ClusterNode("m2"), ShouldNotBeNil)
+	})
+}
+
+func TestCertRevoke(t *testing.T) {
+	Convey("cert revoke", t, func() {
+		manager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.Method != http.MethodDelete || r.URL.Path != "/v1/certs/10.0.0.1" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer manager.Close()
+		ctl := &Ctl{manager: manager.URL, output: OutputTable, out: &bytes.Buffer{}, http: manager.Client()}
+
+		So(ctl.CertRevoke("10.0.0.1"), ShouldNotBeNil)
+		ctl.token = "secret"
+		So(ctl.CertRevoke("10.0.0.1"), ShouldBeNil)
+	})
+}
@@ -0,0 +1,126 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package ctl
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/moresec-io/conduit/pkg/manager/service"
+)
+
+func (ctl *Ctl) Cluster() error {
+	conduits := []*service.ConduitInfo{}
+	if err := ctl.do(ctl.http, http.MethodGet, ctl.managerURL("/v1/cluster"), nil, &conduits); err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, conduit := range conduits {
+		rows = append(rows, []string{
+			conduit.MachineID, roles(conduit), conduit.Remote,
+			formatOr(conduit.Addr, "-"), formatOr(formatIPs(conduit.IPs), "-"),
+		})
+	}
+	return ctl.print(conduits, []string{"MACHINE ID", "ROLES", "REMOTE", "ADDR", "IPS"}, rows)
+}
+
+func (ctl *Ctl) ClusterNode(machineID string) error {
+	conduit := &service.ConduitInfo{}
+	err := ctl.do(ctl.http, http.MethodGet, ctl.managerURL("/v1/cluster/"+url.PathEscape(machineID)), nil, conduit)
+	if err != nil {
+		return err
+	}
+	return ctl.printKV(conduit, [][2]string{
+		{"machine id", conduit.MachineID},
+		{"roles", roles(conduit)},
+		{"remote", conduit.Remote},
+		{"network", formatOr(conduit.Network, "-")},
+		{"addr", formatOr(conduit.Addr, "-")},
+		{"ips", formatOr(formatIPs(conduit.IPs), "-")},
+	})
+}
+
+func roles(conduit *service.ConduitInfo) string {
+	roles := []string{}
+	if conduit.Client {
+		roles = append(roles, "client")
+	}
+	if conduit.Server {
+		roles = append(roles, "server")
+	}
+	if conduit.Draining {
+		roles = append(roles, "draining")
+	}
+	return formatOr(strings.Join(roles, ","), "-")
+}
+
+func (ctl *Ctl) CertList() error {
+	certs := []*CertInfo{}
+	if err := ctl.do(ctl.http, http.MethodGet, ctl.managerURL("/v1/certs"), nil, &certs); err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, cert := range certs {
+		rows = append(rows, []string{
+			strconv.FormatUint(cert.ID, 10), cert.SAN, formatOr(cert.SPIFFEID, "-"),
+			cert.Serial, formatTime(cert.NotAfter),
+		})
+	}
+	return ctl.print(certs, []string{"ID", "SAN", "SPIFFE ID", "SERIAL", "NOT AFTER"}, rows)
+}
+
+func (ctl *Ctl) CertIssue(args []string) error {
+	req := struct {
+		MachineID string `json:"machine_id"`
+		SAN       string `json:"san"`
+		Renew     bool   `json:"renew"`
+	}{}
+	fs := flag.NewFlagSet("cert issue", flag.ContinueOnError)
+	fs.StringVar(&req.MachineID, "machine-id", "", "machine id of the server conduit")
+	fs.StringVar(&req.SAN, "san", "", "ip of the server conduit")
+	fs.BoolVar(&req.Renew, "renew", false, "reissue even if the cert exists")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cert := &CertInfo{}
+	if err := ctl.do(ctl.http, http.MethodPost, ctl.managerURL("/v1/certs"), &req, cert); err != nil {
+		return err
+	}
+	return ctl.printCert(cert)
+}
+
+func (ctl *Ctl) CertRevoke(san string) error {
+	return ctl.do(ctl.http, http.MethodDelete, ctl.managerURL("/v1/certs/"+url.PathEscape(san)), nil, nil)
+}
+
+func (ctl *Ctl) CertInspect(args []string) error {
+	var file string
+	fs := flag.NewFlagSet("cert inspect", flag.ContinueOnError)
+	fs.StringVar(&file, "f", "", "local pem file instead of a cert in manager")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if file != "" {
+		x509cert, err := readCert(file)
+		if err != nil {
+			return err
+		}
+		return ctl.printCert(NewCertInfo(x509cert))
+	}
+	if fs.NArg() != 1 {
+		return ErrIllegalArgs
+	}
+	cert := &CertInfo{}
+	err := ctl.do(ctl.http, http.MethodGet, ctl.managerURL("/v1/certs/"+url.PathEscape(fs.Arg(0))), nil, cert)
+	if err != nil {
+		return err
+	}
+	return ctl.printCert(cert)
+}
@@ -0,0 +1,85 @@
+/*
+ * Apache License 2.0
+ *
+ * Copyright (c) 2022, Moresec Inc.
+ * All rights reserved.
+ */
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// print v as json, or a table by headers and rows
+func (ctl *Ctl) print(v interface{}, headers []string, rows [][]string) error {
+	if ctl.output == OutputJSON {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(ctl.out, string(data))
+		return err
+	}
+	w := tabwriter.NewWriter(ctl.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// print key value pairs as a two column table
+func (ctl *Ctl) printKV(v interface{}, kvs [][2]string) error {
+	if ctl.output == OutputJSON {
+		return ctl.print(v, nil, nil)
+	}
+	w := tabwriter.NewWriter(ctl.out, 0, 0, 2, ' ', 0)
+	for _, kv := range kvs {
+		fmt.Fprintf(w, "%s:\t%s\n", kv[0], kv[1])
+	}
+	return w.Flush()
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func formatIPs(ips []net.IP) string {
+	strs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		strs = append(strs, ip.String())
+	}
+	return strings.Join(strs, ",")
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(time.RFC3339)
+}
+
+func formatOr(str, or string) string {
+	if str == "" {
+		return or
+	}
+	return str
+}
@@ -1,249 +1,213 @@
 package cms
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"math"
-	"math/big"
 	"net"
-	"strconv"
-	"strings"
+	"net/url"
 	"time"
 
 	"github.com/jumboframes/armorigo/log"
 	"github.com/moresec-io/conduit/pkg/manager/config"
 	"github.com/moresec-io/conduit/pkg/manager/repo"
-	"github.com/singchia/go-timer/v2"
+	"github.com/moresec-io/conduit/pkg/utils"
 	"gorm.io/gorm"
 )
 
 type CMS interface {
-	GetClientCert() (*Cert, error)
-	GetServerCert(san net.IP) (*Cert, error)
+	GetClientCert(machineID string) (*Cert, error)
+	GetServerCert(machineID string, san net.IP) (*Cert, error)
+	// reissue the server cert with the same identity
+	RenewServerCert(san net.IP) (*Cert, error)
 	ListCerts() ([]*Cert, error)
 	DelCertBySAN(san net.IP) error
+	// trust bundle for spiffe-aware peers
+	CACert() ([]byte, error)
+	// CAs to be trusted, the CA and those rotating in or out
+	CABundle() ([][]byte, error)
+	TrustDomain() string
 }
 
 type Cert struct {
 	CA   []byte
+	CAs  [][]byte
 	Cert []byte
 	Key  []byte
 }
 
 type cms struct {
-	repo repo.Repo
-	conf *config.Config
-	tmr  timer.Timer
-
-	// cache
-	cacert []byte
-	cakey  []byte
+	repo   repo.Repo
+	conf   *config.Config
+	signer Signer
 }
 
-func NewCMS(conf *config.Config, repo repo.Repo) (CMS, error) {
+func NewCMS(conf *config.Config, repo repo.Repo, signer Signer) (CMS, error) {
 	cms := &cms{
-		repo: repo,
-		conf: conf,
-		tmr:  timer.NewTimer(),
-	}
-	err := cms.initCA()
-	if err != nil {
-		log.Errorf("newcms init err: %s", err)
-		return nil, err
+		repo:   repo,
+		conf:   conf,
+		signer: signer,
 	}
 	return cms, nil
 }
 
-func (cms *cms) initCA() error {
-	caconf := cms.conf.Cert.CA
-	now := time.Now()
+func (cms *cms) spiffeID(role, machineID string) *utils.SPIFFEID {
+	return utils.NewSPIFFEID(cms.conf.Cert.SPIFFE.TrustDomain, role, machineID)
+}
 
-	createCA := func() ([]byte, []byte, int64, error) {
-		years, months, days := getDate(caconf.NotAfter)
-		notBefore, notAfter := now, now.AddDate(years, months, days)
-		cert, key, err := cms.genCA(notBefore, notAfter,
-			caconf.Organization, caconf.CommonName, 2048)
-		if err != nil {
-			return nil, nil, 0, err
-		}
-		mca := &repo.CA{
-			Organization: caconf.Organization,
-			CommonName:   caconf.CommonName,
-			NotAfter:     caconf.NotAfter,
-			Expiration:   notAfter.Unix(),
-			Cert:         cert,
-			Key:          key,
-			Deleted:      false,
-			CreateTime:   now.Unix(),
-			UpdateTime:   now.Unix(),
-		}
-		err = cms.repo.CreateCA(mca)
-		if err != nil {
-			return nil, nil, 0, err
-		}
-		return cert, key, int64(notAfter.Sub(notBefore).Seconds()), nil
+func (cms *cms) issueServerCert(machineID string, san net.IP) ([]byte, []byte, error) {
+	certconf := cms.conf.Cert.Cert
+	now := time.Now()
+	years, months, days := config.ParseNotAfter(certconf.NotAfter)
+	notBefore, notAfter := now, now.AddDate(years, months, days)
+	cert, key, err := cms.signer.Issue(&CertRequest{
+		Usage:        CertUsageServer,
+		Organization: certconf.Organization,
+		CommonName:   certconf.CommonName,
+		IPs:          []net.IP{san},
+		URIs:         []*url.URL{cms.spiffeID(utils.SPIFFERoleServer, machineID).URL()},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	mcert := &repo.Cert{
+		Organization:           certconf.Organization,
+		CommonName:             certconf.CommonName,
+		SubjectAlternativeName: san.String(),
+		NotAfter:               certconf.NotAfter,
+		Expiration:             notAfter.Unix(),
+		Cert:                   cert,
+		Key:                    key,
+		Deleted:                false,
+		CreateTime:             now.Unix(),
+		UpdateTime:             now.Unix(),
 	}
-	var (
-		expiration int64
-		cert       []byte
-		key        []byte
-	)
-	ca, err := cms.repo.GetCA()
+	err = cms.repo.CreateCert(mcert)
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			cert, key, expiration, err = createCA()
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
-	} else if ca.Expiration >= now.Unix() {
-		err = cms.repo.DeleteCA(ca.ID)
-		if err != nil {
-			return err
-		}
-		cert, key, expiration, err = createCA()
-		if err != nil {
-			return err
-		}
-	} else {
-		cert, key = ca.Cert, ca.Key
+		return nil, nil, err
 	}
-
-	cms.cacert, cms.cakey = cert, key
-	cms.tmr.Add(time.Duration(expiration)*time.Second, timer.WithHandler(func(e *timer.Event) {
-		err = cms.initCA()
-		if err != nil {
-			log.Errorf("cms init ca err: %s", err)
-		}
-	}))
-	return nil
+	return cert, key, nil
 }
 
-func (cms *cms) initCert() error {
-	certconf := cms.conf.Cert.Cert
-	now := time.Now()
-
-	createCert := func(san net.IP) (int64, error) {
-		years, months, days := getDate(certconf.NotAfter)
-		notBefore, notAfter := now, now.AddDate(years, months, days)
-		cert, key, err := cms.genServerCert(cms.cacert, cms.cakey, notBefore, notAfter, certconf.Organization, certconf.CommonName, san, 2048)
-		if err != nil {
-			return 0, err
-		}
-		mcert := &repo.Cert{
-			Organization:           certconf.Organization,
-			CommonName:             certconf.CommonName,
-			SubjectAlternativeName: san.String(),
-			NotAfter:               certconf.NotAfter,
-			Expiration:             notAfter.Unix(),
-			Cert:                   cert,
-			Key:                    key,
-			Deleted:                false,
-			CreateTime:             now.Unix(),
-			UpdateTime:             now.Unix(),
-		}
-		err = cms.repo.CreateCert(mcert)
-		if err != nil {
-			return 0, err
-		}
-		return int64(notAfter.Sub(notBefore).Seconds()), nil
-	}
-	minexpiration := math.MaxInt64
-	mcerts, err := cms.repo.ListCert(&repo.CertQuery{})
+// generate cert if not exist, or the identity in it is not the machine's
+func (cms *cms) GetServerCert(machineID string, san net.IP) (*Cert, error) {
+	cacert, err := cms.signer.CACert()
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil
-		} else {
-			return err
-		}
+		return nil, err
 	}
-	for _, mcert := range mcerts {
-		if mcert.Expiration >= now.Unix() {
-			err = cms.repo.DeleteCert(&repo.CertDelete{ID: mcert.ID})
-			if err != nil {
-				return err
-			}
-			expiration, err := createCert(net.ParseIP(mcert.SubjectAlternativeName))
-			if err != nil {
-				return err
-			}
-			if expiration < int64(minexpiration) {
-				minexpiration = int(expiration)
-			}
-		}
+	bundle, err := cms.signer.CABundle()
+	if err != nil {
+		return nil, err
 	}
-	cms.tmr.Add(time.Duration(minexpiration)*time.Second, timer.WithHandler(func(e *timer.Event) {
-		err = cms.initCert()
+	issue := func() (*Cert, error) {
+		cert, key, err := cms.issueServerCert(machineID, san)
 		if err != nil {
-			log.Errorf("cms init cert err: %s", err)
+			return nil, err
 		}
-	}))
-	return nil
-}
-
-// generate cert if not exist
-func (cms *cms) GetServerCert(san net.IP) (*Cert, error) {
+		return &Cert{
+			CA:   cacert,
+			CAs:  bundle,
+			Cert: cert,
+			Key:  key}, nil
+	}
 	cert, err := cms.repo.GetCert(san.String())
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			certconf := cms.conf.Cert.Cert
-			now := time.Now()
-			years, months, days := getDate(certconf.NotAfter)
-			notBefore, notAfter := now, now.AddDate(years, months, days)
-			cert, key, err := cms.genServerCert(cms.cacert, cms.cakey, notBefore, notAfter, certconf.Organization, certconf.CommonName, san, 2048)
-			if err != nil {
-				return nil, err
-			}
-			mcert := &repo.Cert{
-				Organization:           certconf.Organization,
-				CommonName:             certconf.CommonName,
-				SubjectAlternativeName: san.String(),
-				NotAfter:               certconf.NotAfter,
-				Expiration:             notAfter.Unix(),
-				Cert:                   cert,
-				Key:                    key,
-				Deleted:                false,
-				CreateTime:             now.Unix(),
-				UpdateTime:             now.Unix(),
-			}
-			err = cms.repo.CreateCert(mcert)
-			if err != nil {
-				return nil, err
-			}
-			return &Cert{
-				CA:   cms.cacert,
-				Cert: cert,
-				Key:  key}, nil
+			return issue()
 		}
 		return nil, err
 	}
+	if !cms.matchSPIFFEID(cert.Cert, cms.spiffeID(utils.SPIFFERoleServer, machineID)) {
+		// the ip moved to another machine, or cert issued before spiffe ids
+		log.Infof("cms get server cert, san: %s identity mismatch, reissue for machine: %s", san, machineID)
+		if err = cms.DelCertBySAN(san); err != nil {
+			return nil, err
+		}
+		return issue()
+	}
 	return &Cert{
-		CA:   cms.cacert,
+		CA:   cacert,
+		CAs:  bundle,
 		Cert: cert.Cert,
 		Key:  cert.Key}, nil
 }
 
-func (cms *cms) GetClientCert() (*Cert, error) {
+func (cms *cms) RenewServerCert(san net.IP) (*Cert, error) {
+	mcert, err := cms.repo.GetCert(san.String())
+	if err != nil {
+		return nil, err
+	}
+	x509cert, err := x509.ParseCertificate(mcert.Cert)
+	if err != nil {
+		return nil, err
+	}
+	id, err := utils.CertSPIFFEID(x509cert)
+	if err != nil {
+		// issued before spiffe ids, the machine is unknown until it reports again
+		log.Errorf("cms renew server cert, san: %s get spiffe id err: %s", san, err)
+		return nil, err
+	}
+	if err = cms.DelCertBySAN(san); err != nil {
+		return nil, err
+	}
+	return cms.GetServerCert(id.MachineID, san)
+}
+
+func (cms *cms) matchSPIFFEID(cert []byte, expected *utils.SPIFFEID) bool {
+	x509cert, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return false
+	}
+	id, err := utils.CertSPIFFEID(x509cert)
+	if err != nil {
+		return false
+	}
+	return *id == *expected
+}
+
+func (cms *cms) GetClientCert(machineID string) (*Cert, error) {
+	cacert, err := cms.signer.CACert()
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := cms.signer.CABundle()
+	if err != nil {
+		return nil, err
+	}
 	certconf := cms.conf.Cert.Cert
 	now := time.Now()
-	years, months, days := getDate(certconf.NotAfter)
+	years, months, days := config.ParseNotAfter(certconf.NotAfter)
 	notBefore, notAfter := now, now.AddDate(years, months, days)
-	cert, key, err := cms.genClientCert(cms.cacert, cms.cakey, notBefore, notAfter, certconf.Organization, 2048)
+	// vault pki roles require a common name by default
+	commonName := certconf.CommonName
+	if commonName == "" {
+		commonName = machineID
+	}
+	cert, key, err := cms.signer.Issue(&CertRequest{
+		Usage:        CertUsageClient,
+		Organization: certconf.Organization,
+		CommonName:   commonName,
+		URIs:         []*url.URL{cms.spiffeID(utils.SPIFFERoleClient, machineID).URL()},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	})
 	if err != nil {
+		log.Errorf("cms get client cert, signer issue err: %s", err)
 		return nil, err
 	}
 	return &Cert{
-		CA:   cms.cacert,
+		CA:   cacert,
+		CAs:  bundle,
 		Cert: cert,
 		Key:  key,
 	}, nil
 }
 
 func (cms *cms) ListCerts() ([]*Cert, error) {
+	cacert, err := cms.signer.CACert()
+	if err != nil {
+		return nil, err
+	}
 	mcerts, err := cms.repo.ListCert(&repo.CertQuery{})
 	if err != nil {
 		return nil, err
@@ -251,7 +215,7 @@ func (cms *cms) ListCerts() ([]*Cert, error) {
 	certs := []*Cert{}
 	for _, mcert := range mcerts {
 		cert := &Cert{
-			CA:   cms.cacert,
+			CA:   cacert,
 			Cert: mcert.Cert,
 			Key:  mcert.Key,
 		}
@@ -261,144 +225,32 @@ func (cms *cms) ListCerts() ([]*Cert, error) {
 }
 
 func (cms *cms) DelCertBySAN(san net.IP) error {
-	return cms.repo.DeleteCert(&repo.CertDelete{
+	mcerts, err := cms.repo.ListCert(&repo.CertQuery{
 		SAN: san.String(),
 	})
-}
-
-// notAfter: 1,2,3 means now add 1 year 2 months and 3 days
-func (cms *cms) GenCA(notAfterStr string, organization, commonName string) ([]byte, []byte, error) {
-	years, months, days := getDate(notAfterStr)
-	notBefore := time.Now()
-	notAfter := notBefore.AddDate(years, months, days)
-	return cms.genCA(notBefore, notAfter, organization, commonName, 2048)
-}
-
-// DER format cert
-func (cms *cms) genCA(notBefore, notAfter time.Time,
-	organization, commonName string, bits int) ([]byte, []byte, error) {
-
-	key, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
-	if err != nil {
-		return nil, nil, err
-	}
-
-	catemplate := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{organization},
-			CommonName:   commonName,
-		},
-		NotBefore:             notBefore,
-		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-	}
-	// ASN.1 DER
-	ca, err := x509.CreateCertificate(rand.Reader, &catemplate, &catemplate, &key.PublicKey, key)
-	if err != nil {
-		return nil, nil, err
+	for _, mcert := range mcerts {
+		err = cms.signer.Revoke(mcert.Cert)
+		if err != nil {
+			log.Errorf("cms del cert by san, signer revoke cert: %d err: %s", mcert.ID, err)
+			return err
+		}
 	}
-	return ca, x509.MarshalPKCS1PrivateKey(key), nil
+	return cms.repo.DeleteCert(&repo.CertDelete{
+		SAN: san.String(),
+	})
 }
 
-func (cms *cms) genServerCert(cacert, cakey []byte,
-	notBefore, notAfter time.Time,
-	organization, commonName string, san net.IP, bits int) ([]byte, []byte, error) {
-	ca, err := x509.ParseCertificate(cacert)
-	if err != nil {
-		return nil, nil, err
-	}
-	key, err := x509.ParsePKCS1PrivateKey(cakey)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	signkey, err := rsa.GenerateKey(rand.Reader, bits)
-	if err != nil {
-		return nil, nil, err
-	}
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
-	if err != nil {
-		return nil, nil, err
-	}
-	certtemplate := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{organization},
-			CommonName:   commonName,
-		},
-		NotBefore:   notBefore,
-		NotAfter:    notAfter,
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		IPAddresses: []net.IP{san},
-	}
-	signcert, err := x509.CreateCertificate(rand.Reader, &certtemplate, ca, &signkey.PublicKey, key)
-	if err != nil {
-		return nil, nil, err
-	}
-	return signcert, x509.MarshalPKCS1PrivateKey(signkey), nil
+func (cms *cms) CACert() ([]byte, error) {
+	return cms.signer.CACert()
 }
 
-// DER format certs
-func (cms *cms) genClientCert(cacert, cakey []byte,
-	notBefore, notAfter time.Time, organization string, bits int) ([]byte, []byte, error) {
-	ca, err := x509.ParseCertificate(cacert)
-	if err != nil {
-		return nil, nil, err
-	}
-	key, err := x509.ParsePKCS1PrivateKey(cakey)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	signkey, err := rsa.GenerateKey(rand.Reader, bits)
-	if err != nil {
-		return nil, nil, err
-	}
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
-	if err != nil {
-		return nil, nil, err
-	}
-	certtemplate := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{organization},
-		},
-		NotBefore:             notBefore,
-		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-		BasicConstraintsValid: true,
-	}
-	signcert, err := x509.CreateCertificate(rand.Reader, &certtemplate, ca, &signkey.PublicKey, key)
-	if err != nil {
-		log.Errorf("cms gen client cert, x509 create certificate err: %s", err)
-		return nil, nil, err
-	}
-	return signcert, x509.MarshalPKCS1PrivateKey(signkey), nil
+func (cms *cms) CABundle() ([][]byte, error) {
+	return cms.signer.CABundle()
 }
 
-func getDate(str string) (int, int, int) {
-	elems := strings.Split(str, ",")
-	years, months, days := 0, 0, 0
-	for index, elem := range elems {
-		value, _ := strconv.Atoi(elem) // if err not nil, then
-		switch index {
-		case 0:
-			years = value
-		case 1:
-			months = value
-		case 2:
-			days = value
-		}
-	}
-	return years, months, days
+func (cms *cms) TrustDomain() string {
+	return cms.conf.Cert.SPIFFE.TrustDomain
 }
@@ -0,0 +1,392 @@
+package cms
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/manager/config"
+	"github.com/moresec-io/conduit/pkg/manager/repo"
+	"github.com/moresec-io/conduit/pkg/network"
+	"github.com/moresec-io/conduit/pkg/utils"
+)
+
+type ExpiryLevel string
+
+const (
+	ExpiryLevelOK       ExpiryLevel = "ok"
+	ExpiryLevelWarning  ExpiryLevel = "warning"
+	ExpiryLevelCritical ExpiryLevel = "critical"
+	ExpiryLevelExpired  ExpiryLevel = "expired"
+)
+
+type ExpiryEventType string
+
+const (
+	ExpiryEventThreshold   ExpiryEventType = "threshold"
+	ExpiryEventRenewed     ExpiryEventType = "renewed"
+	ExpiryEventRenewFailed ExpiryEventType = "renew_failed"
+)
+
+const (
+	CertKindCA   = "ca"
+	CertKindCert = "cert"
+
+	// events kept for the control plane
+	maxExpiryEvents = 1024
+)
+
+type CertExpiry struct {
+	Kind      string      `json:"kind"`
+	ID        uint64      `json:"id,omitempty"`
+	SAN       string      `json:"san,omitempty"`
+	SPIFFEID  string      `json:"spiffe_id,omitempty"`
+	Serial    string      `json:"serial"`
+	NotAfter  time.Time   `json:"not_after"`
+	Remaining int64       `json:"remaining"` // seconds, negative if expired
+	Level     ExpiryLevel `json:"level"`
+
+	machineID string
+}
+
+func (expiry *CertExpiry) String() string {
+	if expiry.SAN == "" {
+		return expiry.Kind + " serial " + expiry.Serial
+	}
+	return expiry.Kind + " " + expiry.SAN + " serial " + expiry.Serial
+}
+
+type ExpiryEvent struct {
+	Time    time.Time       `json:"time"`
+	Type    ExpiryEventType `json:"type"`
+	Level   ExpiryLevel     `json:"level"`
+	Message string          `json:"message"`
+	Cert    *CertExpiry     `json:"cert"`
+}
+
+// CertSyncer syncs the trust bundle and renewed certs to conduits
+type CertSyncer interface {
+	// whether all conduits online took the bundle
+	SyncTrustBundle(cas [][]byte) bool
+	// conduits of the machine ids pull their certs, nil for all conduits
+	SyncCertsRenewed(machineIDs []string)
+}
+
+// ExpiryScanner scans the CA and server certs periodically, raises events when
+// certs cross the warning and critical thresholds, and renews certs whose
+// remaining lifetime is below renew_before.
+type ExpiryScanner struct {
+	conf    *config.Expiry
+	repo    repo.Repo
+	signer  Signer
+	cms     CMS
+	webhook *http.Client
+	syncer  CertSyncer
+
+	mtx      sync.RWMutex
+	expiries []*CertExpiry
+	events   []*ExpiryEvent
+	levels   map[string]ExpiryLevel // key: serial; value: last level
+
+	quit chan struct{}
+}
+
+func NewExpiryScanner(conf *config.Config, repo repo.Repo, signer Signer, cms CMS) (*ExpiryScanner, error) {
+	scanner := &ExpiryScanner{
+		conf:   &conf.Cert.Expiry,
+		repo:   repo,
+		signer: signer,
+		cms:    cms,
+		levels: map[string]ExpiryLevel{},
+		quit:   make(chan struct{}),
+	}
+	webhook := &scanner.conf.Webhook
+	if webhook.URL != "" {
+		timeout := 10 * time.Second
+		if webhook.Timeout != 0 {
+			timeout = time.Duration(webhook.Timeout) * time.Second
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if webhook.TLS != nil && webhook.TLS.Enable {
+			tlsconfig, err := network.NewClientTLSConfig(webhook.TLS)
+			if err != nil {
+				return nil, err
+			}
+			transport.TLSClientConfig = tlsconfig
+		}
+		scanner.webhook = &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		}
+	}
+	return scanner, nil
+}
+
+// set before Serve, certs are renewed without conduits knowing if not set
+func (scanner *ExpiryScanner) SetCertSyncer(syncer CertSyncer) {
+	scanner.syncer = syncer
+}
+
+func (scanner *ExpiryScanner) Serve() {
+	go func() {
+		scanner.Scan()
+		ticker := time.NewTicker(scanner.conf.ScanInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				scanner.Scan()
+			case <-scanner.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (scanner *ExpiryScanner) Scan() {
+	now := time.Now()
+	expiries := []*CertExpiry{}
+
+	// ca first, all certs are reissued once the next CA is activated
+	reissue := false
+	cacert, err := scanner.signer.CACert()
+	if err != nil {
+		log.Errorf("expiry scanner, get ca cert err: %s", err)
+	} else {
+		expiry, err := scanner.newCertExpiry(now, CertKindCA, cacert)
+		if err != nil {
+			log.Errorf("expiry scanner, parse ca cert err: %s", err)
+		} else {
+			scanner.check(expiry)
+			if rotator, ok := scanner.signer.(CARotator); ok {
+				reissue = scanner.rotate(rotator, expiry)
+			}
+			expiries = append(expiries, expiry)
+		}
+	}
+
+	mcerts, err := scanner.repo.ListCert(&repo.CertQuery{})
+	if err != nil {
+		log.Errorf("expiry scanner, list cert err: %s", err)
+		return
+	}
+	renewed := []string{}
+	for _, mcert := range mcerts {
+		expiry, err := scanner.newCertExpiry(now, CertKindCert, mcert.Cert)
+		if err != nil {
+			log.Errorf("expiry scanner, parse cert: %d err: %s", mcert.ID, err)
+			continue
+		}
+		expiry.ID = mcert.ID
+		expiry.SAN = mcert.SubjectAlternativeName
+		scanner.check(expiry)
+		switch {
+		case !reissue && !scanner.needRenew(expiry):
+		case expiry.machineID == "":
+			// issued before spiffe ids, can't be renewed until the machine
+			// reports again, threshold events tell how close it is to expire
+			log.Debugf("expiry scanner, %s without spiffe id, skip renew", expiry)
+		default:
+			_, err = scanner.cms.RenewServerCert(net.ParseIP(mcert.SubjectAlternativeName))
+			scanner.renewed(expiry, err)
+			if err == nil {
+				renewed = append(renewed, expiry.machineID)
+			}
+		}
+		expiries = append(expiries, expiry)
+	}
+	// client certs are signed by the old CA too
+	if scanner.syncer != nil {
+		if reissue {
+			scanner.syncer.SyncCertsRenewed(nil)
+		} else if len(renewed) != 0 {
+			scanner.syncer.SyncCertsRenewed(renewed)
+		}
+	}
+
+	scanner.mtx.Lock()
+	scanner.expiries = expiries
+	// forget renewed or deleted certs
+	levels := map[string]ExpiryLevel{}
+	for _, expiry := range expiries {
+		if level, ok := scanner.levels[expiry.Serial]; ok {
+			levels[expiry.Serial] = level
+		}
+	}
+	scanner.levels = levels
+	scanner.mtx.Unlock()
+}
+
+func (scanner *ExpiryScanner) newCertExpiry(now time.Time, kind string, cert []byte) (*CertExpiry, error) {
+	x509cert, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	remaining := x509cert.NotAfter.Sub(now)
+	expiry := &CertExpiry{
+		Kind:      kind,
+		Serial:    utils.FormatSerial(x509cert.SerialNumber),
+		NotAfter:  x509cert.NotAfter,
+		Remaining: int64(remaining.Seconds()),
+		Level:     scanner.level(remaining),
+	}
+	if id, err := utils.CertSPIFFEID(x509cert); err == nil {
+		expiry.SPIFFEID = id.String()
+		expiry.machineID = id.MachineID
+	}
+	return expiry, nil
+}
+
+// prepare the next CA if the CA is about to expire and sync the bundle to
+// conduits, the next CA is activated only after all conduits trust it,
+// returns true if activated
+func (scanner *ExpiryScanner) rotate(rotator CARotator, expiry *CertExpiry) bool {
+	if !rotator.CAPending() {
+		if !scanner.needRenew(expiry) {
+			return false
+		}
+		if err := rotator.PrepareCA(); err != nil {
+			scanner.renewed(expiry, err)
+			return false
+		}
+	}
+	bundle, err := scanner.signer.CABundle()
+	if err != nil {
+		log.Errorf("expiry scanner, get ca bundle err: %s", err)
+		return false
+	}
+	if scanner.syncer != nil && !scanner.syncer.SyncTrustBundle(bundle) {
+		log.Warnf("expiry scanner, %s rotating, not all conduits trust the next ca, activate later", expiry)
+		return false
+	}
+	err = rotator.ActivateCA()
+	scanner.renewed(expiry, err)
+	return err == nil
+}
+
+func (scanner *ExpiryScanner) level(remaining time.Duration) ExpiryLevel {
+	switch {
+	case remaining <= 0:
+		return ExpiryLevelExpired
+	case remaining <= scanner.conf.Critical:
+		return ExpiryLevelCritical
+	case remaining <= scanner.conf.Warning:
+		return ExpiryLevelWarning
+	}
+	return ExpiryLevelOK
+}
+
+func (scanner *ExpiryScanner) needRenew(expiry *CertExpiry) bool {
+	return expiry.Remaining < int64(scanner.conf.RenewBefore.Seconds())
+}
+
+// raise an event only when the level changes
+func (scanner *ExpiryScanner) check(expiry *CertExpiry) {
+	scanner.mtx.Lock()
+	last, ok := scanner.levels[expiry.Serial]
+	scanner.levels[expiry.Serial] = expiry.Level
+	scanner.mtx.Unlock()
+	if (!ok && expiry.Level == ExpiryLevelOK) || last == expiry.Level {
+		return
+	}
+	scanner.emit(&ExpiryEvent{
+		Time:  time.Now(),
+		Type:  ExpiryEventThreshold,
+		Level: expiry.Level,
+		Message: fmt.Sprintf("%s expires at %s, %s remaining",
+			expiry, expiry.NotAfter.Format(time.RFC3339),
+			time.Duration(expiry.Remaining)*time.Second),
+		Cert: expiry,
+	})
+}
+
+func (scanner *ExpiryScanner) renewed(expiry *CertExpiry, err error) {
+	event := &ExpiryEvent{
+		Time:    time.Now(),
+		Type:    ExpiryEventRenewed,
+		Level:   expiry.Level,
+		Message: fmt.Sprintf("%s renewed", expiry),
+		Cert:    expiry,
+	}
+	if err != nil {
+		event.Type = ExpiryEventRenewFailed
+		event.Message = fmt.Sprintf("%s renew err: %s", expiry, err)
+	}
+	scanner.emit(event)
+}
+
+func (scanner *ExpiryScanner) emit(event *ExpiryEvent) {
+	switch {
+	case event.Type == ExpiryEventRenewFailed:
+		log.Errorf("expiry scanner, %s", event.Message)
+	case event.Level == ExpiryLevelOK || event.Type == ExpiryEventRenewed:
+		log.Infof("expiry scanner, %s", event.Message)
+	case event.Level == ExpiryLevelWarning:
+		log.Warnf("expiry scanner, %s", event.Message)
+	default:
+		log.Errorf("expiry scanner, %s", event.Message)
+	}
+
+	scanner.mtx.Lock()
+	scanner.events = append(scanner.events, event)
+	if len(scanner.events) > maxExpiryEvents {
+		scanner.events = scanner.events[len(scanner.events)-maxExpiryEvents:]
+	}
+	scanner.mtx.Unlock()
+
+	if scanner.webhook != nil {
+		if err := scanner.post(event); err != nil {
+			log.Errorf("expiry scanner, post webhook err: %s", err)
+		}
+	}
+}
+
+func (scanner *ExpiryScanner) post(event *ExpiryEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	rsp, err := scanner.webhook.Post(scanner.conf.Webhook.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook status: %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+// remaining lifetime of the CA and server certs, sorted by remaining
+func (scanner *ExpiryScanner) Expiries() []*CertExpiry {
+	scanner.mtx.RLock()
+	expiries := make([]*CertExpiry, len(scanner.expiries))
+	copy(expiries, scanner.expiries)
+	scanner.mtx.RUnlock()
+
+	sort.Slice(expiries, func(i, j int) bool {
+		return expiries[i].Remaining < expiries[j].Remaining
+	})
+	return expiries
+}
+
+// recent events, the oldest first
+func (scanner *ExpiryScanner) Events() []*ExpiryEvent {
+	scanner.mtx.RLock()
+	defer scanner.mtx.RUnlock()
+
+	events := make([]*ExpiryEvent, len(scanner.events))
+	copy(events, scanner.events)
+	return events
+}
+
+func (scanner *ExpiryScanner) Close() {
+	close(scanner.quit)
+}
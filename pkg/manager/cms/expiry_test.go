@@ -0,0 +1,185 @@
+package cms
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/manager/config"
+	"github.com/moresec-io/conduit/pkg/manager/repo"
+	"github.com/moresec-io/conduit/pkg/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeCertSyncer struct {
+	trusted  bool
+	bundles  [][][]byte
+	renewals [][]string
+}
+
+func (syncer *fakeCertSyncer) SyncTrustBundle(cas [][]byte) bool {
+	syncer.bundles = append(syncer.bundles, cas)
+	return syncer.trusted
+}
+
+func (syncer *fakeCertSyncer) SyncCertsRenewed(machineIDs []string) {
+	syncer.renewals = append(syncer.renewals, machineIDs)
+}
+
+func TestExpiryScanner(t *testing.T) {
+	Convey("expiry scanner", t, func() {
+		mtx := sync.Mutex{}
+		posted := []*ExpiryEvent{}
+		webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			event := &ExpiryEvent{}
+			json.NewDecoder(r.Body).Decode(event)
+			mtx.Lock()
+			posted = append(posted, event)
+			mtx.Unlock()
+		}))
+		defer webhook.Close()
+
+		conf := &config.Config{}
+		conf.DB = config.DB{Driver: repo.DBDriverSqlite, Address: t.TempDir(), DB: "manager.db"}
+		conf.Cert.CA.NotAfter = "1,0,0"
+		// certs expire in 1 day, below the critical threshold
+		conf.Cert.Cert.NotAfter = "0,0,1"
+		conf.Cert.SPIFFE.TrustDomain = config.DefaultTrustDomain
+		conf.Cert.Expiry = config.Expiry{
+			ScanInterval: time.Hour,
+			Warning:      30 * 24 * time.Hour,
+			Critical:     7 * 24 * time.Hour,
+			RenewBefore:  12 * time.Hour,
+			Webhook:      config.Webhook{URL: webhook.URL},
+		}
+		r, err := repo.NewRepo(conf)
+		So(err, ShouldBeNil)
+		signer, err := NewSigner(conf, r)
+		So(err, ShouldBeNil)
+		c, err := NewCMS(conf, r, signer)
+		So(err, ShouldBeNil)
+		scanner, err := NewExpiryScanner(conf, r, signer, c)
+		So(err, ShouldBeNil)
+
+		san := net.ParseIP("192.168.0.1")
+		_, err = c.GetServerCert("machine1", san)
+		So(err, ShouldBeNil)
+
+		Convey("critical", func() {
+			scanner.Scan()
+			expiries := scanner.Expiries()
+			So(len(expiries), ShouldEqual, 2)
+			So(expiries[0].Kind, ShouldEqual, CertKindCert)
+			So(expiries[0].Level, ShouldEqual, ExpiryLevelCritical)
+			So(expiries[0].SPIFFEID, ShouldEqual, "spiffe://conduit.local/conduit/server/machine1")
+			So(expiries[1].Kind, ShouldEqual, CertKindCA)
+			So(expiries[1].Level, ShouldEqual, ExpiryLevelOK)
+
+			events := scanner.Events()
+			So(len(events), ShouldEqual, 1)
+			So(events[0].Type, ShouldEqual, ExpiryEventThreshold)
+			So(events[0].Level, ShouldEqual, ExpiryLevelCritical)
+			mtx.Lock()
+			So(len(posted), ShouldEqual, 1)
+			mtx.Unlock()
+
+			// no more events until the level changes
+			scanner.Scan()
+			So(len(scanner.Events()), ShouldEqual, 1)
+		})
+
+		Convey("renew", func() {
+			conf.Cert.Expiry.RenewBefore = 2 * 24 * time.Hour
+			scanner.Scan()
+			events := scanner.Events()
+			So(len(events), ShouldEqual, 2)
+			So(events[1].Type, ShouldEqual, ExpiryEventRenewed)
+
+			cert, err := r.GetCert(san.String())
+			So(err, ShouldBeNil)
+			x509cert, err := x509.ParseCertificate(cert.Cert)
+			So(err, ShouldBeNil)
+			So(utils.FormatSerial(x509cert.SerialNumber), ShouldNotEqual, events[1].Cert.Serial)
+		})
+
+		Convey("without spiffe id", func() {
+			// issued before spiffe ids
+			legacy := net.ParseIP("192.168.0.2")
+			now := time.Now()
+			cert, key, err := signer.Issue(&CertRequest{
+				Usage:     CertUsageServer,
+				IPs:       []net.IP{legacy},
+				NotBefore: now,
+				NotAfter:  now.Add(24 * time.Hour),
+			})
+			So(err, ShouldBeNil)
+			err = r.CreateCert(&repo.Cert{
+				SubjectAlternativeName: legacy.String(),
+				Cert:                   cert,
+				Key:                    key,
+			})
+			So(err, ShouldBeNil)
+
+			// renew machine1 only, the legacy cert raises no renew_failed
+			conf.Cert.Expiry.RenewBefore = 2 * 24 * time.Hour
+			scanner.Scan()
+			scanner.Scan()
+			for _, event := range scanner.Events() {
+				So(event.Type, ShouldNotEqual, ExpiryEventRenewFailed)
+				if event.Type == ExpiryEventRenewed {
+					So(event.Cert.SAN, ShouldEqual, san.String())
+				}
+			}
+			mtx.Lock()
+			for _, event := range posted {
+				So(event.Type, ShouldNotEqual, ExpiryEventRenewFailed)
+			}
+			mtx.Unlock()
+		})
+
+		Convey("rotate ca", func() {
+			syncer := &fakeCertSyncer{}
+			scanner.SetCertSyncer(syncer)
+			// the ca expires in a year
+			conf.Cert.Expiry.RenewBefore = 400 * 24 * time.Hour
+			oldca, err := signer.CACert()
+			So(err, ShouldBeNil)
+
+			// not all conduits trust the next ca, certs are still signed by the old one
+			scanner.Scan()
+			So(signer.(CARotator).CAPending(), ShouldBeTrue)
+			So(len(syncer.bundles), ShouldEqual, 1)
+			So(len(syncer.bundles[0]), ShouldEqual, 2)
+			So(syncer.bundles[0][0], ShouldResemble, oldca)
+			cacert, err := signer.CACert()
+			So(err, ShouldBeNil)
+			So(cacert, ShouldResemble, oldca)
+			So(syncer.renewals, ShouldResemble, [][]string{{"machine1"}})
+
+			// trusted, the next ca signs and all certs are reissued
+			syncer.trusted = true
+			scanner.Scan()
+			So(signer.(CARotator).CAPending(), ShouldBeFalse)
+			cacert, err = signer.CACert()
+			So(err, ShouldBeNil)
+			So(cacert, ShouldResemble, syncer.bundles[1][1])
+			So(syncer.renewals[1], ShouldBeNil)
+			bundle, err := signer.CABundle()
+			So(err, ShouldBeNil)
+			So(len(bundle), ShouldEqual, 2)
+
+			cert, err := r.GetCert(san.String())
+			So(err, ShouldBeNil)
+			x509cert, err := x509.ParseCertificate(cert.Cert)
+			So(err, ShouldBeNil)
+			x509ca, err := x509.ParseCertificate(cacert)
+			So(err, ShouldBeNil)
+			So(x509cert.CheckSignatureFrom(x509ca), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,111 @@
+package cms
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/manager/config"
+	"github.com/moresec-io/conduit/pkg/manager/repo"
+)
+
+var (
+	ErrUnsupportedSigner    = errors.New("unsupported signer")
+	ErrUnsupportedCertUsage = errors.New("unsupported cert usage")
+)
+
+type CertUsage int
+
+const (
+	CertUsageServer CertUsage = iota + 1
+	CertUsageClient
+)
+
+type CertRequest struct {
+	Usage        CertUsage
+	Organization string
+	CommonName   string
+	IPs          []net.IP
+	URIs         []*url.URL
+	NotBefore    time.Time
+	NotAfter     time.Time
+}
+
+// Signer holds the CA and signs certs for conduits, all certs and keys are in DER format.
+type Signer interface {
+	// the CA cert to be distributed to conduits
+	CACert() ([]byte, error)
+	// CAs to be trusted by conduits, the CA and those rotating in or out
+	CABundle() ([][]byte, error)
+	// generate a key pair and sign it, returns cert and PKCS #1 key
+	Issue(req *CertRequest) ([]byte, []byte, error)
+	// sign a PKCS #10 certificate request
+	Sign(csr []byte, req *CertRequest) ([]byte, error)
+	// revoke a cert signed by us
+	Revoke(cert []byte) error
+}
+
+// signers holding the CA key rotate it in stages when it's about to expire,
+// the next CA is prepared and joins the bundle, then signs after conduits
+// trust it, while the old one stays in the bundle until it expires
+type CARotator interface {
+	PrepareCA() error
+	// whether a prepared CA is waiting to be activated
+	CAPending() bool
+	ActivateCA() error
+}
+
+func NewSigner(conf *config.Config, repo repo.Repo) (Signer, error) {
+	var (
+		signer Signer
+		err    error
+	)
+	switch conf.Cert.Signer.Type {
+	case "", config.SignerTypeLocal:
+		signer, err = newLocalSigner(conf, repo)
+	case config.SignerTypeVault:
+		signer, err = newVaultSigner(&conf.Cert.Signer.Vault)
+	default:
+		return nil, ErrUnsupportedSigner
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newMeteredSigner(signer), nil
+}
+
+func newCertTemplate(req *CertRequest) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{req.Organization},
+			CommonName:   req.CommonName,
+		},
+		NotBefore: req.NotBefore,
+		NotAfter:  req.NotAfter,
+		URIs:      req.URIs,
+	}
+	switch req.Usage {
+	case CertUsageServer:
+		// client auth too for relaying to next conduits
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		template.IPAddresses = req.IPs
+	case CertUsageClient:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.BasicConstraintsValid = true
+	default:
+		return nil, ErrUnsupportedCertUsage
+	}
+	return template, nil
+}
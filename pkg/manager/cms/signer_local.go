@@ -0,0 +1,257 @@
+package cms
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/manager/config"
+	"github.com/moresec-io/conduit/pkg/manager/repo"
+)
+
+// local signer keeps the CA in manager's database
+type localSigner struct {
+	repo repo.Repo
+	conf *config.Config
+
+	// cache
+	mtx    sync.RWMutex
+	cacert []byte
+	cakey  []byte
+	// prepared but not signing yet, nil if not rotating
+	pending *repo.CA
+	// all CAs not expired, the oldest first
+	bundle [][]byte
+}
+
+func newLocalSigner(conf *config.Config, repo repo.Repo) (*localSigner, error) {
+	signer := &localSigner{
+		repo: repo,
+		conf: conf,
+	}
+	err := signer.initCA()
+	if err != nil {
+		log.Errorf("new local signer, init ca err: %s", err)
+		return nil, err
+	}
+	return signer, nil
+}
+
+// load the CA signing, the one prepared and the one rotated out from database,
+// the expired are deleted and a CA is created if none signs
+func (signer *localSigner) initCA() error {
+	now := time.Now()
+	cas, err := signer.repo.ListCA()
+	if err != nil {
+		return err
+	}
+	var active, pending *repo.CA
+	bundle := [][]byte{}
+	for _, ca := range cas {
+		if ca.Expiration <= now.Unix() {
+			log.Infof("local signer init ca, ca: %d expired at %s, delete", ca.ID, time.Unix(ca.Expiration, 0))
+			if err = signer.repo.DeleteCA(ca.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		// the newest wins
+		if ca.Pending {
+			pending = ca
+		} else {
+			active = ca
+		}
+		bundle = append(bundle, ca.Cert)
+	}
+	if active == nil && pending != nil {
+		// the signing one expired before the prepared one was activated
+		if err = signer.repo.ActivateCA(pending.ID); err != nil {
+			return err
+		}
+		active, pending = pending, nil
+	}
+	if active == nil {
+		active, err = signer.createCA(now, false)
+		if err != nil {
+			return err
+		}
+		bundle = append(bundle, active.Cert)
+	}
+
+	signer.mtx.Lock()
+	signer.cacert, signer.cakey = active.Cert, active.Key
+	signer.pending = pending
+	signer.bundle = bundle
+	signer.mtx.Unlock()
+	return nil
+}
+
+func (signer *localSigner) createCA(now time.Time, pending bool) (*repo.CA, error) {
+	caconf := signer.conf.Cert.CA
+	years, months, days := config.ParseNotAfter(caconf.NotAfter)
+	notBefore, notAfter := now, now.AddDate(years, months, days)
+	cert, key, err := genCA(notBefore, notAfter,
+		caconf.Organization, caconf.CommonName, 2048)
+	if err != nil {
+		return nil, err
+	}
+	mca := &repo.CA{
+		Organization: caconf.Organization,
+		CommonName:   caconf.CommonName,
+		NotAfter:     caconf.NotAfter,
+		Expiration:   notAfter.Unix(),
+		Cert:         cert,
+		Key:          key,
+		Pending:      pending,
+		Deleted:      false,
+		CreateTime:   now.Unix(),
+		UpdateTime:   now.Unix(),
+	}
+	err = signer.repo.CreateCA(mca)
+	if err != nil {
+		return nil, err
+	}
+	return mca, nil
+}
+
+// the next CA joins the bundle, signs after activated
+func (signer *localSigner) PrepareCA() error {
+	if signer.CAPending() {
+		return nil
+	}
+	ca, err := signer.createCA(time.Now(), true)
+	if err != nil {
+		return err
+	}
+	log.Infof("local signer prepare ca, ca: %d prepared", ca.ID)
+	return signer.initCA()
+}
+
+func (signer *localSigner) CAPending() bool {
+	signer.mtx.RLock()
+	defer signer.mtx.RUnlock()
+
+	return signer.pending != nil
+}
+
+// the prepared CA signs, the old one stays in the bundle until it expires
+func (signer *localSigner) ActivateCA() error {
+	signer.mtx.RLock()
+	pending := signer.pending
+	signer.mtx.RUnlock()
+	if pending == nil {
+		return nil
+	}
+	err := signer.repo.ActivateCA(pending.ID)
+	if err != nil {
+		return err
+	}
+	log.Infof("local signer activate ca, ca: %d activated", pending.ID)
+	return signer.initCA()
+}
+
+func (signer *localSigner) CABundle() ([][]byte, error) {
+	signer.mtx.RLock()
+	defer signer.mtx.RUnlock()
+
+	return signer.bundle, nil
+}
+
+func (signer *localSigner) CACert() ([]byte, error) {
+	signer.mtx.RLock()
+	defer signer.mtx.RUnlock()
+
+	return signer.cacert, nil
+}
+
+func (signer *localSigner) Issue(req *CertRequest) ([]byte, []byte, error) {
+	signkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := signer.sign(req, &signkey.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, x509.MarshalPKCS1PrivateKey(signkey), nil
+}
+
+func (signer *localSigner) Sign(csr []byte, req *CertRequest) ([]byte, error) {
+	certRequest, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, err
+	}
+	if err = certRequest.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return signer.sign(req, certRequest.PublicKey)
+}
+
+// local CA has no CRL to publish, deleting the cert from database is all we can do
+func (signer *localSigner) Revoke(cert []byte) error {
+	return nil
+}
+
+func (signer *localSigner) sign(req *CertRequest, pub interface{}) ([]byte, error) {
+	signer.mtx.RLock()
+	cacert, cakey := signer.cacert, signer.cakey
+	signer.mtx.RUnlock()
+
+	ca, err := x509.ParseCertificate(cacert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(cakey)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newCertTemplate(req)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, ca, pub, key)
+	if err != nil {
+		log.Errorf("local signer sign, x509 create certificate err: %s", err)
+		return nil, err
+	}
+	return cert, nil
+}
+
+// DER format cert
+func genCA(notBefore, notAfter time.Time,
+	organization, commonName string, bits int) ([]byte, []byte, error) {
+
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	catemplate := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{organization},
+			CommonName:   commonName,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	// ASN.1 DER
+	ca, err := x509.CreateCertificate(rand.Reader, &catemplate, &catemplate, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, x509.MarshalPKCS1PrivateKey(key), nil
+}
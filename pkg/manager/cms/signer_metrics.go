@@ -0,0 +1,64 @@
+package cms
+
+import (
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/manager/metrics"
+)
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+func (usage CertUsage) String() string {
+	switch usage {
+	case CertUsageServer:
+		return "server"
+	case CertUsageClient:
+		return "client"
+	}
+	return "unknown"
+}
+
+// meteredSigner counts issuance and observes its latency
+type meteredSigner struct {
+	Signer
+}
+
+// keep CARotator visible for the expiry scanner
+type meteredRotator struct {
+	meteredSigner
+	CARotator
+}
+
+func newMeteredSigner(signer Signer) Signer {
+	metered := meteredSigner{signer}
+	if rotator, ok := signer.(CARotator); ok {
+		return &meteredRotator{metered, rotator}
+	}
+	return &metered
+}
+
+func (signer *meteredSigner) Issue(req *CertRequest) ([]byte, []byte, error) {
+	start := time.Now()
+	cert, key, err := signer.Signer.Issue(req)
+	observeIssue(req.Usage, start, err)
+	return cert, key, err
+}
+
+func (signer *meteredSigner) Sign(csr []byte, req *CertRequest) ([]byte, error) {
+	start := time.Now()
+	cert, err := signer.Signer.Sign(csr, req)
+	observeIssue(req.Usage, start, err)
+	return cert, err
+}
+
+func observeIssue(usage CertUsage, start time.Time, err error) {
+	metrics.CertIssueDuration.With(usage.String()).Observe(time.Since(start).Seconds())
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+	}
+	metrics.CertsIssued.With(usage.String(), result).Inc()
+}
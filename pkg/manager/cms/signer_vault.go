@@ -0,0 +1,287 @@
+package cms
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/manager/config"
+	"github.com/moresec-io/conduit/pkg/network"
+	"github.com/moresec-io/conduit/pkg/utils"
+)
+
+var (
+	ErrIllegalVaultConfig = errors.New("illegal vault config")
+	ErrIllegalPEM         = errors.New("illegal pem")
+)
+
+// vault signer talks to a Vault-PKI-compatible API, see
+// https://developer.hashicorp.com/vault/api-docs/secret/pki
+type vaultSigner struct {
+	conf   *config.Vault
+	token  string
+	mount  string
+	client *http.Client
+
+	// cache
+	mtx    sync.RWMutex
+	cacert *vaultCACert
+}
+
+type vaultCACert struct {
+	raw      []byte
+	notAfter time.Time
+}
+
+type vaultError struct {
+	Errors []string `json:"errors"`
+}
+
+type vaultCertRequest struct {
+	CommonName        string `json:"common_name,omitempty"`
+	IPSANs            string `json:"ip_sans,omitempty"`
+	URISANs           string `json:"uri_sans,omitempty"`
+	TTL               string `json:"ttl,omitempty"`
+	Format            string `json:"format,omitempty"`
+	CSR               string `json:"csr,omitempty"`
+	ExcludeCNFromSANs bool   `json:"exclude_cn_from_sans,omitempty"`
+}
+
+type vaultCertResponse struct {
+	Data struct {
+		Certificate  string `json:"certificate"`
+		IssuingCA    string `json:"issuing_ca"`
+		PrivateKey   string `json:"private_key"`
+		SerialNumber string `json:"serial_number"`
+	} `json:"data"`
+}
+
+type vaultRevokeRequest struct {
+	SerialNumber string `json:"serial_number"`
+}
+
+func newVaultSigner(conf *config.Vault) (*vaultSigner, error) {
+	if conf.Address == "" || conf.Role == "" {
+		return nil, ErrIllegalVaultConfig
+	}
+	signer := &vaultSigner{
+		conf:  conf,
+		token: conf.Token,
+		mount: strings.Trim(conf.Mount, "/"),
+	}
+	if signer.token == "" {
+		signer.token = os.Getenv("VAULT_TOKEN")
+	}
+	if signer.mount == "" {
+		signer.mount = "pki"
+	}
+	timeout := 10 * time.Second
+	if conf.Timeout != 0 {
+		timeout = time.Duration(conf.Timeout) * time.Second
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.TLS != nil && conf.TLS.Enable {
+		tlsconfig, err := network.NewClientTLSConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsconfig
+	}
+	signer.client = &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+	// make sure the vault is reachable at startup
+	_, err := signer.CACert()
+	if err != nil {
+		log.Errorf("new vault signer, get ca cert err: %s", err)
+		return nil, err
+	}
+	return signer, nil
+}
+
+func (signer *vaultSigner) CACert() ([]byte, error) {
+	signer.mtx.RLock()
+	cacert := signer.cacert
+	signer.mtx.RUnlock()
+	if cacert != nil && time.Now().Before(cacert.notAfter) {
+		return cacert.raw, nil
+	}
+
+	response := &vaultCertResponse{}
+	err := signer.do(http.MethodGet, "/cert/ca", nil, response)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := pemToDER(response.Data.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+	signer.mtx.Lock()
+	signer.cacert = &vaultCACert{raw: raw, notAfter: ca.NotAfter}
+	signer.mtx.Unlock()
+	return raw, nil
+}
+
+// vault rotates its issuers itself, only the current one is known
+func (signer *vaultSigner) CABundle() ([][]byte, error) {
+	cacert, err := signer.CACert()
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{cacert}, nil
+}
+
+func (signer *vaultSigner) Issue(req *CertRequest) ([]byte, []byte, error) {
+	request := signer.newCertRequest(req)
+	response := &vaultCertResponse{}
+	err := signer.do(http.MethodPost, "/issue/"+signer.conf.Role, request, response)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := pemToDER(response.Data.Certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := pemToPKCS1DER(response.Data.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func (signer *vaultSigner) Sign(csr []byte, req *CertRequest) ([]byte, error) {
+	request := signer.newCertRequest(req)
+	request.CSR = string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csr,
+	}))
+	response := &vaultCertResponse{}
+	err := signer.do(http.MethodPost, "/sign/"+signer.conf.Role, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return pemToDER(response.Data.Certificate)
+}
+
+func (signer *vaultSigner) Revoke(cert []byte) error {
+	x509cert, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return err
+	}
+	request := &vaultRevokeRequest{
+		SerialNumber: utils.FormatSerial(x509cert.SerialNumber),
+	}
+	return signer.do(http.MethodPost, "/revoke", request, nil)
+}
+
+func (signer *vaultSigner) newCertRequest(req *CertRequest) *vaultCertRequest {
+	request := &vaultCertRequest{
+		CommonName:        req.CommonName,
+		IPSANs:            utils.IPs(req.IPs).String(),
+		URISANs:           joinURIs(req.URIs),
+		Format:            "pem",
+		ExcludeCNFromSANs: true,
+	}
+	if !req.NotAfter.IsZero() {
+		ttl := time.Until(req.NotAfter)
+		request.TTL = strconv.FormatInt(int64(ttl.Seconds()), 10) + "s"
+	}
+	return request
+}
+
+func (signer *vaultSigner) do(method, path string, request, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	url := strings.TrimSuffix(signer.conf.Address, "/") + "/v1/" + signer.mount + path
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", signer.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rsp, err := signer.client.Do(req)
+	if err != nil {
+		log.Errorf("vault signer, %s %s err: %s", method, path, err)
+		return err
+	}
+	defer rsp.Body.Close()
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode/100 != 2 {
+		verr := &vaultError{}
+		_ = json.Unmarshal(data, verr)
+		log.Errorf("vault signer, %s %s status: %d, errors: %v", method, path, rsp.StatusCode, verr.Errors)
+		return fmt.Errorf("vault %s %s: %d %s", method, path, rsp.StatusCode, strings.Join(verr.Errors, "; "))
+	}
+	if response == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, response)
+}
+
+func joinURIs(uris []*url.URL) string {
+	strs := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		strs = append(strs, uri.String())
+	}
+	return strings.Join(strs, ",")
+}
+
+func pemToDER(str string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(str))
+	if block == nil {
+		return nil, ErrIllegalPEM
+	}
+	return block.Bytes, nil
+}
+
+// conduits only accept PKCS #1 rsa keys
+func pemToPKCS1DER(str string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(str))
+	if block == nil {
+		return nil, ErrIllegalPEM
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return block.Bytes, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsakey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T, the vault role must use rsa keys", key)
+		}
+		return x509.MarshalPKCS1PrivateKey(rsakey), nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %s, the vault role must use rsa keys", block.Type)
+}
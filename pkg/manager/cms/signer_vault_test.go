@@ -0,0 +1,207 @@
+package cms
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/manager/config"
+	"github.com/moresec-io/conduit/pkg/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// a stand-in for the vault pki secrets engine
+type fakeVault struct {
+	t       *testing.T
+	token   string
+	cacert  *x509.Certificate
+	cakey   *rsa.PrivateKey
+	mtx     sync.Mutex
+	revoked []string
+	// like the role's require_cn, true by default
+	requireCN bool
+}
+
+func newFakeVault(t *testing.T, token string) *fakeVault {
+	now := time.Now()
+	cert, key, err := genCA(now, now.AddDate(1, 0, 0), "vault", "vault ca", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacert, _ := x509.ParseCertificate(cert)
+	cakey, _ := x509.ParsePKCS1PrivateKey(key)
+	return &fakeVault{t: t, token: token, cacert: cacert, cakey: cakey, requireCN: true}
+}
+
+func (vault *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != vault.token {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	request := &vaultCertRequest{}
+	json.Unmarshal(body, request)
+	response := &vaultCertResponse{}
+	switch r.URL.Path {
+	case "/v1/pki/cert/ca":
+		response.Data.Certificate = utils.X509CertoToPem(vault.cacert)
+	case "/v1/pki/issue/conduit":
+		if vault.requireCN && request.CommonName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["the common_name field is required, or must be provided in a CSR with \"use_csr_common_name\" set to true, unless \"require_cn\" is set to false"]}`))
+			return
+		}
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		cert := vault.sign(request, &key.PublicKey)
+		response.Data.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+		pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+		response.Data.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	case "/v1/pki/sign/conduit":
+		block, _ := pem.Decode([]byte(request.CSR))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cert := vault.sign(request, csr.PublicKey)
+		response.Data.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+	case "/v1/pki/revoke":
+		revoke := &vaultRevokeRequest{}
+		json.Unmarshal(body, revoke)
+		vault.mtx.Lock()
+		vault.revoked = append(vault.revoked, revoke.SerialNumber)
+		vault.mtx.Unlock()
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (vault *fakeVault) sign(request *vaultCertRequest, pub interface{}) []byte {
+	ttl, _ := time.ParseDuration(request.TTL)
+	ips := []net.IP{}
+	for _, ip := range strings.Split(request.IPSANs, ",") {
+		if ip != "" {
+			ips = append(ips, net.ParseIP(ip))
+		}
+	}
+	template, _ := newCertTemplate(&CertRequest{
+		Usage:      CertUsageServer,
+		CommonName: request.CommonName,
+		IPs:        ips,
+		NotBefore:  time.Now(),
+		NotAfter:   time.Now().Add(ttl),
+	})
+	cert, err := x509.CreateCertificate(rand.Reader, template, vault.cacert, pub, vault.cakey)
+	if err != nil {
+		vault.t.Fatal(err)
+	}
+	return cert
+}
+
+func TestVaultSigner(t *testing.T) {
+	Convey("vault signer", t, func() {
+		vault := newFakeVault(t, "s.token")
+		server := httptest.NewServer(vault)
+		defer server.Close()
+
+		conf := &config.Vault{
+			Address: server.URL,
+			Token:   "s.token",
+			Role:    "conduit",
+		}
+		signer, err := newVaultSigner(conf)
+		So(err, ShouldBeNil)
+
+		Convey("ca cert", func() {
+			cacert, err := signer.CACert()
+			So(err, ShouldBeNil)
+			So(cacert, ShouldResemble, vault.cacert.Raw)
+		})
+
+		Convey("issue cert", func() {
+			cert, key, err := signer.Issue(&CertRequest{
+				Usage:      CertUsageServer,
+				CommonName: "conduit.com",
+				IPs:        []net.IP{net.ParseIP("192.168.0.1")},
+				NotBefore:  time.Now(),
+				NotAfter:   time.Now().Add(time.Hour),
+			})
+			So(err, ShouldBeNil)
+			x509cert, err := x509.ParseCertificate(cert)
+			So(err, ShouldBeNil)
+			So(x509cert.IPAddresses[0].Equal(net.ParseIP("192.168.0.1")), ShouldBeTrue)
+			So(x509cert.CheckSignatureFrom(vault.cacert), ShouldBeNil)
+			// conduits need PKCS #1
+			_, err = x509.ParsePKCS1PrivateKey(key)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("sign csr", func() {
+			key, _ := rsa.GenerateKey(rand.Reader, 2048)
+			csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+			So(err, ShouldBeNil)
+			cert, err := signer.Sign(csr, &CertRequest{
+				Usage:      CertUsageServer,
+				CommonName: "conduit.com",
+				NotAfter:   time.Now().Add(time.Hour),
+			})
+			So(err, ShouldBeNil)
+			x509cert, err := x509.ParseCertificate(cert)
+			So(err, ShouldBeNil)
+			So(x509cert.CheckSignatureFrom(vault.cacert), ShouldBeNil)
+		})
+
+		Convey("issue cert without common name", func() {
+			_, _, err := signer.Issue(&CertRequest{
+				Usage:    CertUsageClient,
+				NotAfter: time.Now().Add(time.Hour),
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("client cert by cms", func() {
+			mconf := &config.Config{}
+			mconf.Cert.Cert.NotAfter = "0,0,1"
+			mconf.Cert.SPIFFE.TrustDomain = "conduit.local"
+			cms, err := NewCMS(mconf, nil, signer)
+			So(err, ShouldBeNil)
+			cert, err := cms.GetClientCert("machine-a")
+			So(err, ShouldBeNil)
+			x509cert, err := x509.ParseCertificate(cert.Cert)
+			So(err, ShouldBeNil)
+			So(x509cert.Subject.CommonName, ShouldEqual, "machine-a")
+		})
+
+		Convey("revoke cert", func() {
+			cert, _, err := signer.Issue(&CertRequest{
+				Usage:      CertUsageServer,
+				CommonName: "conduit.com",
+				NotAfter:   time.Now().Add(time.Hour),
+			})
+			So(err, ShouldBeNil)
+			err = signer.Revoke(cert)
+			So(err, ShouldBeNil)
+			x509cert, _ := x509.ParseCertificate(cert)
+			So(vault.revoked, ShouldContain, utils.FormatSerial(x509cert.SerialNumber))
+		})
+
+		Convey("wrong token", func() {
+			conf.Token = "s.wrong"
+			_, err := newVaultSigner(conf)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jumboframes/armorigo/log"
@@ -32,6 +34,21 @@ type DB struct {
 	MaxIdleConn int64       `yaml:"max_idle_conn"` // mysql only
 	MaxOpenConn int64       `yaml:"max_open_conn"` // mysql only
 	TLS         *config.TLS `yaml:"tls"`           // mysql only
+	Encryption  Encryption  `yaml:"encryption"`
+}
+
+// envelope encryption for private keys at rest
+type Encryption struct {
+	Enable       bool  `yaml:"enable"`
+	KEK          KEK   `yaml:"kek"`           // key encryption key to encrypt with
+	PreviousKEKs []KEK `yaml:"previous_keks"` // retired keys, only to decrypt while rotating
+}
+
+// a base64 encoded 32 bytes AES-256 key, from file or environment
+type KEK struct {
+	ID   string `yaml:"id"`
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
 }
 
 type Cert struct {
@@ -45,14 +62,73 @@ type Cert struct {
 		CommonName   string `yaml:"common_name"`
 		Organization string `yaml:"organization"`
 	}
+	Signer Signer `yaml:"signer"`
+	SPIFFE SPIFFE `yaml:"spiffe"`
+	Expiry Expiry `yaml:"expiry"`
+}
+
+// expiry scanner raises events when certs cross the thresholds,
+// and renews certs when the remaining lifetime is below renew_before
+type Expiry struct {
+	ScanInterval time.Duration `yaml:"scan_interval"` // default 1h
+	Warning      time.Duration `yaml:"warning"`       // default 720h
+	Critical     time.Duration `yaml:"critical"`      // default 168h
+	RenewBefore  time.Duration `yaml:"renew_before"`  // default same as critical
+	Webhook      Webhook       `yaml:"webhook"`
+}
+
+// expiry events are posted as json to the webhook
+type Webhook struct {
+	URL     string      `yaml:"url"`     // empty to disable
+	Timeout int         `yaml:"timeout"` // seconds, default 10
+	TLS     *config.TLS `yaml:"tls"`
+}
+
+// conduits are issued SVID-style certs with uri san
+// spiffe://<trust_domain>/conduit/<role>/<machineid>
+type SPIFFE struct {
+	TrustDomain string `yaml:"trust_domain"` // default conduit.local
 }
 
+const (
+	SignerTypeLocal = "local"
+	SignerTypeVault = "vault"
+)
+
+type Signer struct {
+	Type  string `yaml:"type"` // local or vault, default local
+	Vault Vault  `yaml:"vault"`
+}
+
+// Vault-PKI-compatible signer, the CA key never leaves the signer
+type Vault struct {
+	Address string      `yaml:"address"` // like https://127.0.0.1:8200
+	Token   string      `yaml:"token"`   // fallback to env VAULT_TOKEN if empty
+	Mount   string      `yaml:"mount"`   // pki secrets engine mount path, default pki
+	Role    string      `yaml:"role"`
+	Timeout int         `yaml:"timeout"` // seconds, default 10
+	TLS     *config.TLS `yaml:"tls"`
+}
+
+const (
+	DefaultTrustDomain      = "conduit.local"
+	DefaultControlPlaneAddr = "0.0.0.0:5052"
+
+	// fallback of the control plane token
+	EnvControlPlaneToken = "CONDUIT_MANAGER_TOKEN"
+)
+
 type ControlPlane struct {
 	Listen config.Listen `yaml:"listen"`
+	// bearer token required by apis issuing and revoking certs, fallback to
+	// env CONDUIT_MANAGER_TOKEN if empty, they are refused if neither is set
+	Token string `yaml:"token"`
 }
 
 type ConduitManager struct {
 	Listen config.Listen `yaml:"listen"`
+	// distributed to all client conduits
+	Exclude config.Exclude `yaml:"exclude"`
 }
 
 type Config struct {
@@ -85,6 +161,32 @@ func NewConfig() (*Config, error) {
 		return nil, err
 	}
 
+	if Conf.ControlPlane.Listen.Addr == "" {
+		Conf.ControlPlane.Listen.Network = "tcp"
+		Conf.ControlPlane.Listen.Addr = DefaultControlPlaneAddr
+	}
+	if Conf.Cert.SPIFFE.TrustDomain == "" {
+		Conf.Cert.SPIFFE.TrustDomain = DefaultTrustDomain
+	}
+	expiry := &Conf.Cert.Expiry
+	if expiry.ScanInterval == 0 {
+		expiry.ScanInterval = time.Hour
+	}
+	if expiry.Warning == 0 {
+		expiry.Warning = 30 * 24 * time.Hour
+	}
+	if expiry.Critical == 0 {
+		expiry.Critical = 7 * 24 * time.Hour
+	}
+	if expiry.RenewBefore == 0 {
+		expiry.RenewBefore = expiry.Critical
+	}
+	err = validateExpiry(&Conf.Cert)
+	if err != nil {
+		log.Warnf("new config, validate cert expiry err: %s", err)
+		return nil, err
+	}
+
 	err = initLog()
 	if err != nil {
 		return nil, err
@@ -132,3 +234,42 @@ func initLog() error {
 	log.SetOutput(RotateLog)
 	return nil
 }
+
+// certs are renewed and the CA rotated at every scan if renew_before is not
+// shorter than their lifetimes
+func validateExpiry(cert *Cert) error {
+	now := time.Now()
+	lifetime := func(notAfter string) time.Duration {
+		years, months, days := ParseNotAfter(notAfter)
+		return now.AddDate(years, months, days).Sub(now)
+	}
+	renewBefore := cert.Expiry.RenewBefore
+	if life := lifetime(cert.Cert.NotAfter); renewBefore >= life {
+		return fmt.Errorf("renew_before: %s not shorter than cert lifetime: %s", renewBefore, life)
+	}
+	// vault keeps its own CA
+	if cert.Signer.Type == "" || cert.Signer.Type == SignerTypeLocal {
+		if life := lifetime(cert.CA.NotAfter); renewBefore >= life {
+			return fmt.Errorf("renew_before: %s not shorter than ca lifetime: %s", renewBefore, life)
+		}
+	}
+	return nil
+}
+
+// ParseNotAfter parses "years,months,days" of not_after
+func ParseNotAfter(str string) (int, int, int) {
+	elems := strings.Split(str, ",")
+	years, months, days := 0, 0, 0
+	for index, elem := range elems {
+		value, _ := strconv.Atoi(elem) // if err not nil, then
+		switch index {
+		case 0:
+			years = value
+		case 1:
+			months = value
+		case 2:
+			days = value
+		}
+	}
+	return years, months, days
+}
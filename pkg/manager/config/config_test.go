@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidateExpiry(t *testing.T) {
+	Convey("validate expiry", t, func() {
+		cert := &Cert{}
+		cert.CA.NotAfter = "0,1,0"
+		cert.Cert.NotAfter = "0,0,10"
+		cert.Expiry.RenewBefore = 7 * 24 * time.Hour
+		So(validateExpiry(cert), ShouldBeNil)
+
+		Convey("not shorter than cert lifetime", func() {
+			cert.Cert.NotAfter = "0,0,7"
+			So(validateExpiry(cert), ShouldNotBeNil)
+		})
+
+		Convey("not shorter than ca lifetime", func() {
+			cert.Expiry.RenewBefore = 9 * 24 * time.Hour
+			cert.CA.NotAfter = "0,0,9"
+			So(validateExpiry(cert), ShouldNotBeNil)
+
+			// vault keeps its own ca
+			cert.Signer.Type = SignerTypeVault
+			So(validateExpiry(cert), ShouldBeNil)
+		})
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/moresec-io/conduit/pkg/manager/cms"
 	"github.com/moresec-io/conduit/pkg/manager/config"
 	"github.com/moresec-io/conduit/pkg/manager/repo"
+	"github.com/moresec-io/conduit/pkg/manager/server"
 	"github.com/moresec-io/conduit/pkg/manager/service"
 	"github.com/singchia/go-timer/v2"
 	"go.uber.org/dig"
@@ -25,13 +26,25 @@ func BuildContainer() (*dig.Container, error) {
 	if err := container.Provide(repo.NewRepo); err != nil {
 		return nil, err
 	}
+	// provide signer for cert manager service
+	if err := container.Provide(cms.NewSigner); err != nil {
+		return nil, err
+	}
 	// provide cert manager service
 	if err := container.Provide(cms.NewCMS); err != nil {
 		return nil, err
 	}
+	// provide cert expiry scanner
+	if err := container.Provide(cms.NewExpiryScanner); err != nil {
+		return nil, err
+	}
 	// provide conduit manager
 	if err := container.Provide(service.NewConduitManager); err != nil {
 		return nil, err
 	}
+	// provide control plane server
+	if err := container.Provide(server.NewServer); err != nil {
+		return nil, err
+	}
 	return container, nil
 }
@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"github.com/moresec-io/conduit/pkg/metrics"
+)
+
+var (
+	Registry = metrics.NewRegistry()
+
+	Conduits = Registry.NewGaugeVec("manager_conduits",
+		"Connected conduits by role, a conduit can be both client and server.", "role")
+	EventQueueDepth = Registry.NewGaugeVec("manager_event_queue_depth",
+		"Events queued to notify conduits.")
+	RPCDuration = Registry.NewHistogramVec("manager_rpc_duration_seconds",
+		"RPC latency by method.", nil, "method")
+	RPCErrors = Registry.NewCounterVec("manager_rpc_errors_total",
+		"RPC errors by method.", "method")
+	CertsIssued = Registry.NewCounterVec("manager_certs_issued_total",
+		"Certs issued by usage and result.", "usage", "result")
+	CertIssueDuration = Registry.NewHistogramVec("manager_cert_issue_duration_seconds",
+		"Cert issuance latency by usage.", nil, "usage")
+	DBDuration = Registry.NewHistogramVec("manager_db_duration_seconds",
+		"DB operation latency.", []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}, "op", "table")
+	DBErrors = Registry.NewCounterVec("manager_db_errors_total",
+		"DB operation errors, record not found excluded.", "op", "table")
+)
@@ -17,6 +17,8 @@ const (
 type dao struct {
 	db   *gorm.DB
 	conf *config.DB
+	// nil if encryption disabled
+	keyring *keyring
 }
 
 func NewDao(conf *config.Config) (*dao, error) {
@@ -44,10 +46,24 @@ func NewDao(conf *config.Config) (*dao, error) {
 			return nil, err
 		}
 	}
+	if err = registerMetrics(db); err != nil {
+		return nil, err
+	}
 	if err = db.AutoMigrate(&Cert{}, &CA{}); err != nil {
 		return nil, err
 	}
-	return &dao{db: db, conf: dbconf}, nil
+	dao := &dao{db: db, conf: dbconf}
+	if dbconf.Encryption.Enable {
+		dao.keyring, err = newKeyring(&dbconf.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		// encrypt plaintext keys and rewrap keys from previous KEKs
+		if err = dao.migrateKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return dao, nil
 }
 
 func setMaxConn(db *gorm.DB, maxOpenConn int64, maxIdleConn int64) error {
@@ -65,6 +81,14 @@ func setMaxConn(db *gorm.DB, maxOpenConn int64, maxIdleConn int64) error {
 	return nil
 }
 
+func (dao *dao) Ping() error {
+	sqlDB, err := dao.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Ping()
+}
+
 func (dao *dao) Close() error {
 	var retErr error
 	sqlDB, err := dao.db.DB()
@@ -12,20 +12,46 @@ func (dao *dao) CreateCA(ca *CA) error {
 	if dao.conf.Debug {
 		tx = tx.Debug()
 	}
-	return tx.Create(ca).Error
+	// keep caller's plaintext key untouched
+	sealed := *ca
+	key, dek, kekID, err := dao.sealKey(ca.Key)
+	if err != nil {
+		return err
+	}
+	sealed.Key, sealed.KeyDEK, sealed.KeyKEKID = key, dek, kekID
+	if err = tx.Create(&sealed).Error; err != nil {
+		return err
+	}
+	ca.ID = sealed.ID
+	return nil
 }
 
-func (dao *dao) GetCA() (*CA, error) {
+func (dao *dao) ListCA() ([]*CA, error) {
 	tx := dao.db.Model(&CA{})
 	if dao.conf.Debug {
 		tx = tx.Debug()
 	}
-	ca := &CA{}
-	tx.Where("deleted", false).Limit(1).Find(ca)
-	if tx.RowsAffected == 0 {
-		return nil, gorm.ErrRecordNotFound
+	cas := []*CA{}
+	tx = tx.Where("deleted", false).Order("id").Find(&cas)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	for _, ca := range cas {
+		if err := dao.openCA(ca); err != nil {
+			return nil, err
+		}
+	}
+	return cas, nil
+}
+
+func (dao *dao) ActivateCA(id uint64) error {
+	tx := dao.db.Model(&CA{})
+	if dao.conf.Debug {
+		tx = tx.Debug()
 	}
-	return ca, tx.Error
+	tx = tx.Where("id", id)
+	now := time.Now().Unix()
+	return tx.Updates(map[string]interface{}{"update_time": now, "pending": false}).Error
 }
 
 func (dao *dao) DeleteCA(id uint64) error {
@@ -44,7 +70,17 @@ func (dao *dao) CreateCert(cert *Cert) error {
 	if dao.conf.Debug {
 		tx = tx.Debug()
 	}
-	return tx.Create(cert).Error
+	sealed := *cert
+	key, dek, kekID, err := dao.sealKey(cert.Key)
+	if err != nil {
+		return err
+	}
+	sealed.Key, sealed.KeyDEK, sealed.KeyKEKID = key, dek, kekID
+	if err = tx.Create(&sealed).Error; err != nil {
+		return err
+	}
+	cert.ID = sealed.ID
+	return nil
 }
 
 func (dao *dao) DeleteCert(delete *CertDelete) error {
@@ -69,7 +105,10 @@ func (dao *dao) GetCert(san string) (*Cert, error) {
 	if tx.RowsAffected == 0 {
 		return nil, gorm.ErrRecordNotFound
 	}
-	return cert, tx.Error
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return cert, dao.openCert(cert)
 }
 
 func (dao *dao) ListCert(query *CertQuery) ([]*Cert, error) {
@@ -80,6 +119,14 @@ func (dao *dao) ListCert(query *CertQuery) ([]*Cert, error) {
 	tx = buildCertQuery(tx, query)
 	certs := []*Cert{}
 	tx = tx.Find(&certs)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	for _, cert := range certs {
+		if err := dao.openCert(cert); err != nil {
+			return nil, err
+		}
+	}
 	return certs, nil
 }
 
@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"github.com/jumboframes/armorigo/log"
+)
+
+func (dao *dao) sealKey(key []byte) ([]byte, []byte, string, error) {
+	if dao.keyring == nil {
+		return key, nil, "", nil
+	}
+	return dao.keyring.seal(key)
+}
+
+func (dao *dao) openKey(key, dek []byte, kekID string) ([]byte, error) {
+	if kekID == "" {
+		// plaintext key, not migrated yet
+		return key, nil
+	}
+	if dao.keyring == nil {
+		return nil, ErrEncryptionOff
+	}
+	return dao.keyring.open(key, dek, kekID)
+}
+
+func (dao *dao) openCA(ca *CA) error {
+	key, err := dao.openKey(ca.Key, ca.KeyDEK, ca.KeyKEKID)
+	if err != nil {
+		return err
+	}
+	ca.Key, ca.KeyDEK, ca.KeyKEKID = key, nil, ""
+	return nil
+}
+
+func (dao *dao) openCert(cert *Cert) error {
+	key, err := dao.openKey(cert.Key, cert.KeyDEK, cert.KeyKEKID)
+	if err != nil {
+		return err
+	}
+	cert.Key, cert.KeyDEK, cert.KeyKEKID = key, nil, ""
+	return nil
+}
+
+// migrate keys to current KEK, deleted rows included since they are still in dumps
+func (dao *dao) migrateKeys() error {
+	cas := []*CA{}
+	if err := dao.db.Model(&CA{}).Find(&cas).Error; err != nil {
+		return err
+	}
+	for _, ca := range cas {
+		updates, err := dao.migrateKey(ca.Key, ca.KeyDEK, ca.KeyKEKID)
+		if err != nil {
+			log.Errorf("dao migrate keys, ca: %d err: %s", ca.ID, err)
+			return err
+		}
+		if updates == nil {
+			continue
+		}
+		if err = dao.db.Model(&CA{}).Where("id = ?", ca.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		log.Infof("dao migrate keys, ca: %d migrated to kek: %s", ca.ID, dao.keyring.current)
+	}
+
+	certs := []*Cert{}
+	if err := dao.db.Model(&Cert{}).Find(&certs).Error; err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		updates, err := dao.migrateKey(cert.Key, cert.KeyDEK, cert.KeyKEKID)
+		if err != nil {
+			log.Errorf("dao migrate keys, cert: %d err: %s", cert.ID, err)
+			return err
+		}
+		if updates == nil {
+			continue
+		}
+		if err = dao.db.Model(&Cert{}).Where("id = ?", cert.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		log.Infof("dao migrate keys, cert: %d migrated to kek: %s", cert.ID, dao.keyring.current)
+	}
+	return nil
+}
+
+// returns nil if nothing to update
+func (dao *dao) migrateKey(key, dek []byte, kekID string) (map[string]interface{}, error) {
+	switch kekID {
+	case dao.keyring.current:
+		return nil, nil
+	case "":
+		if len(key) == 0 {
+			return nil, nil
+		}
+		key, dek, kekID, err := dao.keyring.seal(key)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"key": key, "key_dek": dek, "key_kek_id": kekID}, nil
+	default:
+		dek, kekID, err := dao.keyring.rewrap(dek, kekID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"key_dek": dek, "key_kek_id": kekID}, nil
+	}
+}
@@ -0,0 +1,155 @@
+package repo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/moresec-io/conduit/pkg/manager/config"
+)
+
+var (
+	ErrKEKNotFound       = errors.New("key encryption key not found")
+	ErrIllegalKEK        = errors.New("illegal key encryption key, must be base64 encoded 32 bytes")
+	ErrIllegalCiphertext = errors.New("illegal ciphertext")
+	ErrEncryptionOff     = errors.New("key is encrypted but encryption is disabled")
+)
+
+// envelope encryption, every key is sealed by a random data encryption key(DEK),
+// and the DEK is sealed by the key encryption key(KEK). Rotating the KEK only
+// needs to rewrap DEKs.
+type keyring struct {
+	current string
+	keks    map[string]cipher.AEAD
+}
+
+func newKeyring(conf *config.Encryption) (*keyring, error) {
+	kr := &keyring{
+		current: conf.KEK.ID,
+		keks:    map[string]cipher.AEAD{},
+	}
+	for _, kek := range append([]config.KEK{conf.KEK}, conf.PreviousKEKs...) {
+		if kek.ID == "" {
+			return nil, fmt.Errorf("%w: empty id", ErrIllegalKEK)
+		}
+		if _, ok := kr.keks[kek.ID]; ok {
+			return nil, fmt.Errorf("%w: duplicated id %s", ErrIllegalKEK, kek.ID)
+		}
+		key, err := loadKEK(&kek)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		kr.keks[kek.ID] = aead
+	}
+	return kr, nil
+}
+
+func loadKEK(kek *config.KEK) ([]byte, error) {
+	var encoded string
+	switch {
+	case kek.File != "":
+		data, err := os.ReadFile(kek.File)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	case kek.Env != "":
+		encoded = os.Getenv(kek.Env)
+	default:
+		return nil, fmt.Errorf("%w: kek %s has neither file nor env", ErrIllegalKEK, kek.ID)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%w: kek %s", ErrIllegalKEK, kek.ID)
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// returns sealed data, wrapped DEK and the KEK id
+func (kr *keyring) seal(plaintext []byte) ([]byte, []byte, string, error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, nil, "", err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	ciphertext, err := sealAEAD(aead, plaintext, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	wrapped, err := sealAEAD(kr.keks[kr.current], dek, []byte(kr.current))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return ciphertext, wrapped, kr.current, nil
+}
+
+func (kr *keyring) open(ciphertext, wrapped []byte, kekID string) ([]byte, error) {
+	kek, ok := kr.keks[kekID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKEKNotFound, kekID)
+	}
+	dek, err := openAEAD(kek, wrapped, []byte(kekID))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return openAEAD(aead, ciphertext, nil)
+}
+
+// rewrap the DEK with current KEK, the sealed data stays untouched
+func (kr *keyring) rewrap(wrapped []byte, kekID string) ([]byte, string, error) {
+	kek, ok := kr.keks[kekID]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", ErrKEKNotFound, kekID)
+	}
+	dek, err := openAEAD(kek, wrapped, []byte(kekID))
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err = sealAEAD(kr.keks[kr.current], dek, []byte(kr.current))
+	if err != nil {
+		return nil, "", err
+	}
+	return wrapped, kr.current, nil
+}
+
+// nonce is prepended to the ciphertext
+func sealAEAD(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func openAEAD(aead cipher.AEAD, ciphertext, additional []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrIllegalCiphertext
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additional)
+}
@@ -0,0 +1,127 @@
+package repo
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moresec-io/conduit/pkg/manager/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newTestKEK(t *testing.T, id string) config.KEK {
+	key := make([]byte, 32)
+	rand.Read(key)
+	file := filepath.Join(t.TempDir(), id)
+	if err := os.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config.KEK{ID: id, File: file}
+}
+
+func TestKeyring(t *testing.T) {
+	Convey("keyring", t, func() {
+		kek1, kek2 := newTestKEK(t, "kek1"), newTestKEK(t, "kek2")
+		kr, err := newKeyring(&config.Encryption{Enable: true, KEK: kek1})
+		So(err, ShouldBeNil)
+
+		plaintext := []byte("private key")
+		ciphertext, wrapped, kekID, err := kr.seal(plaintext)
+		So(err, ShouldBeNil)
+		So(kekID, ShouldEqual, "kek1")
+		So(ciphertext, ShouldNotResemble, plaintext)
+
+		Convey("open", func() {
+			opened, err := kr.open(ciphertext, wrapped, kekID)
+			So(err, ShouldBeNil)
+			So(opened, ShouldResemble, plaintext)
+		})
+
+		Convey("rotate", func() {
+			rotated, err := newKeyring(&config.Encryption{
+				Enable:       true,
+				KEK:          kek2,
+				PreviousKEKs: []config.KEK{kek1},
+			})
+			So(err, ShouldBeNil)
+			wrapped, kekID, err := rotated.rewrap(wrapped, kekID)
+			So(err, ShouldBeNil)
+			So(kekID, ShouldEqual, "kek2")
+			opened, err := rotated.open(ciphertext, wrapped, kekID)
+			So(err, ShouldBeNil)
+			So(opened, ShouldResemble, plaintext)
+
+			// previous KEK retired
+			retired, err := newKeyring(&config.Encryption{Enable: true, KEK: kek2})
+			So(err, ShouldBeNil)
+			opened, err = retired.open(ciphertext, wrapped, kekID)
+			So(err, ShouldBeNil)
+			So(opened, ShouldResemble, plaintext)
+		})
+
+		Convey("wrong kek", func() {
+			_, err := kr.open(ciphertext, wrapped, "kek2")
+			So(err, ShouldWrap, ErrKEKNotFound)
+
+			other, err := newKeyring(&config.Encryption{Enable: true, KEK: config.KEK{ID: "kek1", File: kek2.File}})
+			So(err, ShouldBeNil)
+			_, err = other.open(ciphertext, wrapped, kekID)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("illegal kek", func() {
+			os.Setenv("CONDUIT_TEST_KEK", "short")
+			defer os.Unsetenv("CONDUIT_TEST_KEK")
+			_, err := newKeyring(&config.Encryption{Enable: true, KEK: config.KEK{ID: "env", Env: "CONDUIT_TEST_KEK"}})
+			So(err, ShouldWrap, ErrIllegalKEK)
+		})
+	})
+}
+
+func TestDaoMigrateKeys(t *testing.T) {
+	Convey("dao migrate keys", t, func() {
+		conf := &config.Config{DB: config.DB{
+			Driver:  DBDriverSqlite,
+			Address: t.TempDir(),
+			DB:      "conduit.db",
+		}}
+		// rows written before encryption enabled
+		plain, err := NewDao(conf)
+		So(err, ShouldBeNil)
+		cert := &Cert{SubjectAlternativeName: "conduit.com", Key: []byte("private key")}
+		So(plain.CreateCert(cert), ShouldBeNil)
+		So(plain.Close(), ShouldBeNil)
+
+		kek1, kek2 := newTestKEK(t, "kek1"), newTestKEK(t, "kek2")
+		conf.DB.Encryption = config.Encryption{Enable: true, KEK: kek1}
+		encrypted, err := NewDao(conf)
+		So(err, ShouldBeNil)
+		raw := &Cert{}
+		So(encrypted.db.Model(&Cert{}).Where("id = ?", cert.ID).Find(raw).Error, ShouldBeNil)
+		So(raw.KeyKEKID, ShouldEqual, "kek1")
+		So(raw.Key, ShouldNotResemble, []byte("private key"))
+		got, err := encrypted.GetCert("conduit.com")
+		So(err, ShouldBeNil)
+		So(got.Key, ShouldResemble, []byte("private key"))
+		So(encrypted.Close(), ShouldBeNil)
+
+		// rotate
+		conf.DB.Encryption = config.Encryption{Enable: true, KEK: kek2, PreviousKEKs: []config.KEK{kek1}}
+		rotated, err := NewDao(conf)
+		So(err, ShouldBeNil)
+		raw = &Cert{}
+		So(rotated.db.Model(&Cert{}).Where("id = ?", cert.ID).Find(raw).Error, ShouldBeNil)
+		So(raw.KeyKEKID, ShouldEqual, "kek2")
+		So(rotated.Close(), ShouldBeNil)
+
+		// encryption disabled on encrypted rows
+		conf.DB.Encryption = config.Encryption{}
+		off, err := NewDao(conf)
+		So(err, ShouldBeNil)
+		_, err = off.GetCert("conduit.com")
+		So(err, ShouldEqual, ErrEncryptionOff)
+		So(off.Close(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,56 @@
+package repo
+
+import (
+	"errors"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/manager/metrics"
+	"gorm.io/gorm"
+)
+
+const metricsStartKey = "metrics:start"
+
+// observe db latency and errors by gorm callbacks
+func registerMetrics(db *gorm.DB) error {
+	callback := db.Callback()
+	if err := callback.Create().Before("gorm:create").Register("metrics:before_create", metricsBefore); err != nil {
+		return err
+	}
+	if err := callback.Create().After("gorm:create").Register("metrics:after_create", metricsAfter("create")); err != nil {
+		return err
+	}
+	if err := callback.Query().Before("gorm:query").Register("metrics:before_query", metricsBefore); err != nil {
+		return err
+	}
+	if err := callback.Query().After("gorm:query").Register("metrics:after_query", metricsAfter("query")); err != nil {
+		return err
+	}
+	if err := callback.Update().Before("gorm:update").Register("metrics:before_update", metricsBefore); err != nil {
+		return err
+	}
+	if err := callback.Update().After("gorm:update").Register("metrics:after_update", metricsAfter("update")); err != nil {
+		return err
+	}
+	if err := callback.Delete().Before("gorm:delete").Register("metrics:before_delete", metricsBefore); err != nil {
+		return err
+	}
+	return callback.Delete().After("gorm:delete").Register("metrics:after_delete", metricsAfter("delete"))
+}
+
+func metricsBefore(tx *gorm.DB) {
+	tx.InstanceSet(metricsStartKey, time.Now())
+}
+
+func metricsAfter(op string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		value, ok := tx.InstanceGet(metricsStartKey)
+		if !ok {
+			return
+		}
+		table := tx.Statement.Table
+		metrics.DBDuration.With(op, table).Observe(time.Since(value.(time.Time)).Seconds())
+		if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			metrics.DBErrors.With(op, table).Inc()
+		}
+	}
+}
@@ -14,6 +14,8 @@ type Cert struct {
 	Expiration             int64  `gorm:"expiration"`
 	Cert                   []byte `gorm:"cert;type:text"`
 	Key                    []byte `gorm:"key;type:text"`
+	KeyDEK                 []byte `gorm:"key_dek;type:text"` // wrapped data encryption key
+	KeyKEKID               string `gorm:"key_kek_id"`        // empty means key in plaintext
 	Deleted                bool   `gorm:"deleted"`
 	CreateTime             int64  `gorm:"create_time"`
 	UpdateTime             int64  `gorm:"update_time"`
@@ -31,6 +33,9 @@ type CA struct {
 	Expiration   int64  `gorm:"expiration"`
 	Cert         []byte `gorm:"cert;type:text"`
 	Key          []byte `gorm:"key;type:text"`
+	KeyDEK       []byte `gorm:"key_dek;type:text"` // wrapped data encryption key
+	KeyKEKID     string `gorm:"key_kek_id"`        // empty means key in plaintext
+	Pending      bool   `gorm:"pending"`           // trusted by conduits but not signing yet
 	Deleted      bool   `gorm:"deleted"`
 	CreateTime   int64  `gorm:"create_time"`
 	UpdateTime   int64  `gorm:"update_time"`
@@ -4,13 +4,17 @@ import "github.com/moresec-io/conduit/pkg/manager/config"
 
 type Repo interface {
 	CreateCA(ca *CA) error
-	GetCA() (*CA, error)
+	// the oldest first
+	ListCA() ([]*CA, error)
+	ActivateCA(id uint64) error
 	DeleteCA(id uint64) error
 
 	CreateCert(cert *Cert) error
 	DeleteCert(delete *CertDelete) error
 	GetCert(san string) (*Cert, error)
 	ListCert(query *CertQuery) ([]*Cert, error)
+
+	Ping() error
 }
 
 func NewRepo(conf *config.Config) (Repo, error) {
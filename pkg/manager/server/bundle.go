@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/utils"
+)
+
+var (
+	ErrUnsupportedPublicKey = errors.New("unsupported public key")
+)
+
+// refresh hint for spiffe-aware peers in seconds
+const bundleRefreshHint = 300
+
+// SPIFFE trust bundle, see
+// https://github.com/spiffe/spiffe/blob/main/standards/SPIFFE_Trust_Domain_and_Bundle.md
+type bundle struct {
+	Keys        []*jwk `json:"keys"`
+	RefreshHint int    `json:"spiffe_refresh_hint,omitempty"`
+}
+
+type jwk struct {
+	Use string   `json:"use"`
+	Kty string   `json:"kty"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	N   string   `json:"n,omitempty"`
+	E   string   `json:"e,omitempty"`
+	X5c []string `json:"x5c"`
+}
+
+// GET /v1/trustbundle, returns the bundle in spiffe format, or pem with ?format=pem
+func (server *Server) TrustBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// the next CA joins while rotating
+	cas, err := server.cms.CABundle()
+	if err != nil {
+		log.Errorf("server trust bundle, cms get ca bundle err: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	x509cas := []*x509.Certificate{}
+	for _, cacert := range cas {
+		ca, err := x509.ParseCertificate(cacert)
+		if err != nil {
+			log.Errorf("server trust bundle, parse ca cert err: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		x509cas = append(x509cas, ca)
+	}
+	w.Header().Set("X-Spiffe-Trust-Domain", server.cms.TrustDomain())
+	if r.URL.Query().Get("format") == "pem" {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		for _, ca := range x509cas {
+			w.Write([]byte(utils.X509CertoToPem(ca)))
+		}
+		return
+	}
+	keys := []*jwk{}
+	for _, ca := range x509cas {
+		key, err := newX509SVIDJWK(ca)
+		if err != nil {
+			log.Errorf("server trust bundle, new jwk err: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, key)
+	}
+	data, err := json.Marshal(&bundle{
+		Keys:        keys,
+		RefreshHint: bundleRefreshHint,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func newX509SVIDJWK(ca *x509.Certificate) (*jwk, error) {
+	key := &jwk{
+		Use: "x509-svid",
+		X5c: []string{base64.StdEncoding.EncodeToString(ca.Raw)},
+	}
+	switch pub := ca.PublicKey.(type) {
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		key.Kty = "EC"
+		key.Crv = pub.Curve.Params().Name
+		key.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		key.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	default:
+		return nil, ErrUnsupportedPublicKey
+	}
+	return key, nil
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/manager/repo"
+	"github.com/moresec-io/conduit/pkg/utils"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrIllegalSAN       = errors.New("illegal san")
+	ErrIllegalMachineID = errors.New("illegal machine id")
+)
+
+type certInfo struct {
+	ID        uint64    `json:"id,omitempty"`
+	SAN       string    `json:"san"`
+	SPIFFEID  string    `json:"spiffe_id,omitempty"`
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	PEM       string    `json:"pem,omitempty"`
+}
+
+func newCertInfo(cert []byte, withPEM bool) (*certInfo, error) {
+	x509cert, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	info := &certInfo{
+		Serial:    utils.FormatSerial(x509cert.SerialNumber),
+		Subject:   x509cert.Subject.String(),
+		Issuer:    x509cert.Issuer.String(),
+		NotBefore: x509cert.NotBefore,
+		NotAfter:  x509cert.NotAfter,
+	}
+	if len(x509cert.IPAddresses) != 0 {
+		info.SAN = x509cert.IPAddresses[0].String()
+	}
+	if id, err := utils.CertSPIFFEID(x509cert); err == nil {
+		info.SPIFFEID = id.String()
+	}
+	if withPEM {
+		info.PEM = utils.X509CertoToPem(x509cert)
+	}
+	return info, nil
+}
+
+type issueRequest struct {
+	MachineID string `json:"machine_id"`
+	SAN       string `json:"san"`
+	// reissue even if the cert exists
+	Renew bool `json:"renew"`
+}
+
+// GET /v1/certs to list server certs, POST /v1/certs with the token to issue one
+func (server *Server) Certs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		server.listCerts(w, r)
+	case http.MethodPost:
+		if !server.authorized(w, r) {
+			return
+		}
+		server.issueCert(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (server *Server) listCerts(w http.ResponseWriter, _ *http.Request) {
+	mcerts, err := server.repo.ListCert(&repo.CertQuery{})
+	if err != nil {
+		log.Errorf("server list certs, repo list cert err: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	infos := []*certInfo{}
+	for _, mcert := range mcerts {
+		info, err := newCertInfo(mcert.Cert, false)
+		if err != nil {
+			log.Errorf("server list certs, parse cert: %d err: %s", mcert.ID, err)
+			continue
+		}
+		info.ID = mcert.ID
+		info.SAN = mcert.SubjectAlternativeName
+		infos = append(infos, info)
+	}
+	writeJSON(w, infos)
+}
+
+func (server *Server) issueCert(w http.ResponseWriter, r *http.Request) {
+	req := &issueRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	san := net.ParseIP(req.SAN)
+	if san == nil {
+		http.Error(w, ErrIllegalSAN.Error(), http.StatusBadRequest)
+		return
+	}
+	// renewing keeps the identity in the cert
+	if req.MachineID == "" && !req.Renew {
+		http.Error(w, ErrIllegalMachineID.Error(), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if req.Renew {
+		_, err = server.cms.RenewServerCert(san)
+	} else {
+		_, err = server.cms.GetServerCert(req.MachineID, san)
+	}
+	if err != nil {
+		log.Errorf("server issue cert, san: %s err: %s", san, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the key is only delivered to conduits
+	server.getCert(w, san)
+}
+
+// GET /v1/certs/{san} to inspect, DELETE /v1/certs/{san} with the token to revoke
+func (server *Server) Cert(w http.ResponseWriter, r *http.Request) {
+	san := net.ParseIP(strings.TrimPrefix(r.URL.Path, "/v1/certs/"))
+	if san == nil {
+		http.Error(w, ErrIllegalSAN.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		server.getCert(w, san)
+	case http.MethodDelete:
+		if !server.authorized(w, r) {
+			return
+		}
+		if err := server.cms.DelCertBySAN(san); err != nil {
+			log.Errorf("server revoke cert, san: %s err: %s", san, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (server *Server) getCert(w http.ResponseWriter, san net.IP) {
+	mcert, err := server.repo.GetCert(san.String())
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Errorf("server get cert, san: %s err: %s", san, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	info, err := newCertInfo(mcert.Cert, true)
+	if err != nil {
+		log.Errorf("server get cert, parse cert: %d err: %s", mcert.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	info.ID = mcert.ID
+	info.SAN = mcert.SubjectAlternativeName
+	writeJSON(w, info)
+}
+
+// GET /v1/certs/expiry, remaining lifetime of the CA and server certs
+func (server *Server) CertExpiries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, server.scanner.Expiries())
+}
+
+// GET /v1/certs/events, recent expiry events
+func (server *Server) CertEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, server.scanner.Events())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
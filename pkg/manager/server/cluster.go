@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// GET /v1/cluster, registered conduits
+func (server *Server) Cluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, server.conduitManager.ListConduits())
+}
+
+// GET /v1/cluster/{machine_id}
+func (server *Server) ClusterNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	info, ok := server.conduitManager.GetConduit(strings.TrimPrefix(r.URL.Path, "/v1/cluster/"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, info)
+}
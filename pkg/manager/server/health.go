@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	checkOK     = "ok"
+	checkFailed = "failed"
+)
+
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// liveness, the conduit listener is accepting
+func (server *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	server.health(w, server.checkListener())
+}
+
+// readiness, the conduit listener is accepting and the db is reachable
+func (server *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := server.checkListener()
+	checks["db"] = checkOK
+	if err := server.repo.Ping(); err != nil {
+		checks["db"] = checkFailed + ": " + err.Error()
+	}
+	server.health(w, checks)
+}
+
+func (server *Server) checkListener() map[string]string {
+	checks := map[string]string{"listener": checkOK}
+	if !server.conduitManager.Serving() {
+		checks["listener"] = checkFailed + ": not accepting"
+	}
+	return checks
+}
+
+func (server *Server) health(w http.ResponseWriter, checks map[string]string) {
+	status := &healthStatus{Status: checkOK, Checks: checks}
+	code := http.StatusOK
+	for _, check := range checks {
+		if check != checkOK {
+			status.Status = checkFailed
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
@@ -1,32 +1,123 @@
 package server
 
 import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
 	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/manager/apis"
+	"github.com/moresec-io/conduit/pkg/manager/cms"
 	"github.com/moresec-io/conduit/pkg/manager/config"
+	"github.com/moresec-io/conduit/pkg/manager/metrics"
 	"github.com/moresec-io/conduit/pkg/manager/repo"
+	"github.com/moresec-io/conduit/pkg/manager/service"
 	"github.com/moresec-io/conduit/pkg/network"
-	"github.com/singchia/go-timer/v2"
 	"github.com/soheilhy/cmux"
 )
 
+var (
+	ErrNoToken      = errors.New("no control plane token configured")
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
 type Server struct {
-	tmr timer.Timer
+	// bearer token for mutating apis
+	token          string
+	cms            cms.CMS
+	scanner        *cms.ExpiryScanner
+	repo           repo.Repo
+	conduitManager *service.ConduitManager
+
+	ln   net.Listener
+	cm   cmux.CMux
+	http *http.Server
 }
 
-// TODO add control plane
-func NewServer(conf *config.Config, repo repo.Repo) (*Server, error) {
+func NewServer(conf *config.Config, cms cms.CMS, scanner *cms.ExpiryScanner,
+	repo repo.Repo, conduitManager *service.ConduitManager) (*Server, error) {
 	listen := &conf.ControlPlane.Listen
 	ln, err := network.Listen(listen)
 	if err != nil {
 		log.Errorf("server listen err: %s", err)
 		return nil, err
 	}
-	server := &Server{}
+	server := &Server{
+		token:          conf.ControlPlane.Token,
+		cms:            cms,
+		scanner:        scanner,
+		repo:           repo,
+		conduitManager: conduitManager,
+		ln:             ln,
+	}
+	if server.token == "" {
+		server.token = os.Getenv(config.EnvControlPlaneToken)
+	}
+	if server.token == "" {
+		log.Warnf("server, no control plane token, issuing and revoking certs are refused")
+	}
+	server.http = &http.Server{
+		Handler: server.router(),
+	}
 
 	// http and geminio server
-	cm := cmux.New(ln)
-	// the first byte is geminio Version, the second byte is geminio ConnPacket
-	_ = cm.Match(cmux.PrefixMatcher(string([]byte{0x01, 0x01})))
-	_ = cm.Match(cmux.Any())
+	// TODO geminio control plane, the first byte is geminio Version,
+	// the second byte is geminio ConnPacket
+	server.cm = cmux.New(ln)
 	return server, nil
 }
+
+func (server *Server) router() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/trustbundle", server.TrustBundle)
+	mux.HandleFunc("/v1/cluster", server.Cluster)
+	mux.HandleFunc("/v1/cluster/", server.ClusterNode)
+	mux.HandleFunc("/v1/certs", server.Certs)
+	mux.HandleFunc("/v1/certs/", server.Cert)
+	mux.HandleFunc("/v1/certs/expiry", server.CertExpiries)
+	mux.HandleFunc("/v1/certs/events", server.CertEvents)
+	mux.Handle("/metrics", metrics.Registry.Handler())
+	mux.HandleFunc("/healthz", server.Healthz)
+	mux.HandleFunc("/readyz", server.Readyz)
+	return mux
+}
+
+// mutating apis require the bearer token, refused if no token configured
+func (server *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if server.token == "" {
+		http.Error(w, ErrNoToken.Error(), http.StatusForbidden)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(server.token)) != 1 {
+		log.Warnf("server, unauthorized %s %s from: %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, ErrUnauthorized.Error(), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (server *Server) Serve() {
+	httpln := server.cm.Match(cmux.Any())
+	go func() {
+		err := server.http.Serve(httpln)
+		if err != nil && err != http.ErrServerClosed && err != cmux.ErrListenerClosed {
+			log.Errorf("server http serve err: %s", err)
+		}
+	}()
+	go func() {
+		err := server.cm.Serve()
+		if err != nil && !strings.Contains(err.Error(), apis.ErrStrUseOfClosedConnection) {
+			log.Errorf("server cmux serve err: %s", err)
+		}
+	}()
+}
+
+func (server *Server) Close() {
+	server.http.Close()
+	server.ln.Close()
+}
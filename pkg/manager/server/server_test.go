@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAuthorized(t *testing.T) {
+	Convey("authorized", t, func() {
+		server := &Server{}
+		newRequest := func(token string) *http.Request {
+			r := httptest.NewRequest(http.MethodDelete, "/v1/certs/10.0.0.1", nil)
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			return r
+		}
+
+		Convey("refused without token configured", func() {
+			w := httptest.NewRecorder()
+			server.Cert(w, newRequest("secret"))
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("bearer token", func() {
+			server.token = "secret"
+			w := httptest.NewRecorder()
+			server.Cert(w, newRequest(""))
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+			w = httptest.NewRecorder()
+			server.Certs(w, httptest.NewRequest(http.MethodPost, "/v1/certs", nil))
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+			w = httptest.NewRecorder()
+			So(server.authorized(w, newRequest("wrong")), ShouldBeFalse)
+			So(server.authorized(httptest.NewRecorder(), newRequest("secret")), ShouldBeTrue)
+		})
+	})
+}
@@ -22,6 +22,15 @@ type ServerConfig struct {
 	Network string
 	Cert    *cms.Cert
 	IPs     []net.IP
+	IPNets  []net.IPNet
+	// stops accepting new connections
+	Draining bool
+	// relays connections to other conduits
+	Relay bool
+	// behind nat, reached through relays
+	Reverse bool
+	// machine ids of servers behind nat keeping sessions to us as the relay
+	Reverses []string
 }
 
 type Conduit interface {
@@ -30,16 +39,25 @@ type Conduit interface {
 	IsClient() bool
 	GetServerConfig() *ServerConfig
 	SetServer(*ServerConfig)
-	SetServerIPs([]net.IP)
+	SetServerNetworks([]net.IP, []net.IPNet)
+	SetServerDraining()
 	IsServer() bool
+	SetZone(zone string, reaches []string)
+	Zone() string
+	Reaches() []string
 
 	// events
 	ServerOffline(machineID string) error
 	ServerOnline(serverConduit *proto.Conduit) error
-	ServerNetworksChanged(machineID string, ips []net.IP) error
+	ServerNetworksChanged(machineID string, ips []net.IP, ipnets []net.IPNet) error
+	ServerDraining(machineID string) error
+	TrustBundle(cas [][]byte) error
+	CertsRenewed() error
 
 	// meta
 	MachineID() string
+	ClientID() uint64
+	RemoteAddr() net.Addr
 
 	// lifecycle
 	Close() error
@@ -57,6 +75,8 @@ type conduit struct {
 	typ          ConduitType
 	serverConfig *ServerConfig
 	machineID    string
+	zone         string
+	reaches      []string
 }
 
 // caches
@@ -68,8 +88,13 @@ func (conduit *conduit) GetServerConfig() *ServerConfig {
 	return conduit.serverConfig
 }
 
-func (conduit *conduit) SetServerIPs(ips []net.IP) {
+func (conduit *conduit) SetServerNetworks(ips []net.IP, ipnets []net.IPNet) {
 	conduit.serverConfig.IPs = ips
+	conduit.serverConfig.IPNets = ipnets
+}
+
+func (conduit *conduit) SetServerDraining() {
+	conduit.serverConfig.Draining = true
 }
 
 func (conduit *conduit) SetServer(config *ServerConfig) {
@@ -85,6 +110,19 @@ func (conduit *conduit) IsClient() bool {
 	return (conduit.typ & ConduitClient) > 0
 }
 
+func (conduit *conduit) SetZone(zone string, reaches []string) {
+	conduit.zone = zone
+	conduit.reaches = reaches
+}
+
+func (conduit *conduit) Zone() string {
+	return conduit.zone
+}
+
+func (conduit *conduit) Reaches() []string {
+	return conduit.reaches
+}
+
 // events
 func (conduit *conduit) ServerOffline(machineID string) error {
 	request := &proto.SyncConduitOfflineRequest{
@@ -124,10 +162,11 @@ func (conduit *conduit) ServerOnline(serverConduit *proto.Conduit) error {
 	return nil
 }
 
-func (conduit *conduit) ServerNetworksChanged(machineID string, ips []net.IP) error {
+func (conduit *conduit) ServerNetworksChanged(machineID string, ips []net.IP, ipnets []net.IPNet) error {
 	request := &proto.SyncConduitNetworksChangedRequest{
 		MachineID: machineID,
 		IPs:       ips,
+		IPNets:    ipnets,
 	}
 	data, err := json.Marshal(request)
 	if err != nil {
@@ -144,11 +183,69 @@ func (conduit *conduit) ServerNetworksChanged(machineID string, ips []net.IP) er
 	return nil
 }
 
+func (conduit *conduit) ServerDraining(machineID string) error {
+	request := &proto.SyncConduitDrainingRequest{
+		MachineID: machineID,
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req := conduit.end.NewRequest(data)
+	rsp, err := conduit.end.Call(context.TODO(), proto.RPCSyncConduitDraining, req)
+	if err != nil {
+		return err
+	}
+	if rsp.Error() != nil {
+		return rsp.Error()
+	}
+	return nil
+}
+
+func (conduit *conduit) TrustBundle(cas [][]byte) error {
+	request := &proto.SyncTrustBundleRequest{
+		CAs: cas,
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req := conduit.end.NewRequest(data)
+	rsp, err := conduit.end.Call(context.TODO(), proto.RPCSyncTrustBundle, req)
+	if err != nil {
+		return err
+	}
+	if rsp.Error() != nil {
+		return rsp.Error()
+	}
+	return nil
+}
+
+func (conduit *conduit) CertsRenewed() error {
+	req := conduit.end.NewRequest(nil)
+	rsp, err := conduit.end.Call(context.TODO(), proto.RPCSyncCertsRenewed, req)
+	if err != nil {
+		return err
+	}
+	if rsp.Error() != nil {
+		return rsp.Error()
+	}
+	return nil
+}
+
 // meta
 func (conduit *conduit) MachineID() string {
 	return conduit.machineID
 }
 
+func (conduit *conduit) ClientID() uint64 {
+	return conduit.end.ClientID()
+}
+
+func (conduit *conduit) RemoteAddr() net.Addr {
+	return conduit.end.RemoteAddr()
+}
+
 func (conduit *conduit) Close() error {
 	return conduit.end.Close()
 }
@@ -5,15 +5,19 @@ import (
 	"encoding/json"
 	"errors"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jumboframes/armorigo/log"
+	gconfig "github.com/moresec-io/conduit/pkg/config"
 	"github.com/moresec-io/conduit/pkg/manager/apis"
 	"github.com/moresec-io/conduit/pkg/manager/cms"
 	"github.com/moresec-io/conduit/pkg/manager/config"
+	"github.com/moresec-io/conduit/pkg/manager/metrics"
 	"github.com/moresec-io/conduit/pkg/manager/repo"
 	"github.com/moresec-io/conduit/pkg/network"
 	"github.com/moresec-io/conduit/pkg/proto"
@@ -37,6 +41,7 @@ const (
 	eventTypeServerOnline
 	eventTypeServerOffline
 	eventTypeServerNetworkChanged
+	eventTypeServerDraining
 )
 
 type event struct {
@@ -53,6 +58,10 @@ type ConduitManager struct {
 	idFactory id.IDFactory
 	// event channel
 	eventCh chan *event
+	// whether the listener is accepting
+	serving int32
+	// exclusions distributed to clients
+	exclude *gconfig.Exclude
 
 	// inflight ends
 	mtx        sync.RWMutex
@@ -74,6 +83,7 @@ func NewConduitManager(conf *config.Config, repo repo.Repo, cms cms.CMS, tmr tim
 		machineIDs:            map[uint64]string{},
 		ends:                  map[string]*endNtime{},
 		conduits:              map[string]Conduit{},
+		exclude:               &conf.ConduitManager.Exclude,
 	}
 	ln, err := network.Listen(listen)
 	if err != nil {
@@ -82,12 +92,15 @@ func NewConduitManager(conf *config.Config, repo repo.Repo, cms cms.CMS, tmr tim
 	}
 	cm.ln = ln
 	go cm.notify()
+	metrics.Registry.OnCollect(cm.collect)
 
 	return cm, nil
 }
 
 func (cm *ConduitManager) Serve() {
+	atomic.StoreInt32(&cm.serving, 1)
 	go func() error {
+		defer atomic.StoreInt32(&cm.serving, 0)
 		for {
 			conn, err := cm.ln.Accept()
 			if err != nil {
@@ -102,6 +115,11 @@ func (cm *ConduitManager) Serve() {
 	}()
 }
 
+// Serving reports whether the listener is still accepting conduits
+func (cm *ConduitManager) Serving() bool {
+	return atomic.LoadInt32(&cm.serving) == 1
+}
+
 func (cm *ConduitManager) notify() {
 	for {
 		event, ok := <-cm.eventCh
@@ -110,7 +128,7 @@ func (cm *ConduitManager) notify() {
 		}
 		switch event.eventType {
 		case eventTypeServerOffline:
-			for _, conduit := range cm.conduits {
+			for _, conduit := range cm.listConduits() {
 				if conduit.IsClient() {
 					if conduit.MachineID() == event.conduit.MachineID() {
 						// ignore the event source conduit
@@ -124,36 +142,61 @@ func (cm *ConduitManager) notify() {
 				}
 			}
 		case eventTypeServerOnline:
+			// routes of all clients from one snapshot, calls to conduits are out of mtx
+			clients, routes := []Conduit{}, [][]string{}
+			cm.mtx.RLock()
 			for _, conduit := range cm.conduits {
 				if conduit.IsClient() {
 					if conduit.MachineID() == event.conduit.MachineID() {
 						// ignore the event source conduit
 						continue
 					}
-					// notify all clients
-					err := conduit.ServerOnline(&proto.Conduit{
-						MachineID: event.conduit.MachineID(),
-						Network:   event.conduit.GetServerConfig().Network,
-						Addr:      event.conduit.GetServerConfig().Addr,
-						IPs:       event.conduit.GetServerConfig().IPs,
-					})
-					if err != nil {
-						log.Errorf("conduit manager, call conduit server online err: %s", err)
-					}
+					clients = append(clients, conduit)
+					routes = append(routes, cm.route(conduit, event.conduit))
+				}
+			}
+			cm.mtx.RUnlock()
+			// notify all clients
+			for i, conduit := range clients {
+				err := conduit.ServerOnline(&proto.Conduit{
+					MachineID: event.conduit.MachineID(),
+					Network:   event.conduit.GetServerConfig().Network,
+					Addr:      event.conduit.GetServerConfig().Addr,
+					IPs:       event.conduit.GetServerConfig().IPs,
+					IPNets:    event.conduit.GetServerConfig().IPNets,
+					Route:     routes[i],
+				})
+				if err != nil {
+					log.Errorf("conduit manager, call conduit server online err: %s", err)
 				}
 			}
 		case eventTypeServerNetworkChanged:
-			for _, conduit := range cm.conduits {
+			for _, conduit := range cm.listConduits() {
 				if conduit.MachineID() == event.conduit.MachineID() {
 					// ignore the event source conduit
 					continue
 				}
 				// notify all clients
-				err := conduit.ServerNetworksChanged(conduit.MachineID(), event.conduit.GetServerConfig().IPs)
+				serverConfig := event.conduit.GetServerConfig()
+				err := conduit.ServerNetworksChanged(event.conduit.MachineID(), serverConfig.IPs, serverConfig.IPNets)
 				if err != nil {
 					log.Errorf("conduit manager, call conduit server network changed err: %s", err)
 				}
 			}
+		case eventTypeServerDraining:
+			for _, conduit := range cm.listConduits() {
+				if conduit.IsClient() {
+					if conduit.MachineID() == event.conduit.MachineID() {
+						// ignore the event source conduit
+						continue
+					}
+					// notify all clients
+					err := conduit.ServerDraining(event.conduit.MachineID())
+					if err != nil {
+						log.Errorf("conduit manager, call conduit server draining err: %s", err)
+					}
+				}
+			}
 		}
 	}
 }
@@ -187,29 +230,47 @@ func (cm *ConduitManager) handleConn(conn net.Conn) error {
 
 func (cm *ConduitManager) register(end geminio.End) error {
 	// register ReportNetworks function
-	err := end.Register(context.TODO(), proto.RPCReportNetworks, cm.ReportNetworks)
+	err := end.Register(context.TODO(), proto.RPCReportNetworks, instrument(proto.RPCReportNetworks, cm.ReportNetworks))
 	if err != nil {
 		log.Errorf("conduit manager register, register ReportConduit err: %s", err)
 		return err
 	}
 	// register ReportClient function
-	err = end.Register(context.TODO(), proto.RPCReportClient, cm.ReportClient)
+	err = end.Register(context.TODO(), proto.RPCReportClient, instrument(proto.RPCReportClient, cm.ReportClient))
 	if err != nil {
 		log.Errorf("conduit manager register, register ReportClient err: %s", err)
 		return err
 	}
 	// register ReportServer function
-	err = end.Register(context.TODO(), proto.RPCReportServer, cm.ReportServer)
+	err = end.Register(context.TODO(), proto.RPCReportServer, instrument(proto.RPCReportServer, cm.ReportServer))
 	if err != nil {
 		log.Errorf("conduit manager register, register ReportServer err: %s", err)
 		return err
 	}
+	// register ReportDraining function
+	err = end.Register(context.TODO(), proto.RPCReportDraining, instrument(proto.RPCReportDraining, cm.ReportDraining))
+	if err != nil {
+		log.Errorf("conduit manager register, register ReportDraining err: %s", err)
+		return err
+	}
+	// register ReportReverses function
+	err = end.Register(context.TODO(), proto.RPCReportReverses, instrument(proto.RPCReportReverses, cm.ReportReverses))
+	if err != nil {
+		log.Errorf("conduit manager register, register ReportReverses err: %s", err)
+		return err
+	}
 	// register PullCluster function
-	err = end.Register(context.TODO(), proto.RPCPullCluster, cm.PullCluster)
+	err = end.Register(context.TODO(), proto.RPCPullCluster, instrument(proto.RPCPullCluster, cm.PullCluster))
 	if err != nil {
 		log.Errorf("conduit manager register, register PullCluster err: %s", err)
 		return err
 	}
+	// register PullCerts function
+	err = end.Register(context.TODO(), proto.RPCPullCerts, instrument(proto.RPCPullCerts, cm.PullCerts))
+	if err != nil {
+		log.Errorf("conduit manager register, register PullCerts err: %s", err)
+		return err
+	}
 
 	log.Infof("conduit manager register functions for end: %s success", end.RemoteAddr().String())
 	return nil
@@ -224,7 +285,7 @@ func (cm *ConduitManager) ReportClient(_ context.Context, req geminio.Request, r
 		return
 	}
 	log.Infof("conduit manager report client, machine_id: %s", request.MachineID)
-	cert, err := cm.cms.GetClientCert()
+	cert, err := cm.cms.GetClientCert(request.MachineID)
 	if err != nil {
 		log.Errorf("conduit manager report client, cms get client cert err: %s", err)
 		rsp.SetError(err)
@@ -233,6 +294,7 @@ func (cm *ConduitManager) ReportClient(_ context.Context, req geminio.Request, r
 	response := &proto.ReportClientResponse{
 		TLS: &proto.TLS{
 			CA:   cert.CA,
+			CAs:  cert.CAs,
 			Cert: cert.Cert,
 			Key:  cert.Key,
 		},
@@ -257,11 +319,13 @@ func (cm *ConduitManager) ReportClient(_ context.Context, req geminio.Request, r
 			return
 		}
 		conduit.SetClient()
+		conduit.SetZone(request.Zone, request.Reaches)
 		return
 	}
 
 	conduit := NewConduit(request.MachineID, end.end)
 	conduit.SetClient()
+	conduit.SetZone(request.Zone, request.Reaches)
 	cm.conduits[request.MachineID] = conduit
 	// delete after transfer to conduits
 	delete(cm.ends, request.MachineID)
@@ -290,7 +354,7 @@ func (cm *ConduitManager) ReportServer(_ context.Context, req geminio.Request, r
 	}
 	ip := net.ParseIP(host)
 	// set ip as cert san
-	cert, err := cm.cms.GetServerCert(ip)
+	cert, err := cm.cms.GetServerCert(request.MachineID, ip)
 	if err != nil {
 		rsp.SetError(err)
 		return
@@ -300,6 +364,7 @@ func (cm *ConduitManager) ReportServer(_ context.Context, req geminio.Request, r
 	response := &proto.ReportServerResponse{
 		TLS: &proto.TLS{
 			CA:   cert.CA,
+			CAs:  cert.CAs,
 			Cert: cert.Cert,
 			Key:  cert.Key,
 		},
@@ -317,10 +382,11 @@ func (cm *ConduitManager) ReportServer(_ context.Context, req geminio.Request, r
 		Addr:    request.Addr,
 		Cert:    cert,
 		IPs:     request.IPs,
+		Relay:   request.Relay,
+		Reverse: request.Reverse,
 	}
 
 	cm.mtx.Lock()
-	defer cm.mtx.Unlock()
 	// cache it
 	end, ok := cm.ends[request.MachineID]
 	if !ok {
@@ -328,21 +394,27 @@ func (cm *ConduitManager) ReportServer(_ context.Context, req geminio.Request, r
 		if !ok {
 			log.Errorf("conduit manager report server, conduit: %s not found", request.MachineID)
 			rsp.SetError(errors.New("end not found"))
+			cm.mtx.Unlock()
 			return
 		}
 		conduit.SetServer(serverConfig)
-		// server conduit online event
+		conduit.SetZone(request.Zone, request.Reaches)
+		cm.mtx.Unlock()
+
+		// server conduit online event, notify takes mtx too
 		cm.eventCh <- &event{
 			eventType: eventTypeServerOnline,
 			conduit:   conduit,
 		}
-	} else {
-		conduit := NewConduit(request.MachineID, end.end)
-		conduit.SetServer(serverConfig)
-		cm.conduits[request.MachineID] = conduit
-		// delete after transfer to conduits
-		delete(cm.ends, request.MachineID)
+		return
 	}
+	conduit := NewConduit(request.MachineID, end.end)
+	conduit.SetServer(serverConfig)
+	conduit.SetZone(request.Zone, request.Reaches)
+	cm.conduits[request.MachineID] = conduit
+	// delete after transfer to conduits
+	delete(cm.ends, request.MachineID)
+	cm.mtx.Unlock()
 }
 
 // server report to manager
@@ -363,15 +435,17 @@ func (cm *ConduitManager) ReportNetworks(_ context.Context, req geminio.Request,
 		return
 	}
 	if conduit.GetServerConfig() == nil {
+		cm.mtx.RUnlock()
 		return
 	}
 	// compare
-	if utils.CompareNets(request.IPs, conduit.GetServerConfig().IPs) {
+	if utils.CompareNets(request.IPs, conduit.GetServerConfig().IPs) &&
+		utils.CompareIPNets(request.IPNets, conduit.GetServerConfig().IPNets) {
 		// nothing changed
 		cm.mtx.RUnlock()
 		return
 	}
-	conduit.SetServerIPs(request.IPs)
+	conduit.SetServerNetworks(request.IPs, request.IPNets)
 	cm.mtx.RUnlock()
 
 	// server conduit network update event
@@ -381,6 +455,77 @@ func (cm *ConduitManager) ReportNetworks(_ context.Context, req geminio.Request,
 	}
 }
 
+// server report to manager before shutting down
+func (cm *ConduitManager) ReportDraining(_ context.Context, req geminio.Request, rsp geminio.Response) {
+	request := &proto.ReportDrainingRequest{}
+	err := json.Unmarshal(req.Data(), request)
+	if err != nil {
+		rsp.SetError(err)
+		return
+	}
+	log.Infof("conduit manager report draining, machine_id: %s", request.MachineID)
+	cm.mtx.Lock()
+	conduit, ok := cm.conduits[request.MachineID]
+	if !ok || conduit.GetServerConfig() == nil {
+		log.Errorf("conduit manager report draining, server conduit: %s not found", request.MachineID)
+		rsp.SetError(errors.New("end not found"))
+		cm.mtx.Unlock()
+		return
+	}
+	conduit.SetServerDraining()
+	cm.mtx.Unlock()
+
+	// server conduit draining event
+	cm.eventCh <- &event{
+		eventType: eventTypeServerDraining,
+		conduit:   conduit,
+	}
+}
+
+// relay report servers behind nat keeping sessions to it
+func (cm *ConduitManager) ReportReverses(_ context.Context, req geminio.Request, rsp geminio.Response) {
+	request := &proto.ReportReversesRequest{}
+	err := json.Unmarshal(req.Data(), request)
+	if err != nil {
+		rsp.SetError(err)
+		return
+	}
+	log.Infof("conduit manager report reverses, machine_id: %s, reverses: %v", request.MachineID, request.Reverses)
+	cm.mtx.Lock()
+	conduit, ok := cm.conduits[request.MachineID]
+	if !ok || conduit.GetServerConfig() == nil {
+		log.Errorf("conduit manager report reverses, server conduit: %s not found", request.MachineID)
+		rsp.SetError(errors.New("end not found"))
+		cm.mtx.Unlock()
+		return
+	}
+	serverConfig := conduit.GetServerConfig()
+	// servers whose routes may change
+	changed := map[string]struct{}{}
+	for _, machineID := range serverConfig.Reverses {
+		changed[machineID] = struct{}{}
+	}
+	for _, machineID := range request.Reverses {
+		changed[machineID] = struct{}{}
+	}
+	serverConfig.Reverses = request.Reverses
+	reverses := []Conduit{}
+	for machineID := range changed {
+		if reverse, ok := cm.conduits[machineID]; ok && reverse.IsServer() {
+			reverses = append(reverses, reverse)
+		}
+	}
+	cm.mtx.Unlock()
+
+	// online again to clients with new routes
+	for _, reverse := range reverses {
+		cm.eventCh <- &event{
+			eventType: eventTypeServerOnline,
+			conduit:   reverse,
+		}
+	}
+}
+
 func (cm *ConduitManager) PullCluster(_ context.Context, req geminio.Request, rsp geminio.Response) {
 	request := &proto.PullClusterRequest{}
 	err := json.Unmarshal(req.Data(), request)
@@ -391,13 +536,21 @@ func (cm *ConduitManager) PullCluster(_ context.Context, req geminio.Request, rs
 	// pull all server conduits
 	cm.mtx.RLock()
 	conduits := []proto.Conduit{}
+	puller := cm.conduits[request.MachineID]
 	for _, conduit := range cm.conduits {
 		if conduit.IsServer() && request.MachineID != conduit.MachineID() {
+			var route []string
+			if puller != nil {
+				route = cm.route(puller, conduit)
+			}
 			conduits = append(conduits, proto.Conduit{
 				MachineID: conduit.MachineID(),
 				Network:   conduit.GetServerConfig().Network,
 				Addr:      conduit.GetServerConfig().Addr,
 				IPs:       conduit.GetServerConfig().IPs,
+				IPNets:    conduit.GetServerConfig().IPNets,
+				Draining:  conduit.GetServerConfig().Draining,
+				Route:     route,
 			})
 		}
 	}
@@ -406,6 +559,63 @@ func (cm *ConduitManager) PullCluster(_ context.Context, req geminio.Request, rs
 	// return to clients
 	response := &proto.PullClusterResponse{
 		Cluster: conduits,
+		Exclude: cm.exclude,
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		rsp.SetError(err)
+		return
+	}
+	rsp.SetData(data)
+}
+
+// conduits pull certs after told they are renewed
+func (cm *ConduitManager) PullCerts(_ context.Context, req geminio.Request, rsp geminio.Response) {
+	request := &proto.PullCertsRequest{}
+	err := json.Unmarshal(req.Data(), request)
+	if err != nil {
+		rsp.SetError(err)
+		return
+	}
+	cm.mtx.RLock()
+	conduit, ok := cm.conduits[request.MachineID]
+	var serverConfig *ServerConfig
+	if ok {
+		serverConfig = conduit.GetServerConfig()
+	}
+	cm.mtx.RUnlock()
+	if !ok {
+		log.Errorf("conduit manager pull certs, conduit: %s not found", request.MachineID)
+		rsp.SetError(errors.New("end not found"))
+		return
+	}
+
+	response := &proto.PullCertsResponse{}
+	if conduit.IsClient() {
+		cert, err := cm.cms.GetClientCert(request.MachineID)
+		if err != nil {
+			log.Errorf("conduit manager pull certs, cms get client cert err: %s", err)
+			rsp.SetError(err)
+			return
+		}
+		response.Client = newTLS(cert)
+	}
+	if serverConfig != nil {
+		host, _, err := net.SplitHostPort(serverConfig.Addr)
+		if err != nil {
+			rsp.SetError(err)
+			return
+		}
+		cert, err := cm.cms.GetServerCert(request.MachineID, net.ParseIP(host))
+		if err != nil {
+			log.Errorf("conduit manager pull certs, cms get server cert err: %s", err)
+			rsp.SetError(err)
+			return
+		}
+		cm.mtx.Lock()
+		serverConfig.Cert = cert
+		cm.mtx.Unlock()
+		response.Server = newTLS(cert)
 	}
 	data, err := json.Marshal(response)
 	if err != nil {
@@ -413,28 +623,121 @@ func (cm *ConduitManager) PullCluster(_ context.Context, req geminio.Request, rs
 		return
 	}
 	rsp.SetData(data)
+	log.Infof("conduit manager pull certs, machine_id: %s", request.MachineID)
+}
+
+func newTLS(cert *cms.Cert) *proto.TLS {
+	return &proto.TLS{
+		CA:   cert.CA,
+		CAs:  cert.CAs,
+		Cert: cert.Cert,
+		Key:  cert.Key,
+	}
+}
+
+// SyncTrustBundle syncs the bundle to all conduits, returns whether all of
+// them took it
+func (cm *ConduitManager) SyncTrustBundle(cas [][]byte) bool {
+	all := true
+	for _, conduit := range cm.listConduits() {
+		err := conduit.TrustBundle(cas)
+		if err != nil {
+			log.Errorf("conduit manager, call conduit: %s trust bundle err: %s", conduit.MachineID(), err)
+			all = false
+		}
+	}
+	return all
+}
+
+// SyncCertsRenewed tells conduits of the machine ids to pull their certs, all
+// conduits if nil
+func (cm *ConduitManager) SyncCertsRenewed(machineIDs []string) {
+	renewed := map[string]struct{}{}
+	for _, machineID := range machineIDs {
+		renewed[machineID] = struct{}{}
+	}
+	for _, conduit := range cm.listConduits() {
+		if _, ok := renewed[conduit.MachineID()]; machineIDs != nil && !ok {
+			continue
+		}
+		err := conduit.CertsRenewed()
+		if err != nil {
+			log.Errorf("conduit manager, call conduit: %s certs renewed err: %s", conduit.MachineID(), err)
+		}
+	}
+}
+
+// calls to conduits are out of mtx
+func (cm *ConduitManager) listConduits() []Conduit {
+	cm.mtx.RLock()
+	defer cm.mtx.RUnlock()
+
+	conduits := make([]Conduit, 0, len(cm.conduits))
+	for _, conduit := range cm.conduits {
+		conduits = append(conduits, conduit)
+	}
+	return conduits
+}
+
+// relays of the client to the server computed from zones, direct if
+// unreachable, servers behind nat are reached through relays keeping their
+// sessions, the caller holds mtx
+func (cm *ConduitManager) route(client, server Conduit) []string {
+	relays, vias := []*hop{}, []*hop{}
+	for _, conduit := range cm.conduits {
+		serverConfig := conduit.GetServerConfig()
+		if !conduit.IsServer() || !serverConfig.Relay || serverConfig.Draining {
+			continue
+		}
+		relays = append(relays, newHop(conduit))
+		for _, machineID := range serverConfig.Reverses {
+			if machineID == server.MachineID() {
+				vias = append(vias, newHop(conduit))
+				break
+			}
+		}
+	}
+	if server.GetServerConfig().Reverse {
+		addrs, ok := routeReverse(newHop(client), vias, relays)
+		if !ok {
+			log.Warnf("conduit manager route, conduit: %s behind nat unreachable from conduit: %s, no relay keeps its session",
+				server.MachineID(), client.MachineID())
+		}
+		return addrs
+	}
+	addrs, ok := route(newHop(client), newHop(server), relays)
+	if !ok {
+		log.Warnf("conduit manager route, zone: %s of conduit: %s unreachable from zone: %s of conduit: %s, dial directly",
+			server.Zone(), server.MachineID(), client.Zone(), client.MachineID())
+	}
+	return addrs
 }
 
 // connection layer offline
 func (cm *ConduitManager) ConnOffline(cb delegate.ConnDescriber) error {
 	cm.mtx.Lock()
-	defer cm.mtx.Unlock()
-
 	log.Infof("conduit manager conn: %s offline", cb.RemoteAddr().String())
 
 	machineID, ok := cm.machineIDs[cb.ClientID()]
 	if !ok {
 		log.Errorf("conduit manager conn: %s offline, but machineID not found", cb.Meta())
+		cm.mtx.Unlock()
 		return nil
 	}
 	// delete inflight ends
+	delete(cm.machineIDs, cb.ClientID())
 	delete(cm.ends, machineID)
 	// delete stored conduit
 	conduit, ok := cm.conduits[machineID]
-	if !ok {
-		// it's normal to be here when end connected but not registered
+	if !ok || conduit.ClientID() != cb.ClientID() {
+		// it's normal to be here when end connected but not registered,
+		// or the conduit is online again by another end
+		cm.mtx.Unlock()
 		return nil
 	}
+	delete(cm.conduits, machineID)
+	cm.mtx.Unlock()
+
 	if conduit.IsServer() {
 		// notify all clients
 		cm.eventCh <- &event{
@@ -445,6 +748,72 @@ func (cm *ConduitManager) ConnOffline(cb delegate.ConnDescriber) error {
 	return nil
 }
 
+// ConduitInfo is a registered conduit for the control plane
+type ConduitInfo struct {
+	MachineID string      `json:"machine_id"`
+	Client    bool        `json:"client"`
+	Server    bool        `json:"server"`
+	Remote    string      `json:"remote"`
+	Network   string      `json:"network,omitempty"`
+	Addr      string      `json:"addr,omitempty"`
+	IPs       []net.IP    `json:"ips,omitempty"`
+	IPNets    []net.IPNet `json:"ipnets,omitempty"`
+	Draining  bool        `json:"draining,omitempty"`
+	Relay     bool        `json:"relay,omitempty"`
+	Reverse   bool        `json:"reverse,omitempty"`
+	Reverses  []string    `json:"reverses,omitempty"`
+	Zone      string      `json:"zone,omitempty"`
+	Reaches   []string    `json:"reaches,omitempty"`
+}
+
+func newConduitInfo(conduit Conduit) *ConduitInfo {
+	info := &ConduitInfo{
+		MachineID: conduit.MachineID(),
+		Client:    conduit.IsClient(),
+		Server:    conduit.IsServer(),
+		Remote:    conduit.RemoteAddr().String(),
+		Zone:      conduit.Zone(),
+		Reaches:   conduit.Reaches(),
+	}
+	if serverConfig := conduit.GetServerConfig(); serverConfig != nil {
+		info.Network = serverConfig.Network
+		info.Addr = serverConfig.Addr
+		info.IPs = serverConfig.IPs
+		info.IPNets = serverConfig.IPNets
+		info.Draining = serverConfig.Draining
+		info.Relay = serverConfig.Relay
+		info.Reverse = serverConfig.Reverse
+		info.Reverses = serverConfig.Reverses
+	}
+	return info
+}
+
+// ListConduits returns registered conduits sorted by machine id
+func (cm *ConduitManager) ListConduits() []*ConduitInfo {
+	cm.mtx.RLock()
+	infos := make([]*ConduitInfo, 0, len(cm.conduits))
+	for _, conduit := range cm.conduits {
+		infos = append(infos, newConduitInfo(conduit))
+	}
+	cm.mtx.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].MachineID < infos[j].MachineID
+	})
+	return infos
+}
+
+func (cm *ConduitManager) GetConduit(machineID string) (*ConduitInfo, bool) {
+	cm.mtx.RLock()
+	defer cm.mtx.RUnlock()
+
+	conduit, ok := cm.conduits[machineID]
+	if !ok {
+		return nil, false
+	}
+	return newConduitInfo(conduit), true
+}
+
 func (cm *ConduitManager) GetClientID(uint64, []byte) (uint64, error) {
 	return id.DefaultIncIDCounter.GetID(), nil
 }
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/moresec-io/conduit/pkg/manager/metrics"
+	"github.com/singchia/geminio"
+)
+
+const (
+	roleClient = "client"
+	roleServer = "server"
+)
+
+// meteredResponse records whether the rpc failed
+type meteredResponse struct {
+	geminio.Response
+	failed bool
+}
+
+func (rsp *meteredResponse) SetError(err error) {
+	rsp.failed = err != nil
+	rsp.Response.SetError(err)
+}
+
+// instrument observes latency and errors of a rpc by method
+func instrument(method string, rpc geminio.RPC) geminio.RPC {
+	return func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		start := time.Now()
+		metered := &meteredResponse{Response: rsp}
+		rpc(ctx, req, metered)
+		metrics.RPCDuration.With(method).Observe(time.Since(start).Seconds())
+		if metered.failed {
+			metrics.RPCErrors.With(method).Inc()
+		}
+	}
+}
+
+// refresh gauges before collecting
+func (cm *ConduitManager) collect() {
+	clients, servers := 0, 0
+	cm.mtx.RLock()
+	for _, conduit := range cm.conduits {
+		if conduit.IsClient() {
+			clients++
+		}
+		if conduit.IsServer() {
+			servers++
+		}
+	}
+	cm.mtx.RUnlock()
+	metrics.Conduits.With(roleClient).Set(float64(clients))
+	metrics.Conduits.With(roleServer).Set(float64(servers))
+	metrics.EventQueueDepth.With().Set(float64(len(cm.eventCh)))
+}
@@ -0,0 +1,97 @@
+package service
+
+import "sort"
+
+// a conduit in routing, addr is the server addr of relays
+type hop struct {
+	machineID string
+	zone      string
+	reaches   []string
+	addr      string
+}
+
+func newHop(conduit Conduit) *hop {
+	h := &hop{
+		machineID: conduit.MachineID(),
+		zone:      conduit.Zone(),
+		reaches:   conduit.Reaches(),
+	}
+	if serverConfig := conduit.GetServerConfig(); serverConfig != nil {
+		h.addr = serverConfig.Addr
+	}
+	return h
+}
+
+// conduits without zone reach and are reached by all
+func (h *hop) reach(zone string) bool {
+	if h.zone == "" || zone == "" || h.zone == zone {
+		return true
+	}
+	for _, reach := range h.reaches {
+		if reach == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns addrs of relays from src to dst with fewest hops, ties are
+// broken by machine id, false if dst is unreachable
+func route(src, dst *hop, relays []*hop) ([]string, bool) {
+	if src.reach(dst.zone) {
+		return nil, true
+	}
+	sorted := make([]*hop, len(relays))
+	copy(sorted, relays)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].machineID < sorted[j].machineID
+	})
+	visited := map[string]struct{}{src.machineID: {}, dst.machineID: {}}
+	prev := map[int]int{}
+	queue := []int{}
+	from := func(h *hop, i int) {
+		for j, relay := range sorted {
+			if _, ok := visited[relay.machineID]; ok || !h.reach(relay.zone) {
+				continue
+			}
+			visited[relay.machineID] = struct{}{}
+			prev[j] = i
+			queue = append(queue, j)
+		}
+	}
+	from(src, -1)
+	for len(queue) != 0 {
+		i := queue[0]
+		queue = queue[1:]
+		if sorted[i].reach(dst.zone) {
+			addrs := []string{}
+			for j := i; j != -1; j = prev[j] {
+				addrs = append([]string{sorted[j].addr}, addrs...)
+			}
+			return addrs, true
+		}
+		from(sorted[i], i)
+	}
+	return nil, false
+}
+
+// routeReverse returns addrs of relays from src to a server behind nat, the
+// last is one of vias it keeps sessions to, fewest hops first
+func routeReverse(src *hop, vias []*hop, relays []*hop) ([]string, bool) {
+	sorted := make([]*hop, len(vias))
+	copy(sorted, vias)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].machineID < sorted[j].machineID
+	})
+	var best []string
+	found := false
+	for _, via := range sorted {
+		addrs, ok := route(src, via, relays)
+		if !ok || (found && len(addrs)+1 >= len(best)) {
+			continue
+		}
+		best = append(addrs, via.addr)
+		found = true
+	}
+	return best, found
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRoute(t *testing.T) {
+	Convey("route through relays", t, func() {
+		src := &hop{machineID: "client", zone: "office"}
+		dst := &hop{machineID: "server", zone: "prod", addr: "10.0.2.1:5053"}
+		dmz := &hop{machineID: "dmz", zone: "dmz", reaches: []string{"prod"}, addr: "10.0.1.1:5053"}
+
+		Convey("zones not declared or reached directly", func() {
+			addrs, ok := route(&hop{machineID: "client"}, dst, nil)
+			So(ok, ShouldBeTrue)
+			So(addrs, ShouldBeEmpty)
+
+			src.reaches = []string{"prod"}
+			addrs, ok = route(src, dst, []*hop{dmz})
+			So(ok, ShouldBeTrue)
+			So(addrs, ShouldBeEmpty)
+		})
+
+		Convey("unreachable", func() {
+			_, ok := route(src, dst, []*hop{dmz})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("one relay", func() {
+			src.reaches = []string{"dmz"}
+			addrs, ok := route(src, dst, []*hop{dmz})
+			So(ok, ShouldBeTrue)
+			So(addrs, ShouldResemble, []string{"10.0.1.1:5053"})
+		})
+
+		Convey("fewest hops then machine id", func() {
+			src.reaches = []string{"edge", "dmz"}
+			edge := &hop{machineID: "edge", zone: "edge", reaches: []string{"dmz"}, addr: "10.0.0.1:5053"}
+			dmz2 := &hop{machineID: "dmz2", zone: "dmz", reaches: []string{"prod"}, addr: "10.0.1.2:5053"}
+			addrs, ok := route(src, dst, []*hop{dmz2, edge, dmz})
+			So(ok, ShouldBeTrue)
+			So(addrs, ShouldResemble, []string{"10.0.1.1:5053"})
+
+			src.reaches = []string{"edge"}
+			addrs, ok = route(src, dst, []*hop{dmz2, edge, dmz})
+			So(ok, ShouldBeTrue)
+			So(addrs, ShouldResemble, []string{"10.0.0.1:5053", "10.0.1.1:5053"})
+		})
+
+		Convey("servers behind nat through relays keeping their sessions", func() {
+			src.reaches = []string{"edge"}
+			edge := &hop{machineID: "edge", zone: "edge", reaches: []string{"dmz"}, addr: "10.0.0.1:5053"}
+			addrs, ok := routeReverse(src, []*hop{dmz, edge}, []*hop{dmz, edge})
+			So(ok, ShouldBeTrue)
+			So(addrs, ShouldResemble, []string{"10.0.0.1:5053"})
+
+			addrs, ok = routeReverse(src, []*hop{dmz}, []*hop{dmz, edge})
+			So(ok, ShouldBeTrue)
+			So(addrs, ShouldResemble, []string{"10.0.0.1:5053", "10.0.1.1:5053"})
+
+			_, ok = routeReverse(src, nil, []*hop{dmz, edge})
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,406 @@
+// Package metrics is a minimal prometheus text format exporter, counters,
+// gauges and histograms with labels are all we need.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+
+	// content type of prometheus text format
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mtx        sync.RWMutex
+	collectors []collector
+	onCollects []func()
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (registry *Registry) register(c collector) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+
+	registry.collectors = append(registry.collectors, c)
+}
+
+// OnCollect registers a function called before every collection,
+// to refresh gauges whose values are expensive to track.
+func (registry *Registry) OnCollect(fn func()) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+
+	registry.onCollects = append(registry.onCollects, fn)
+}
+
+func (registry *Registry) Write(w io.Writer) error {
+	registry.mtx.RLock()
+	collectors := registry.collectors
+	onCollects := registry.onCollects
+	registry.mtx.RUnlock()
+
+	for _, fn := range onCollects {
+		fn()
+	}
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (registry *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		registry.Write(w)
+	})
+}
+
+// vec holds children by label values
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mtx      sync.RWMutex
+	children map[string]*child
+	newValue func() interface{}
+}
+
+type child struct {
+	values []string
+	value  interface{}
+}
+
+func newVec(name, help, typ string, labels []string, newValue func() interface{}) *vec {
+	return &vec{
+		name:     name,
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		children: map[string]*child{},
+		newValue: newValue,
+	}
+}
+
+func (v *vec) with(values ...string) interface{} {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.name + " label values mismatch")
+	}
+	key := strings.Join(values, "\xff")
+	v.mtx.RLock()
+	c, ok := v.children[key]
+	v.mtx.RUnlock()
+	if ok {
+		return c.value
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	c, ok = v.children[key]
+	if !ok {
+		c = &child{
+			values: append([]string{}, values...),
+			value:  v.newValue(),
+		}
+		v.children[key] = c
+	}
+	return c.value
+}
+
+func (v *vec) delete(values ...string) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	delete(v.children, strings.Join(values, "\xff"))
+}
+
+func (v *vec) reset() {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	v.children = map[string]*child{}
+}
+
+// children sorted by label values for stable output
+func (v *vec) sorted() []*child {
+	v.mtx.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*child, 0, len(keys))
+	for _, key := range keys {
+		children = append(children, v.children[key])
+	}
+	v.mtx.RUnlock()
+	return children
+}
+
+func (v *vec) writeHeader(w *bufio.Writer) {
+	w.WriteString("# HELP " + v.name + " " + escapeHelp(v.help) + "\n")
+	w.WriteString("# TYPE " + v.name + " " + v.typ + "\n")
+}
+
+func (v *vec) writeSample(w *bufio.Writer, name string, values []string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(values) != 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, label := range v.labels {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + `="` + escapeLabel(values[i]) + `"`)
+		}
+		if extraName != "" {
+			if len(values) != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+// a float64 updated atomically
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		new := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, new) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Counter only goes up
+type Counter struct {
+	value
+}
+
+func (counter *Counter) Inc() {
+	counter.add(1)
+}
+
+func (counter *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	counter.add(delta)
+}
+
+func (counter *Counter) Value() float64 {
+	return counter.get()
+}
+
+type CounterVec struct {
+	*vec
+}
+
+func (registry *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{newVec(name, help, typeCounter, labels, func() interface{} {
+		return &Counter{}
+	})}
+	registry.register(cv)
+	return cv
+}
+
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.with(values...).(*Counter)
+}
+
+func (cv *CounterVec) Delete(values ...string) {
+	cv.delete(values...)
+}
+
+func (cv *CounterVec) write(w *bufio.Writer) {
+	cv.writeHeader(w)
+	for _, c := range cv.sorted() {
+		cv.writeSample(w, cv.name, c.values, "", "", c.value.(*Counter).Value())
+	}
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	value
+}
+
+func (gauge *Gauge) Set(f float64) {
+	gauge.set(f)
+}
+
+func (gauge *Gauge) Inc() {
+	gauge.add(1)
+}
+
+func (gauge *Gauge) Dec() {
+	gauge.add(-1)
+}
+
+func (gauge *Gauge) Add(delta float64) {
+	gauge.add(delta)
+}
+
+func (gauge *Gauge) Value() float64 {
+	return gauge.get()
+}
+
+type GaugeVec struct {
+	*vec
+}
+
+func (registry *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	gv := &GaugeVec{newVec(name, help, typeGauge, labels, func() interface{} {
+		return &Gauge{}
+	})}
+	registry.register(gv)
+	return gv
+}
+
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	return gv.with(values...).(*Gauge)
+}
+
+func (gv *GaugeVec) Delete(values ...string) {
+	gv.delete(values...)
+}
+
+// Reset drops all children, useful before refreshing in OnCollect
+func (gv *GaugeVec) Reset() {
+	gv.reset()
+}
+
+func (gv *GaugeVec) write(w *bufio.Writer) {
+	gv.writeHeader(w)
+	for _, c := range gv.sorted() {
+		gv.writeSample(w, gv.name, c.values, "", "", c.value.(*Gauge).Value())
+	}
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64
+	count       uint64
+	sum         value
+}
+
+func (histogram *Histogram) Observe(f float64) {
+	for i, bound := range histogram.upperBounds {
+		if f <= bound {
+			atomic.AddUint64(&histogram.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&histogram.count, 1)
+	histogram.sum.add(f)
+}
+
+type HistogramVec struct {
+	*vec
+}
+
+// buckets must be sorted in increasing order, +Inf is added implicitly
+func (registry *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	hv := &HistogramVec{newVec(name, help, typeHistogram, labels, func() interface{} {
+		return &Histogram{
+			upperBounds: buckets,
+			counts:      make([]uint64, len(buckets)),
+		}
+	})}
+	registry.register(hv)
+	return hv
+}
+
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.with(values...).(*Histogram)
+}
+
+func (hv *HistogramVec) Delete(values ...string) {
+	hv.delete(values...)
+}
+
+func (hv *HistogramVec) write(w *bufio.Writer) {
+	hv.writeHeader(w)
+	for _, c := range hv.sorted() {
+		histogram := c.value.(*Histogram)
+		cumulative := uint64(0)
+		for i, bound := range histogram.upperBounds {
+			cumulative += atomic.LoadUint64(&histogram.counts[i])
+			hv.writeSample(w, hv.name+"_bucket", c.values, "le", formatFloat(bound), float64(cumulative))
+		}
+		count := atomic.LoadUint64(&histogram.count)
+		hv.writeSample(w, hv.name+"_bucket", c.values, "le", "+Inf", float64(count))
+		hv.writeSample(w, hv.name+"_sum", c.values, "", "", histogram.sum.get())
+		hv.writeSample(w, hv.name+"_count", c.values, "", "", float64(count))
+	}
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(str string) string {
+	return labelReplacer.Replace(str)
+}
+
+func escapeHelp(str string) string {
+	return helpReplacer.Replace(str)
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRegistry(t *testing.T) {
+	Convey("registry", t, func() {
+		registry := NewRegistry()
+
+		Convey("counter", func() {
+			cv := registry.NewCounterVec("conduit_test_total", "test counter", "side", "peer")
+			cv.With("client", `1.1.1.1:5053`).Inc()
+			cv.With("client", `1.1.1.1:5053`).Add(2)
+			cv.With("server", "a\"b").Inc()
+
+			buf := &bytes.Buffer{}
+			So(registry.Write(buf), ShouldBeNil)
+			So(buf.String(), ShouldEqual, `# HELP conduit_test_total test counter
+# TYPE conduit_test_total counter
+conduit_test_total{side="client",peer="1.1.1.1:5053"} 3
+conduit_test_total{side="server",peer="a\"b"} 1
+`)
+		})
+
+		Convey("gauge", func() {
+			gv := registry.NewGaugeVec("conduit_test", "test gauge")
+			gv.With().Set(5)
+			gv.With().Dec()
+			refreshed := false
+			registry.OnCollect(func() { refreshed = true })
+
+			buf := &bytes.Buffer{}
+			So(registry.Write(buf), ShouldBeNil)
+			So(refreshed, ShouldBeTrue)
+			So(buf.String(), ShouldEqual, `# HELP conduit_test test gauge
+# TYPE conduit_test gauge
+conduit_test 4
+`)
+		})
+
+		Convey("histogram", func() {
+			hv := registry.NewHistogramVec("conduit_test_seconds", "test histogram", []float64{0.1, 1}, "peer")
+			hv.With("p").Observe(0.05)
+			hv.With("p").Observe(0.5)
+			hv.With("p").Observe(5)
+
+			buf := &bytes.Buffer{}
+			So(registry.Write(buf), ShouldBeNil)
+			So(buf.String(), ShouldEqual, `# HELP conduit_test_seconds test histogram
+# TYPE conduit_test_seconds histogram
+conduit_test_seconds_bucket{peer="p",le="0.1"} 1
+conduit_test_seconds_bucket{peer="p",le="1"} 2
+conduit_test_seconds_bucket{peer="p",le="+Inf"} 3
+conduit_test_seconds_sum{peer="p"} 5.55
+conduit_test_seconds_count{peer="p"} 3
+`)
+		})
+	})
+}
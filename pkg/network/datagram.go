@@ -0,0 +1,84 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// MaxDatagram is the max payload of a framed datagram
+const MaxDatagram = 65535
+
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// WriteDatagram writes data framed by big endian uint16 length
+func WriteDatagram(w io.Writer, data []byte) error {
+	if len(data) > MaxDatagram {
+		return ErrDatagramTooLarge
+	}
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads a framed datagram into buf, which must hold MaxDatagram
+func ReadDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	bs := make([]byte, 2)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return nil, err
+	}
+	data := buf[:binary.BigEndian.Uint16(bs)]
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DatagramConn carries the datagrams of a connected packet conn as framed
+// datagrams of a stream, so it can be piped with a tunnel
+type DatagramConn struct {
+	net.Conn
+	rbuf    []byte // framed datagram read, not returned yet
+	pending []byte // partial frames written
+}
+
+func NewDatagramConn(conn net.Conn) *DatagramConn {
+	return &DatagramConn{Conn: conn}
+}
+
+func (dc *DatagramConn) Read(p []byte) (int, error) {
+	if len(dc.rbuf) == 0 {
+		buf := make([]byte, 2+MaxDatagram)
+		n, err := dc.Conn.Read(buf[2:])
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		dc.rbuf = buf[:2+n]
+	}
+	n := copy(p, dc.rbuf)
+	dc.rbuf = dc.rbuf[n:]
+	return n, nil
+}
+
+// Write sends every complete frame as a datagram, partial ones are kept
+func (dc *DatagramConn) Write(p []byte) (int, error) {
+	dc.pending = append(dc.pending, p...)
+	for len(dc.pending) >= 2 {
+		length := int(binary.BigEndian.Uint16(dc.pending))
+		if len(dc.pending) < 2+length {
+			break
+		}
+		if _, err := dc.Conn.Write(dc.pending[2 : 2+length]); err != nil {
+			return 0, err
+		}
+		dc.pending = dc.pending[2+length:]
+	}
+	if len(dc.pending) == 0 {
+		dc.pending = nil
+	}
+	return len(p), nil
+}
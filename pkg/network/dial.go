@@ -24,6 +24,8 @@ type TLS struct {
 	CAPool             *x509.CertPool
 	Certs              []tls.Certificate
 	InsecureSkipVerify bool
+	// takes over CAPool and Certs if set
+	Reloadable *ReloadableTLS
 }
 
 type DialConfig struct {
@@ -62,16 +64,20 @@ func DialWithConfig(dialconfig *DialConfig, index int) (net.Conn, error) {
 		}
 		return conn, err
 	} else {
+		certs, caPool := dialconfig.TLS.Certs, dialconfig.TLS.CAPool
+		if reloadable := dialconfig.TLS.Reloadable; reloadable != nil {
+			certs, caPool = reloadable.Certs(), reloadable.CAPool()
+		}
 		if !dialconfig.TLS.MTLS {
 			tlsDialer := &tls.Dialer{
 				NetDialer: &net.Dialer{
 					Control: dialconfig.Control,
 				},
 				Config: &tls.Config{
-					Certificates: dialconfig.TLS.Certs,
+					Certificates: certs,
 					// it's user's call to verify the server certs or not.
 					InsecureSkipVerify: dialconfig.TLS.InsecureSkipVerify,
-					RootCAs:            dialconfig.TLS.CAPool,
+					RootCAs:            caPool,
 				},
 			}
 			conn, err := tlsDialer.Dial(network, addr)
@@ -86,10 +92,10 @@ func DialWithConfig(dialconfig *DialConfig, index int) (net.Conn, error) {
 					Control: dialconfig.Control,
 				},
 				Config: &tls.Config{
-					Certificates: dialconfig.TLS.Certs,
+					Certificates: certs,
 					// it's user's call to verify the server certs or not.
 					InsecureSkipVerify: dialconfig.TLS.InsecureSkipVerify,
-					RootCAs:            dialconfig.TLS.CAPool,
+					RootCAs:            caPool,
 				},
 			}
 			conn, err := tlsDialer.Dial(network, addr)
@@ -118,3 +118,8 @@ func ListenDERMTLS(network, addr string, caraw, certraw, keyraw []byte) (net.Lis
 		Certificates: []tls.Certificate{tlscert},
 	})
 }
+
+// ListenReloadableMTLS listens with certs which may be swapped later
+func ListenReloadableMTLS(network, addr string, rt *ReloadableTLS) (net.Listener, error) {
+	return tls.Listen(network, addr, rt.ServerConfig())
+}
@@ -1,9 +1,13 @@
 package network
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+
+	"golang.org/x/sys/unix"
 )
 
 // Function to read the namespace link
@@ -78,3 +82,74 @@ func ListDifferentNetNamespacePids() ([]int, error) {
 	}
 	return pids, nil
 }
+
+// NetNamespacePids maps each net namespace like net:[4026531840] to the
+// lowest pid in it
+func NetNamespacePids() (map[string]int, error) {
+	files, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	nsMap := make(map[string]int)
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		pid, err := strconv.Atoi(file.Name())
+		if err != nil {
+			continue
+		}
+		nsLink, err := readNamespaceLink(file.Name(), "net")
+		if err != nil {
+			// the process is gone or not permitted
+			continue
+		}
+		if old, ok := nsMap[nsLink]; !ok || pid < old {
+			nsMap[nsLink] = pid
+		}
+	}
+	return nsMap, nil
+}
+
+// SelfNetNamespace returns the net namespace of the process
+func SelfNetNamespace() (string, error) {
+	return readNamespaceLink("self", "net")
+}
+
+// InNetNamespace runs fn in the net namespace ns of pid, sockets created and
+// commands executed by fn belong to it, fn must not start goroutines relying
+// on the namespace
+func InNetNamespace(pid int, ns string, fn func() error) error {
+	target, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "ns", "net"))
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	// the pid may be reused by a process in another namespace
+	link, err := readNamespaceLink(strconv.Itoa(pid), "net")
+	if err != nil {
+		return err
+	}
+	if link != ns {
+		return fmt.Errorf("pid %d moved from %s to %s", pid, ns, link)
+	}
+
+	runtime.LockOSThread()
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	if err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	fnErr := fn()
+	if err = unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+		// leave the thread locked, it's dropped when the goroutine exits
+		return err
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
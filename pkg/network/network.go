@@ -2,14 +2,21 @@ package network
 
 import (
 	"net"
+	"strings"
 	"syscall"
 	"unsafe"
 
+	"github.com/moresec-io/conduit/pkg/config"
 	"github.com/vishvananda/netlink"
 )
 
-func ListIPs() ([]net.IP, error) {
+// ListIPs lists ipv4 addresses of local interfaces matched by filter, lo is
+// always skipped, bridges are skipped unless included explicitly
+func ListIPs(filter *config.IPFilter) ([]net.IP, error) {
 	ips := []net.IP{}
+	if filter == nil {
+		filter = &config.IPFilter{}
+	}
 
 	handle, err := netlink.NewHandle()
 	if err != nil {
@@ -20,11 +27,16 @@ func ListIPs() ([]net.IP, error) {
 		return nil, err
 	}
 	for _, link := range links {
-		if link.Attrs().Name == "lo" {
+		name := link.Attrs().Name
+		if name == "lo" || MatchInterfaces(filter.ExcludeInterfaces, name) {
 			continue
 		}
-		if _, isBridge := link.(*netlink.Bridge); isBridge {
-			// we don't handle bridge for now
+		if len(filter.IncludeInterfaces) != 0 {
+			if !MatchInterfaces(filter.IncludeInterfaces, name) {
+				continue
+			}
+		} else if _, isBridge := link.(*netlink.Bridge); isBridge {
+			// we don't handle bridge by default
 			continue
 		}
 		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
@@ -32,12 +44,50 @@ func ListIPs() ([]net.IP, error) {
 			return nil, err
 		}
 		for _, addr := range addrs {
+			scope := scopeName(netlink.Scope(addr.Scope))
+			if contains(filter.ExcludeScopes, scope) {
+				continue
+			}
+			if len(filter.IncludeScopes) != 0 && !contains(filter.IncludeScopes, scope) {
+				continue
+			}
 			ips = append(ips, addr.IP)
 		}
 	}
 	return ips, nil
 }
 
+// MatchInterfaces matches name against iptables like patterns, docker0 or cali+
+func MatchInterfaces(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "+") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "+")) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
+
+// named as ip addr shows
+func scopeName(scope netlink.Scope) string {
+	if scope == netlink.SCOPE_UNIVERSE {
+		return "global"
+	}
+	return scope.String()
+}
+
+func contains(strs []string, str string) bool {
+	for _, elem := range strs {
+		if elem == str {
+			return true
+		}
+	}
+	return false
+}
+
 func GetSocketMark(fd uintptr) (uint32, error) {
 	var mark uint32
 	size := unsafe.Sizeof(mark)
@@ -1,16 +1,217 @@
 package network
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/singchia/go-hammer/log"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestListNetworks(t *testing.T) {
-	ips, err := ListIPs()
+	ips, err := ListIPs(nil)
 	assert.Equal(t, nil, err)
 	for _, ip := range ips {
 		log.Info(ip.String())
 	}
 }
+
+func TestNetNamespacePids(t *testing.T) {
+	self, err := SelfNetNamespace()
+	assert.Equal(t, nil, err)
+	pids, err := NetNamespacePids()
+	assert.Equal(t, nil, err)
+	_, ok := pids[self]
+	assert.Equal(t, true, ok)
+}
+
+func TestMatchInterfaces(t *testing.T) {
+	patterns := []string{"docker0", "cali+"}
+	assert.Equal(t, true, MatchInterfaces(patterns, "docker0"))
+	assert.Equal(t, false, MatchInterfaces(patterns, "docker1"))
+	assert.Equal(t, true, MatchInterfaces(patterns, "cali12ab"))
+	assert.Equal(t, false, MatchInterfaces(patterns, "eth0"))
+}
+
+func TestSysctlManager(t *testing.T) {
+	root := t.TempDir()
+	path, err := sysctlPath(root, "net.ipv4.conf.eth0/100.rp_filter")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, filepath.Join(root, "net/ipv4/conf/eth0.100/rp_filter"), path)
+	_, err = sysctlPath(root, "net..ip_forward")
+	assert.Equal(t, ErrIllegalSysctl, err)
+
+	assert.Equal(t, nil, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Equal(t, nil, os.WriteFile(path, []byte("1\n"), 0644))
+	sm := &SysctlManager{root: root, origins: map[string]string{}}
+
+	written, err := sm.Set("net.ipv4.conf.eth0/100.rp_filter", "2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, written)
+	// already there
+	written, err = sm.Set("net.ipv4.conf.eth0/100.rp_filter", "2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, written)
+	value, err := sm.Get("net.ipv4.conf.eth0/100.rp_filter")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "2", value)
+
+	// drifted and set again, the value before first write is restored
+	assert.Equal(t, nil, os.WriteFile(path, []byte("0\n"), 0644))
+	written, err = sm.Set("net.ipv4.conf.eth0/100.rp_filter", "2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, written)
+	assert.Equal(t, nil, sm.Close())
+	value, err = sm.Get("net.ipv4.conf.eth0/100.rp_filter")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "1", value)
+}
+
+func TestDatagramConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer pc.Close()
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	assert.Equal(t, nil, err)
+	dc := NewDatagramConn(conn)
+	defer dc.Close()
+
+	// 2 frames written across 3 writes come out as 2 datagrams
+	stream := &bytes.Buffer{}
+	assert.Equal(t, nil, WriteDatagram(stream, []byte("ping")))
+	assert.Equal(t, nil, WriteDatagram(stream, []byte("pong!")))
+	frames := stream.Bytes()
+	for _, part := range [][]byte{frames[:3], frames[3:8], frames[8:]} {
+		n, err := dc.Write(part)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, len(part), n)
+	}
+	buf := make([]byte, MaxDatagram)
+	n, addr, err := pc.ReadFrom(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+	n, _, err = pc.ReadFrom(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "pong!", string(buf[:n]))
+
+	// a datagram back is read as a frame, even by small reads
+	_, err = pc.WriteTo([]byte("hello"), addr)
+	assert.Equal(t, nil, err)
+	framed := &bytes.Buffer{}
+	small := make([]byte, 3)
+	for framed.Len() < 7 {
+		n, err := dc.Read(small)
+		assert.Equal(t, nil, err)
+		framed.Write(small[:n])
+	}
+	data, err := ReadDatagram(framed, buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 34567}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}
+	assert.Equal(t, "PROXY TCP4 10.0.0.1 10.0.0.2 34567 80\r\n", string(ProxyHeaderV1(src, dst)))
+	src6 := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 34567}
+	assert.Equal(t, "PROXY TCP6 fd00::1 ::ffff:10.0.0.2 34567 80\r\n", string(ProxyHeaderV1(src6, dst)))
+
+	header := ProxyHeaderV2(src, dst, TLV{Type: PP2TypeConduitIdentity, Value: []byte("a")})
+	assert.Equal(t, proxyV2Signature, header[:12])
+	assert.Equal(t, []byte{0x21, 0x11, 0x00, 16}, header[12:16])
+	assert.Equal(t, []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x87, 0x07, 0x00, 80}, header[16:28])
+	assert.Equal(t, []byte{PP2TypeConduitIdentity, 0x00, 0x01, 'a'}, header[28:])
+
+	header = ProxyHeaderV2(src6, dst)
+	assert.Equal(t, []byte{0x21, 0x21, 0x00, 36}, header[12:16])
+	assert.Equal(t, 16+36, len(header))
+}
+
+// DER format cert and PKCS #1 key signed by parent, self-signed CA if nil
+func genTestCert(t *testing.T, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "conduit"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(raw)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func TestReloadableTLS(t *testing.T) {
+	oldCA, oldKey := genTestCert(t, nil, nil)
+	newCA, newKey := genTestCert(t, nil, nil)
+	oldCert, oldCertKey := genTestCert(t, oldCA, oldKey)
+	newCert, newCertKey := genTestCert(t, newCA, newKey)
+
+	server, client := &ReloadableTLS{}, &ReloadableTLS{}
+	assert.NoError(t, server.SetCAs([][]byte{oldCA.Raw}))
+	assert.NoError(t, server.SetCert(oldCert.Raw, x509.MarshalPKCS1PrivateKey(oldCertKey)))
+	assert.NoError(t, client.SetCAs([][]byte{oldCA.Raw}))
+	assert.NoError(t, client.SetCert(oldCert.Raw, x509.MarshalPKCS1PrivateKey(oldCertKey)))
+
+	ln, err := ListenReloadableMTLS("tcp", "127.0.0.1:0", server)
+	assert.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write([]byte("ok"))
+				conn.Close()
+			}()
+		}
+	}()
+	dial := func() error {
+		conn, err := DialWithConfig(&DialConfig{
+			Netwotk: "tcp",
+			Addrs:   []string{ln.Addr().String()},
+			TLS:     &TLS{Enable: true, MTLS: true, Reloadable: client},
+		}, 0)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Read(make([]byte, 2))
+		return err
+	}
+	assert.NoError(t, dial())
+
+	// the server is reissued by the next CA the client doesn't trust yet
+	assert.NoError(t, server.SetCAs([][]byte{oldCA.Raw, newCA.Raw}))
+	assert.NoError(t, server.SetCert(newCert.Raw, x509.MarshalPKCS1PrivateKey(newCertKey)))
+	assert.Error(t, dial())
+
+	// trusted both, the client with the old cert still passes
+	assert.NoError(t, client.SetCAs([][]byte{oldCA.Raw, newCA.Raw}))
+	assert.NoError(t, dial())
+}
@@ -0,0 +1,63 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// PP2TypeConduitIdentity is the custom tlv carrying the identity of the conduit
+const PP2TypeConduitIdentity = 0xe0
+
+var proxyV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+// TLV is a type-length-value of proxy protocol v2
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeaderV1 is the human-readable header of tcp src to dst, both in ipv6
+// if either is
+func ProxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src4, dst4, src.Port, dst.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(src.IP), ipv6String(dst.IP), src.Port, dst.Port))
+}
+
+// ipv4 mapped in ipv6 form, String prints them dotted only
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// ProxyHeaderV2 is the binary header of tcp src to dst with tlvs
+func ProxyHeaderV2(src, dst *net.TCPAddr, tlvs ...TLV) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	// version 2, command proxy
+	header = append(header, 0x21)
+	var addrs []byte
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		// tcp over ipv4
+		header = append(header, 0x11)
+		addrs = append(append(addrs, src4...), dst4...)
+	} else {
+		// tcp over ipv6
+		header = append(header, 0x21)
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+	for _, tlv := range tlvs {
+		addrs = append(addrs, tlv.Type)
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(len(tlv.Value)))
+		addrs = append(addrs, tlv.Value...)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
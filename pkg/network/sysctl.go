@@ -0,0 +1,114 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const ProcSys = "/proc/sys"
+
+var ErrIllegalSysctl = errors.New("illegal sysctl key")
+
+// SysctlManager writes tunables to /proc/sys directly, the values before
+// its first write are kept and written back on Close.
+type SysctlManager struct {
+	mtx  sync.Mutex
+	root string
+	// key in order first set, and value before
+	keys    []string
+	origins map[string]string
+}
+
+func NewSysctlManager() *SysctlManager {
+	return &SysctlManager{
+		root:    ProcSys,
+		origins: map[string]string{},
+	}
+}
+
+// SysctlPath returns path of key like net.ipv4.conf.eth0/100.rp_filter,
+// dots and slashes are swapped like sysctl does
+func SysctlPath(key string) (string, error) {
+	return sysctlPath(ProcSys, key)
+}
+
+func sysctlPath(root, key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, ".") || strings.HasSuffix(key, ".") ||
+		strings.Contains(key, "..") || strings.ContainsAny(key, " \t\n") {
+		return "", ErrIllegalSysctl
+	}
+	elems := strings.Split(key, ".")
+	for i, elem := range elems {
+		elems[i] = strings.ReplaceAll(elem, "/", ".")
+	}
+	return filepath.Join(append([]string{root}, elems...)...), nil
+}
+
+func (sm *SysctlManager) Get(key string) (string, error) {
+	path, err := sysctlPath(sm.root, key)
+	if err != nil {
+		return "", err
+	}
+	return readSysctl(path)
+}
+
+// Set writes value only if it's not there, returns whether it's written
+func (sm *SysctlManager) Set(key, value string) (bool, error) {
+	path, err := sysctlPath(sm.root, key)
+	if err != nil {
+		return false, err
+	}
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+
+	current, err := readSysctl(path)
+	if err != nil {
+		return false, err
+	}
+	value = normalizeSysctl(value)
+	if current == value {
+		return false, nil
+	}
+	if err = os.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+		return false, err
+	}
+	if _, ok := sm.origins[key]; !ok {
+		sm.keys = append(sm.keys, key)
+		sm.origins[key] = current
+	}
+	return true, nil
+}
+
+// Close writes back values before, in reverse order
+func (sm *SysctlManager) Close() error {
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+
+	var err error
+	for i := len(sm.keys) - 1; i >= 0; i-- {
+		key := sm.keys[i]
+		path, _ := sysctlPath(sm.root, key)
+		if werr := os.WriteFile(path, []byte(sm.origins[key]+"\n"), 0644); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	sm.keys = nil
+	sm.origins = map[string]string{}
+	return err
+}
+
+func readSysctl(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return normalizeSysctl(string(data)), nil
+}
+
+// multi-value tunables like ip_local_port_range are tab separated
+func normalizeSysctl(value string) string {
+	return strings.Join(strings.Fields(value), "\t")
+}
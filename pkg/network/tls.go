@@ -0,0 +1,119 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/moresec-io/conduit/pkg/config"
+)
+
+// client side tls config, the cas are used to verify the server and the certs
+// are presented if the server asks for them.
+func NewClientTLSConfig(conf *config.TLS) (*tls.Config, error) {
+	tlsconfig := &tls.Config{
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+	for _, certFile := range conf.Certs {
+		cert, err := tls.LoadX509KeyPair(certFile.Cert, certFile.Key)
+		if err != nil {
+			log.Errorf("tls config, load x509 cert err: %s, cert: %s, key: %s", err, certFile.Cert, certFile.Key)
+			return nil, err
+		}
+		tlsconfig.Certificates = append(tlsconfig.Certificates, cert)
+	}
+	if len(conf.CAs) != 0 {
+		caPool := x509.NewCertPool()
+		for _, caFile := range conf.CAs {
+			ca, err := os.ReadFile(caFile)
+			if err != nil {
+				log.Errorf("tls config, read ca cert err: %s, file: %s", err, caFile)
+				return nil, err
+			}
+			if !caPool.AppendCertsFromPEM(ca) {
+				log.Errorf("tls config, append ca cert to ca pool failed, file: %s", caFile)
+				return nil, errors.New("illegal ca cert")
+			}
+		}
+		tlsconfig.RootCAs = caPool
+	}
+	return tlsconfig, nil
+}
+
+// ReloadableTLS keeps the cas and the cert of a conduit from manager, both are
+// swapped when manager rotates them and handshakes afterwards take the new ones.
+type ReloadableTLS struct {
+	mtx    sync.RWMutex
+	caPool *x509.CertPool
+	cert   *tls.Certificate
+}
+
+// SetCAs replaces the pool by DER format cas, both the old and the next CA
+// during rotation
+func (rt *ReloadableTLS) SetCAs(cas [][]byte) error {
+	caPool := x509.NewCertPool()
+	for _, raw := range cas {
+		ca, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		caPool.AddCert(ca)
+	}
+	rt.mtx.Lock()
+	rt.caPool = caPool
+	rt.mtx.Unlock()
+	return nil
+}
+
+// SetCert replaces the cert by DER format cert and PKCS #1 key
+func (rt *ReloadableTLS) SetCert(cert, key []byte) error {
+	privateKey, err := x509.ParsePKCS1PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	rt.mtx.Lock()
+	rt.cert = &tls.Certificate{
+		Certificate: [][]byte{cert},
+		PrivateKey:  privateKey,
+	}
+	rt.mtx.Unlock()
+	return nil
+}
+
+func (rt *ReloadableTLS) CAPool() *x509.CertPool {
+	rt.mtx.RLock()
+	defer rt.mtx.RUnlock()
+
+	return rt.caPool
+}
+
+func (rt *ReloadableTLS) Certs() []tls.Certificate {
+	rt.mtx.RLock()
+	defer rt.mtx.RUnlock()
+
+	if rt.cert == nil {
+		return nil
+	}
+	return []tls.Certificate{*rt.cert}
+}
+
+// ServerConfig requires and verifies client certs, by the pool and the cert
+// current at each handshake
+func (rt *ReloadableTLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: CiperSuites,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				CipherSuites: CiperSuites,
+				ClientCAs:    rt.CAPool(),
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				Certificates: rt.Certs(),
+			}, nil
+		},
+	}
+}
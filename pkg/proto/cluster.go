@@ -1,6 +1,10 @@
 package proto
 
-import "net"
+import (
+	"net"
+
+	"github.com/moresec-io/conduit/pkg/config"
+)
 
 const (
 	RPCPullCluster = "pull_cluster"
@@ -15,9 +19,17 @@ type Conduit struct {
 	Network   string
 	Addr      string
 	IPs       []net.IP `json:"ips"`
-	// IPNets []net.IPNet `json:"ipnets"` // unsupported yet
+	// stops accepting new connections, clients should pick other peers
+	Draining bool `json:"draining,omitempty"`
+	// like pod cidrs of the node, routed to the conduit
+	IPNets []net.IPNet `json:"ipnets,omitempty"`
+	// relay addrs to dial in order to reach the conduit, routed by manager
+	// for the puller from zones
+	Route []string `json:"route,omitempty"`
 }
 
 type PullClusterResponse struct {
 	Cluster []Conduit `json:"conduits"`
+	// exclusions distributed by manager
+	Exclude *config.Exclude `json:"exclude,omitempty"`
 }
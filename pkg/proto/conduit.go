@@ -7,11 +7,21 @@ const (
 	RPCReportServer   = "report_server"
 	RPCReportClient   = "report_cliet"
 	RPCReportNetworks = "report_networks"
+	RPCReportDraining = "report_draining"
+	RPCReportReverses = "report_reverses"
 
 	// manager report to server
 	RPCSyncConduitOnline          = "sync_conduit_online"
 	RPCSyncConduitOffline         = "sync_conduit_offline"
 	RPCSyncConduitNetworksChanged = "sync_conduit_networks_changed"
+	RPCSyncConduitDraining        = "sync_conduit_draining"
+
+	// manager sync to all conduits
+	RPCSyncTrustBundle  = "sync_trust_bundle"
+	RPCSyncCertsRenewed = "sync_certs_renewed"
+
+	// conduit pull from manager
+	RPCPullCerts = "pull_certs"
 )
 
 // manager sync to clients
@@ -26,14 +36,46 @@ type SyncConduitOfflineRequest struct {
 
 // manager sync to clients
 type SyncConduitNetworksChangedRequest struct {
-	MachineID string   `json:"machine_id"`
-	IPs       []net.IP `json:"ips"`
+	MachineID string      `json:"machine_id"`
+	IPs       []net.IP    `json:"ips"`
+	IPNets    []net.IPNet `json:"ipnets,omitempty"`
+}
+
+// manager sync to clients
+type SyncConduitDrainingRequest struct {
+	MachineID string `json:"machine_id"`
+}
+
+// manager sync to conduits before certs signed by the next CA are issued
+type SyncTrustBundleRequest struct {
+	CAs [][]byte `json:"cas"`
+}
+
+// conduit pull certs after manager synced they are renewed
+type PullCertsRequest struct {
+	MachineID string `json:"machine_id"`
+}
+
+// nil for the side the conduit doesn't serve
+type PullCertsResponse struct {
+	Client *TLS `json:"client,omitempty"`
+	Server *TLS `json:"server,omitempty"`
 }
 
 type TLS struct {
 	CA   []byte `json:"ca"`
 	Cert []byte `json:"cert"`
 	Key  []byte `json:"key"`
+	// trust bundle, the CA and those rotating in or out
+	CAs [][]byte `json:"cas,omitempty"`
+}
+
+// CAs to trust, only the CA from managers without bundles
+func (tls *TLS) Bundle() [][]byte {
+	if len(tls.CAs) == 0 {
+		return [][]byte{tls.CA}
+	}
+	return tls.CAs
 }
 
 // server report to manager
@@ -42,6 +84,13 @@ type ReportServerRequest struct {
 	Network   string   `json:"network"`
 	Addr      string   `json:"addr"`
 	IPs       []net.IP `json:"ips"`
+	// relays connections to other conduits
+	Relay bool `json:"relay,omitempty"`
+	// behind nat, reached only through relays it keeps sessions to
+	Reverse bool `json:"reverse,omitempty"`
+	// zone and zones reached directly, for manager to route
+	Zone    string   `json:"zone,omitempty"`
+	Reaches []string `json:"reaches,omitempty"`
 }
 
 type ReportServerResponse struct {
@@ -50,7 +99,9 @@ type ReportServerResponse struct {
 
 // server report to manager
 type ReportClientRequest struct {
-	MachineID string `json:"machine_id"`
+	MachineID string   `json:"machine_id"`
+	Zone      string   `json:"zone,omitempty"`
+	Reaches   []string `json:"reaches,omitempty"`
 }
 
 type ReportClientResponse struct {
@@ -59,6 +110,18 @@ type ReportClientResponse struct {
 
 // server report to manager
 type ReportNetworksRequest struct {
+	MachineID string      `json:"machine_id"`
+	IPs       []net.IP    `json:"ips"`
+	IPNets    []net.IPNet `json:"ipnets,omitempty"`
+}
+
+// server report to manager before shutting down
+type ReportDrainingRequest struct {
+	MachineID string `json:"machine_id"`
+}
+
+// relay report to manager the servers keeping reverse sessions to it
+type ReportReversesRequest struct {
 	MachineID string   `json:"machine_id"`
-	IPs       []net.IP `json:"ips"`
+	Reverses  []string `json:"reverses"` // machine ids
 }
@@ -4,6 +4,9 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
 )
 
 func TLSCertToPEM(cert *tls.Certificate) string {
@@ -26,3 +29,13 @@ func X509CertoToPem(cert *x509.Certificate) string {
 	}
 	return string(pem.EncodeToMemory(block))
 }
+
+// serial in colon separated hex, like 7f:c1:09:22
+func FormatSerial(serial *big.Int) string {
+	bs := serial.Bytes()
+	strs := make([]string, 0, len(bs))
+	for _, b := range bs {
+		strs = append(strs, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(strs, ":")
+}
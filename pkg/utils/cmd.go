@@ -39,3 +39,15 @@ func Cmd(name string, arg ...string) ([]byte, []byte, error) {
 	}
 	return infoO.Bytes(), infoE.Bytes(), nil
 }
+
+// CmdStdin runs the command with stdin fed
+func CmdStdin(stdin []byte, name string, arg ...string) ([]byte, []byte, error) {
+	cmd := exec.Command(name, arg...)
+	infoO := new(bytes.Buffer)
+	infoE := new(bytes.Buffer)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = infoO
+	cmd.Stderr = infoE
+	err := cmd.Run()
+	return infoO.Bytes(), infoE.Bytes(), err
+}
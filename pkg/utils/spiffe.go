@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrIllegalSPIFFEID = errors.New("illegal spiffe id")
+	ErrNoSPIFFEID      = errors.New("no spiffe id in cert")
+)
+
+const (
+	SPIFFEScheme = "spiffe"
+
+	SPIFFERoleClient = "client"
+	SPIFFERoleServer = "server"
+)
+
+// conduit's workload identity, spiffe://<trust-domain>/conduit/<role>/<machineid>
+type SPIFFEID struct {
+	TrustDomain string
+	Role        string
+	MachineID   string
+}
+
+func NewSPIFFEID(trustDomain, role, machineID string) *SPIFFEID {
+	return &SPIFFEID{
+		TrustDomain: trustDomain,
+		Role:        role,
+		MachineID:   machineID,
+	}
+}
+
+func (id *SPIFFEID) URL() *url.URL {
+	return &url.URL{
+		Scheme: SPIFFEScheme,
+		Host:   id.TrustDomain,
+		Path:   "/conduit/" + id.Role + "/" + id.MachineID,
+	}
+}
+
+func (id *SPIFFEID) String() string {
+	return id.URL().String()
+}
+
+func ParseSPIFFEID(uri *url.URL) (*SPIFFEID, error) {
+	if uri.Scheme != SPIFFEScheme || uri.Host == "" || uri.User != nil ||
+		uri.RawQuery != "" || uri.Fragment != "" {
+		return nil, ErrIllegalSPIFFEID
+	}
+	elems := strings.Split(strings.TrimPrefix(uri.Path, "/"), "/")
+	if len(elems) != 3 || elems[0] != "conduit" || elems[1] == "" || elems[2] == "" {
+		return nil, ErrIllegalSPIFFEID
+	}
+	return NewSPIFFEID(uri.Host, elems[1], elems[2]), nil
+}
+
+// a SVID carries exactly one spiffe uri san
+func CertSPIFFEID(cert *x509.Certificate) (*SPIFFEID, error) {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == SPIFFEScheme {
+			return ParseSPIFFEID(uri)
+		}
+	}
+	return nil, ErrNoSPIFFEID
+}
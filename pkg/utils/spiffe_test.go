@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSPIFFEID(t *testing.T) {
+	Convey("spiffe id", t, func() {
+		id := NewSPIFFEID("conduit.local", SPIFFERoleServer, "4c4c4544")
+		So(id.String(), ShouldEqual, "spiffe://conduit.local/conduit/server/4c4c4544")
+
+		parsed, err := ParseSPIFFEID(id.URL())
+		So(err, ShouldBeNil)
+		So(*parsed, ShouldResemble, *id)
+
+		for _, str := range []string{
+			"https://conduit.local/conduit/server/4c4c4544",
+			"spiffe://conduit.local/conduit/server",
+			"spiffe://conduit.local/other/server/4c4c4544",
+			"spiffe:///conduit/server/4c4c4544",
+		} {
+			uri, _ := url.Parse(str)
+			_, err = ParseSPIFFEID(uri)
+			So(err, ShouldEqual, ErrIllegalSPIFFEID)
+		}
+	})
+}
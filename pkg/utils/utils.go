@@ -24,6 +24,25 @@ func CompareNets(old, new []net.IP) bool {
 	return true
 }
 
+func CompareIPNets(old, new []net.IPNet) bool {
+	if len(old) != len(new) {
+		return false
+	}
+	for _, oldnet := range old {
+		found := false
+		for _, newnet := range new {
+			if oldnet.String() == newnet.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 type IPs []net.IP
 
 func (ips IPs) String() string {
@@ -33,3 +52,13 @@ func (ips IPs) String() string {
 	}
 	return strings.Join(ipstrs, ",")
 }
+
+type IPNets []net.IPNet
+
+func (ipnets IPNets) String() string {
+	strs := []string{}
+	for _, ipnet := range ipnets {
+		strs = append(strs, ipnet.String())
+	}
+	return strings.Join(strs, ",")
+}